@@ -16,6 +16,7 @@
 	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/dns/dnsmessage"
@@ -25,6 +26,7 @@
 	"tailscale.com/util/dnsname"
 	"tailscale.com/util/execqueue"
 	"tailscale.com/util/mak"
+	"tailscale.com/util/set"
 	"tailscale.com/util/slicesx"
 )
 
@@ -107,6 +109,15 @@ func recordMetric(val int64, buckets []int64, metrics []*clientmetric.Metric) {
 	metrics[bucket].Add(1)
 }
 
+// Route churn metrics for learned (DNS-discovered) routes.
+var (
+	metricRoutesAdvertised      = clientmetric.NewCounter("appc_routes_advertised")
+	metricRoutesExpired         = clientmetric.NewCounter("appc_routes_expired")
+	metricRoutesExpiryDeferred  = clientmetric.NewCounter("appc_routes_expiry_deferred_active")
+	metricRoutesRemovedByDomain = clientmetric.NewCounter("appc_routes_removed_domain")
+	metricRoutesLearned         = clientmetric.NewGauge("appc_routes_learned")
+)
+
 func metricStoreRoutes(rate, nRoutes int64) {
 	if len(metricStoreRoutesRate) == 0 {
 		initMetricStoreRoutes()
@@ -126,6 +137,30 @@ type RouteInfo struct {
 	// Wildcards are the configured DNS lookup domains to observe. When a DNS query matches Wildcards,
 	// its result is added to Domains.
 	Wildcards []string `json:",omitempty"`
+	// LastSeen maps the addresses in Domains to the time they were last
+	// observed in a DNS response, plus the TTL of the record; that is, until
+	// when the most recent resolution of the address was valid. It is used
+	// to expire learned routes; see AppConnector.SetRouteExpiry.
+	LastSeen map[netip.Addr]time.Time `json:",omitempty"`
+	// Patterns are the configured domain patterns and exclusions that are
+	// neither exact domains nor plain wildcards, as configured.
+	Patterns []string `json:",omitempty"`
+	// Aggregates are the prefixes advertised in place of the learned
+	// addresses they cover; see AppConnector.SetRouteAggregation.
+	Aggregates []netip.Prefix `json:",omitempty"`
+}
+
+// AggregationConfig configures the aggregation of learned routes into
+// covering prefixes.
+type AggregationConfig struct {
+	// Threshold is the number of learned addresses within a prefix at which
+	// the prefix is advertised in place of the individual addresses. Zero
+	// disables aggregation.
+	Threshold int
+
+	// IPv4Bits and IPv6Bits are the lengths of the prefixes that IPv4 and
+	// IPv6 addresses are aggregated into. They default to 24 and 64.
+	IPv4Bits, IPv6Bits int
 }
 
 // AppConnector is an implementation of an AppConnector that performs
@@ -157,6 +192,69 @@ type AppConnector struct {
 	// wildcards is the list of domain strings that match subdomains.
 	wildcards []string
 
+	// patterns are the configured domain patterns that are neither exact
+	// domains nor plain wildcards. Names matching them are added to domains
+	// like names matching wildcards.
+	patterns []*domainPattern
+
+	// exclusions are the patterns of names that are not routed even if they
+	// match wildcards or patterns.
+	exclusions []*domainPattern
+
+	// aggregation configures the aggregation of learned routes.
+	aggregation AggregationConfig
+
+	// aggregates is the set of prefixes advertised in place of the learned
+	// addresses they cover.
+	aggregates set.Set[netip.Prefix]
+
+	// learnedIn indexes the addresses in domains by the aggregate prefix,
+	// per aggregation, that covers them. Each address maps to the number of
+	// domains it was learned for.
+	learnedIn map[netip.Prefix]map[netip.Addr]int
+
+	// lastSeen is the time until which each address in domains was last
+	// known to be valid, per the TTL of the DNS record it was observed in.
+	lastSeen map[netip.Addr]time.Time
+
+	// lastSeenDirty is whether lastSeen changed since routes were last
+	// stored.
+	lastSeenDirty bool
+
+	// routeExpiry is how long after lastSeen a learned address is
+	// unadvertised. Zero means learned addresses never expire.
+	routeExpiry time.Duration
+
+	// lastExpiryCheck is when expired routes were last looked for.
+	lastExpiryCheck time.Time
+
+	// expiryLoopStarted is whether expireRoutesPeriodically was started.
+	expiryLoopStarted bool
+
+	// expiryCheckInterval is how often expireRoutesPeriodically looks for
+	// expired routes; it is RouteExpiryCheckInterval except in tests.
+	expiryCheckInterval time.Duration
+
+	// ctx is canceled by Close.
+	ctx       context.Context
+	ctxCancel context.CancelFunc
+
+	// trackTraffic is whether NoteTraffic records traffic, which is only
+	// needed while route expiry is enabled.
+	trackTraffic atomic.Bool
+
+	// lastTraffic maps each address with recent traffic to an
+	// *atomic.Int64 holding when NoteTraffic last noted traffic to it, in
+	// Unix nanoseconds. It is lock-free as NoteTraffic is called for every
+	// forwarded packet.
+	lastTraffic sync.Map
+
+	// numTraffic is the number of entries in lastTraffic.
+	numTraffic atomic.Int64
+
+	// now returns the current time; it is time.Now except in tests.
+	now func() time.Time
+
 	// queue provides ordering for update operations
 	queue execqueue.ExecQueue
 
@@ -167,15 +265,36 @@ type AppConnector struct {
 // NewAppConnector creates a new AppConnector.
 func NewAppConnector(logf logger.Logf, routeAdvertiser RouteAdvertiser, routeInfo *RouteInfo, storeRoutesFunc func(*RouteInfo) error) *AppConnector {
 	ac := &AppConnector{
-		logf:            logger.WithPrefix(logf, "appc: "),
-		routeAdvertiser: routeAdvertiser,
-		storeRoutesFunc: storeRoutesFunc,
+		logf:                logger.WithPrefix(logf, "appc: "),
+		routeAdvertiser:     routeAdvertiser,
+		storeRoutesFunc:     storeRoutesFunc,
+		now:                 time.Now,
+		expiryCheckInterval: RouteExpiryCheckInterval,
+		aggregation:         AggregationConfig{IPv4Bits: 24, IPv6Bits: 64},
 	}
+	ac.ctx, ac.ctxCancel = context.WithCancel(context.Background())
 	if routeInfo != nil {
 		ac.domains = routeInfo.Domains
 		ac.wildcards = routeInfo.Wildcards
 		ac.controlRoutes = routeInfo.Control
+		ac.lastSeen = routeInfo.LastSeen
+		ac.setPatternsLocked(routeInfo.Patterns)
+		if len(routeInfo.Aggregates) > 0 {
+			ac.aggregates = set.SetOf(routeInfo.Aggregates)
+		}
 	}
+	// Addresses stored without a last seen time, such as by older versions,
+	// count as seen now.
+	now := ac.now()
+	for _, addrs := range ac.domains {
+		for _, a := range addrs {
+			if _, ok := ac.lastSeen[a]; !ok {
+				mak.Set(&ac.lastSeen, a, now)
+			}
+		}
+	}
+	ac.reindexLearnedLocked()
+	metricRoutesLearned.Set(int64(len(ac.lastSeen)))
 	ac.writeRateMinute = newRateLogger(time.Now, time.Minute, func(c int64, s time.Time, l int64) {
 		ac.logf("routeInfo write rate: %d in minute starting at %v (%d routes)", c, s, l)
 		metricStoreRoutes(c, l)
@@ -206,13 +325,228 @@ func (e *AppConnector) storeRoutesLocked() error {
 	e.writeRateMinute.update(numRoutes)
 	e.writeRateDay.update(numRoutes)
 
+	e.lastSeenDirty = false
 	return e.storeRoutesFunc(&RouteInfo{
-		Control:   e.controlRoutes,
-		Domains:   e.domains,
-		Wildcards: e.wildcards,
+		Control:    e.controlRoutes,
+		Domains:    e.domains,
+		Wildcards:  e.wildcards,
+		LastSeen:   e.lastSeen,
+		Patterns:   e.patternStringsLocked(),
+		Aggregates: e.aggregates.Slice(),
+	})
+}
+
+// SetRouteExpiry asynchronously configures the expiry of learned routes.
+// Addresses learned from DNS responses are unadvertised once they have not
+// been observed in a DNS response for window past the TTL of the last one,
+// unless they carry active flows, as reported by NoteTraffic. A window of
+// zero disables expiry.
+//
+// Expired routes are looked for every RouteExpiryCheckInterval, until Close
+// is called, and when DNS responses are observed or ExpireRoutes is called.
+func (e *AppConnector) SetRouteExpiry(window time.Duration) {
+	e.queue.Add(func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		e.routeExpiry = window
+		e.trackTraffic.Store(window > 0)
+		if window > 0 && !e.expiryLoopStarted {
+			e.expiryLoopStarted = true
+			go e.expireRoutesPeriodically()
+		}
 	})
 }
 
+// RouteExpiryCheckInterval is the minimum interval between two automatic
+// checks for expired routes.
+const RouteExpiryCheckInterval = time.Minute
+
+// activeFlowTimeout is how long after NoteTraffic was last called for an
+// address it is considered to carry active flows.
+const activeFlowTimeout = 5 * time.Minute
+
+// maxTrackedTraffic is the maximum number of addresses NoteTraffic tracks.
+// Traffic to further addresses is not recorded until old entries are
+// pruned.
+const maxTrackedTraffic = 1 << 16
+
+// trafficNoteInterval is the minimum interval between two updates of the
+// time traffic to an address was last noted, so that packets of busy flows
+// mostly only read it.
+const trafficNoteInterval = time.Second
+
+// NoteTraffic records that a packet to addr is being forwarded. Learned
+// routes for addresses with recent traffic carry active flows and are not
+// expired. It is called for every forwarded packet and does not block.
+func (e *AppConnector) NoteTraffic(addr netip.Addr) {
+	if !e.trackTraffic.Load() {
+		return
+	}
+	now := e.now().UnixNano()
+	v, ok := e.lastTraffic.Load(addr)
+	if !ok {
+		if e.numTraffic.Load() >= maxTrackedTraffic {
+			return
+		}
+		t := new(atomic.Int64)
+		t.Store(now)
+		if v, ok = e.lastTraffic.LoadOrStore(addr, t); !ok {
+			e.numTraffic.Add(1)
+			return
+		}
+	}
+	t := v.(*atomic.Int64)
+	if last := t.Load(); now-last >= int64(trafficNoteInterval) {
+		t.CompareAndSwap(last, now)
+	}
+}
+
+// hasActiveFlows reports whether NoteTraffic was called for addr within
+// activeFlowTimeout of now.
+func (e *AppConnector) hasActiveFlows(addr netip.Addr, now time.Time) bool {
+	v, ok := e.lastTraffic.Load(addr)
+	return ok && now.Sub(time.Unix(0, v.(*atomic.Int64).Load())) < activeFlowTimeout
+}
+
+// pruneTraffic forgets the traffic noted more than activeFlowTimeout before
+// now.
+func (e *AppConnector) pruneTraffic(now time.Time) {
+	e.lastTraffic.Range(func(k, v any) bool {
+		if now.Sub(time.Unix(0, v.(*atomic.Int64).Load())) >= activeFlowTimeout && e.lastTraffic.CompareAndDelete(k, v) {
+			e.numTraffic.Add(-1)
+		}
+		return true
+	})
+}
+
+// expireRoutesPeriodically calls ExpireRoutes every expiryCheckInterval
+// until Close is called.
+func (e *AppConnector) expireRoutesPeriodically() {
+	t := time.NewTicker(e.expiryCheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-t.C:
+			e.ExpireRoutes()
+		}
+	}
+}
+
+// Close stops the periodic expiry of learned routes and the processing of
+// asynchronous configuration changes. The AppConnector must not be used
+// after Close.
+func (e *AppConnector) Close() {
+	e.ctxCancel()
+	e.queue.Shutdown()
+}
+
+// ExpireRoutes removes the learned routes that have expired, as configured
+// with SetRouteExpiry, and queues unadvertising them.
+func (e *AppConnector) ExpireRoutes() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.expireRoutesLocked()
+}
+
+// maybeExpireRoutesLocked calls expireRoutesLocked if route expiry is enabled
+// and RouteExpiryCheckInterval has passed since the last check.
+// e.mu must be held.
+func (e *AppConnector) maybeExpireRoutesLocked() {
+	if e.routeExpiry <= 0 || e.now().Sub(e.lastExpiryCheck) < RouteExpiryCheckInterval {
+		return
+	}
+	e.expireRoutesLocked()
+}
+
+// expireRoutesLocked removes expired addresses from the learned domains and
+// schedules unadvertising their routes.
+// e.mu must be held.
+func (e *AppConnector) expireRoutesLocked() {
+	now := e.now()
+	e.lastExpiryCheck = now
+	if e.routeExpiry <= 0 {
+		return
+	}
+
+	learned := make(map[netip.Addr]bool)
+	expired := make(map[netip.Addr]bool)
+	for _, addrs := range e.domains {
+		for _, a := range addrs {
+			if learned[a] {
+				continue
+			}
+			learned[a] = true
+			seen, ok := e.lastSeen[a]
+			if !ok {
+				mak.Set(&e.lastSeen, a, now)
+				e.lastSeenDirty = true
+				continue
+			}
+			if now.Sub(seen) < e.routeExpiry {
+				continue
+			}
+			if e.hasActiveFlows(a, now) {
+				metricRoutesExpiryDeferred.Add(1)
+				continue
+			}
+			expired[a] = true
+		}
+	}
+	for a, seen := range e.lastSeen {
+		// Addresses that aren't learned yet may be pending advertisement;
+		// forget them only once they would have expired anyway.
+		if expired[a] || !learned[a] && now.Sub(seen) >= e.routeExpiry {
+			delete(e.lastSeen, a)
+			e.lastSeenDirty = true
+		}
+	}
+	e.pruneTraffic(now)
+	metricRoutesLearned.Set(int64(len(e.lastSeen)))
+	if len(expired) == 0 {
+		if e.lastSeenDirty {
+			if err := e.storeRoutesLocked(); err != nil {
+				e.logf("failed to store route info: %v", err)
+			}
+		}
+		return
+	}
+
+	var toRemove []netip.Prefix
+	for d, addrs := range e.domains {
+		e.domains[d] = slices.DeleteFunc(addrs, func(a netip.Addr) bool {
+			if expired[a] {
+				e.unindexLearnedLocked(a)
+				return true
+			}
+			return false
+		})
+	}
+	for a := range expired {
+		// Addresses covered by control routes or aggregates were never
+		// advertised on their own; leave those routes alone.
+		if slices.ContainsFunc(e.controlRoutes, func(p netip.Prefix) bool { return p.Contains(a) }) || e.isAggregatedLocked(a) {
+			continue
+		}
+		toRemove = append(toRemove, netip.PrefixFrom(a, a.BitLen()))
+	}
+	toRemove = append(toRemove, e.pruneAggregatesLocked()...)
+	slices.SortFunc(toRemove, func(a, b netip.Prefix) int { return a.Addr().Compare(b.Addr()) })
+	metricRoutesExpired.Add(int64(len(expired)))
+	e.logf("expiring %d learned routes not seen in DNS responses for %v", len(expired), e.routeExpiry)
+	if len(toRemove) > 0 {
+		e.queue.Add(func() {
+			if err := e.routeAdvertiser.UnadvertiseRoute(toRemove...); err != nil {
+				e.logf("failed to unadvertise expired routes: %v: %v", toRemove, err)
+			}
+		})
+	}
+	if err := e.storeRoutesLocked(); err != nil {
+		e.logf("failed to store route info: %v", err)
+	}
+}
+
 // ClearRoutes removes all route state from the AppConnector.
 func (e *AppConnector) ClearRoutes() error {
 	e.mu.Lock()
@@ -220,6 +554,12 @@ func (e *AppConnector) ClearRoutes() error {
 	e.controlRoutes = nil
 	e.domains = nil
 	e.wildcards = nil
+	e.patterns = nil
+	e.exclusions = nil
+	e.lastSeen = nil
+	e.aggregates = nil
+	e.learnedIn = nil
+	metricRoutesLearned.Set(0)
 	return e.storeRoutesLocked()
 }
 
@@ -236,7 +576,14 @@ func (e *AppConnector) UpdateDomainsAndRoutes(domains []string, routes []netip.P
 // UpdateDomains asynchronously replaces the current set of configured domains
 // with the supplied set of domains. Domains must not contain a trailing dot,
 // and should be lower case. If the domain contains a leading '*' label it
-// matches all subdomains of a domain.
+// matches all subdomains of a domain, at any depth.
+//
+// Domains may also be patterns: a '*' label elsewhere matches exactly one
+// label, a '*' within a label matches any characters in that label (such as
+// "cdn-*.example.com"), and a domain enclosed in slashes is a regular
+// expression matched against the whole name. A domain prefixed with '!' is
+// an exclusion: names matching it are not routed, even if they match a
+// wildcard or pattern. Exclusions do not apply to exactly listed domains.
 func (e *AppConnector) UpdateDomains(domains []string) {
 	e.queue.Add(func() {
 		e.updateDomains(domains)
@@ -256,11 +603,18 @@ func (e *AppConnector) updateDomains(domains []string) {
 	var oldDomains map[string][]netip.Addr
 	oldDomains, e.domains = e.domains, make(map[string][]netip.Addr, len(domains))
 	e.wildcards = e.wildcards[:0]
+	var patterns []string
 	for _, d := range domains {
-		d = strings.ToLower(d)
+		if !strings.HasPrefix(strings.TrimPrefix(d, "!"), "/") {
+			d = strings.ToLower(d)
+		}
 		if len(d) == 0 {
 			continue
 		}
+		if strings.HasPrefix(d, "!") || isPattern(d) {
+			patterns = append(patterns, d)
+			continue
+		}
 		if strings.HasPrefix(d, "*.") {
 			e.wildcards = append(e.wildcards, d[2:])
 			continue
@@ -268,27 +622,35 @@ func (e *AppConnector) updateDomains(domains []string) {
 		e.domains[d] = oldDomains[d]
 		delete(oldDomains, d)
 	}
+	e.setPatternsLocked(patterns)
 
 	// Ensure that still-live wildcards addresses are preserved as well.
 	for d, addrs := range oldDomains {
-		for _, wc := range e.wildcards {
-			if dnsname.HasSuffix(d, wc) {
-				e.domains[d] = addrs
-				delete(oldDomains, d)
-				break
-			}
+		if e.matchesWildcardLocked(d) {
+			e.domains[d] = addrs
+			delete(oldDomains, d)
 		}
 	}
 
 	// Everything left in oldDomains is a domain we're no longer tracking
 	// and if we are storing route info we can unadvertise the routes
+	for _, addrs := range oldDomains {
+		for _, a := range addrs {
+			e.unindexLearnedLocked(a)
+		}
+	}
 	if e.ShouldStoreRoutes() {
 		toRemove := []netip.Prefix{}
 		for _, addrs := range oldDomains {
 			for _, a := range addrs {
+				metricRoutesRemovedByDomain.Add(1)
+				if e.isAggregatedLocked(a) {
+					continue
+				}
 				toRemove = append(toRemove, netip.PrefixFrom(a, a.BitLen()))
 			}
 		}
+		toRemove = append(toRemove, e.pruneAggregatesLocked()...)
 		e.queue.Add(func() {
 			if err := e.routeAdvertiser.UnadvertiseRoute(toRemove...); err != nil {
 				e.logf("failed to unadvertise routes on domain removal: %v: %v: %v", slicesx.MapKeys(oldDomains), toRemove, err)
@@ -296,7 +658,254 @@ func (e *AppConnector) updateDomains(domains []string) {
 		})
 	}
 
-	e.logf("handling domains: %v and wildcards: %v", slicesx.MapKeys(e.domains), e.wildcards)
+	e.logf("handling domains: %v and wildcards: %v and patterns: %v", slicesx.MapKeys(e.domains), e.wildcards, patterns)
+}
+
+// setPatternsLocked replaces the configured patterns and exclusions with the
+// parsed patterns, which are prefixed with '!' for exclusions. Invalid
+// patterns are logged and ignored.
+// e.mu must be held.
+func (e *AppConnector) setPatternsLocked(patterns []string) {
+	e.patterns = nil
+	e.exclusions = nil
+	for _, s := range patterns {
+		excl, isExclusion := strings.CutPrefix(s, "!")
+		p, err := parseDomainPattern(excl)
+		if err != nil {
+			e.logf("ignoring domain: %v", err)
+			continue
+		}
+		if isExclusion {
+			e.exclusions = append(e.exclusions, p)
+		} else {
+			e.patterns = append(e.patterns, p)
+		}
+	}
+}
+
+// patternStringsLocked returns the configured patterns and exclusions in the
+// form accepted by setPatternsLocked.
+// e.mu must be held.
+func (e *AppConnector) patternStringsLocked() []string {
+	var ret []string
+	for _, p := range e.patterns {
+		ret = append(ret, p.raw)
+	}
+	for _, p := range e.exclusions {
+		ret = append(ret, "!"+p.raw)
+	}
+	return ret
+}
+
+// matchesWildcardLocked reports whether domain is routed due to a wildcard or
+// pattern, and isn't excluded.
+// e.mu must be held.
+func (e *AppConnector) matchesWildcardLocked(domain string) bool {
+	for _, p := range e.exclusions {
+		if p.match(domain) {
+			return false
+		}
+	}
+	for _, wc := range e.wildcards {
+		if dnsname.HasSuffix(domain, wc) {
+			return true
+		}
+	}
+	for _, p := range e.patterns {
+		if p.match(domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetRouteAggregation asynchronously configures the aggregation of learned
+// routes. Once c.Threshold learned addresses fall within the same aggregate
+// prefix, the prefix is advertised and the routes of the individual addresses
+// are unadvertised. Aggregates are unadvertised when none of the learned
+// addresses they cover remain, such as when they expire or their domains are
+// removed. A zero c.Threshold disables further aggregation.
+func (e *AppConnector) SetRouteAggregation(c AggregationConfig) {
+	if c.IPv4Bits <= 0 || c.IPv4Bits > 32 {
+		c.IPv4Bits = 24
+	}
+	if c.IPv6Bits <= 0 || c.IPv6Bits > 128 {
+		c.IPv6Bits = 64
+	}
+	e.queue.Add(func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		reindex := e.aggregation.IPv4Bits != c.IPv4Bits || e.aggregation.IPv6Bits != c.IPv6Bits
+		e.aggregation = c
+		if reindex {
+			e.reindexLearnedLocked()
+		}
+		var learned []netip.Addr
+		for _, addrs := range e.learnedIn {
+			for a := range addrs {
+				learned = append(learned, a)
+			}
+		}
+		e.aggregateLocked(learned)
+	})
+}
+
+// reindexLearnedLocked rebuilds learnedIn from domains.
+// e.mu must be held.
+func (e *AppConnector) reindexLearnedLocked() {
+	e.learnedIn = nil
+	for _, addrs := range e.domains {
+		for _, a := range addrs {
+			e.indexLearnedLocked(a)
+		}
+	}
+}
+
+// indexLearnedLocked records in learnedIn that addr was learned for one more
+// domain.
+// e.mu must be held.
+func (e *AppConnector) indexLearnedLocked(addr netip.Addr) {
+	p := e.aggregatePrefixLocked(addr)
+	addrs := e.learnedIn[p]
+	if addrs == nil {
+		addrs = make(map[netip.Addr]int)
+		mak.Set(&e.learnedIn, p, addrs)
+	}
+	addrs[addr]++
+}
+
+// unindexLearnedLocked records in learnedIn that addr was removed from one
+// of the domains it was learned for.
+// e.mu must be held.
+func (e *AppConnector) unindexLearnedLocked(addr netip.Addr) {
+	p := e.aggregatePrefixLocked(addr)
+	addrs := e.learnedIn[p]
+	if addrs[addr] > 1 {
+		addrs[addr]--
+		return
+	}
+	delete(addrs, addr)
+	if len(addrs) == 0 {
+		delete(e.learnedIn, p)
+	}
+}
+
+// aggregatePrefixLocked returns the aggregate prefix that covers addr.
+// e.mu must be held.
+func (e *AppConnector) aggregatePrefixLocked(addr netip.Addr) netip.Prefix {
+	bits := e.aggregation.IPv4Bits
+	if addr.Is6() {
+		bits = e.aggregation.IPv6Bits
+	}
+	p, _ := addr.Prefix(bits)
+	return p
+}
+
+// isAggregatedLocked reports whether addr is covered by an advertised
+// aggregate prefix.
+// e.mu must be held.
+func (e *AppConnector) isAggregatedLocked(addr netip.Addr) bool {
+	if len(e.aggregates) == 0 {
+		return false
+	}
+	// Aggregates may have been created with another configuration, so look
+	// for covering prefixes of any length.
+	for bits := range addr.BitLen() + 1 {
+		p, _ := addr.Prefix(bits)
+		if e.aggregates.Contains(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// aggregateLocked schedules advertising the aggregate prefixes of addrs that
+// reached the aggregation threshold, and unadvertising the routes of the
+// individual addresses they cover.
+// e.mu must be held.
+func (e *AppConnector) aggregateLocked(addrs []netip.Addr) {
+	if e.aggregation.Threshold <= 0 {
+		return
+	}
+	var toAdvertise []netip.Prefix
+	for _, a := range addrs {
+		p := e.aggregatePrefixLocked(a)
+		if e.aggregates.Contains(p) || e.isAggregatedLocked(a) {
+			continue
+		}
+		if len(e.learnedAddrsInLocked(p)) < e.aggregation.Threshold {
+			continue
+		}
+		e.aggregates.Make()
+		e.aggregates.Add(p)
+		toAdvertise = append(toAdvertise, p)
+	}
+	if len(toAdvertise) == 0 {
+		return
+	}
+	var toRemove []netip.Prefix
+	for _, p := range toAdvertise {
+		for _, a := range e.learnedAddrsInLocked(p) {
+			toRemove = append(toRemove, netip.PrefixFrom(a, a.BitLen()))
+		}
+	}
+	e.logf("aggregating %d learned routes into %v", len(toRemove), toAdvertise)
+	e.queue.Add(func() {
+		if err := e.routeAdvertiser.AdvertiseRoute(toAdvertise...); err != nil {
+			e.logf("failed to advertise aggregate routes: %v: %v", toAdvertise, err)
+			return
+		}
+		if err := e.routeAdvertiser.UnadvertiseRoute(toRemove...); err != nil {
+			e.logf("failed to unadvertise aggregated routes: %v: %v", toRemove, err)
+		}
+	})
+	if err := e.storeRoutesLocked(); err != nil {
+		e.logf("failed to store route info: %v", err)
+	}
+}
+
+// learnedAddrsInLocked returns the distinct learned addresses within p that
+// aren't covered by a control route, and are thus subject to aggregation.
+// e.mu must be held.
+func (e *AppConnector) learnedAddrsInLocked(p netip.Prefix) []netip.Addr {
+	var ret []netip.Addr
+	add := func(addrs map[netip.Addr]int) {
+		for a := range addrs {
+			if !p.Contains(a) {
+				continue
+			}
+			if slices.ContainsFunc(e.controlRoutes, func(r netip.Prefix) bool { return r.Contains(a) }) {
+				continue
+			}
+			ret = append(ret, a)
+		}
+	}
+	if p == e.aggregatePrefixLocked(p.Addr()) {
+		add(e.learnedIn[p])
+	} else {
+		// p is an aggregate created with another configuration.
+		for q, addrs := range e.learnedIn {
+			if q.Overlaps(p) {
+				add(addrs)
+			}
+		}
+	}
+	slices.SortFunc(ret, compareAddr)
+	return ret
+}
+
+// pruneAggregatesLocked removes the aggregates that no longer cover any
+// learned address, and returns them for unadvertising.
+// e.mu must be held.
+func (e *AppConnector) pruneAggregatesLocked() []netip.Prefix {
+	var pruned []netip.Prefix
+	for p := range e.aggregates {
+		if len(e.learnedAddrsInLocked(p)) == 0 {
+			e.aggregates.Delete(p)
+			pruned = append(pruned, p)
+		}
+	}
+	return pruned
 }
 
 // updateRoutes merges the supplied routes into the currently configured routes. The routes supplied
@@ -395,6 +1004,9 @@ func (e *AppConnector) ObserveDNSResponse(res []byte) error {
 	// addressRecords is a list of address records found in the response.
 	var addressRecords map[string][]netip.Addr
 
+	// ttls is the largest TTL of the records for each address.
+	var ttls map[netip.Addr]uint32
+
 	for {
 		h, err := p.AnswerHeader()
 		if err == dnsmessage.ErrSectionDone {
@@ -447,6 +1059,7 @@ func (e *AppConnector) ObserveDNSResponse(res []byte) error {
 			}
 			addr := netip.AddrFrom4(r.A)
 			mak.Set(&addressRecords, domain, append(addressRecords[domain], addr))
+			mak.Set(&ttls, addr, max(ttls[addr], h.TTL))
 		case dnsmessage.TypeAAAA:
 			r, err := p.AAAAResource()
 			if err != nil {
@@ -454,6 +1067,7 @@ func (e *AppConnector) ObserveDNSResponse(res []byte) error {
 			}
 			addr := netip.AddrFrom16(r.AAAA)
 			mak.Set(&addressRecords, domain, append(addressRecords[domain], addr))
+			mak.Set(&ttls, addr, max(ttls[addr], h.TTL))
 		default:
 			if err := p.SkipAnswer(); err != nil {
 				return err
@@ -465,6 +1079,7 @@ func (e *AppConnector) ObserveDNSResponse(res []byte) error {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
+	now := e.now()
 	for domain, addrs := range addressRecords {
 		domain, isRouted := e.findRoutedDomainLocked(domain, cnameChain)
 
@@ -473,6 +1088,10 @@ func (e *AppConnector) ObserveDNSResponse(res []byte) error {
 			continue
 		}
 
+		for _, addr := range addrs {
+			e.markSeenLocked(addr, now.Add(time.Duration(ttls[addr])*time.Second))
+		}
+
 		// advertise each address we have learned for the routed domain, that
 		// was not already known.
 		var toAdvertise []netip.Prefix
@@ -487,9 +1106,21 @@ func (e *AppConnector) ObserveDNSResponse(res []byte) error {
 			e.scheduleAdvertisement(domain, toAdvertise...)
 		}
 	}
+	e.maybeExpireRoutesLocked()
 	return nil
 }
 
+// markSeenLocked records that addr was resolved in a DNS response that is
+// valid until validUntil.
+// e.mu must be held.
+func (e *AppConnector) markSeenLocked(addr netip.Addr, validUntil time.Time) {
+	if prev, ok := e.lastSeen[addr]; ok && !validUntil.After(prev) {
+		return
+	}
+	mak.Set(&e.lastSeen, addr, validUntil)
+	e.lastSeenDirty = true
+}
+
 // starting from the given domain that resolved to an address, find it, or any
 // of the domains in the CNAME chain toward resolving it, that are routed
 // domains, returning the routed domain name and a bool indicating whether a
@@ -503,13 +1134,11 @@ func (e *AppConnector) findRoutedDomainLocked(domain string, cnameChain map[stri
 			break
 		}
 
-		// match wildcard domains
-		for _, wc := range e.wildcards {
-			if dnsname.HasSuffix(domain, wc) {
-				e.domains[domain] = nil
-				isRouted = true
-				break
-			}
+		// match wildcard domains and patterns
+		if e.matchesWildcardLocked(domain) {
+			e.domains[domain] = nil
+			isRouted = true
+			break
 		}
 
 		next, ok := cnameChain[domain]
@@ -529,6 +1158,10 @@ func (e *AppConnector) isAddrKnownLocked(domain string, addr netip.Addr) bool {
 	if e.hasDomainAddrLocked(domain, addr) {
 		return true
 	}
+	if e.isAggregatedLocked(addr) {
+		e.addDomainAddrLocked(domain, addr)
+		return true
+	}
 	for _, route := range e.controlRoutes {
 		if route.Contains(addr) {
 			// record the new address associated with the domain for faster matching in subsequent
@@ -558,9 +1191,21 @@ func (e *AppConnector) scheduleAdvertisement(domain string, routes ...netip.Pref
 			addr := route.Addr()
 			if !e.hasDomainAddrLocked(domain, addr) {
 				e.addDomainAddrLocked(domain, addr)
+				metricRoutesAdvertised.Add(1)
 				e.logf("[v2] advertised route for %v: %v", domain, addr)
 			}
+			if _, ok := e.lastSeen[addr]; !ok {
+				mak.Set(&e.lastSeen, addr, e.now())
+			}
+		}
+		metricRoutesLearned.Set(int64(len(e.lastSeen)))
+		var addrs []netip.Addr
+		for _, route := range routes {
+			if route.IsSingleIP() {
+				addrs = append(addrs, route.Addr())
+			}
 		}
+		e.aggregateLocked(addrs)
 		if err := e.storeRoutesLocked(); err != nil {
 			e.logf("failed to store route info: %v", err)
 		}
@@ -579,6 +1224,7 @@ func (e *AppConnector) hasDomainAddrLocked(domain string, addr netip.Addr) bool
 func (e *AppConnector) addDomainAddrLocked(domain string, addr netip.Addr) {
 	e.domains[domain] = append(e.domains[domain], addr)
 	slices.SortFunc(e.domains[domain], compareAddr)
+	e.indexLearnedLocked(addr)
 }
 
 func compareAddr(l, r netip.Addr) int {
@@ -5,9 +5,11 @@
 
 import (
 	"context"
+	"fmt"
 	"net/netip"
 	"reflect"
 	"slices"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -626,6 +628,9 @@ func TestRouteStoreMetrics(t *testing.T) {
 		"appc_store_routes_rate_over":     1,
 	}
 	for _, x := range clientmetric.Metrics() {
+		if !strings.HasPrefix(x.Name(), "appc_store_routes_") {
+			continue
+		}
 		if x.Value() != wanted[x.Name()] {
 			t.Errorf("%s: want: %d, got: %d", x.Name(), wanted[x.Name()], x.Value())
 		}
@@ -694,3 +699,233 @@ func TestUpdateRoutesDeadlock(t *testing.T) {
 		t.Fatalf("got %v, want %v", rc.Routes(), want)
 	}
 }
+
+func TestRouteExpiry(t *testing.T) {
+	ctx := context.Background()
+	clock := tstest.Clock{}
+	rc := &appctest.RouteCollector{}
+	var stored *RouteInfo
+	a := NewAppConnector(t.Logf, rc, &RouteInfo{}, func(ri *RouteInfo) error {
+		stored = ri
+		return nil
+	})
+	defer a.Close()
+	a.now = clock.Now
+	a.SetRouteExpiry(time.Hour)
+	a.Wait(ctx)
+	a.updateDomains([]string{"example.com"})
+
+	for _, addr := range []string{"192.0.0.8", "192.0.0.9", "192.0.0.10"} {
+		must.Do(a.ObserveDNSResponse(dnsResponse("example.com.", addr)))
+	}
+	a.Wait(ctx)
+
+	// Observing an address again keeps it alive.
+	clock.Advance(30 * time.Minute)
+	must.Do(a.ObserveDNSResponse(dnsResponse("example.com.", "192.0.0.10")))
+	a.Wait(ctx)
+
+	expired := metricRoutesExpired.Value()
+	deferred := metricRoutesExpiryDeferred.Value()
+	clock.Advance(40 * time.Minute)
+	a.NoteTraffic(netip.MustParseAddr("192.0.0.9")) // an active flow
+	a.NoteTraffic(netip.MustParseAddr("192.0.0.8")) // too long ago
+	clock.Advance(activeFlowTimeout)
+	a.NoteTraffic(netip.MustParseAddr("192.0.0.9"))
+	a.ExpireRoutes()
+	a.Wait(ctx)
+
+	if got, want := rc.RemovedRoutes(), prefixes("192.0.0.8/32"); !slices.Equal(got, want) {
+		t.Errorf("removed routes: got %v; want %v", got, want)
+	}
+	wantAddrs := []netip.Addr{netip.MustParseAddr("192.0.0.9"), netip.MustParseAddr("192.0.0.10")}
+	if got := a.DomainRoutes()["example.com"]; !slices.Equal(got, wantAddrs) {
+		t.Errorf("domain routes: got %v; want %v", got, wantAddrs)
+	}
+	if got := len(stored.LastSeen); got != 2 {
+		t.Errorf("stored %d last seen times; want 2", got)
+	}
+	if got := metricRoutesExpired.Value() - expired; got != 1 {
+		t.Errorf("expired metric increased by %d; want 1", got)
+	}
+	if got := metricRoutesExpiryDeferred.Value() - deferred; got != 1 {
+		t.Errorf("deferred metric increased by %d; want 1", got)
+	}
+
+	// Expiry happens automatically as DNS responses are observed, and
+	// routes are restored with their last seen times.
+	b := NewAppConnector(t.Logf, rc, stored, fakeStoreRoutes)
+	defer b.Close()
+	b.now = clock.Now
+	b.SetRouteExpiry(time.Hour)
+	b.Wait(ctx)
+	clock.Advance(time.Hour)
+	must.Do(b.ObserveDNSResponse(dnsResponse("example.com.", "192.0.0.10")))
+	b.Wait(ctx)
+	if got, want := b.DomainRoutes()["example.com"], wantAddrs[1:]; !slices.Equal(got, want) {
+		t.Errorf("restored domain routes: got %v; want %v", got, want)
+	}
+}
+
+func TestRouteExpiryPeriodic(t *testing.T) {
+	ctx := context.Background()
+	clock := tstest.NewClock(tstest.ClockOpts{})
+	rc := &appctest.RouteCollector{}
+	a := NewAppConnector(t.Logf, rc, nil, nil)
+	defer a.Close()
+	a.now = clock.Now
+	a.expiryCheckInterval = time.Millisecond
+	a.updateDomains([]string{"example.com"})
+	must.Do(a.ObserveDNSResponse(dnsResponse("example.com.", "192.0.0.8")))
+	a.Wait(ctx)
+
+	// Without any DNS responses, routes still expire.
+	a.SetRouteExpiry(time.Hour)
+	a.Wait(ctx)
+	clock.Advance(2 * time.Hour)
+	if err := tstest.WaitFor(5*time.Second, func() error {
+		a.Wait(ctx)
+		if got, want := rc.RemovedRoutes(), prefixes("192.0.0.8/32"); !slices.Equal(got, want) {
+			return fmt.Errorf("removed routes: got %v; want %v", got, want)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPatternDomains(t *testing.T) {
+	ctx := context.Background()
+	rc := &appctest.RouteCollector{}
+	a := NewAppConnector(t.Logf, rc, &RouteInfo{}, fakeStoreRoutes)
+	a.updateDomains([]string{"*.example.com", "CDN-*.example.org", "!*.internal.example.com", "!cdn-test.example.org"})
+
+	for _, tt := range []struct {
+		domain, addr string
+		want         bool
+	}{
+		{"foo.example.com.", "192.0.0.1", true},
+		{"db.internal.example.com.", "192.0.0.2", false},
+		{"cdn-1.example.org.", "192.0.0.3", true},
+		{"cdn-test.example.org.", "192.0.0.4", false},
+		{"www.example.org.", "192.0.0.5", false},
+	} {
+		rc.SetRoutes(nil)
+		must.Do(a.ObserveDNSResponse(dnsResponse(tt.domain, tt.addr)))
+		a.Wait(ctx)
+		if got := len(rc.Routes()) > 0; got != tt.want {
+			t.Errorf("%s routed = %v; want %v", tt.domain, got, tt.want)
+		}
+	}
+
+	// Narrowing the exclusions keeps learned domains that are still routed,
+	// and newly excluded domains are dropped.
+	a.updateDomains([]string{"*.example.com", "!foo.example.com", "cdn-*.example.org"})
+	routes := a.DomainRoutes()
+	if _, ok := routes["foo.example.com"]; ok {
+		t.Error("excluded foo.example.com still in domains")
+	}
+	if _, ok := routes["cdn-1.example.org"]; !ok {
+		t.Error("cdn-1.example.org was not preserved")
+	}
+}
+
+func TestRouteAggregation(t *testing.T) {
+	ctx := context.Background()
+	rc := &appctest.RouteCollector{}
+	var stored *RouteInfo
+	a := NewAppConnector(t.Logf, rc, &RouteInfo{}, func(ri *RouteInfo) error {
+		stored = ri
+		return nil
+	})
+	a.SetRouteAggregation(AggregationConfig{Threshold: 3})
+	a.Wait(ctx)
+	a.updateDomains([]string{"a.example.com", "b.example.com"})
+
+	for _, res := range [][]byte{
+		dnsResponse("a.example.com.", "192.0.2.1"),
+		dnsResponse("b.example.com.", "192.0.2.2"),
+		dnsResponse("a.example.com.", "198.51.100.1"),
+	} {
+		must.Do(a.ObserveDNSResponse(res))
+	}
+	a.Wait(ctx)
+	if got, want := rc.Routes(), prefixes("192.0.2.1/32", "192.0.2.2/32", "198.51.100.1/32"); !slices.Equal(got, want) {
+		t.Fatalf("routes before threshold: got %v; want %v", got, want)
+	}
+
+	must.Do(a.ObserveDNSResponse(dnsResponse("b.example.com.", "192.0.2.3")))
+	a.Wait(ctx)
+	if got, want := rc.Routes(), prefixes("198.51.100.1/32", "192.0.2.0/24"); !slices.Equal(got, want) {
+		t.Fatalf("routes after threshold: got %v; want %v", got, want)
+	}
+	if got, want := stored.Aggregates, prefixes("192.0.2.0/24"); !slices.Equal(got, want) {
+		t.Errorf("stored aggregates: got %v; want %v", got, want)
+	}
+
+	// New addresses in the aggregate need no new route.
+	must.Do(a.ObserveDNSResponse(dnsResponse("a.example.com.", "192.0.2.4")))
+	a.Wait(ctx)
+	if got, want := len(rc.Routes()), 2; got != want {
+		t.Errorf("got %d routes; want %d", got, want)
+	}
+	if got := a.DomainRoutes()["a.example.com"]; !slices.Contains(got, netip.MustParseAddr("192.0.2.4")) {
+		t.Errorf("aggregated address not recorded for domain: %v", got)
+	}
+
+	// The aggregate is removed with the last domain it covers.
+	a.updateDomains([]string{"a.example.com"})
+	a.Wait(ctx)
+	if got, want := len(rc.Routes()), 2; got != want {
+		t.Errorf("aggregate removed while still in use: routes %v", rc.Routes())
+	}
+	a.updateDomains(nil)
+	a.Wait(ctx)
+	if got := rc.Routes(); len(got) != 0 {
+		t.Errorf("routes after removing all domains: %v", got)
+	}
+}
+
+func TestRouteAggregationRestored(t *testing.T) {
+	ctx := context.Background()
+	rc := &appctest.RouteCollector{}
+	a := NewAppConnector(t.Logf, rc, &RouteInfo{
+		Domains: map[string][]netip.Addr{
+			"a.example.com": {netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")},
+			"b.example.com": {netip.MustParseAddr("192.0.2.2"), netip.MustParseAddr("192.0.2.3")},
+		},
+	}, fakeStoreRoutes)
+	defer a.Close()
+
+	// Restored addresses count towards the threshold, once each.
+	a.SetRouteAggregation(AggregationConfig{Threshold: 4})
+	a.Wait(ctx)
+	if got := rc.Routes(); len(got) != 0 {
+		t.Fatalf("routes below threshold: %v", got)
+	}
+	a.SetRouteAggregation(AggregationConfig{Threshold: 3})
+	a.Wait(ctx)
+	if got, want := rc.Routes(), prefixes("192.0.2.0/24"); !slices.Equal(got, want) {
+		t.Fatalf("routes after threshold: got %v; want %v", got, want)
+	}
+
+	// Aggregates created with another prefix length still cover their
+	// addresses, and are kept while any remain.
+	a.SetRouteAggregation(AggregationConfig{Threshold: 3, IPv4Bits: 16})
+	a.Wait(ctx)
+	must.Do(a.ObserveDNSResponse(dnsResponse("a.example.com.", "192.0.2.9")))
+	a.Wait(ctx)
+	if got, want := rc.Routes(), prefixes("192.0.2.0/24"); !slices.Equal(got, want) {
+		t.Fatalf("routes after observing aggregated address: got %v; want %v", got, want)
+	}
+	a.updateDomains([]string{"a.example.com"})
+	a.Wait(ctx)
+	if got, want := rc.Routes(), prefixes("192.0.2.0/24"); !slices.Equal(got, want) {
+		t.Errorf("aggregate removed while still in use: routes %v", got)
+	}
+	a.updateDomains(nil)
+	a.Wait(ctx)
+	if got := rc.Routes(); len(got) != 0 {
+		t.Errorf("routes after removing all domains: %v", got)
+	}
+}
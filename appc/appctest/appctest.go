@@ -7,9 +7,11 @@
 import (
 	"net/netip"
 	"slices"
+	"sync"
 )
 
-// RouteCollector is a test helper that collects the list of routes advertised
+// RouteCollector is a test helper that collects the list of routes advertised.
+// It is safe for concurrent use.
 type RouteCollector struct {
 	// AdvertiseCallback (optional) is called synchronously from
 	// AdvertiseRoute.
@@ -18,12 +20,15 @@ type RouteCollector struct {
 	// UnadvertiseRoute.
 	UnadvertiseCallback func()
 
+	mu            sync.Mutex
 	routes        []netip.Prefix
 	removedRoutes []netip.Prefix
 }
 
 func (rc *RouteCollector) AdvertiseRoute(pfx ...netip.Prefix) error {
+	rc.mu.Lock()
 	rc.routes = append(rc.routes, pfx...)
+	rc.mu.Unlock()
 	if rc.AdvertiseCallback != nil {
 		rc.AdvertiseCallback()
 	}
@@ -31,8 +36,9 @@ func (rc *RouteCollector) AdvertiseRoute(pfx ...netip.Prefix) error {
 }
 
 func (rc *RouteCollector) UnadvertiseRoute(toRemove ...netip.Prefix) error {
+	rc.mu.Lock()
 	routes := rc.routes
-	rc.routes = rc.routes[:0]
+	rc.routes = nil
 	for _, r := range routes {
 		if !slices.Contains(toRemove, r) {
 			rc.routes = append(rc.routes, r)
@@ -40,6 +46,7 @@ func (rc *RouteCollector) UnadvertiseRoute(toRemove ...netip.Prefix) error {
 			rc.removedRoutes = append(rc.removedRoutes, r)
 		}
 	}
+	rc.mu.Unlock()
 	if rc.UnadvertiseCallback != nil {
 		rc.UnadvertiseCallback()
 	}
@@ -48,16 +55,22 @@ func (rc *RouteCollector) UnadvertiseRoute(toRemove ...netip.Prefix) error {
 
 // RemovedRoutes returns the list of routes that were removed.
 func (rc *RouteCollector) RemovedRoutes() []netip.Prefix {
-	return rc.removedRoutes
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return slices.Clone(rc.removedRoutes)
 }
 
 // Routes returns the ordered list of routes that were added, including
 // possible duplicates.
 func (rc *RouteCollector) Routes() []netip.Prefix {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
 	return rc.routes
 }
 
 func (rc *RouteCollector) SetRoutes(routes []netip.Prefix) error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
 	rc.routes = routes
 	return nil
 }
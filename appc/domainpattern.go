@@ -0,0 +1,121 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package appc
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// domainPattern is a parsed domain pattern that is more complex than an exact
+// domain name or a plain "*." wildcard, which the AppConnector handles
+// directly.
+//
+// Patterns support the following forms:
+//
+//   - "api.*.example.com": a "*" label matches exactly one label.
+//   - "cdn-*.example.com", "*-edge.example.com": a "*" within a label matches
+//     any characters in that label, which allows matching label prefixes and
+//     suffixes.
+//   - "*.cdn-*.example.com": a leading "*." label matches one or more labels,
+//     as for plain wildcards, and may be combined with the above.
+//   - "/(eu|us)[0-9]+\.example\.com/": a regular expression matched against
+//     the whole name, without a trailing dot, as if it were anchored with
+//     ^ and $.
+type domainPattern struct {
+	raw string
+
+	// anyDepth is whether the pattern started with "*.", matching one or
+	// more labels before labels.
+	anyDepth bool
+	// labels are the remaining labels of the pattern, which may contain '*'.
+	labels []string
+
+	// re, if non-nil, is the regular expression the pattern consists of;
+	// anyDepth and labels are then unused.
+	re *regexp.Regexp
+}
+
+// parseDomainPattern parses s as a domain pattern. See domainPattern for the
+// supported forms.
+func parseDomainPattern(s string) (*domainPattern, error) {
+	if len(s) >= 2 && strings.HasPrefix(s, "/") && strings.HasSuffix(s, "/") {
+		re, err := regexp.Compile(`^(?:` + s[1:len(s)-1] + `)$`)
+		if err != nil {
+			return nil, fmt.Errorf("invalid domain pattern %q: %w", s, err)
+		}
+		return &domainPattern{raw: s, re: re}, nil
+	}
+	p := &domainPattern{raw: s}
+	rest, ok := strings.CutPrefix(s, "*.")
+	p.anyDepth = ok
+	if rest == "" {
+		return nil, fmt.Errorf("invalid domain pattern %q: no labels", s)
+	}
+	p.labels = strings.Split(rest, ".")
+	for _, l := range p.labels {
+		if err := checkPatternLabel(l); err != nil {
+			return nil, fmt.Errorf("invalid domain pattern %q: %w", s, err)
+		}
+	}
+	return p, nil
+}
+
+func checkPatternLabel(l string) error {
+	if l == "" {
+		return errors.New("empty label")
+	}
+	for _, c := range l {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '_', c == '*':
+		default:
+			return fmt.Errorf("invalid character %q in label %q", c, l)
+		}
+	}
+	return nil
+}
+
+// match reports whether the lower case domain name, without a trailing dot,
+// matches the pattern.
+func (p *domainPattern) match(name string) bool {
+	if p.re != nil {
+		return p.re.MatchString(name)
+	}
+	labels := strings.Split(name, ".")
+	if p.anyDepth {
+		if len(labels) <= len(p.labels) {
+			return false
+		}
+		labels = labels[len(labels)-len(p.labels):]
+	} else if len(labels) != len(p.labels) {
+		return false
+	}
+	for i, pl := range p.labels {
+		// Labels are checked to only contain '*' as a special character,
+		// for which path.Match never returns an error.
+		if ok, _ := path.Match(pl, labels[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// isPlainWildcard reports whether s is a "*." wildcard followed by a
+// literal domain name, which matches all subdomains of that name.
+func isPlainWildcard(s string) bool {
+	rest, ok := strings.CutPrefix(s, "*.")
+	return ok && rest != "" && !strings.Contains(rest, "*") && !strings.HasPrefix(s, "/")
+}
+
+// isPattern reports whether the configured domain s is a pattern other than
+// a plain wildcard, to be parsed with parseDomainPattern.
+func isPattern(s string) bool {
+	if isPlainWildcard(s) {
+		return false
+	}
+	return strings.Contains(s, "*") || strings.HasPrefix(s, "/")
+}
@@ -0,0 +1,50 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package appc
+
+import "testing"
+
+func TestDomainPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"*.example.com", "a.example.com", true},
+		{"*.example.com", "a.b.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"api.*.example.com", "api.eu.example.com", true},
+		{"api.*.example.com", "api.eu.west.example.com", false},
+		{"api.*.example.com", "www.eu.example.com", false},
+		{"cdn-*.example.com", "cdn-1.example.com", true},
+		{"cdn-*.example.com", "cdn.example.com", false},
+		{"cdn-*.example.com", "x.cdn-1.example.com", false},
+		{"*-edge.example.com", "eu-edge.example.com", true},
+		{"*.cdn-*.example.com", "a.b.cdn-1.example.com", true},
+		{"*.cdn-*.example.com", "cdn-1.example.com", false},
+		{`/^(eu|us)[0-9]+\.example\.com$/`, "eu12.example.com", true},
+		{`/^(eu|us)[0-9]+\.example\.com$/`, "ap1.example.com", false},
+		{`/(eu|us)[0-9]+\.example\.com/`, "us1.example.com", true},
+		{`/example\.com/`, "example.com", true},
+		{`/example\.com/`, "example.com.attacker.net", false},
+		{`/example\.com/`, "attacker-example.com", false},
+		{`/a|b\.example\.com/`, "a.attacker.net", false},
+	}
+	for _, tt := range tests {
+		p, err := parseDomainPattern(tt.pattern)
+		if err != nil {
+			t.Errorf("parseDomainPattern(%q): %v", tt.pattern, err)
+			continue
+		}
+		if got := p.match(tt.name); got != tt.want {
+			t.Errorf("%q.match(%q) = %v; want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"*.", "a..example.com", "a/b.example.com", "[a].example.com", "/(/"} {
+		if _, err := parseDomainPattern(bad); err == nil {
+			t.Errorf("parseDomainPattern(%q) succeeded; want error", bad)
+		}
+	}
+}
@@ -15,6 +15,7 @@
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"iter"
 	"net"
 	"net/http"
@@ -35,6 +36,7 @@
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/net/netutil"
+	"tailscale.com/net/udprelay/status"
 	"tailscale.com/paths"
 	"tailscale.com/safesocket"
 	"tailscale.com/tailcfg"
@@ -594,6 +596,17 @@ func (lc *Client) DebugResultJSON(ctx context.Context, action string) (any, erro
 	return x, nil
 }
 
+// DebugPeerRelaySessions returns the status of this node's peer relay server,
+// including the sessions it is relaying and the resource usage of the peers
+// that own them.
+func (lc *Client) DebugPeerRelaySessions(ctx context.Context) (*status.ServerStatus, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/debug-peer-relay-sessions")
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSON[*status.ServerStatus](body)
+}
+
 // DebugPortmapOpts contains options for the [Client.DebugPortmap] command.
 type DebugPortmapOpts struct {
 	// Duration is how long the mapping should be created for. It defaults
@@ -744,7 +757,27 @@ func (lc *Client) WaitingFiles(ctx context.Context) ([]apitype.WaitingFile, erro
 // If the duration is 0, it will return immediately. The duration is respected at second
 // granularity only. If no files are available, it returns (nil, nil).
 func (lc *Client) AwaitWaitingFiles(ctx context.Context, d time.Duration) ([]apitype.WaitingFile, error) {
+	return lc.awaitWaitingFiles(ctx, d, false)
+}
+
+// WaitingFilesAndTrees is like [Client.WaitingFiles] but also returns the
+// files within received directory trees. They are named by their
+// slash-separated path, starting with the tree's name.
+func (lc *Client) WaitingFilesAndTrees(ctx context.Context) ([]apitype.WaitingFile, error) {
+	return lc.AwaitWaitingFilesAndTrees(ctx, 0)
+}
+
+// AwaitWaitingFilesAndTrees is like [Client.AwaitWaitingFiles] but also
+// returns, and waits for, the files within received directory trees.
+func (lc *Client) AwaitWaitingFilesAndTrees(ctx context.Context, d time.Duration) ([]apitype.WaitingFile, error) {
+	return lc.awaitWaitingFiles(ctx, d, true)
+}
+
+func (lc *Client) awaitWaitingFiles(ctx context.Context, d time.Duration, trees bool) ([]apitype.WaitingFile, error) {
 	path := "/localapi/v0/files/?waitsec=" + fmt.Sprint(int(d.Seconds()))
+	if trees {
+		path += "&trees=true"
+	}
 	body, err := lc.get200(ctx, path)
 	if err != nil {
 		return nil, err
@@ -810,6 +843,69 @@ func (lc *Client) PushFile(ctx context.Context, target tailcfg.StableNodeID, siz
 	return bestError(fmt.Errorf("%s: %s", res.Status, all), all)
 }
 
+// PushFileTree sends the directory tree described by tree to target,
+// reading the contents of each file from fsys by its path within the tree.
+//
+// If an earlier transfer of a tree of the same name to target was
+// interrupted, only the files that are still needed are sent, and those
+// partially sent resume where they stopped. The target verifies the whole
+// tree against the manifest before making it visible.
+func (lc *Client) PushFileTree(ctx context.Context, target tailcfg.StableNodeID, tree *apitype.TaildropTree, fsys fs.FS) error {
+	treeURL := "/localapi/v0/file-put-tree/" + string(target)
+	body, err := lc.send(ctx, "POST", treeURL, 200, jsonBody(tree))
+	if err != nil {
+		return err
+	}
+	status, err := decodeJSON[apitype.TaildropTreeStatus](body)
+	if err != nil {
+		return err
+	}
+	sizes := make(map[string]int64, len(tree.Files))
+	for _, f := range tree.Files {
+		sizes[f.Path] = f.Size
+	}
+	treeURL += "/" + url.PathEscape(tree.Name)
+	for _, p := range status.Need {
+		size, ok := sizes[p]
+		if !ok {
+			return fmt.Errorf("peer requested unknown file %q", p)
+		}
+		if err := lc.pushTreeFile(ctx, treeURL, p, size, fsys); err != nil {
+			return fmt.Errorf("sending %s: %w", p, err)
+		}
+	}
+	_, err = lc.send(ctx, "POST", treeURL, 200, nil)
+	return err
+}
+
+func (lc *Client) pushTreeFile(ctx context.Context, treeURL, p string, size int64, fsys fs.FS) error {
+	f, err := fsys.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	elems := strings.Split(p, "/")
+	for i, elem := range elems {
+		elems[i] = url.PathEscape(elem)
+	}
+	req, err := http.NewRequestWithContext(ctx, "PUT", "http://"+apitype.LocalAPIHost+treeURL+"/"+strings.Join(elems, "/"), io.LimitReader(f, size))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	res, err := lc.doLocalRequestNiceError(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == 200 {
+		io.Copy(io.Discard, res.Body)
+		return nil
+	}
+	all, _ := io.ReadAll(res.Body)
+	return bestError(fmt.Errorf("%s: %s", res.Status, all), all)
+}
+
 // CheckIPForwarding asks the local Tailscale daemon whether it looks like the
 // machine is properly configured to forward IP packets as a subnet router
 // or exit node.
@@ -1320,6 +1416,41 @@ type modifyRequest struct {
 	return nil
 }
 
+// NetworkLockModifyRequest returns an unsigned request to add and/or remove
+// keys in the tailnet key authority, to be signed elsewhere with
+// tka.SigningRequest.Sign and submitted with NetworkLockSubmitSigned.
+func (lc *Client) NetworkLockModifyRequest(ctx context.Context, addKeys, removeKeys []tka.Key) (*tka.SigningRequest, error) {
+	var b bytes.Buffer
+	type modifyRequest struct {
+		AddKeys    []tka.Key
+		RemoveKeys []tka.Key
+	}
+
+	if err := json.NewEncoder(&b).Encode(modifyRequest{AddKeys: addKeys, RemoveKeys: removeKeys}); err != nil {
+		return nil, err
+	}
+
+	body, err := lc.send(ctx, "POST", "/localapi/v0/tka/modify-request", 200, &b)
+	if err != nil {
+		return nil, fmt.Errorf("error: %w", err)
+	}
+	var req tka.SigningRequest
+	if err := req.Unserialize(body); err != nil {
+		return nil, fmt.Errorf("decoding signing request: %w", err)
+	}
+	return &req, nil
+}
+
+// NetworkLockSubmitSigned validates a signing request which was signed
+// elsewhere and submits it to the control plane.
+func (lc *Client) NetworkLockSubmitSigned(ctx context.Context, req *tka.SigningRequest) error {
+	r := bytes.NewReader(req.Serialize())
+	if _, err := lc.send(ctx, "POST", "/localapi/v0/tka/submit-signed", 200, r); err != nil {
+		return fmt.Errorf("error: %w", err)
+	}
+	return nil
+}
+
 // NetworkLockSign signs the specified node-key and transmits that signature to the control plane.
 // rotationPublic, if specified, must be an ed25519 public key.
 func (lc *Client) NetworkLockSign(ctx context.Context, nodeKey key.NodePublic, rotationPublic []byte) error {
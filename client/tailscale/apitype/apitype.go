@@ -5,6 +5,9 @@
 package apitype
 
 import (
+	"io/fs"
+	"time"
+
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/dnstype"
 	"tailscale.com/util/ctxkey"
@@ -52,8 +55,62 @@ type FileTarget struct {
 }
 
 type WaitingFile struct {
+	// Name is the file's name. Files received as part of a directory
+	// tree have a slash-separated path, starting with the tree's name;
+	// they are only listed for clients that ask for them.
 	Name string
 	Size int64
+
+	// Mode and ModTime are the permission bits and modification time
+	// the sender gave a file received as part of a directory tree.
+	// They are zero for individually sent files.
+	Mode    fs.FileMode `json:",omitempty"`
+	ModTime time.Time   `json:",omitzero"`
+}
+
+// TaildropTree is the manifest of a directory tree sent with Taildrop.
+// It is sent to the receiving node before any file contents, and is used
+// to resume interrupted transfers and to verify the whole tree before it
+// is made visible.
+type TaildropTree struct {
+	// Name is the base name of the tree's root directory.
+	Name string
+
+	// Files are the files and directories within the tree. The root
+	// directory itself is not included.
+	Files []TaildropTreeFile
+}
+
+// TaildropTreeFile is a regular file or directory within a TaildropTree.
+type TaildropTreeFile struct {
+	// Path is the slash-separated path of the file, relative to the root
+	// of the tree.
+	Path string
+
+	// Mode holds the file's permission bits, plus fs.ModeDir for
+	// directories. Other mode bits are not permitted.
+	Mode fs.FileMode
+
+	ModTime time.Time
+
+	// Size and SHA256 are the length and hex-encoded SHA-256 hash of the
+	// file's contents. They are empty for directories.
+	Size   int64  `json:",omitempty"`
+	SHA256 string `json:",omitempty"`
+}
+
+// TaildropTreeStatus is the receiving node's response to a TaildropTree
+// manifest.
+type TaildropTreeStatus struct {
+	// SHA256 is the hex-encoded hash of the whole tree, which the receiver
+	// verifies against the received contents before making the tree
+	// visible.
+	SHA256 string
+
+	// Need are the paths of the files whose contents are still needed,
+	// in manifest order. Files received by an earlier, interrupted
+	// transfer are not included.
+	Need []string
 }
 
 // SetPushDeviceTokenRequest is the body POSTed to the LocalAPI endpoint /set-device-token.
@@ -24,6 +24,7 @@
 	"regexp"
 	"time"
 
+	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
 	"tailscale.com/tailcfg"
 )
@@ -42,7 +43,24 @@ type certProvider interface {
 	HTTPHandler(fallback http.Handler) http.Handler
 }
 
-func certProviderByCertMode(mode, dir, hostname string) (certProvider, error) {
+// acmeConfig configures the ACME CA used by the "letsencrypt" and "dns01"
+// cert modes.
+type acmeConfig struct {
+	DirectoryURL string                       // if empty, Let's Encrypt is used
+	Email        string                       // optional contact email
+	EAB          *acme.ExternalAccountBinding // optional External Account Binding
+
+	// DNSProvider publishes DNS-01 challenge records. It is required in the
+	// "dns01" cert mode and ignored otherwise.
+	DNSProvider dnsProvider
+	// PropagationDelay is how long to wait after publishing a DNS-01
+	// challenge record before asking the CA to check it.
+	PropagationDelay time.Duration
+}
+
+// certProviderByCertMode returns the certProvider for the given cert mode.
+// ac may be nil to use Let's Encrypt with no further options.
+func certProviderByCertMode(mode, dir, hostname string, ac *acmeConfig) (certProvider, error) {
 	if dir == "" {
 		return nil, errors.New("missing required --certdir flag")
 	}
@@ -53,6 +71,13 @@ func certProviderByCertMode(mode, dir, hostname string) (certProvider, error) {
 			HostPolicy: autocert.HostWhitelist(hostname),
 			Cache:      autocert.DirCache(dir),
 		}
+		if ac != nil {
+			if ac.DirectoryURL != "" {
+				certManager.Client = &acme.Client{DirectoryURL: ac.DirectoryURL}
+			}
+			certManager.Email = ac.Email
+			certManager.ExternalAccountBinding = ac.EAB
+		}
 		if hostname == "derp.tailscale.com" {
 			certManager.HostPolicy = prodAutocertHostPolicy
 			certManager.Email = "security@tailscale.com"
@@ -60,6 +85,8 @@ func certProviderByCertMode(mode, dir, hostname string) (certProvider, error) {
 		return certManager, nil
 	case "manual":
 		return NewManualCertManager(dir, hostname)
+	case "dns01":
+		return newDNS01CertManager(dir, hostname, ac)
 	default:
 		return nil, fmt.Errorf("unsupport cert mode: %q", mode)
 	}
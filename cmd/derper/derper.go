@@ -14,6 +14,7 @@
 	"cmp"
 	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"expvar"
@@ -38,6 +39,7 @@
 	"time"
 
 	"github.com/tailscale/setec/client/setec"
+	"golang.org/x/crypto/acme"
 	"golang.org/x/time/rate"
 	"tailscale.com/atomicfile"
 	"tailscale.com/derp"
@@ -57,24 +59,37 @@
 var (
 	dev         = flag.Bool("dev", false, "run in localhost development mode (overrides -a)")
 	versionFlag = flag.Bool("version", false, "print version and exit")
-	addr        = flag.String("a", ":443", "server HTTP/HTTPS listen address, in form \":port\", \"ip:port\", or for IPv6 \"[ip]:port\". If the IP is omitted, it defaults to all interfaces. Serves HTTPS if the port is 443 and/or -certmode is manual, otherwise HTTP.")
+	addr        = flag.String("a", ":443", "server HTTP/HTTPS listen address, in form \":port\", \"ip:port\", or for IPv6 \"[ip]:port\". If the IP is omitted, it defaults to all interfaces. Serves HTTPS if the port is 443 and/or -certmode is manual or dns01, otherwise HTTP.")
 	httpPort    = flag.Int("http-port", 80, "The port on which to serve HTTP. Set to -1 to disable. The listener is bound to the same IP (if any) as specified in the -a flag.")
 	stunPort    = flag.Int("stun-port", 3478, "The UDP port on which to serve STUN. The listener is bound to the same IP (if any) as specified in the -a flag.")
 	configPath  = flag.String("c", "", "config file path")
-	certMode    = flag.String("certmode", "letsencrypt", "mode for getting a cert. possible options: manual, letsencrypt")
+	certMode    = flag.String("certmode", "letsencrypt", "mode for getting a cert. possible options: manual, letsencrypt, dns01")
 	certDir     = flag.String("certdir", tsweb.DefaultCertDir("derper-certs"), "directory to store LetsEncrypt certs, if addr's port is :443")
 	hostname    = flag.String("hostname", "derp.tailscale.com", "LetsEncrypt host name, if addr's port is :443. When --certmode=manual, this can be an IP address to avoid SNI checks")
 	runSTUN     = flag.Bool("stun", true, "whether to run a STUN server. It will bind to the same IP (if any) as the --addr flag value.")
 	runDERP     = flag.Bool("derp", true, "whether to run a DERP server. The only reason to set this false is if you're decommissioning a server but want to keep its bootstrap DNS functionality still running.")
 	flagHome    = flag.String("home", "", "what to serve at the root path. It may be left empty (the default, for a default homepage), \"blank\" for a blank page, or a URL to redirect to")
 
-	meshPSKFile     = flag.String("mesh-psk-file", defaultMeshPSKFile(), "if non-empty, path to file containing the mesh pre-shared key file. It must be 64 lowercase hexadecimal characters; whitespace is trimmed.")
-	meshWith        = flag.String("mesh-with", "", "optional comma-separated list of hostnames to mesh with; the server's own hostname can be in the list. If an entry contains a slash, the second part names a hostname to be used when dialing the target.")
-	secretsURL      = flag.String("secrets-url", "", "SETEC server URL for secrets retrieval of mesh key")
-	secretPrefix    = flag.String("secrets-path-prefix", "prod/derp", "setec path prefix for \""+setecMeshKeyName+"\" secret for DERP mesh key")
-	secretsCacheDir = flag.String("secrets-cache-dir", defaultSetecCacheDir(), "directory to cache setec secrets in (required if --secrets-url is set)")
-	bootstrapDNS    = flag.String("bootstrap-dns-names", "", "optional comma-separated list of hostnames to make available at /bootstrap-dns")
-	unpublishedDNS  = flag.String("unpublished-bootstrap-dns-names", "", "optional comma-separated list of hostnames to make available at /bootstrap-dns and not publish in the list. If an entry contains a slash, the second part names a DNS record to poll for its TXT record with a `0` to `100` value for rollout percentage.")
+	acmeDirectoryURL   = flag.String("acme-directory-url", "", "ACME directory URL to get certs from when --certmode is letsencrypt or dns01; empty means Let's Encrypt")
+	acmeEmail          = flag.String("acme-email", "", "optional contact email for the ACME account")
+	acmeEABKeyID       = flag.String("acme-eab-kid", "", "key identifier for ACME External Account Binding, if required by the CA")
+	acmeEABKeyFile     = flag.String("acme-eab-hmac-key-file", "", "path to file containing the base64url-encoded HMAC key for ACME External Account Binding; whitespace is trimmed")
+	dns01Provider      = flag.String("dns01-provider", "rfc2136", "DNS provider used to publish ACME challenge records when --certmode=dns01. possible options: rfc2136")
+	dns01Propagation   = flag.Duration("dns01-propagation-delay", 0, "how long to wait after publishing an ACME challenge record before asking the CA to check it")
+	rfc2136Server      = flag.String("rfc2136-server", "", "for --dns01-provider=rfc2136, the \"host[:port]\" of the primary name server to send dynamic updates to")
+	rfc2136Zone        = flag.String("rfc2136-zone", "", "for --dns01-provider=rfc2136, the zone containing the _acme-challenge record for --hostname")
+	rfc2136TSIGKeyFile = flag.String("rfc2136-tsig-key-file", "", "for --dns01-provider=rfc2136, optional path to file containing a TSIG key in nsupdate -y format, \"[hmac-sha256:]name:base64secret\"")
+
+	meshPSKFile        = flag.String("mesh-psk-file", defaultMeshPSKFile(), "if non-empty, path to file containing the mesh pre-shared key file. It must be 64 lowercase hexadecimal characters; whitespace is trimmed.")
+	meshWith           = flag.String("mesh-with", "", "optional comma-separated list of hostnames to mesh with; the server's own hostname can be in the list. If an entry contains a slash, the second part names a hostname to be used when dialing the target.")
+	meshWithFile       = flag.String("mesh-with-file", "", "optional path to a file containing the list of hostnames to mesh with, in the same format as --mesh-with but also allowing newlines as separators. It is reloaded on SIGHUP and every --mesh-reload-interval; mesh peers are added and removed without a restart.")
+	meshReloadInterval = flag.Duration("mesh-reload-interval", 30*time.Second, "how often to check --mesh-with-file and --mesh-psk-file for changes; 0 means only on SIGHUP")
+	meshKeyGrace       = flag.Duration("mesh-key-grace", 10*time.Minute, "when the mesh key in --mesh-psk-file changes, how long to keep accepting and dialing with the previous key before switching all mesh connections to the new one")
+	secretsURL         = flag.String("secrets-url", "", "SETEC server URL for secrets retrieval of mesh key")
+	secretPrefix       = flag.String("secrets-path-prefix", "prod/derp", "setec path prefix for \""+setecMeshKeyName+"\" secret for DERP mesh key")
+	secretsCacheDir    = flag.String("secrets-cache-dir", defaultSetecCacheDir(), "directory to cache setec secrets in (required if --secrets-url is set)")
+	bootstrapDNS       = flag.String("bootstrap-dns-names", "", "optional comma-separated list of hostnames to make available at /bootstrap-dns")
+	unpublishedDNS     = flag.String("unpublished-bootstrap-dns-names", "", "optional comma-separated list of hostnames to make available at /bootstrap-dns and not publish in the list. If an entry contains a slash, the second part names a DNS record to poll for its TXT record with a `0` to `100` value for rollout percentage.")
 
 	verifyClients   = flag.Bool("verify-clients", false, "verify clients to this DERP server through a local tailscaled instance.")
 	verifyClientURL = flag.String("verify-client-url", "", "if non-empty, an admission controller URL for permitting client connections; see tailcfg.DERPAdmitClientRequest")
@@ -85,6 +100,12 @@
 	acceptConnLimit = flag.Float64("accept-connection-limit", math.Inf(+1), "rate limit for accepting new connection")
 	acceptConnBurst = flag.Int("accept-connection-burst", math.MaxInt, "burst limit for accepting new connection")
 
+	perClientRateLimit       = flag.Float64("per-client-rate-limit", 0, "rate limit in bytes per second for packets sent by each client (node key); 0 means unlimited. Mesh peers are not limited.")
+	perClientRateBurst       = flag.Int("per-client-rate-burst", 0, "burst size in bytes for --per-client-rate-limit; values below the maximum DERP packet size are rounded up to it")
+	perClientPacketRateLimit = flag.Float64("per-client-packet-rate-limit", 0, "rate limit in packets per second for packets sent by each client (node key); 0 means unlimited. Mesh peers are not limited.")
+	perClientPacketRateBurst = flag.Int("per-client-packet-rate-burst", 100, "burst size in packets for --per-client-packet-rate-limit")
+	fairQueue                = flag.Bool("fair-queue", false, "serve packets queued to each client round-robin by sender, so that one busy sender cannot starve others")
+
 	// tcpKeepAlive is intentionally long, to reduce battery cost. There is an L7 keepalive on a higher frequency schedule.
 	tcpKeepAlive = flag.Duration("tcp-keepalive-time", 10*time.Minute, "TCP keepalive time")
 	// tcpUserTimeout is intentionally short, so that hung connections are cleaned up promptly. DERPs should be nearby users.
@@ -184,7 +205,7 @@ func main() {
 
 	cfg := loadConfig()
 
-	serveTLS := tsweb.IsProd443(*addr) || *certMode == "manual"
+	serveTLS := tsweb.IsProd443(*addr) || *certMode == "manual" || *certMode == "dns01"
 
 	s := derp.NewServer(cfg.PrivateKey, log.Printf)
 	s.SetVerifyClient(*verifyClients)
@@ -192,6 +213,9 @@ func main() {
 	s.SetVerifyClientURL(*verifyClientURL)
 	s.SetVerifyClientURLFailOpen(*verifyFailOpen)
 	s.SetTCPWriteTimeout(*tcpWriteTimeout)
+	s.SetPerClientRateLimit(*perClientRateLimit, *perClientRateBurst)
+	s.SetPerClientPacketRateLimit(*perClientPacketRateLimit, *perClientPacketRateBurst)
+	s.SetFairQueuing(*fairQueue)
 
 	var meshKey string
 	if *dev {
@@ -241,9 +265,11 @@ func main() {
 		log.Println("DERP mesh key configured")
 	}
 
-	if err := startMesh(s); err != nil {
+	mm, err := startMesh(s)
+	if err != nil {
 		log.Fatalf("startMesh: %v", err)
 	}
+	go mm.reloadLoop(ctx)
 	expvar.Publish("derp", s.ExpVar())
 
 	handleHome, ok := getHomeHandler(*flagHome)
@@ -340,8 +366,13 @@ func main() {
 
 	if serveTLS {
 		log.Printf("derper: serving on %s with TLS", *addr)
+		var ac *acmeConfig
+		ac, err = acmeConfigFromFlags()
+		if err != nil {
+			log.Fatalf("derper: %v", err)
+		}
 		var certManager certProvider
-		certManager, err = certProviderByCertMode(*certMode, *certDir, *hostname)
+		certManager, err = certProviderByCertMode(*certMode, *certDir, *hostname, ac)
 		if err != nil {
 			log.Fatalf("derper: can not start cert provider: %v", err)
 		}
@@ -434,6 +465,42 @@ func defaultSetecCacheDir() string {
 	return filepath.Join(os.Getenv("HOME"), ".cache", "derper-secrets")
 }
 
+// acmeConfigFromFlags returns the ACME configuration specified by the
+// --acme-* and --dns01-* flags.
+func acmeConfigFromFlags() (*acmeConfig, error) {
+	ac := &acmeConfig{
+		DirectoryURL:     *acmeDirectoryURL,
+		Email:            *acmeEmail,
+		PropagationDelay: *dns01Propagation,
+	}
+	if (*acmeEABKeyID == "") != (*acmeEABKeyFile == "") {
+		return nil, errors.New("--acme-eab-kid and --acme-eab-hmac-key-file must be set together")
+	}
+	if *acmeEABKeyID != "" {
+		b, err := os.ReadFile(*acmeEABKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		k, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(strings.TrimSpace(string(b)), "="))
+		if err != nil {
+			return nil, fmt.Errorf("invalid ACME EAB HMAC key in %s: %w", *acmeEABKeyFile, err)
+		}
+		ac.EAB = &acme.ExternalAccountBinding{KID: *acmeEABKeyID, Key: k}
+	}
+	if *certMode == "dns01" {
+		newProvider, ok := dnsProviders[*dns01Provider]
+		if !ok {
+			return nil, fmt.Errorf("unknown --dns01-provider %q", *dns01Provider)
+		}
+		p, err := newProvider()
+		if err != nil {
+			return nil, fmt.Errorf("dns01 provider %q: %w", *dns01Provider, err)
+		}
+		ac.DNSProvider = p
+	}
+	return ac, nil
+}
+
 func defaultMeshPSKFile() string {
 	try := []string{
 		"/home/derp/keys/derp-mesh.key",
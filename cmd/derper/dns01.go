@@ -0,0 +1,353 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"tailscale.com/atomicfile"
+)
+
+// dnsProvider publishes the TXT records used to answer ACME DNS-01
+// challenges.
+type dnsProvider interface {
+	// Present publishes a TXT record named fqdn with the given value.
+	// fqdn is fully qualified, with a trailing dot.
+	Present(ctx context.Context, fqdn, value string) error
+	// CleanUp removes a TXT record previously published with Present.
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
+// dnsProviders are the DNS-01 providers that can be selected with
+// --dns01-provider, keyed by name. Each constructor reads its own flags.
+var dnsProviders = map[string]func() (dnsProvider, error){
+	"rfc2136": newRFC2136ProviderFromFlags,
+}
+
+const (
+	// dns01RenewBefore is how long before expiry certificates are renewed,
+	// matching the autocert default.
+	dns01RenewBefore = 30 * 24 * time.Hour
+
+	// dns01CheckInterval is how often the certificate expiry is checked.
+	dns01CheckInterval = time.Hour
+
+	// dns01AccountKeyFile is the name of the ACME account key file in the
+	// cert directory.
+	dns01AccountKeyFile = "dns01_account+key"
+)
+
+// dns01CertManager is a certProvider that obtains and renews a certificate
+// for a single hostname from an ACME CA using DNS-01 challenges, so that no
+// inbound port 80 or TLS-ALPN access is required.
+//
+// The certificate and key are stored in the cert directory using the same
+// names as the "manual" cert mode.
+type dns01CertManager struct {
+	hostname         string
+	crtPath, keyPath string
+	client           *acme.Client
+	email            string
+	eab              *acme.ExternalAccountBinding
+	provider         dnsProvider
+	propagationDelay time.Duration
+
+	registered bool // whether the ACME account was registered; only used by renew
+
+	mu   sync.Mutex
+	cert *tls.Certificate // current certificate; non-nil once created
+}
+
+// newDNS01CertManager returns a cert provider for hostname that uses DNS-01
+// challenges as configured by ac. It loads a cached certificate from certdir
+// or, if there is no valid one, obtains one before returning. The
+// certificate is renewed in the background thereafter.
+func newDNS01CertManager(certdir, hostname string, ac *acmeConfig) (certProvider, error) {
+	if ac == nil || ac.DNSProvider == nil {
+		return nil, errors.New("dns01 cert mode requires a DNS provider")
+	}
+	if hostname == "" {
+		return nil, errors.New("dns01 cert mode requires --hostname")
+	}
+	if err := os.MkdirAll(certdir, 0700); err != nil {
+		return nil, err
+	}
+	accountKey, err := loadOrCreateECKey(filepath.Join(certdir, dns01AccountKeyFile))
+	if err != nil {
+		return nil, fmt.Errorf("ACME account key: %w", err)
+	}
+	keyname := unsafeHostnameCharacters.ReplaceAllString(hostname, "")
+	m := &dns01CertManager{
+		hostname: hostname,
+		crtPath:  filepath.Join(certdir, keyname+".crt"),
+		keyPath:  filepath.Join(certdir, keyname+".key"),
+		client: &acme.Client{
+			Key:          accountKey,
+			DirectoryURL: ac.DirectoryURL,
+			UserAgent:    "derper",
+		},
+		email:            ac.Email,
+		eab:              ac.EAB,
+		provider:         ac.DNSProvider,
+		propagationDelay: ac.PropagationDelay,
+	}
+
+	if cert, err := tls.LoadX509KeyPair(m.crtPath, m.keyPath); err == nil {
+		if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil && leaf.VerifyHostname(hostname) == nil {
+			m.cert = &cert
+		}
+	}
+	if m.needsRenewal(time.Now()) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		defer cancel()
+		if err := m.renew(ctx); err != nil {
+			if m.cert == nil {
+				return nil, err
+			}
+			log.Printf("dns01: renewing certificate for %q failed, using cached certificate: %v", hostname, err)
+		}
+	}
+	go m.renewLoop()
+	return m, nil
+}
+
+func (m *dns01CertManager) TLSConfig() *tls.Config {
+	return &tls.Config{
+		Certificates: nil,
+		NextProtos: []string{
+			"http/1.1",
+		},
+		GetCertificate: m.getCertificate,
+	}
+}
+
+func (m *dns01CertManager) getCertificate(hi *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if hi.ServerName != m.hostname {
+		return nil, fmt.Errorf("cert mismatch with hostname: %q", hi.ServerName)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Return a shallow copy of the cert so the caller can append to its
+	// Certificate field.
+	certCopy := new(tls.Certificate)
+	*certCopy = *m.cert
+	certCopy.Certificate = certCopy.Certificate[:len(certCopy.Certificate):len(certCopy.Certificate)]
+	return certCopy, nil
+}
+
+func (m *dns01CertManager) HTTPHandler(fallback http.Handler) http.Handler {
+	return fallback
+}
+
+// needsRenewal reports whether the current certificate is missing or within
+// dns01RenewBefore of expiring at now.
+func (m *dns01CertManager) needsRenewal(now time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cert == nil {
+		return true
+	}
+	leaf, err := x509.ParseCertificate(m.cert.Certificate[0])
+	if err != nil {
+		return true
+	}
+	return now.Add(dns01RenewBefore).After(leaf.NotAfter)
+}
+
+// renewLoop periodically renews the certificate when it nears expiry. It
+// never returns.
+func (m *dns01CertManager) renewLoop() {
+	for {
+		time.Sleep(dns01CheckInterval)
+		if !m.needsRenewal(time.Now()) {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		if err := m.renew(ctx); err != nil {
+			log.Printf("dns01: renewing certificate for %q: %v", m.hostname, err)
+		}
+		cancel()
+	}
+}
+
+// register registers the ACME account, with External Account Binding if
+// configured, unless that was already done successfully.
+func (m *dns01CertManager) register(ctx context.Context) error {
+	if m.registered {
+		return nil
+	}
+	acct := &acme.Account{ExternalAccountBinding: m.eab}
+	if m.email != "" {
+		acct.Contact = []string{"mailto:" + m.email}
+	}
+	_, err := m.client.Register(ctx, acct, acme.AcceptTOS)
+	if err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return fmt.Errorf("registering ACME account: %w", err)
+	}
+	m.registered = true
+	return nil
+}
+
+// renew obtains a new certificate for m.hostname, stores it on disk and
+// starts serving it.
+func (m *dns01CertManager) renew(ctx context.Context) error {
+	if err := m.register(ctx); err != nil {
+		return err
+	}
+	order, err := m.client.AuthorizeOrder(ctx, acme.DomainIDs(m.hostname))
+	if err != nil {
+		return fmt.Errorf("creating ACME order: %w", err)
+	}
+	for _, u := range order.AuthzURLs {
+		if err := m.authorize(ctx, u); err != nil {
+			return err
+		}
+	}
+	order, err = m.client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return fmt.Errorf("waiting for ACME order: %w", err)
+	}
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: m.hostname},
+		DNSNames: []string{m.hostname},
+	}, priv)
+	if err != nil {
+		return err
+	}
+	der, _, err := m.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return fmt.Errorf("finalizing ACME order: %w", err)
+	}
+	if len(der) == 0 {
+		return errors.New("ACME CA returned an empty certificate chain")
+	}
+
+	var certPEM []byte
+	for _, b := range der {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b})...)
+	}
+	keyBytes, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	if err := atomicfile.WriteFile(m.keyPath, keyPEM, 0600); err != nil {
+		return err
+	}
+	if err := atomicfile.WriteFile(m.crtPath, certPEM, 0644); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.cert = &cert
+	m.mu.Unlock()
+	log.Printf("dns01: obtained new certificate for %q", m.hostname)
+	return nil
+}
+
+// authorize completes the ACME authorization at authzURL using its DNS-01
+// challenge, if it is not already valid.
+func (m *dns01CertManager) authorize(ctx context.Context, authzURL string) error {
+	authz, err := m.client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return fmt.Errorf("fetching ACME authorization: %w", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "dns-01" {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("ACME CA offered no dns-01 challenge for %q", authz.Identifier.Value)
+	}
+	value, err := m.client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return err
+	}
+	fqdn := "_acme-challenge." + strings.TrimSuffix(authz.Identifier.Value, ".") + "."
+	if err := m.provider.Present(ctx, fqdn, value); err != nil {
+		return fmt.Errorf("publishing %s TXT record: %w", fqdn, err)
+	}
+	defer func() {
+		if err := m.provider.CleanUp(context.WithoutCancel(ctx), fqdn, value); err != nil {
+			log.Printf("dns01: removing %s TXT record: %v", fqdn, err)
+		}
+	}()
+	if m.propagationDelay > 0 {
+		select {
+		case <-time.After(m.propagationDelay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if _, err := m.client.Accept(ctx, chal); err != nil {
+		return fmt.Errorf("accepting dns-01 challenge: %w", err)
+	}
+	if _, err := m.client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("dns-01 authorization for %q: %w", authz.Identifier.Value, err)
+	}
+	return nil
+}
+
+// loadOrCreateECKey reads the PEM-encoded EC private key at path, generating
+// and writing a new P-256 key if the file does not exist.
+func loadOrCreateECKey(path string) (crypto.Signer, error) {
+	b, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(b)
+		if block == nil || block.Type != "EC PRIVATE KEY" {
+			return nil, fmt.Errorf("%s: no EC private key found", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	keyBytes, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes})
+	if err := atomicfile.WriteFile(path, keyPEM, 0600); err != nil {
+		return nil, err
+	}
+	return priv, nil
+}
@@ -0,0 +1,356 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// fakeDNSProvider is a dnsProvider that keeps its TXT records in memory.
+type fakeDNSProvider struct {
+	mu        sync.Mutex
+	txt       map[string]string // fqdn => value
+	presented int
+}
+
+func (p *fakeDNSProvider) Present(ctx context.Context, fqdn, value string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.txt == nil {
+		p.txt = map[string]string{}
+	}
+	p.txt[fqdn] = value
+	p.presented++
+	return nil
+}
+
+func (p *fakeDNSProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.txt[fqdn] != value {
+		return fmt.Errorf("no TXT record %q for %s", value, fqdn)
+	}
+	delete(p.txt, fqdn)
+	return nil
+}
+
+func (p *fakeDNSProvider) lookup(fqdn string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.txt[fqdn]
+}
+
+// fakeACMEServer is a minimal RFC 8555 CA that issues certificates for
+// orders with a single identifier once its dns-01 challenge record is
+// published with dns. It does not verify request signatures.
+type fakeACMEServer struct {
+	srv    *httptest.Server
+	dns    *fakeDNSProvider
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+
+	mu         sync.Mutex
+	orders     int
+	eabKID     string // "kid" of the external account binding, if any
+	identifier string // of the current order
+	status     string // of the current authorization
+	certPEM    []byte // issued for the current order, once finalized
+}
+
+const fakeACMEToken = "fake-token"
+
+func newFakeACMEServer(t *testing.T, dns *fakeDNSProvider) *fakeACMEServer {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake ACME CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeACMEServer{dns: dns, caKey: caKey}
+	f.caCert, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.srv = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+func (f *fakeACMEServer) url(path string) string { return f.srv.URL + path }
+
+func (f *fakeACMEServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", fmt.Sprint(time.Now().UnixNano()))
+	if r.URL.Path == "/directory" {
+		writeJSON(w, http.StatusOK, map[string]string{
+			"newNonce":   f.url("/new-nonce"),
+			"newAccount": f.url("/new-account"),
+			"newOrder":   f.url("/new-order"),
+			"revokeCert": f.url("/revoke-cert"),
+			"keyChange":  f.url("/key-change"),
+		})
+		return
+	}
+	if r.URL.Path == "/new-nonce" {
+		return
+	}
+
+	var jws struct {
+		Payload string `json:"payload"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.URL.Path {
+	case "/new-account":
+		var req struct {
+			EAB *struct {
+				Protected string `json:"protected"`
+			} `json:"externalAccountBinding"`
+		}
+		json.Unmarshal(payload, &req)
+		if req.EAB != nil {
+			var hdr struct {
+				KID string `json:"kid"`
+			}
+			b, _ := base64.RawURLEncoding.DecodeString(req.EAB.Protected)
+			json.Unmarshal(b, &hdr)
+			f.eabKID = hdr.KID
+		}
+		w.Header().Set("Location", f.url("/account/1"))
+		writeJSON(w, http.StatusCreated, map[string]string{"status": "valid"})
+	case "/new-order":
+		var req struct {
+			Identifiers []struct{ Value string } `json:"identifiers"`
+		}
+		if err := json.Unmarshal(payload, &req); err != nil || len(req.Identifiers) != 1 {
+			http.Error(w, "bad order", http.StatusBadRequest)
+			return
+		}
+		f.orders++
+		f.identifier = req.Identifiers[0].Value
+		f.status = acme.StatusPending
+		f.certPEM = nil
+		w.Header().Set("Location", f.url("/order/1"))
+		writeJSON(w, http.StatusCreated, f.orderLocked())
+	case "/order/1":
+		w.Header().Set("Location", f.url("/order/1"))
+		writeJSON(w, http.StatusOK, f.orderLocked())
+	case "/authz/1":
+		writeJSON(w, http.StatusOK, map[string]any{
+			"status":     f.status,
+			"identifier": map[string]string{"type": "dns", "value": f.identifier},
+			"challenges": []map[string]string{{
+				"type":   "dns-01",
+				"url":    f.url("/challenge/1"),
+				"token":  fakeACMEToken,
+				"status": f.status,
+			}},
+		})
+	case "/challenge/1":
+		// A real CA would compare the record against the key
+		// authorization; checking that one is published is enough here.
+		if f.dns.lookup("_acme-challenge."+f.identifier+".") != "" {
+			f.status = acme.StatusValid
+		} else {
+			f.status = acme.StatusInvalid
+		}
+		writeJSON(w, http.StatusOK, map[string]string{
+			"type":   "dns-01",
+			"url":    f.url("/challenge/1"),
+			"token":  fakeACMEToken,
+			"status": f.status,
+		})
+	case "/finalize/1":
+		var req struct {
+			CSR string `json:"csr"`
+		}
+		json.Unmarshal(payload, &req)
+		if err := f.issueLocked(req.CSR); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Location", f.url("/order/1"))
+		writeJSON(w, http.StatusOK, f.orderLocked())
+	case "/cert/1":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(f.certPEM)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeACMEServer) orderLocked() map[string]any {
+	o := map[string]any{
+		"status":         acme.StatusPending,
+		"identifiers":    []map[string]string{{"type": "dns", "value": f.identifier}},
+		"authorizations": []string{f.url("/authz/1")},
+		"finalize":       f.url("/finalize/1"),
+	}
+	switch {
+	case f.certPEM != nil:
+		o["status"] = acme.StatusValid
+		o["certificate"] = f.url("/cert/1")
+	case f.status == acme.StatusValid:
+		o["status"] = acme.StatusReady
+	case f.status == acme.StatusInvalid:
+		o["status"] = acme.StatusInvalid
+	}
+	return o
+}
+
+func (f *fakeACMEServer) issueLocked(csr64 string) error {
+	if f.status != acme.StatusValid {
+		return fmt.Errorf("order not ready")
+	}
+	der, err := base64.RawURLEncoding.DecodeString(csr64)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return err
+	}
+	if len(csr.DNSNames) != 1 || csr.DNSNames[0] != f.identifier {
+		return fmt.Errorf("CSR names %q do not match order", csr.DNSNames)
+	}
+	leaf, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(int64(f.orders) + 1),
+		Subject:      pkix.Name{CommonName: f.identifier},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, f.caCert, csr.PublicKey, f.caKey)
+	if err != nil {
+		return err
+	}
+	f.certPEM = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.caCert.Raw})...)
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func TestDNS01CertMode(t *testing.T) {
+	const hostname = "derp.example.com"
+	dns := new(fakeDNSProvider)
+	ca := newFakeACMEServer(t, dns)
+	dir := t.TempDir()
+	ac := &acmeConfig{
+		DirectoryURL: ca.url("/directory"),
+		Email:        "admin@example.com",
+		EAB: &acme.ExternalAccountBinding{
+			KID: "eab-kid",
+			Key: []byte("eab-hmac-key"),
+		},
+		DNSProvider: dns,
+	}
+
+	cp, err := certProviderByCertMode("dns01", dir, hostname, ac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca.orders != 1 {
+		t.Errorf("orders = %d, want 1", ca.orders)
+	}
+	if ca.eabKID != "eab-kid" {
+		t.Errorf("external account binding kid = %q, want %q", ca.eabKID, "eab-kid")
+	}
+	if dns.presented != 1 || len(dns.txt) != 0 {
+		t.Errorf("challenge records presented %d times, %d left; want 1, 0", dns.presented, len(dns.txt))
+	}
+
+	verify := func(cp certProvider) {
+		t.Helper()
+		cert, err := cp.TLSConfig().GetCertificate(&tls.ClientHelloInfo{ServerName: hostname})
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.caCert)
+		if _, err := leaf.Verify(x509.VerifyOptions{DNSName: hostname, Roots: roots}); err != nil {
+			t.Errorf("certificate does not verify: %v", err)
+		}
+	}
+	verify(cp)
+	if _, err := cp.TLSConfig().GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example.com"}); err == nil {
+		t.Error("got certificate for other hostname")
+	}
+
+	// A restart uses the cached certificate rather than ordering a new one.
+	cp, err = certProviderByCertMode("dns01", dir, hostname, ac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify(cp)
+	if ca.orders != 1 {
+		t.Errorf("orders after restart = %d, want 1", ca.orders)
+	}
+}
+
+func TestDNS01ChallengeFailure(t *testing.T) {
+	// A provider that reports success without publishing anything leads
+	// to an invalid authorization, and no certificate.
+	ca := newFakeACMEServer(t, new(fakeDNSProvider))
+	_, err := certProviderByCertMode("dns01", t.TempDir(), "derp.example.com", &acmeConfig{
+		DirectoryURL: ca.url("/directory"),
+		DNSProvider:  nopDNSProvider{},
+	})
+	var authzErr *acme.AuthorizationError
+	if !errors.As(err, &authzErr) {
+		t.Fatalf("got error %v, want an AuthorizationError", err)
+	}
+}
+
+type nopDNSProvider struct{}
+
+func (nopDNSProvider) Present(ctx context.Context, fqdn, value string) error { return nil }
+func (nopDNSProvider) CleanUp(ctx context.Context, fqdn, value string) error { return nil }
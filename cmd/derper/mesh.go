@@ -9,35 +9,250 @@
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"slices"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"tailscale.com/derp"
 	"tailscale.com/derp/derphttp"
 	"tailscale.com/net/netmon"
+	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
+	"tailscale.com/util/set"
 )
 
-func startMesh(s *derp.Server) error {
-	if *meshWith == "" {
-		return nil
+// meshManager maintains the derphttp clients that mesh this server with the
+// other servers in its region. The set of peers and the mesh key can be
+// reloaded while serving; see reload.
+type meshManager struct {
+	s *derp.Server
+
+	mu          sync.Mutex
+	peers       map[string]*meshPeer // keyed by host tuple
+	meshKey     key.DERPMesh         // key the current peers were started with
+	nextMeshKey key.DERPMesh         // key to switch the peers to after the grace period, or zero
+	switchTimer *time.Timer          // fires switchKey for nextMeshKey, or nil
+}
+
+// meshPeer is a mesh client connection to another server in the region.
+type meshPeer struct {
+	s      *derp.Server
+	c      *derphttp.Client
+	cancel context.CancelFunc
+	done   chan struct{} // closed when the watch loop returns
+
+	mu      sync.Mutex
+	present set.Set[key.NodePublic] // clients forwarded via c
+}
+
+func startMesh(s *derp.Server) (*meshManager, error) {
+	m := &meshManager{s: s}
+	hosts, err := meshHosts()
+	if err != nil {
+		return nil, err
+	}
+	if len(hosts) == 0 {
+		return m, nil
 	}
 	if !s.HasMeshKey() {
-		return errors.New("--mesh-with requires --mesh-psk-file")
+		return nil, errors.New("--mesh-with requires --mesh-psk-file")
+	}
+	if err := m.update(hosts, s.MeshKey(), 0); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// meshHosts returns the host tuples to mesh with, from --mesh-with or
+// --mesh-with-file.
+func meshHosts() ([]string, error) {
+	v := *meshWith
+	if *meshWithFile != "" {
+		if v != "" {
+			return nil, errors.New("--mesh-with and --mesh-with-file are mutually exclusive")
+		}
+		b, err := os.ReadFile(*meshWithFile)
+		if err != nil {
+			return nil, err
+		}
+		v = string(b)
+	}
+	var hosts []string
+	for _, f := range strings.FieldsFunc(v, func(r rune) bool {
+		return r == ',' || r == '\n' || r == '\r' || r == ' ' || r == '\t'
+	}) {
+		if !slices.Contains(hosts, f) {
+			hosts = append(hosts, f)
+		}
+	}
+	return hosts, nil
+}
+
+// reloadLoop reloads the mesh configuration on SIGHUP and, if
+// --mesh-reload-interval is positive, periodically, until ctx is done.
+func (m *meshManager) reloadLoop(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if *meshReloadInterval > 0 && (*meshWithFile != "" || meshKeyReloadable()) {
+		t := time.NewTicker(*meshReloadInterval)
+		defer t.Stop()
+		tick = t.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Printf("mesh: got SIGHUP; reloading")
+		case <-tick:
+		}
+		if err := m.reload(); err != nil {
+			log.Printf("mesh: reload failed, keeping previous configuration: %v", err)
+		}
+	}
+}
+
+// meshKeyReloadable reports whether the mesh key comes from --mesh-psk-file
+// and can therefore be reloaded.
+func meshKeyReloadable() bool {
+	return !*dev && *secretsURL == "" && *meshPSKFile != ""
+}
+
+// reload rereads the mesh peers and, if it comes from a file, the mesh key,
+// and reconciles the running mesh clients with them. If the mesh key
+// changed, the previous key is still accepted from other servers for
+// --mesh-key-grace, and is used to dial them until then.
+func (m *meshManager) reload() error {
+	hosts, err := meshHosts()
+	if err != nil {
+		return err
+	}
+	if meshKeyReloadable() {
+		b, err := os.ReadFile(*meshPSKFile)
+		if err != nil {
+			return err
+		}
+		k, err := key.ParseDERPMesh(strings.TrimSpace(string(b)))
+		if err != nil {
+			return fmt.Errorf("invalid mesh key in %s: %w", *meshPSKFile, err)
+		}
+		if !k.Equal(m.s.MeshKey()) {
+			if err := m.s.RotateMeshKey(k.String(), *meshKeyGrace); err != nil {
+				return err
+			}
+			log.Printf("mesh: rotated mesh key; accepting previous key for %v", *meshKeyGrace)
+		}
+	}
+	if len(hosts) > 0 && !m.s.HasMeshKey() {
+		return errors.New("mesh peers configured without a mesh key")
+	}
+	return m.update(hosts, m.s.MeshKey(), *meshKeyGrace)
+}
+
+// update starts and stops mesh clients so that there is exactly one per
+// host tuple in hosts, all using meshKey.
+//
+// If meshKey differs from the key the clients were started with and grace
+// is positive, the clients keep using the previous key for grace, as the
+// other servers may not have the new key yet, and are then restarted with
+// meshKey. Otherwise they are restarted with meshKey immediately.
+func (m *meshManager) update(hosts []string, meshKey key.DERPMesh, grace time.Duration) error {
+	for _, h := range hosts {
+		if _, _, err := parseMeshHostTuple(h); err != nil {
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case meshKey.Equal(m.meshKey):
+		m.cancelSwitchLocked()
+	case meshKey.Equal(m.nextMeshKey):
+		// Already switching to it.
+	case grace > 0 && !m.meshKey.IsZero():
+		m.cancelSwitchLocked()
+		m.nextMeshKey = meshKey
+		m.switchTimer = time.AfterFunc(grace, func() { m.switchKey(meshKey) })
+	default:
+		m.cancelSwitchLocked()
+		for h, p := range m.peers {
+			p.stop()
+			delete(m.peers, h)
+		}
+		m.meshKey = meshKey
+	}
+	for h, p := range m.peers {
+		if !slices.Contains(hosts, h) {
+			log.Printf("mesh: removing %q", h)
+			p.stop()
+			delete(m.peers, h)
+		}
 	}
-	for _, hostTuple := range strings.Split(*meshWith, ",") {
-		if err := startMeshWithHost(s, hostTuple); err != nil {
+	for _, h := range hosts {
+		if _, ok := m.peers[h]; ok {
+			continue
+		}
+		p, err := startMeshWithHost(m.s, h, m.meshKey)
+		if err != nil {
 			return err
 		}
+		if m.peers == nil {
+			m.peers = make(map[string]*meshPeer)
+		}
+		m.peers[h] = p
 	}
 	return nil
 }
 
-func startMeshWithHost(s *derp.Server, hostTuple string) error {
-	var host string
-	var dialHost string
+// cancelSwitchLocked cancels any pending switch to nextMeshKey.
+//
+// m.mu must be held.
+func (m *meshManager) cancelSwitchLocked() {
+	if m.switchTimer != nil {
+		m.switchTimer.Stop()
+		m.switchTimer = nil
+	}
+	m.nextMeshKey = key.DERPMesh{}
+}
+
+// switchKey restarts the mesh clients with meshKey at the end of its grace
+// period, unless the pending switch was since cancelled or replaced.
+func (m *meshManager) switchKey(meshKey key.DERPMesh) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.nextMeshKey.IsZero() || !meshKey.Equal(m.nextMeshKey) {
+		return
+	}
+	m.switchTimer = nil
+	m.nextMeshKey = key.DERPMesh{}
+	m.meshKey = meshKey
+	log.Printf("mesh: grace period over; reconnecting to mesh peers with the new mesh key")
+	for h, p := range m.peers {
+		p.stop()
+		np, err := startMeshWithHost(m.s, h, meshKey)
+		if err != nil {
+			log.Printf("mesh: restarting %q: %v", h, err)
+			delete(m.peers, h)
+			continue
+		}
+		m.peers[h] = np
+	}
+}
+
+// parseMeshHostTuple parses a --mesh-with entry of the form "host" or
+// "host/dialHost".
+func parseMeshHostTuple(hostTuple string) (host, dialHost string, err error) {
 	hostParts := strings.Split(hostTuple, "/")
 	if len(hostParts) > 2 {
-		return fmt.Errorf("too many components in host tuple %q", hostTuple)
+		return "", "", fmt.Errorf("too many components in host tuple %q", hostTuple)
 	}
 	host = hostParts[0]
 	if len(hostParts) == 2 {
@@ -45,14 +260,22 @@ func startMeshWithHost(s *derp.Server, hostTuple string) error {
 	} else {
 		dialHost = hostParts[0]
 	}
+	return host, dialHost, nil
+}
+
+func startMeshWithHost(s *derp.Server, hostTuple string, meshKey key.DERPMesh) (*meshPeer, error) {
+	host, dialHost, err := parseMeshHostTuple(hostTuple)
+	if err != nil {
+		return nil, err
+	}
 
 	logf := logger.WithPrefix(log.Printf, fmt.Sprintf("mesh(%q): ", host))
 	netMon := netmon.NewStatic() // good enough for cmd/derper; no need for netns fanciness
 	c, err := derphttp.NewClient(s.PrivateKey(), "https://"+host+"/derp", logf, netMon)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	c.MeshKey = s.MeshKey()
+	c.MeshKey = meshKey
 	c.WatchConnectionChanges = true
 
 	logf("will dial %q for %q", dialHost, host)
@@ -70,9 +293,45 @@ func startMeshWithHost(s *derp.Server, hostTuple string) error {
 		})
 	}
 
-	add := func(m derp.PeerPresentMessage) { s.AddPacketForwarder(m.Key, c) }
-	remove := func(m derp.PeerGoneMessage) { s.RemovePacketForwarder(m.Peer, c) }
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &meshPeer{
+		s:       s,
+		c:       c,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		present: set.Set[key.NodePublic]{},
+	}
+	add := func(m derp.PeerPresentMessage) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.present.Add(m.Key)
+		s.AddPacketForwarder(m.Key, c)
+	}
+	remove := func(m derp.PeerGoneMessage) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.present.Delete(m.Peer)
+		s.RemovePacketForwarder(m.Peer, c)
+	}
 	notifyError := func(err error) {}
-	go c.RunWatchConnectionLoop(context.Background(), s.PublicKey(), logf, add, remove, notifyError)
-	return nil
+	go func() {
+		defer close(p.done)
+		c.RunWatchConnectionLoop(ctx, s.PublicKey(), logf, add, remove, notifyError)
+	}()
+	return p, nil
+}
+
+// stop closes the mesh client and removes the packet forwarders it
+// registered.
+func (p *meshPeer) stop() {
+	p.cancel()
+	p.c.Close()
+	<-p.done
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for k := range p.present {
+		p.s.RemovePacketForwarder(k, p.c)
+	}
+	p.present = nil
 }
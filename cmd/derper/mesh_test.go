@@ -0,0 +1,119 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"tailscale.com/derp"
+	"tailscale.com/types/key"
+	"tailscale.com/util/must"
+)
+
+func TestMeshHosts(t *testing.T) {
+	defer func(v, f string) { *meshWith, *meshWithFile = v, f }(*meshWith, *meshWithFile)
+
+	*meshWith, *meshWithFile = "a.example.com,b.example.com/10.0.0.2,a.example.com", ""
+	if got, want := must.Get(meshHosts()), []string{"a.example.com", "b.example.com/10.0.0.2"}; !slices.Equal(got, want) {
+		t.Errorf("from --mesh-with: got %q; want %q", got, want)
+	}
+
+	path := filepath.Join(t.TempDir(), "mesh")
+	if err := os.WriteFile(path, []byte("a.example.com\n c.example.com, d.example.com\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	*meshWith, *meshWithFile = "", path
+	if got, want := must.Get(meshHosts()), []string{"a.example.com", "c.example.com", "d.example.com"}; !slices.Equal(got, want) {
+		t.Errorf("from --mesh-with-file: got %q; want %q", got, want)
+	}
+
+	*meshWith = "a.example.com"
+	if _, err := meshHosts(); err == nil {
+		t.Error("got no error with both --mesh-with and --mesh-with-file")
+	}
+}
+
+func TestMeshManagerUpdate(t *testing.T) {
+	s := derp.NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	const (
+		key1 = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+		key2 = "fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210"
+	)
+	k1 := must.Get(key.ParseDERPMesh(key1))
+	k2 := must.Get(key.ParseDERPMesh(key2))
+
+	// The peers never connect, as the .invalid hosts don't resolve.
+	m := &meshManager{s: s}
+	defer m.update(nil, k1, 0)
+	if err := m.update([]string{"a.invalid", "b.invalid/127.0.0.1:1"}, k1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.peers) != 2 {
+		t.Fatalf("got %d peers; want 2", len(m.peers))
+	}
+	b := m.peers["b.invalid/127.0.0.1:1"]
+
+	if err := m.update([]string{"b.invalid/127.0.0.1:1", "c.invalid"}, k1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.peers["a.invalid"]; ok {
+		t.Error("removed peer a.invalid still present")
+	}
+	if m.peers["b.invalid/127.0.0.1:1"] != b {
+		t.Error("unchanged peer b.invalid was restarted")
+	}
+	if _, ok := m.peers["c.invalid"]; !ok {
+		t.Error("added peer c.invalid not present")
+	}
+
+	// During the grace period, peers keep using the old key, as they may
+	// not have the new one yet. New peers are started with it too.
+	if err := m.update([]string{"b.invalid/127.0.0.1:1", "c.invalid", "d.invalid"}, k2, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if m.peers["b.invalid/127.0.0.1:1"] != b {
+		t.Error("peer restarted during mesh key grace period")
+	}
+	if p := m.peers["d.invalid"]; p == nil || !p.c.MeshKey.Equal(k1) {
+		t.Error("peer added during grace period not using the old mesh key")
+	}
+	if err := m.update([]string{"b.invalid/127.0.0.1:1", "c.invalid"}, k2, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if !m.nextMeshKey.Equal(k2) {
+		t.Error("pending mesh key switch lost on reload")
+	}
+
+	m.switchKey(k1) // stale switch; ignored
+	if m.peers["b.invalid/127.0.0.1:1"] != b {
+		t.Error("stale mesh key switch restarted peer")
+	}
+	m.switchKey(k2)
+	for h, p := range m.peers {
+		if p == b || !p.c.MeshKey.Equal(k2) {
+			t.Errorf("peer %q not restarted with new mesh key after grace period", h)
+		}
+	}
+	b = m.peers["b.invalid/127.0.0.1:1"]
+
+	// Without a grace period, peers switch keys immediately.
+	if err := m.update([]string{"b.invalid/127.0.0.1:1", "c.invalid"}, k1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if p := m.peers["b.invalid/127.0.0.1:1"]; p == b || !p.c.MeshKey.Equal(k1) {
+		t.Error("peer not restarted with new mesh key")
+	}
+
+	if err := m.update([]string{"a/b/c"}, k1, 0); err == nil {
+		t.Error("invalid host tuple accepted")
+	}
+	if len(m.peers) != 2 {
+		t.Errorf("failed update changed peers: got %d; want 2", len(m.peers))
+	}
+}
@@ -0,0 +1,318 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// dnsOpCodeUpdate is the DNS UPDATE opcode, per RFC 2136 section 1.3.
+	dnsOpCodeUpdate dnsmessage.OpCode = 5
+
+	// dnsClassNone is the NONE class, used in RFC 2136 updates to delete
+	// a specific record.
+	dnsClassNone dnsmessage.Class = 254
+
+	// dnsTypeTSIG is the TSIG resource record type, per RFC 8945.
+	dnsTypeTSIG dnsmessage.Type = 250
+
+	// tsigFudge is the permitted clock skew in seconds for TSIG-signed
+	// messages, as recommended by RFC 8945 section 10.
+	tsigFudge = 300
+
+	rfc2136Timeout = 30 * time.Second
+)
+
+// tsigAlgorithms are the supported TSIG algorithms, keyed by their
+// name without the trailing dot.
+var tsigAlgorithms = map[string]func() hash.Hash{
+	"hmac-sha256": sha256.New,
+	"hmac-sha512": sha512.New,
+}
+
+// rfc2136Provider is a dnsProvider that publishes records using RFC 2136
+// dynamic updates, optionally authenticated with TSIG (RFC 8945).
+//
+// Updates are sent over TCP. The server's response is checked for success
+// but its TSIG signature, if any, is not verified.
+type rfc2136Provider struct {
+	server string   // host:port of the primary name server
+	zone   string   // zone to update
+	ttl    uint32   // TTL of published records
+	key    *tsigKey // or nil to send unsigned updates
+}
+
+// tsigKey is a TSIG shared secret.
+type tsigKey struct {
+	name      string // key name, fully qualified
+	algorithm string // algorithm name, fully qualified
+	secret    []byte
+	hash      func() hash.Hash
+}
+
+func newRFC2136ProviderFromFlags() (dnsProvider, error) {
+	if *rfc2136Server == "" {
+		return nil, errors.New("--rfc2136-server is required")
+	}
+	if *rfc2136Zone == "" {
+		return nil, errors.New("--rfc2136-zone is required")
+	}
+	p := &rfc2136Provider{
+		server: *rfc2136Server,
+		zone:   *rfc2136Zone,
+		ttl:    60,
+	}
+	if _, _, err := net.SplitHostPort(p.server); err != nil {
+		p.server = net.JoinHostPort(p.server, "53")
+	}
+	if *rfc2136TSIGKeyFile != "" {
+		b, err := os.ReadFile(*rfc2136TSIGKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		p.key, err = parseTSIGKey(strings.TrimSpace(string(b)))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", *rfc2136TSIGKeyFile, err)
+		}
+	}
+	return p, nil
+}
+
+// parseTSIGKey parses a TSIG key in the "[algorithm:]name:secret" form used
+// by nsupdate -y, where secret is base64-encoded. The algorithm defaults to
+// hmac-sha256.
+func parseTSIGKey(s string) (*tsigKey, error) {
+	f := strings.Split(s, ":")
+	alg := "hmac-sha256"
+	switch len(f) {
+	case 2:
+	case 3:
+		alg, f = strings.ToLower(f[0]), f[1:]
+	default:
+		return nil, errors.New("TSIG key must be of the form [algorithm:]name:secret")
+	}
+	h, ok := tsigAlgorithms[strings.TrimSuffix(alg, ".")]
+	if !ok {
+		return nil, fmt.Errorf("unsupported TSIG algorithm %q", alg)
+	}
+	secret, err := base64.StdEncoding.DecodeString(f[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid TSIG secret: %w", err)
+	}
+	if f[0] == "" || len(secret) == 0 {
+		return nil, errors.New("TSIG key name and secret must be non-empty")
+	}
+	return &tsigKey{
+		name:      absDNSName(f[0]),
+		algorithm: absDNSName(alg),
+		secret:    secret,
+		hash:      h,
+	}, nil
+}
+
+// absDNSName returns name with a trailing dot.
+func absDNSName(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+func (p *rfc2136Provider) Present(ctx context.Context, name, value string) error {
+	return p.update(ctx, name, value, true)
+}
+
+func (p *rfc2136Provider) CleanUp(ctx context.Context, name, value string) error {
+	return p.update(ctx, name, value, false)
+}
+
+// update adds or deletes the TXT record name with the given value.
+func (p *rfc2136Provider) update(ctx context.Context, name, value string, add bool) error {
+	msg, err := p.buildUpdate(name, value, add)
+	if err != nil {
+		return err
+	}
+	resp, err := p.exchange(ctx, msg)
+	if err != nil {
+		return err
+	}
+	var parser dnsmessage.Parser
+	h, err := parser.Start(resp)
+	if err != nil {
+		return fmt.Errorf("parsing DNS UPDATE response: %w", err)
+	}
+	if !h.Response || h.ID != binary.BigEndian.Uint16(msg) {
+		return errors.New("mismatched DNS UPDATE response")
+	}
+	if h.RCode != dnsmessage.RCodeSuccess {
+		return fmt.Errorf("DNS UPDATE of %s failed: %v", name, h.RCode)
+	}
+	return nil
+}
+
+// buildUpdate returns an UPDATE message, signed if p.key is set, that adds
+// or deletes the TXT record name with the given value.
+func (p *rfc2136Provider) buildUpdate(name, value string, add bool) ([]byte, error) {
+	zone, err := dnsmessage.NewName(absDNSName(p.zone))
+	if err != nil {
+		return nil, err
+	}
+	rrName, err := dnsmessage.NewName(absDNSName(name))
+	if err != nil {
+		return nil, err
+	}
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:     binary.BigEndian.Uint16(id[:]),
+		OpCode: dnsOpCodeUpdate,
+	})
+
+	// The question section is the zone section in an UPDATE, and the
+	// authority section holds the updates (RFC 2136 section 2).
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: zone, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+	if err := b.StartAuthorities(); err != nil {
+		return nil, err
+	}
+	rh := dnsmessage.ResourceHeader{Name: rrName, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET, TTL: p.ttl}
+	if !add {
+		// Delete an RR from an RRset (RFC 2136 section 2.5.4).
+		rh.Class, rh.TTL = dnsClassNone, 0
+	}
+	if err := b.TXTResource(rh, dnsmessage.TXTResource{TXT: []string{value}}); err != nil {
+		return nil, err
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		return nil, err
+	}
+	if p.key == nil {
+		return msg, nil
+	}
+	return p.key.sign(msg, time.Now())
+}
+
+// sign returns msg with a TSIG record appended, per RFC 8945 section 4.3.
+func (k *tsigKey) sign(msg []byte, now time.Time) ([]byte, error) {
+	if len(msg) < 12 {
+		return nil, errors.New("DNS message too short")
+	}
+	mac := hmac.New(k.hash, k.secret)
+	mac.Write(msg)
+	mac.Write(k.appendVariables(nil, uint64(now.Unix())))
+	return k.appendRecord(msg, uint64(now.Unix()), mac.Sum(nil)), nil
+}
+
+// appendVariables appends the TSIG variables covered by the MAC (RFC 8945
+// section 4.3.3) for a request signed at timeSigned to b.
+func (k *tsigKey) appendVariables(b []byte, timeSigned uint64) []byte {
+	b = appendWireName(b, k.name)
+	b = binary.BigEndian.AppendUint16(b, uint16(dnsmessage.ClassANY))
+	b = binary.BigEndian.AppendUint32(b, 0) // TTL
+	b = appendWireName(b, k.algorithm)
+	b = appendUint48(b, timeSigned)
+	b = binary.BigEndian.AppendUint16(b, tsigFudge)
+	b = binary.BigEndian.AppendUint16(b, 0) // error
+	b = binary.BigEndian.AppendUint16(b, 0) // other len
+	return b
+}
+
+// appendRecord returns a copy of msg with a TSIG record carrying mac
+// appended and its additional record count incremented.
+func (k *tsigKey) appendRecord(msg []byte, timeSigned uint64, mac []byte) []byte {
+	var rdata []byte
+	rdata = appendWireName(rdata, k.algorithm)
+	rdata = appendUint48(rdata, timeSigned)
+	rdata = binary.BigEndian.AppendUint16(rdata, tsigFudge)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(mac)))
+	rdata = append(rdata, mac...)
+	rdata = append(rdata, msg[0:2]...)              // original ID
+	rdata = binary.BigEndian.AppendUint16(rdata, 0) // error
+	rdata = binary.BigEndian.AppendUint16(rdata, 0) // other len
+
+	out := append([]byte(nil), msg...)
+	out = appendWireName(out, k.name)
+	out = binary.BigEndian.AppendUint16(out, uint16(dnsTypeTSIG))
+	out = binary.BigEndian.AppendUint16(out, uint16(dnsmessage.ClassANY))
+	out = binary.BigEndian.AppendUint32(out, 0) // TTL
+	out = binary.BigEndian.AppendUint16(out, uint16(len(rdata)))
+	out = append(out, rdata...)
+	arcount := binary.BigEndian.Uint16(out[10:12])
+	binary.BigEndian.PutUint16(out[10:12], arcount+1)
+	return out
+}
+
+// appendWireName appends the uncompressed, lowercased wire form of the
+// fully qualified name to b.
+func appendWireName(b []byte, name string) []byte {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	return append(b, 0)
+}
+
+func appendUint48(b []byte, v uint64) []byte {
+	return append(b, byte(v>>40), byte(v>>32), byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// exchange sends msg to p.server over TCP and returns the response.
+func (p *rfc2136Provider) exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	if len(msg) > 0xffff {
+		return nil, errors.New("DNS message too long")
+	}
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", p.server)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(rfc2136Timeout)
+	}
+	c.SetDeadline(deadline)
+
+	req := binary.BigEndian.AppendUint16(nil, uint16(len(msg)))
+	req = append(req, msg...)
+	if _, err := c.Write(req); err != nil {
+		return nil, err
+	}
+	var n [2]byte
+	if _, err := io.ReadFull(c, n[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(n[:]))
+	if _, err := io.ReadFull(c, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
@@ -0,0 +1,285 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testUpdateServer is a minimal authoritative name server for a single zone
+// that accepts RFC 2136 TXT updates, signed with key if non-nil.
+type testUpdateServer struct {
+	t    *testing.T
+	zone string
+	key  *tsigKey
+
+	mu  sync.Mutex
+	txt map[string][]string // name => values
+}
+
+func startTestUpdateServer(t *testing.T, zone string, key *tsigKey) (*testUpdateServer, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	s := &testUpdateServer{t: t, zone: zone, key: key, txt: map[string][]string{}}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serveConn(c)
+		}
+	}()
+	return s, ln.Addr().String()
+}
+
+func (s *testUpdateServer) records(name string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.txt[name])
+}
+
+func (s *testUpdateServer) serveConn(c net.Conn) {
+	defer c.Close()
+	for {
+		var n [2]byte
+		if _, err := io.ReadFull(c, n[:]); err != nil {
+			return
+		}
+		msg := make([]byte, binary.BigEndian.Uint16(n[:]))
+		if _, err := io.ReadFull(c, msg); err != nil {
+			return
+		}
+		h, rcode := s.handle(msg)
+		b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+			ID:       h.ID,
+			Response: true,
+			OpCode:   h.OpCode,
+			RCode:    rcode,
+		})
+		resp, err := b.Finish()
+		if err != nil {
+			s.t.Error(err)
+			return
+		}
+		c.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+	}
+}
+
+type testUpdate struct {
+	name  string
+	class dnsmessage.Class
+	txt   []string
+}
+
+func (s *testUpdateServer) handle(msg []byte) (dnsmessage.Header, dnsmessage.RCode) {
+	const (
+		rcodeNotAuth dnsmessage.RCode = 9
+		rcodeNotZone dnsmessage.RCode = 10
+	)
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil {
+		return h, dnsmessage.RCodeFormatError
+	}
+	if h.OpCode != dnsOpCodeUpdate {
+		return h, dnsmessage.RCodeNotImplemented
+	}
+	qs, err := p.AllQuestions()
+	if err != nil || len(qs) != 1 || qs[0].Type != dnsmessage.TypeSOA {
+		return h, dnsmessage.RCodeFormatError
+	}
+	if !strings.EqualFold(qs[0].Name.String(), s.zone) {
+		return h, rcodeNotZone
+	}
+	if err := p.SkipAllAnswers(); err != nil {
+		return h, dnsmessage.RCodeFormatError
+	}
+	var updates []testUpdate
+	for {
+		rh, err := p.AuthorityHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			break
+		}
+		if err != nil || rh.Type != dnsmessage.TypeTXT {
+			return h, dnsmessage.RCodeFormatError
+		}
+		r, err := p.TXTResource()
+		if err != nil {
+			return h, dnsmessage.RCodeFormatError
+		}
+		updates = append(updates, testUpdate{rh.Name.String(), rh.Class, r.TXT})
+	}
+
+	signed := false
+	for {
+		rh, err := p.AdditionalHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			break
+		}
+		if err != nil {
+			return h, dnsmessage.RCodeFormatError
+		}
+		if rh.Type != dnsTypeTSIG {
+			p.SkipAdditional()
+			continue
+		}
+		r, err := p.UnknownResource()
+		if err != nil {
+			return h, dnsmessage.RCodeFormatError
+		}
+		if s.key == nil || !s.verifyTSIG(msg, rh.Name.String(), r.Data) {
+			return h, rcodeNotAuth
+		}
+		signed = true
+	}
+	if s.key != nil && !signed {
+		return h, rcodeNotAuth
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range updates {
+		switch u.class {
+		case dnsmessage.ClassINET:
+			s.txt[u.name] = append(s.txt[u.name], u.txt...)
+		case dnsClassNone:
+			s.txt[u.name] = slices.DeleteFunc(s.txt[u.name], func(v string) bool {
+				return slices.Contains(u.txt, v)
+			})
+		}
+	}
+	return h, dnsmessage.RCodeSuccess
+}
+
+// verifyTSIG verifies the TSIG record with the given key name and rdata,
+// which must be the last record of msg, following RFC 8945 section 5.
+func (s *testUpdateServer) verifyTSIG(msg []byte, keyName string, rdata []byte) bool {
+	if !strings.EqualFold(keyName, s.key.name) {
+		return false
+	}
+	wireKeyName := appendWireName(nil, keyName)
+	unsigned := slices.Clone(msg[:len(msg)-(len(wireKeyName)+10+len(rdata))])
+	binary.BigEndian.PutUint16(unsigned[10:12], binary.BigEndian.Uint16(unsigned[10:12])-1)
+
+	// rdata is: algorithm name, time signed (6), fudge (2), MAC size (2),
+	// MAC, original ID (2), error (2), other len (2), other data.
+	algLen := 0
+	for algLen < len(rdata) && rdata[algLen] != 0 {
+		algLen += int(rdata[algLen]) + 1
+	}
+	algLen++
+	if len(rdata) < algLen+10 {
+		return false
+	}
+	macSize := int(binary.BigEndian.Uint16(rdata[algLen+8:]))
+	mac := rdata[algLen+10 : algLen+10+macSize]
+	rest := rdata[algLen+10+macSize:]
+
+	var vars []byte
+	vars = append(vars, wireKeyName...)
+	vars = binary.BigEndian.AppendUint16(vars, uint16(dnsmessage.ClassANY))
+	vars = binary.BigEndian.AppendUint32(vars, 0)
+	vars = append(vars, rdata[:algLen+8]...) // algorithm, time signed, fudge
+	vars = append(vars, rest[2:]...)         // error, other len, other data
+
+	h := hmac.New(s.key.hash, s.key.secret)
+	h.Write(unsigned)
+	h.Write(vars)
+	return hmac.Equal(h.Sum(nil), mac)
+}
+
+func TestRFC2136Provider(t *testing.T) {
+	const (
+		zone = "example.com."
+		name = "_acme-challenge.derp.example.com."
+	)
+	key, err := parseTSIGKey("hmac-sha256:derper-key:c2VjcmV0LXNlY3JldC1zZWNyZXQ=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, addr := startTestUpdateServer(t, zone, key)
+	p := &rfc2136Provider{server: addr, zone: "example.com", ttl: 60, key: key}
+	ctx := context.Background()
+
+	if err := p.Present(ctx, name, "token-1"); err != nil {
+		t.Fatalf("Present: %v", err)
+	}
+	if err := p.Present(ctx, name, "token-2"); err != nil {
+		t.Fatalf("Present: %v", err)
+	}
+	if got, want := srv.records(name), []string{"token-1", "token-2"}; !slices.Equal(got, want) {
+		t.Fatalf("records = %q; want %q", got, want)
+	}
+	if err := p.CleanUp(ctx, name, "token-1"); err != nil {
+		t.Fatalf("CleanUp: %v", err)
+	}
+	if got, want := srv.records(name), []string{"token-2"}; !slices.Equal(got, want) {
+		t.Fatalf("after CleanUp, records = %q; want %q", got, want)
+	}
+
+	badKey := *key
+	badKey.secret = []byte("wrong")
+	bad := &rfc2136Provider{server: addr, zone: zone, ttl: 60, key: &badKey}
+	if err := bad.Present(ctx, name, "token-3"); err == nil {
+		t.Error("Present with wrong TSIG secret succeeded")
+	}
+	unsigned := &rfc2136Provider{server: addr, zone: zone, ttl: 60}
+	if err := unsigned.Present(ctx, name, "token-3"); err == nil {
+		t.Error("unsigned Present succeeded")
+	}
+	wrongZone := &rfc2136Provider{server: addr, zone: "example.net.", ttl: 60, key: key}
+	if err := wrongZone.Present(ctx, name, "token-3"); err == nil {
+		t.Error("Present to wrong zone succeeded")
+	}
+	if got, want := srv.records(name), []string{"token-2"}; !slices.Equal(got, want) {
+		t.Errorf("after rejected updates, records = %q; want %q", got, want)
+	}
+}
+
+func TestParseTSIGKey(t *testing.T) {
+	tests := []struct {
+		in      string
+		name    string
+		alg     string
+		wantErr bool
+	}{
+		{in: "key:c2VjcmV0", name: "key.", alg: "hmac-sha256."},
+		{in: "HMAC-SHA512:key.example.:c2VjcmV0", name: "key.example.", alg: "hmac-sha512."},
+		{in: "hmac-md5:key:c2VjcmV0", wantErr: true},
+		{in: "key:not base64", wantErr: true},
+		{in: "c2VjcmV0", wantErr: true},
+		{in: ":c2VjcmV0", wantErr: true},
+	}
+	for _, tt := range tests {
+		k, err := parseTSIGKey(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseTSIGKey(%q) succeeded; want error", tt.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseTSIGKey(%q): %v", tt.in, err)
+			continue
+		}
+		if k.name != tt.name || k.algorithm != tt.alg || string(k.secret) != "secret" {
+			t.Errorf("parseTSIGKey(%q) = %q, %q, %q; want %q, %q, %q", tt.in, k.name, k.algorithm, k.secret, tt.name, tt.alg, "secret")
+		}
+	}
+}
@@ -27,7 +27,10 @@
 // The cluster maintains consistency, reads can be stale and writes can be unavailable if sufficient cluster
 // peers are unavailable.
 type ConsensusIPPool struct {
-	IPSet                 *netipx.IPSet
+	IPSet *netipx.IPSet
+	// IPv6Set, if non-nil, contains the IPv6 addresses to allocate with
+	// IPv6ForDomain. It must be the same on all members of the cluster.
+	IPv6Set               *netipx.IPSet
 	perPeerMap            *syncs.Map[tailcfg.NodeID, *consensusPerPeerState]
 	consensus             commandExecutor
 	clusterController     clusterController
@@ -46,12 +49,29 @@ func NewConsensusIPPool(ipSet *netipx.IPSet) *ConsensusIPPool {
 // If no address association is found, one is allocated from the range of free addresses for this tailcfg.NodeID.
 // If no more address are available, an error is returned.
 func (ipp *ConsensusIPPool) IPForDomain(nid tailcfg.NodeID, domain string) (netip.Addr, error) {
+	return ipp.ipForDomain(nid, domain, false)
+}
+
+// IPv6ForDomain is like IPForDomain, but allocates from IPv6Set. It returns
+// ErrNoIPv6Pool if IPv6Set is nil.
+func (ipp *ConsensusIPPool) IPv6ForDomain(nid tailcfg.NodeID, domain string) (netip.Addr, error) {
+	if ipp.IPv6Set == nil {
+		return netip.Addr{}, ErrNoIPv6Pool
+	}
+	return ipp.ipForDomain(nid, domain, true)
+}
+
+func (ipp *ConsensusIPPool) ipForDomain(nid tailcfg.NodeID, domain string, v6 bool) (netip.Addr, error) {
 	now := time.Now()
 	// Check local state; local state may be stale. If we have an IP for this domain, and we are not
 	// close to the expiry time for the domain, it's safe to return what we have.
 	ps, psFound := ipp.perPeerMap.Load(nid)
 	if psFound {
-		if addr, addrFound := ps.domainToAddr[domain]; addrFound {
+		m := ps.domainToAddr
+		if v6 {
+			m = ps.domainToAddr6
+		}
+		if addr, addrFound := m[domain]; addrFound {
 			if ww, wwFound := ps.addrToDomain.Load(addr); wwFound {
 				if !isCloseToExpiry(ww.LastUsed, now, ipp.unusedAddressLifetime) {
 					ipp.fireAndForgetMarkLastUsed(nid, addr, ww, now)
@@ -67,6 +87,7 @@ func (ipp *ConsensusIPPool) IPForDomain(nid tailcfg.NodeID, domain string) (neti
 		Domain:        domain,
 		ReuseDeadline: now.Add(-1 * ipp.unusedAddressLifetime),
 		UpdatedAt:     now,
+		IPv6:          v6,
 	}
 	bs, err := json.Marshal(args)
 	if err != nil {
@@ -179,8 +200,9 @@ type whereWhen struct {
 }
 
 type consensusPerPeerState struct {
-	domainToAddr map[string]netip.Addr
-	addrToDomain *syncs.Map[netip.Addr, whereWhen]
+	domainToAddr  map[string]netip.Addr
+	domainToAddr6 map[string]netip.Addr
+	addrToDomain  *syncs.Map[netip.Addr, whereWhen]
 }
 
 // StopConsensus is part of the IPPool interface. It stops the raft background routines that handle consensus.
@@ -188,12 +210,12 @@ func (ipp *ConsensusIPPool) StopConsensus(ctx context.Context) error {
 	return (ipp.consensus).(*tsconsensus.Consensus).Stop(ctx)
 }
 
-// unusedIPV4 finds the next unused or expired IP address in the pool.
+// unusedIP finds the next unused or expired IP address in the pool.
 // IP addresses in the pool should be reused if they haven't been used for some period of time.
 // reuseDeadline is the time before which addresses are considered to be expired.
 // So if addresses are being reused after they haven't been used for 24 hours say, reuseDeadline
 // would be 24 hours ago.
-func (ps *consensusPerPeerState) unusedIPV4(ipset *netipx.IPSet, reuseDeadline time.Time) (netip.Addr, bool, string, error) {
+func (ps *consensusPerPeerState) unusedIP(ipset *netipx.IPSet, reuseDeadline time.Time) (netip.Addr, bool, string, error) {
 	// If we want to have a random IP choice behavior we could make that work with the state machine by doing something like
 	// passing the randomly chosen IP into the state machine call (so replaying logs would still be deterministic).
 	for _, r := range ipset.Ranges() {
@@ -364,6 +386,9 @@ type checkoutAddrArgs struct {
 	Domain        string
 	ReuseDeadline time.Time
 	UpdatedAt     time.Time
+	// IPv6 is whether to allocate an IPv6 address. It is omitted for IPv4
+	// so that log entries from before IPv6 support replay unchanged.
+	IPv6 bool `json:",omitempty"`
 }
 
 // executeCheckoutAddr parses a checkoutAddr raft log entry and applies it.
@@ -373,7 +398,12 @@ func (ipp *ConsensusIPPool) executeCheckoutAddr(bs []byte) tsconsensus.CommandRe
 	if err != nil {
 		return tsconsensus.CommandResult{Err: err}
 	}
-	addr, err := ipp.applyCheckoutAddr(args.NodeID, args.Domain, args.ReuseDeadline, args.UpdatedAt)
+	var addr netip.Addr
+	if args.IPv6 {
+		addr, err = ipp.applyCheckoutAddr6(args.NodeID, args.Domain, args.ReuseDeadline, args.UpdatedAt)
+	} else {
+		addr, err = ipp.applyCheckoutAddr(args.NodeID, args.Domain, args.ReuseDeadline, args.UpdatedAt)
+	}
 	if err != nil {
 		return tsconsensus.CommandResult{Err: err}
 	}
@@ -393,6 +423,19 @@ func (ipp *ConsensusIPPool) executeCheckoutAddr(bs []byte) tsconsensus.CommandRe
 // It is not safe for concurrent access (it's only called from raft, which will not call concurrently
 // so that's fine).
 func (ipp *ConsensusIPPool) applyCheckoutAddr(nid tailcfg.NodeID, domain string, reuseDeadline, updatedAt time.Time) (netip.Addr, error) {
+	return ipp.applyCheckout(nid, domain, false, reuseDeadline, updatedAt)
+}
+
+// applyCheckoutAddr6 is like applyCheckoutAddr, but for an IPv6 address from
+// IPv6Set.
+func (ipp *ConsensusIPPool) applyCheckoutAddr6(nid tailcfg.NodeID, domain string, reuseDeadline, updatedAt time.Time) (netip.Addr, error) {
+	if ipp.IPv6Set == nil {
+		return netip.Addr{}, ErrNoIPv6Pool
+	}
+	return ipp.applyCheckout(nid, domain, true, reuseDeadline, updatedAt)
+}
+
+func (ipp *ConsensusIPPool) applyCheckout(nid tailcfg.NodeID, domain string, v6 bool, reuseDeadline, updatedAt time.Time) (netip.Addr, error) {
 	ps, ok := ipp.perPeerMap.Load(nid)
 	if !ok {
 		ps = &consensusPerPeerState{
@@ -400,7 +443,11 @@ func (ipp *ConsensusIPPool) applyCheckoutAddr(nid tailcfg.NodeID, domain string,
 		}
 		ipp.perPeerMap.Store(nid, ps)
 	}
-	if existing, ok := ps.domainToAddr[domain]; ok {
+	domainToAddr, ipset := &ps.domainToAddr, ipp.IPSet
+	if v6 {
+		domainToAddr, ipset = &ps.domainToAddr6, ipp.IPv6Set
+	}
+	if existing, ok := (*domainToAddr)[domain]; ok {
 		ww, ok := ps.addrToDomain.Load(existing)
 		if ok {
 			ww.LastUsed = updatedAt
@@ -409,13 +456,13 @@ func (ipp *ConsensusIPPool) applyCheckoutAddr(nid tailcfg.NodeID, domain string,
 		}
 		log.Printf("applyCheckoutAddr: data out of sync, allocating new IP")
 	}
-	addr, wasInUse, previousDomain, err := ps.unusedIPV4(ipp.IPSet, reuseDeadline)
+	addr, wasInUse, previousDomain, err := ps.unusedIP(ipset, reuseDeadline)
 	if err != nil {
 		return netip.Addr{}, err
 	}
-	mak.Set(&ps.domainToAddr, domain, addr)
+	mak.Set(domainToAddr, domain, addr)
 	if wasInUse {
-		delete(ps.domainToAddr, previousDomain)
+		delete(*domainToAddr, previousDomain)
 	}
 	ps.addrToDomain.Store(addr, whereWhen{Domain: domain, LastUsed: updatedAt})
 	return addr, nil
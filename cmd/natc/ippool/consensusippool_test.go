@@ -381,3 +381,54 @@ func TestConsensusIsCloseToExpiry(t *testing.T) {
 		t.Fatal("times are within half the lifetime, expected false")
 	}
 }
+
+func TestConsensusIPv6ForDomain(t *testing.T) {
+	ipp := makePool(netip.MustParsePrefix("100.64.0.0/16"))
+	from := tailcfg.NodeID(1)
+	if _, err := ipp.IPv6ForDomain(from, "example.com"); err != ErrNoIPv6Pool {
+		t.Fatalf("IPv6ForDomain without IPv6Set: got %v, want ErrNoIPv6Pool", err)
+	}
+
+	v6Pfx := netip.MustParsePrefix("fd7a:115c:a1e0:b1a::/120")
+	ipp.IPv6Set = makeSetFromPrefix(v6Pfx)
+	v4, err := ipp.IPForDomain(from, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v6, err := ipp.IPv6ForDomain(from, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !v6Pfx.Contains(v6) {
+		t.Fatalf("expected %v to be in the prefix %v", v6, v6Pfx)
+	}
+	if again, err := ipp.IPv6ForDomain(from, "example.com"); err != nil || again != v6 {
+		t.Fatalf("IPv6ForDomain again = %v, %v; want %v", again, err, v6)
+	}
+	for _, addr := range []netip.Addr{v4, v6} {
+		if domain, ok := ipp.DomainForIP(from, addr, time.Now()); !ok || domain != "example.com" {
+			t.Errorf("DomainForIP(%v) = %q, %v; want example.com", addr, domain, ok)
+		}
+	}
+
+	// The IPv6 allocations survive a snapshot and restore.
+	fsmSnap, err := ipp.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := json.Marshal(fsmSnap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := makePool(netip.MustParsePrefix("100.64.0.0/16"))
+	if err := restored.Restore(io.NopCloser(bytes.NewReader(bs))); err != nil {
+		t.Fatal(err)
+	}
+	if restored.IPv6Set == nil || !restored.IPv6Set.Contains(v6) {
+		t.Fatal("IPv6Set not restored")
+	}
+	ps, _ := restored.perPeerMap.Load(from)
+	if got := ps.domainToAddr6["example.com"]; got != v6 {
+		t.Errorf("restored IPv6 address = %v, want %v", got, v6)
+	}
+}
@@ -82,11 +82,21 @@ func (ipp *ConsensusIPPool) Restore(rc io.ReadCloser) error {
 	}
 	ipp.IPSet = ipset
 	ipp.perPeerMap = ppm
+	// Snapshots from before IPv6 support have no IPv6 set; keep the
+	// configured one.
+	if snap.IPv6Set != nil {
+		ipset6, err := snap.IPv6Set.toIPSet()
+		if err != nil {
+			return err
+		}
+		ipp.IPv6Set = ipset6
+	}
 	return nil
 }
 
 type fsmSnapshot struct {
 	IPSet      persistableIPSet
+	IPv6Set    *persistableIPSet `json:",omitempty"`
 	PerPeerMap map[tailcfg.NodeID]persistablePPS
 }
 
@@ -115,10 +125,15 @@ func (ipp *ConsensusIPPool) getPersistable() fsmSnapshot {
 	for k, v := range ipp.perPeerMap.All() {
 		ppm[k] = v.getPersistable()
 	}
-	return fsmSnapshot{
+	snap := fsmSnapshot{
 		IPSet:      getPersistableIPSet(ipp.IPSet),
 		PerPeerMap: ppm,
 	}
+	if ipp.IPv6Set != nil {
+		ipset6 := getPersistableIPSet(ipp.IPv6Set)
+		snap.IPv6Set = &ipset6
+	}
+	return snap
 }
 
 func (f fsmSnapshot) getData() (*netipx.IPSet, *syncs.Map[tailcfg.NodeID, *consensusPerPeerState], error) {
@@ -142,14 +157,16 @@ func (f fsmSnapshot) getData() (*netipx.IPSet, *syncs.Map[tailcfg.NodeID, *conse
 // and the results used during persist (concurrently with Apply)
 func (ps *consensusPerPeerState) getPersistable() persistablePPS {
 	return persistablePPS{
-		AddrToDomain: maps.Collect(ps.addrToDomain.All()),
-		DomainToAddr: maps.Clone(ps.domainToAddr),
+		AddrToDomain:  maps.Collect(ps.addrToDomain.All()),
+		DomainToAddr:  maps.Clone(ps.domainToAddr),
+		DomainToAddr6: maps.Clone(ps.domainToAddr6),
 	}
 }
 
 type persistablePPS struct {
-	DomainToAddr map[string]netip.Addr
-	AddrToDomain map[netip.Addr]whereWhen
+	DomainToAddr  map[string]netip.Addr
+	DomainToAddr6 map[string]netip.Addr `json:",omitempty"`
+	AddrToDomain  map[netip.Addr]whereWhen
 }
 
 func (p persistablePPS) toPerPeerState() *consensusPerPeerState {
@@ -158,7 +175,8 @@ func (p persistablePPS) toPerPeerState() *consensusPerPeerState {
 		atd.Store(k, v)
 	}
 	return &consensusPerPeerState{
-		domainToAddr: p.DomainToAddr,
-		addrToDomain: atd,
+		domainToAddr:  p.DomainToAddr,
+		domainToAddr6: p.DomainToAddr6,
+		addrToDomain:  atd,
 	}
 }
@@ -22,8 +22,12 @@
 
 var ErrNoIPsAvailable = errors.New("no IPs available")
 
-// IPPool allocates IPv4 addresses from a pool to DNS domains, on a per tailcfg.NodeID basis.
-// For each tailcfg.NodeID, IPv4 addresses are associated with at most one DNS domain.
+// ErrNoIPv6Pool is returned by IPv6ForDomain if the pool has no IPv6 addresses.
+var ErrNoIPv6Pool = errors.New("no IPv6 pool configured")
+
+// IPPool allocates IPv4 and IPv6 addresses from a pool to DNS domains, on a per tailcfg.NodeID basis.
+// For each tailcfg.NodeID, addresses are associated with at most one DNS domain, and each
+// domain has at most one address of each family.
 // Addresses may be reused across other tailcfg.NodeID's for the same or other domains.
 type IPPool interface {
 	// DomainForIP looks up the domain associated with a tailcfg.NodeID and netip.Addr pair.
@@ -34,11 +38,19 @@ type IPPool interface {
 	// If no address association is found, one is allocated from the range of free addresses for this tailcfg.NodeID.
 	// If no more address are available, an error is returned.
 	IPForDomain(tailcfg.NodeID, string) (netip.Addr, error)
+
+	// IPv6ForDomain is like IPForDomain, but for an IPv6 address. It returns
+	// ErrNoIPv6Pool if the pool has no IPv6 addresses.
+	IPv6ForDomain(tailcfg.NodeID, string) (netip.Addr, error)
 }
 
 type SingleMachineIPPool struct {
 	perPeerMap syncs.Map[tailcfg.NodeID, *perPeerState]
 	IPSet      *netipx.IPSet
+
+	// IPv6Set, if non-nil, contains the IPv6 addresses to allocate with
+	// IPv6ForDomain.
+	IPv6Set *netipx.IPSet
 }
 
 func (ipp *SingleMachineIPPool) DomainForIP(from tailcfg.NodeID, addr netip.Addr, _ time.Time) (string, bool) {
@@ -56,21 +68,35 @@ func (ipp *SingleMachineIPPool) DomainForIP(from tailcfg.NodeID, addr netip.Addr
 }
 
 func (ipp *SingleMachineIPPool) IPForDomain(from tailcfg.NodeID, domain string) (netip.Addr, error) {
+	return ipp.peerState(from).ipForDomain(domain, false)
+}
+
+func (ipp *SingleMachineIPPool) IPv6ForDomain(from tailcfg.NodeID, domain string) (netip.Addr, error) {
+	if ipp.IPv6Set == nil {
+		return netip.Addr{}, ErrNoIPv6Pool
+	}
+	return ipp.peerState(from).ipForDomain(domain, true)
+}
+
+func (ipp *SingleMachineIPPool) peerState(from tailcfg.NodeID) *perPeerState {
 	npps := &perPeerState{
-		ipset: ipp.IPSet,
+		ipset:  ipp.IPSet,
+		ipset6: ipp.IPv6Set,
 	}
 	ps, _ := ipp.perPeerMap.LoadOrStore(from, npps)
-	return ps.ipForDomain(domain)
+	return ps
 }
 
 // perPeerState holds the state for a single peer.
 type perPeerState struct {
-	ipset *netipx.IPSet
-
-	mu           sync.Mutex
-	addrInUse    *big.Int
-	domainToAddr map[string]netip.Addr
-	addrToDomain *bart.Table[string]
+	ipset  *netipx.IPSet
+	ipset6 *netipx.IPSet
+
+	mu            sync.Mutex
+	addrInUse     *big.Int
+	domainToAddr  map[string]netip.Addr
+	domainToAddr6 map[string]netip.Addr
+	addrToDomain  *bart.Table[string]
 }
 
 // domainForIP returns the domain name assigned to the given IP address and
@@ -84,10 +110,10 @@ func (ps *perPeerState) domainForIP(ip netip.Addr) (_ string, ok bool) {
 	return ps.addrToDomain.Lookup(ip)
 }
 
-// ipForDomain assigns a pair of unique IP addresses for the given domain and
-// returns them. The first address is an IPv4 address and the second is an IPv6
-// address. If the domain already has assigned addresses, it returns them.
-func (ps *perPeerState) ipForDomain(domain string) (netip.Addr, error) {
+// ipForDomain assigns a unique IPv4 address, or IPv6 address if v6 is true,
+// for the given domain and returns it. If the domain already has an assigned
+// address of that family, it returns it.
+func (ps *perPeerState) ipForDomain(domain string, v6 bool) (netip.Addr, error) {
 	fqdn, err := dnsname.ToFQDN(domain)
 	if err != nil {
 		return netip.Addr{}, err
@@ -96,10 +122,14 @@ func (ps *perPeerState) ipForDomain(domain string) (netip.Addr, error) {
 
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
-	if addr, ok := ps.domainToAddr[domain]; ok {
+	m := ps.domainToAddr
+	if v6 {
+		m = ps.domainToAddr6
+	}
+	if addr, ok := m[domain]; ok {
 		return addr, nil
 	}
-	addr := ps.assignAddrsLocked(domain)
+	addr := ps.assignAddrsLocked(domain, v6)
 	if !addr.IsValid() {
 		return netip.Addr{}, ErrNoIPsAvailable
 	}
@@ -114,14 +144,38 @@ func (ps *perPeerState) unusedIPv4Locked() netip.Addr {
 	return allocAddr(ps.ipset, ps.addrInUse)
 }
 
-// assignAddrsLocked assigns a pair of unique IP addresses for the given domain
-// and returns them. The first address is an IPv4 address and the second is an
-// IPv6 address. It does not check if the domain already has assigned addresses.
+// unusedIPv6Locked returns the first unused IPv6 address from the available
+// ranges. The IPv6 ranges are typically too large to track with a bitmap like
+// IPv4, but far fewer addresses than they contain are ever allocated.
 // ps.mu must be held.
-func (ps *perPeerState) assignAddrsLocked(domain string) netip.Addr {
+func (ps *perPeerState) unusedIPv6Locked() netip.Addr {
+	for _, r := range ps.ipset6.Ranges() {
+		for ip := r.From(); ip.IsValid() && ip.Compare(r.To()) <= 0; ip = ip.Next() {
+			if _, ok := ps.addrToDomain.Lookup(ip); !ok {
+				return ip
+			}
+		}
+	}
+	return netip.Addr{}
+}
+
+// assignAddrsLocked assigns a unique IPv4 address, or IPv6 address if v6 is
+// true, for the given domain and returns it. It does not check if the domain
+// already has an assigned address.
+// ps.mu must be held.
+func (ps *perPeerState) assignAddrsLocked(domain string, v6 bool) netip.Addr {
 	if ps.addrToDomain == nil {
 		ps.addrToDomain = &bart.Table[string]{}
 	}
+	if v6 {
+		addr := ps.unusedIPv6Locked()
+		if !addr.IsValid() {
+			return netip.Addr{}
+		}
+		mak.Set(&ps.domainToAddr6, domain, addr)
+		ps.addrToDomain.Insert(netip.PrefixFrom(addr, addr.BitLen()), domain)
+		return addr
+	}
 	v4 := ps.unusedIPv4Locked()
 	if !v4.IsValid() {
 		return netip.Addr{}
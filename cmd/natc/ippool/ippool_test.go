@@ -106,3 +106,44 @@ func TestIPPool(t *testing.T) {
 		t.Errorf("ipForDomain() second call = %v, want %v", addr2, addr)
 	}
 }
+
+func TestIPPoolIPv6(t *testing.T) {
+	var ipsb netipx.IPSetBuilder
+	ipsb.AddPrefix(netip.MustParsePrefix("100.64.1.0/24"))
+	var ipsb6 netipx.IPSetBuilder
+	v6Pfx := netip.MustParsePrefix("fd7a:115c:a1e0:b1a::/126")
+	ipsb6.AddPrefix(v6Pfx)
+	pool := SingleMachineIPPool{
+		IPSet:   must.Get(ipsb.IPSet()),
+		IPv6Set: must.Get(ipsb6.IPSet()),
+	}
+	from := tailcfg.NodeID(12345)
+
+	v4 := must.Get(pool.IPForDomain(from, "example.com"))
+	v6 := must.Get(pool.IPv6ForDomain(from, "example.com"))
+	if !v6Pfx.Contains(v6) {
+		t.Fatalf("IPv6ForDomain() = %v, not in %v", v6, v6Pfx)
+	}
+	if again := must.Get(pool.IPv6ForDomain(from, "example.com")); again != v6 {
+		t.Errorf("IPv6ForDomain() second call = %v, want %v", again, v6)
+	}
+	for _, addr := range []netip.Addr{v4, v6} {
+		if domain, ok := pool.DomainForIP(from, addr, time.Now()); !ok || domain != "example.com" {
+			t.Errorf("DomainForIP(%v) = %q, %v; want example.com", addr, domain, ok)
+		}
+	}
+
+	for i := range 3 {
+		if _, err := pool.IPv6ForDomain(from, fmt.Sprintf("%d.example.com", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := pool.IPv6ForDomain(from, "full.example.com"); !errors.Is(err, ErrNoIPsAvailable) {
+		t.Errorf("IPv6ForDomain() on exhausted pool: got %v, want ErrNoIPsAvailable", err)
+	}
+
+	pool4 := SingleMachineIPPool{IPSet: pool.IPSet}
+	if _, err := pool4.IPv6ForDomain(from, "example.com"); !errors.Is(err, ErrNoIPv6Pool) {
+		t.Errorf("IPv6ForDomain() without IPv6 pool: got %v, want ErrNoIPv6Pool", err)
+	}
+}
@@ -36,6 +36,7 @@
 	"tailscale.com/hostinfo"
 	"tailscale.com/ipn"
 	"tailscale.com/net/netutil"
+	"tailscale.com/tailcfg"
 	"tailscale.com/tsnet"
 	"tailscale.com/tsweb"
 	"tailscale.com/util/mak"
@@ -56,6 +57,8 @@ func main() {
 		hostname          = fs.String("hostname", "", "Hostname to register the service under")
 		siteID            = fs.Uint("site-id", 1, "an integer site ID to use for the ULA prefix which allows for multiple proxies to act in a HA configuration")
 		v4PfxStr          = fs.String("v4-pfx", "100.64.1.0/24", "comma-separated list of IPv4 prefixes to advertise")
+		v6PfxStr          = fs.String("v6-pfx", "", "comma-separated list of IPv6 prefixes to advertise and allocate AAAA addresses from (if empty, AAAA addresses are derived from the IPv4 allocation within the site ULA)")
+		nat64             = fs.Bool("nat64", false, "only answer AAAA queries, with addresses from --v6-pfx; destinations without IPv6 addresses are reached over IPv4")
 		dnsServers        = fs.String("dns-servers", "", "comma separated list of upstream DNS to use, including host and port (use system if empty)")
 		verboseTSNet      = fs.Bool("verbose-tsnet", false, "enable verbose logging in tsnet")
 		printULA          = fs.Bool("print-ula", false, "print the ULA prefix and exit")
@@ -66,6 +69,8 @@ func main() {
 		stateDir          = fs.String("state-dir", "", "path to directory in which to store app state")
 		clusterFollowOnly = fs.Bool("follow-only", false, "Try to find a leader with the cluster tag or exit.")
 		clusterAdminPort  = fs.Int("cluster-admin-port", 8081, "Port on localhost for the cluster admin HTTP API")
+		enforcePolicy     = fs.Bool("policy", false, "only allow peers to use the domains granted to them by the "+string(natcCap)+" peer capability")
+		connLogPath       = fs.String("conn-log", "", "path of a file to append JSON connection logs to, or - for stderr (disabled if empty)")
 	)
 	ff.Parse(fs, os.Args[1:], ff.WithEnvVarPrefix("TS_NATC"))
 
@@ -158,11 +163,27 @@ func main() {
 	}
 	routes, dnsAddr, addrPool := calculateAddresses(prefixes)
 
+	var v6Pool *netipx.IPSet
+	if *v6PfxStr != "" {
+		var ipsb netipx.IPSetBuilder
+		for s := range strings.SplitSeq(*v6PfxStr, ",") {
+			p := netip.MustParsePrefix(strings.TrimSpace(s))
+			if !p.Addr().Is6() || p.Masked() != p {
+				log.Fatalf("v6 prefix %v is not a masked IPv6 prefix", p)
+			}
+			ipsb.AddPrefix(p)
+		}
+		v6Pool = must.Get(ipsb.IPSet())
+	} else if *nat64 {
+		log.Fatalf("--nat64 requires --v6-pfx")
+	}
+
 	v6ULA := ula(uint16(*siteID))
 
 	var ipp ippool.IPPool
 	if *clusterTag != "" {
 		cipp := ippool.NewConsensusIPPool(addrPool)
+		cipp.IPv6Set = v6Pool
 		clusterStateDir, err := getClusterStatePath(*stateDir)
 		if err != nil {
 			log.Fatalf("Creating cluster state dir failed: %v", err)
@@ -189,18 +210,36 @@ func main() {
 			log.Print(http.ListenAndServe(fmt.Sprintf("127.0.0.1:%d", *clusterAdminPort), httpClusterAdmin(cipp)))
 		}()
 	} else {
-		ipp = &ippool.SingleMachineIPPool{IPSet: addrPool}
+		ipp = &ippool.SingleMachineIPPool{IPSet: addrPool, IPv6Set: v6Pool}
+	}
+
+	var connLog *connLogger
+	switch *connLogPath {
+	case "":
+	case "-":
+		connLog = &connLogger{w: os.Stderr}
+	default:
+		f, err := os.OpenFile(*connLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			log.Fatalf("opening connection log: %v", err)
+		}
+		defer f.Close()
+		connLog = &connLogger{w: f}
 	}
 
 	c := &connector{
-		ts:         ts,
-		whois:      lc,
-		v6ULA:      v6ULA,
-		ignoreDsts: ignoreDstTable,
-		ipPool:     ipp,
-		routes:     routes,
-		dnsAddr:    dnsAddr,
-		resolver:   getResolver(*dnsServers),
+		ts:            ts,
+		whois:         lc,
+		v6ULA:         v6ULA,
+		ignoreDsts:    ignoreDstTable,
+		ipPool:        ipp,
+		routes:        routes,
+		v6Pool:        v6Pool,
+		nat64:         *nat64,
+		dnsAddr:       dnsAddr,
+		resolver:      getResolver(*dnsServers),
+		enforcePolicy: *enforcePolicy,
+		connLog:       connLog,
 	}
 	c.run(ctx, lc)
 }
@@ -269,6 +308,16 @@ type connector struct {
 	// v6ULA is the ULA prefix used by the app connector to assign IPv6 addresses.
 	v6ULA netip.Prefix
 
+	// v6Pool, if non-nil, is the set of IPv6 ranges advertised to the
+	// tailnet, from which AAAA answers are allocated by the ipPool instead of
+	// being derived from the IPv4 allocation within v6ULA.
+	v6Pool *netipx.IPSet
+
+	// nat64 is whether only AAAA queries are answered, with addresses from
+	// v6Pool. Connections to destinations without IPv6 addresses are then
+	// proxied over IPv4.
+	nat64 bool
+
 	// ignoreDsts is initialized at start up with the contents of --ignore-destinations (if none it is nil)
 	// It is never mutated, only used for lookups.
 	// Users who want to natc a DNS wildcard but not every address record in that domain can supply the
@@ -283,6 +332,14 @@ type connector struct {
 
 	// resolver is used to lookup IP addresses for DNS queries.
 	resolver lookupNetIPer
+
+	// enforcePolicy is whether peers may only use the domains granted to
+	// them by the natcCap peer capability.
+	enforcePolicy bool
+
+	// connLog, if non-nil, receives a record of each proxied or denied
+	// connection.
+	connLog *connLogger
 }
 
 // v6ULA is the ULA prefix used by the app connector to assign IPv6 addresses.
@@ -306,7 +363,7 @@ func (c *connector) run(ctx context.Context, lc *local.Client) {
 	if _, err := lc.EditPrefs(ctx, &ipn.MaskedPrefs{
 		AdvertiseRoutesSet: true,
 		Prefs: ipn.Prefs{
-			AdvertiseRoutes: append(c.routes.Prefixes(), c.v6ULA),
+			AdvertiseRoutes: c.advertisedRoutes(),
 		},
 	}); err != nil {
 		log.Fatalf("failed to advertise routes: %v", err)
@@ -315,6 +372,41 @@ func (c *connector) run(ctx context.Context, lc *local.Client) {
 	c.serveDNS()
 }
 
+// advertisedRoutes returns the routes the connector advertises.
+func (c *connector) advertisedRoutes() []netip.Prefix {
+	var routes []netip.Prefix
+	if !c.nat64 {
+		routes = append(routes, c.routes.Prefixes()...)
+	}
+	if c.v6Pool != nil {
+		return append(routes, c.v6Pool.Prefixes()...)
+	}
+	return append(routes, c.v6ULA)
+}
+
+// synthesizedAddrs returns the addresses to answer DNS queries for domain
+// from the node nid with: an IPv4 address allocated from the ipPool unless
+// in NAT64 mode, and an IPv6 address either allocated from the v6Pool or
+// derived from the IPv4 address.
+func (c *connector) synthesizedAddrs(nid tailcfg.NodeID, domain string) ([]netip.Addr, error) {
+	var addrs []netip.Addr
+	if !c.nat64 {
+		v4, err := c.ipPool.IPForDomain(nid, domain)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, v4)
+		if c.v6Pool == nil {
+			return append(addrs, v6ForV4(c.v6ULA.Addr(), v4)), nil
+		}
+	}
+	v6, err := c.ipPool.IPv6ForDomain(nid, domain)
+	if err != nil {
+		return nil, err
+	}
+	return append(addrs, v6), nil
+}
+
 func (c *connector) serveDNS() {
 	pc, err := c.ts.ListenPacket("udp", net.JoinHostPort(c.dnsAddr.String(), "53"))
 	if err != nil {
@@ -370,6 +462,10 @@ func (c *connector) handleDNS(pc net.PacketConn, buf []byte, remoteAddr *net.UDP
 			continue
 		}
 		addrQCount++
+		if !c.allowed(who, q.Name.String()) {
+			log.Printf("HandleDNS(remote=%s): %s denied access to %s by policy", remoteAddr.String(), who.Node.Name, q.Name.String())
+			continue
+		}
 		if _, ok := resolves[q.Name.String()]; !ok {
 			addrs, err := c.resolver.LookupNetIP(ctx, "ip", q.Name.String())
 			var dnsErr *net.DNSError
@@ -387,12 +483,11 @@ func (c *connector) handleDNS(pc net.PacketConn, buf []byte, remoteAddr *net.UDP
 			// ignored and non-ignored addresses, but it's currently the user
 			// preferred behavior.
 			if !c.ignoreDestination(addrs) {
-				addr, err := c.ipPool.IPForDomain(who.Node.ID, q.Name.String())
+				addrs, err = c.synthesizedAddrs(who.Node.ID, q.Name.String())
 				if err != nil {
 					log.Printf("HandleDNS(remote=%s): lookup destination failed: %v\n", remoteAddr.String(), err)
 					return
 				}
-				addrs = []netip.Addr{addr, v6ForV4(c.v6ULA.Addr(), addr)}
 			}
 			mak.Set(&resolves, q.Name.String(), addrs)
 		}
@@ -520,14 +615,32 @@ func (c *connector) handleTCPFlow(src, dst netip.AddrPort) (handler func(net.Con
 		return nil, false
 	}
 	dstAddr := dst.Addr()
-	if dstAddr.Is6() {
+	if dstAddr.Is6() && c.v6ULA.Contains(dstAddr) {
 		dstAddr = v4ForV6(dstAddr)
 	}
 	domain, ok := c.ipPool.DomainForIP(who.Node.ID, dstAddr, time.Now())
 	if !ok {
 		return nil, false
 	}
+	// The policy is checked again, as the peer's capabilities may have
+	// changed since it resolved the domain.
+	if !c.allowed(who, domain) {
+		log.Printf("HandleTCPFlow: %s denied access to %s by policy", who.Node.Name, domain)
+		if c.connLog != nil {
+			rec := newConnLogRecord(who, src, domain, dst.Port())
+			rec.Denied = true
+			c.connLog.log(rec)
+		}
+		return nil, false
+	}
 	return func(conn net.Conn) {
+		if c.connLog != nil {
+			conn = &loggingConn{
+				Conn:   conn,
+				logger: c.connLog,
+				rec:    newConnLogRecord(who, src, domain, dst.Port()),
+			}
+		}
 		proxyTCPConn(conn, domain, c)
 	}, true
 }
@@ -591,7 +704,10 @@ func proxyTCPConn(c net.Conn, dest string, ctor *connector) {
 	})
 	daddr := daddrs[0]
 
-	// Try to match the upstream and downstream protocols (v4/v6)
+	// Try to match the upstream and downstream protocols (v4/v6). If the
+	// destination has no addresses of the same family, such as an IPv4-only
+	// destination reached through a synthetic IPv6 address, fall back to the
+	// other family.
 	if laddr.Addr().Is6() {
 		for _, addr := range daddrs {
 			if addr.Is6() {
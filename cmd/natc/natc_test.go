@@ -4,16 +4,20 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net"
 	"net/netip"
+	"slices"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/gaissmai/bart"
+	"go4.org/netipx"
 	"golang.org/x/net/dns/dnsmessage"
 	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/cmd/natc/ippool"
@@ -456,6 +460,89 @@ func TestIgnoreDestination(t *testing.T) {
 	}
 }
 
+func TestDomainAllowed(t *testing.T) {
+	who := &apitype.WhoIsResponse{
+		Node: &tailcfg.Node{Name: "peer.ts.net."},
+		CapMap: tailcfg.PeerCapMap{
+			natcCap: []tailcfg.RawMessage{
+				`{"domains": ["example.com"]}`,
+				`{"domains": ["*.Example.ORG"]}`,
+			},
+		},
+	}
+	tests := []struct {
+		domain string
+		want   bool
+	}{
+		{"example.com.", true},
+		{"www.example.com.", false},
+		{"www.example.org.", true},
+		{"a.b.example.org", true},
+		{"example.org.", false},
+		{"example.net.", false},
+	}
+	for _, tc := range tests {
+		got, err := domainAllowed(who, tc.domain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("domainAllowed(%q) = %v, want %v", tc.domain, got, tc.want)
+		}
+	}
+
+	c := &connector{}
+	noCaps := &apitype.WhoIsResponse{Node: &tailcfg.Node{Name: "other.ts.net."}}
+	if !c.allowed(noCaps, "example.net.") {
+		t.Error("domain denied without policy enforcement")
+	}
+	c.enforcePolicy = true
+	if c.allowed(noCaps, "example.com.") {
+		t.Error("domain allowed to peer without capability")
+	}
+	if !c.allowed(who, "example.com.") {
+		t.Error("granted domain denied")
+	}
+}
+
+func TestLoggingConn(t *testing.T) {
+	var buf bytes.Buffer
+	client, server := net.Pipe()
+	who := &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{StableID: "n1", Name: "peer.ts.net."},
+		UserProfile: &tailcfg.UserProfile{LoginName: "user@example.com"},
+	}
+	lc := &loggingConn{
+		Conn:   server,
+		logger: &connLogger{w: &buf},
+		rec:    newConnLogRecord(who, netip.MustParseAddrPort("100.64.0.1:1234"), "example.com.", 443),
+	}
+	go func() {
+		client.Write([]byte("hello"))
+		io.ReadFull(client, make([]byte, 2))
+		client.Close()
+	}()
+	io.ReadFull(lc, make([]byte, 5))
+	lc.Write([]byte("hi"))
+	lc.Close()
+	lc.Close()
+
+	var rec connLogRecord
+	dec := json.NewDecoder(&buf)
+	if err := dec.Decode(&rec); err != nil {
+		t.Fatal(err)
+	}
+	if dec.More() {
+		t.Error("connection logged more than once")
+	}
+	if rec.TxBytes != 5 || rec.RxBytes != 2 {
+		t.Errorf("bytes = tx %d, rx %d; want 5, 2", rec.TxBytes, rec.RxBytes)
+	}
+	if rec.Domain != "example.com" || rec.Port != 443 || rec.User != "user@example.com" || rec.NodeID != "n1" {
+		t.Errorf("unexpected record: %+v", rec)
+	}
+}
+
 func TestV6V4(t *testing.T) {
 	v6ULA := ula(1)
 
@@ -676,3 +763,44 @@ func TestGetResolverEmpty(t *testing.T) {
 		t.Fatal(`getResolver("") should return net.DefaultResolver`)
 	}
 }
+
+func TestSynthesizedAddrs(t *testing.T) {
+	routes, _, addrPool := calculateAddresses([]netip.Prefix{netip.MustParsePrefix("100.64.1.0/24")})
+	var ipsb netipx.IPSetBuilder
+	v6Pfx := netip.MustParsePrefix("fd7a:115c:a1e0:b1a::/64")
+	ipsb.AddPrefix(v6Pfx)
+	v6Pool := must.Get(ipsb.IPSet())
+	nid := tailcfg.NodeID(123)
+
+	c := &connector{
+		v6ULA:  ula(1),
+		ipPool: &ippool.SingleMachineIPPool{IPSet: addrPool},
+	}
+	addrs := must.Get(c.synthesizedAddrs(nid, "example.com."))
+	if len(addrs) != 2 || !addrs[0].Is4() || addrs[1] != v6ForV4(c.v6ULA.Addr(), addrs[0]) {
+		t.Errorf("ULA mode: got %v", addrs)
+	}
+
+	c = &connector{
+		routes: routes,
+		v6ULA:  ula(1),
+		v6Pool: v6Pool,
+		ipPool: &ippool.SingleMachineIPPool{IPSet: addrPool, IPv6Set: v6Pool},
+	}
+	addrs = must.Get(c.synthesizedAddrs(nid, "example.com."))
+	if len(addrs) != 2 || !addrs[0].Is4() || !v6Pfx.Contains(addrs[1]) {
+		t.Errorf("IPv6 pool mode: got %v", addrs)
+	}
+	if got := c.advertisedRoutes(); !slices.Contains(got, v6Pfx) || slices.Contains(got, c.v6ULA) {
+		t.Errorf("IPv6 pool mode advertised routes: %v", got)
+	}
+
+	c.nat64 = true
+	addrs = must.Get(c.synthesizedAddrs(nid, "example.com."))
+	if len(addrs) != 1 || !v6Pfx.Contains(addrs[0]) {
+		t.Errorf("NAT64 mode: got %v", addrs)
+	}
+	if got := c.advertisedRoutes(); len(got) != 1 || got[0] != v6Pfx {
+		t.Errorf("NAT64 mode advertised routes: %v", got)
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstime"
+	"tailscale.com/util/dnsname"
+)
+
+// natcCap is the peer capability that grants access to domains through the
+// connector when --policy is set. Its values are JSON objects of the form
+// of capRule, for example in a grant from the users to the connector:
+//
+//	"app": {
+//	  "tailscale.com/cap/natc": [{
+//	    "domains": ["example.com", "*.example.org"]
+//	  }]
+//	}
+const natcCap tailcfg.PeerCapability = "tailscale.com/cap/natc"
+
+// capRule is a value of the natcCap peer capability.
+type capRule struct {
+	// Domains are the domains the peer may resolve and connect to. A
+	// leading "*." matches all subdomains of a domain, and "*" alone matches
+	// all domains.
+	Domains []string `json:"domains,omitempty"`
+}
+
+// domainAllowed reports whether the peer described by who has been granted
+// access to domain by the natcCap capability. The domain may have a trailing
+// dot.
+func domainAllowed(who *apitype.WhoIsResponse, domain string) (bool, error) {
+	rules, err := tailcfg.UnmarshalCapJSON[capRule](who.CapMap, natcCap)
+	if err != nil {
+		return false, err
+	}
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	for _, r := range rules {
+		for _, d := range r.Domains {
+			d = strings.TrimSuffix(strings.ToLower(d), ".")
+			switch {
+			case d == "*":
+				return true, nil
+			case strings.HasPrefix(d, "*."):
+				if dnsname.HasSuffix(domain, d[2:]) {
+					return true, nil
+				}
+			case d == domain:
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// allowed reports whether the peer described by who may use domain. It is
+// always true unless the connector enforces a policy; denials are logged.
+func (c *connector) allowed(who *apitype.WhoIsResponse, domain string) bool {
+	if !c.enforcePolicy {
+		return true
+	}
+	ok, err := domainAllowed(who, domain)
+	if err != nil {
+		log.Printf("policy: invalid %s capability for %s: %v", natcCap, who.Node.Name, err)
+		return false
+	}
+	return ok
+}
+
+// connLogRecord is a connection log entry, written as a line of JSON.
+type connLogRecord struct {
+	Start    time.Time
+	Duration tstime.GoDuration `json:",omitzero"`
+
+	Src    netip.AddrPort
+	NodeID tailcfg.StableNodeID
+	Node   string
+	User   string   `json:",omitempty"`
+	Tags   []string `json:",omitempty"`
+
+	Domain string
+	Port   uint16
+
+	// TxBytes is the number of bytes sent from the source to the domain,
+	// and RxBytes the number of bytes sent back.
+	TxBytes int64
+	RxBytes int64
+
+	// Denied is whether the connection was refused by the policy.
+	Denied bool `json:",omitempty"`
+}
+
+// connLogger writes connection logs.
+type connLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *connLogger) log(rec *connLogRecord) {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("connLogger: %v", err)
+		return
+	}
+	b = append(b, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.w.Write(b); err != nil {
+		log.Printf("connLogger: %v", err)
+	}
+}
+
+// newConnLogRecord returns a connection log record for a connection from
+// the peer described by who at src to port on domain.
+func newConnLogRecord(who *apitype.WhoIsResponse, src netip.AddrPort, domain string, port uint16) *connLogRecord {
+	rec := &connLogRecord{
+		Start:  time.Now(),
+		Src:    src,
+		NodeID: who.Node.StableID,
+		Node:   who.Node.Name,
+		Tags:   who.Node.Tags,
+		Domain: strings.TrimSuffix(domain, "."),
+		Port:   port,
+	}
+	if who.UserProfile != nil && !who.Node.IsTagged() {
+		rec.User = who.UserProfile.LoginName
+	}
+	return rec
+}
+
+// loggingConn is a net.Conn that counts the bytes read and written through
+// it, and writes a connection log record when it is closed.
+type loggingConn struct {
+	net.Conn
+	logger *connLogger
+	rec    *connLogRecord
+
+	rx, tx    atomic.Int64
+	closeOnce sync.Once
+}
+
+func (c *loggingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.tx.Add(int64(n))
+	return n, err
+}
+
+func (c *loggingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.rx.Add(int64(n))
+	return n, err
+}
+
+// CloseRead closes the read side of the underlying connection, if it
+// supports half-closing, so that the proxy can propagate it.
+func (c *loggingConn) CloseRead() error {
+	if cr, ok := c.Conn.(interface{ CloseRead() error }); ok {
+		return cr.CloseRead()
+	}
+	return nil
+}
+
+// CloseWrite is like CloseRead, for the write side.
+func (c *loggingConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+func (c *loggingConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		c.rec.Duration.Duration = time.Since(c.rec.Start).Round(time.Millisecond)
+		c.rec.TxBytes = c.tx.Load()
+		c.rec.RxBytes = c.rx.Load()
+		c.logger.log(c.rec)
+	})
+	return err
+}
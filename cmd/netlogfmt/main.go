@@ -1,14 +1,19 @@
 // Copyright (c) Tailscale Inc & AUTHORS
 // SPDX-License-Identifier: BSD-3-Clause
 
-// netlogfmt parses a stream of JSON log messages from stdin and
-// formats the network traffic logs produced by "tailscale.com/wgengine/netlog"
-// according to the schema in "tailscale.com/types/netlogtype.Message"
-// in a more humanly readable format.
+// netlogfmt parses a stream of JSON log messages from stdin, or from
+// the files named as arguments, and formats the network traffic logs
+// produced by "tailscale.com/wgengine/netlog" according to the schema in
+// "tailscale.com/types/netlogtype.Message" in a more humanly readable format.
+//
+// The files may be those written by a local "file:" network log sink,
+// including rotated files, which are read oldest first when named in
+// the order "netlog.jsonl.2 netlog.jsonl.1 netlog.jsonl".
 //
 // Example usage:
 //
 //	$ cat netlog.json | go run tailscale.com/cmd/netlogfmt
+//	$ go run tailscale.com/cmd/netlogfmt /var/log/tailscale/netlog.jsonl
 //	=========================================================================================
 //	NodeID: n123456CNTRL
 //	Logged: 2022-10-13T20:23:10.165Z
@@ -66,17 +71,28 @@ func main() {
 	// The logic handles a stream of arbitrary JSON.
 	// So long as a JSON object seems like a network log message,
 	// then this will unmarshal and print it.
-	if err := processStream(os.Stdin); err != nil {
-		if err == io.EOF {
-			return
+	if flag.NArg() == 0 {
+		if err := processStream(os.Stdin); err != nil && err != io.EOF {
+			log.Fatalf("processStream: %v", err)
+		}
+		return
+	}
+	for _, name := range flag.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = processStream(f)
+		f.Close()
+		if err != nil && err != io.EOF {
+			log.Fatalf("processStream(%s): %v", name, err)
 		}
-		log.Fatalf("processStream: %v", err)
 	}
 }
 
 func processStream(r io.Reader) (err error) {
 	defer try.Handle(&err)
-	dec := jsontext.NewDecoder(os.Stdin)
+	dec := jsontext.NewDecoder(r)
 	for {
 		processValue(dec)
 	}
@@ -0,0 +1,167 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// The prober binary runs the probes defined in a HuJSON config file and
+// serves their status and metrics.
+//
+// The config file is reloaded on SIGHUP and whenever it changes on disk.
+// Probes whose definition is unchanged keep running, and keep their history,
+// across reloads. See prober.ProbeConfig for the config file format.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+
+	"tailscale.com/prober"
+	"tailscale.com/tsweb"
+	"tailscale.com/version"
+
+	// Support for prometheus varz in tsweb
+	_ "tailscale.com/tsweb/promvarz"
+)
+
+var (
+	configPath     = flag.String("config", "", "path to the HuJSON probe config file (required)")
+	versionFlag    = flag.Bool("version", false, "print version and exit")
+	listen         = flag.String("listen", ":8030", "HTTP listen address")
+	probeOnce      = flag.Bool("once", false, "probe once and print results, then exit; ignores the listen flag")
+	spread         = flag.Bool("spread", true, "whether to spread probing over time")
+	namespace      = flag.String("metric-namespace", "prober", "prefix of exported probe metric names")
+	title          = flag.String("title", "Prober", "title of the status page")
+	reloadInterval = flag.Duration("reload-interval", 10*time.Second, "how often to check the config file for changes (0 = only reload on SIGHUP)")
+)
+
+func main() {
+	flag.Parse()
+	if *versionFlag {
+		fmt.Println(version.Long())
+		return
+	}
+	if *configPath == "" {
+		log.Fatal("--config is required")
+	}
+
+	p := prober.New().WithSpread(*spread).WithOnce(*probeOnce).WithMetricNamespace(*namespace)
+	loadedMod := modTime(*configPath)
+	cfg, err := prober.LoadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := p.ApplyConfig(cfg); err != nil {
+		log.Fatal(err)
+	}
+
+	if *probeOnce {
+		log.Printf("Waiting for all probes")
+		p.Wait()
+
+		good, bad := overallStatus(p)
+		for _, s := range good {
+			log.Printf("good: %s", s)
+		}
+		for _, s := range bad {
+			log.Printf("bad: %s", s)
+		}
+		if len(bad) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	go reloadLoop(context.Background(), p, *configPath, loadedMod, *reloadInterval)
+
+	mux := http.NewServeMux()
+	d := tsweb.Debugger(mux)
+	d.Handle("probe-run", "Run a probe", tsweb.StdHandler(tsweb.ReturnHandlerFunc(p.RunHandler), tsweb.HandlerOptions{Logf: log.Printf}))
+	d.Handle("probe-all", "Run all configured probes", tsweb.StdHandler(tsweb.ReturnHandlerFunc(p.RunAllHandler), tsweb.HandlerOptions{Logf: log.Printf}))
+	mux.Handle("/", tsweb.StdHandler(p.StatusHandler(
+		prober.WithTitle(*title),
+		prober.WithPageLink("Prober metrics", "/debug/varz"),
+		prober.WithProbeLink("Run Probe", "/debug/probe-run?name={{.Name}}"),
+	), tsweb.HandlerOptions{Logf: log.Printf}))
+	mux.Handle("/healthz", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok\n"))
+	}))
+	log.Printf("Listening on %s", *listen)
+	log.Fatal(http.ListenAndServe(*listen, mux))
+}
+
+// reloadLoop reapplies the config file at path on SIGHUP and, if interval
+// is positive, whenever its modification time differs from that of the
+// last load, initially lastMod, until ctx is done.
+// A config that fails to load or apply is logged and ignored, leaving the
+// previous probes running.
+func reloadLoop(ctx context.Context, p *prober.Prober, path string, lastMod time.Time, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		tick = t.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Printf("got SIGHUP; reloading %s", path)
+		case <-tick:
+			mt := modTime(path)
+			if mt.Equal(lastMod) {
+				continue
+			}
+			log.Printf("%s changed; reloading", path)
+		}
+		lastMod = modTime(path)
+		cfg, err := prober.LoadConfig(path)
+		if err == nil {
+			err = p.ApplyConfig(cfg)
+		}
+		if err != nil {
+			log.Printf("reload failed, keeping previous probes: %v", err)
+		}
+	}
+}
+
+// modTime returns the modification time of the file at path, or the zero
+// time if it can't be determined.
+func modTime(path string) time.Time {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+// overallStatus returns descriptions of the finished probes that succeeded
+// and failed, in sorted order.
+func overallStatus(p *prober.Prober) (good, bad []string) {
+	for name, i := range p.ProbeInfo() {
+		if i.End.IsZero() {
+			// Do not show probes that have not finished yet.
+			continue
+		}
+		if i.Status == prober.ProbeStatusSucceeded {
+			good = append(good, fmt.Sprintf("%s: %s", name, i.Latency))
+		} else {
+			bad = append(bad, fmt.Sprintf("%s: %s", name, i.Error))
+		}
+	}
+	sort.Strings(good)
+	sort.Strings(bad)
+	return good, bad
+}
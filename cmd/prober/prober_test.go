@@ -0,0 +1,109 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/prober"
+)
+
+func TestReloadLoop(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	path := filepath.Join(t.TempDir(), "probes.hujson")
+	mtime := time.Now()
+	writeConfig := func(config string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(strings.ReplaceAll(config, "$ADDR", ln.Addr().String())), 0600); err != nil {
+			t.Fatal(err)
+		}
+		// Make sure each write changes the modification time, regardless
+		// of the file system's timestamp resolution.
+		mtime = mtime.Add(time.Second)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForProbes := func(p *prober.Prober, want ...string) {
+		t.Helper()
+		var got []string
+		for range 500 {
+			got = slices.Sorted(maps.Keys(p.ProbeInfo()))
+			if slices.Equal(got, want) {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("probes = %q; want %q", got, want)
+	}
+
+	writeConfig(`{
+		// Two probes to start with.
+		"Probes": [
+			{"Name": "a", "Class": "tcp", "Target": "$ADDR", "Interval": "1h"},
+			{"Name": "b", "Class": "tcp", "Target": "$ADDR", "Interval": "1h"},
+		],
+	}`)
+	loadedMod := modTime(path)
+	cfg, err := prober.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := prober.New().WithSpread(false)
+	if err := p.ApplyConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer p.ApplyConfig(&prober.Config{})
+	waitForProbes(p, "a", "b")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		reloadLoop(ctx, p, path, loadedMod, 10*time.Millisecond)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// Removing b and adding c is picked up.
+	writeConfig(`{
+		"Probes": [
+			{"Name": "a", "Class": "tcp", "Target": "$ADDR", "Interval": "1h"},
+			{"Name": "c", "Class": "tcp", "Target": "$ADDR", "Interval": "1h"},
+		],
+	}`)
+	waitForProbes(p, "a", "c")
+
+	// An invalid config leaves the probes running.
+	writeConfig(`{"Probes": [{"Name": "a", "Class": "icmp", "Target": "$ADDR"}]}`)
+	time.Sleep(100 * time.Millisecond)
+	waitForProbes(p, "a", "c")
+
+	writeConfig(`{"Probes": [{"Name": "c", "Class": "tcp", "Target": "$ADDR", "Interval": "1h"}]}`)
+	waitForProbes(p, "c")
+}
@@ -0,0 +1,195 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/sessionrecording"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+)
+
+// maxHeaderSize is the maximum size of the header line of a recording.
+const maxHeaderSize = 64 << 10
+
+// recorder is an HTTP handler implementing the upload protocol spoken by
+// [sessionrecording.ConnectToRecorder], storing recordings in a
+// [sessionrecording.LocalStore].
+type recorder struct {
+	store *sessionrecording.LocalStore
+	logf  logger.Logf
+
+	// whoIs looks up the Tailscale identity of the peer at remoteAddr.
+	// Uploads are only accepted from peers granted
+	// [tailcfg.PeerCapabilitySessionRecorder].
+	whoIs func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error)
+
+	// ackInterval is how often to acknowledge the bytes received by a /v2
+	// upload. It must be well below the client's 30 second window.
+	ackInterval time.Duration
+}
+
+// handler returns an HTTP handler for the recorder that serves HTTP/2
+// without TLS, as used by /v2 clients, in addition to HTTP/1.
+func (rec *recorder) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /record", rec.serveV1)
+	mux.HandleFunc("HEAD /v2/record", func(http.ResponseWriter, *http.Request) {})
+	mux.HandleFunc("POST /v2/record", rec.serveV2)
+	return h2c.NewHandler(mux, &http2.Server{})
+}
+
+// serveV1 handles the legacy upload protocol, where the recording is the
+// body of a single HTTP/1 request, and the response reports whether it was
+// stored.
+func (rec *recorder) serveV1(w http.ResponseWriter, r *http.Request) {
+	source, err := rec.authorize(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := rec.storeRecording(source, r.Body); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// ackFrame is a frame of the response to a /v2 upload.
+type ackFrame struct {
+	// Ack is the number of bytes received so far.
+	Ack int64 `json:"ack,omitempty"`
+	// Error is an error encountered while storing the recording. It is only
+	// set in the last frame.
+	Error string `json:"error,omitempty"`
+}
+
+// serveV2 handles the HTTP/2 upload protocol, where the recording is the
+// body of the request, and the response streams frames acknowledging the
+// bytes received while it is uploaded.
+func (rec *recorder) serveV2(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor < 2 {
+		http.Error(w, "HTTP/2 required", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	source, err := rec.authorize(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	send := func(f ackFrame) {
+		enc.Encode(f)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	send(ackFrame{})
+
+	body := &countingReader{r: r.Body}
+	done := make(chan error, 1)
+	go func() {
+		done <- rec.storeRecording(source, body)
+	}()
+	t := time.NewTicker(rec.ackInterval)
+	defer t.Stop()
+	for {
+		select {
+		case err := <-done:
+			f := ackFrame{Ack: body.n.Load()}
+			if err != nil {
+				f.Error = err.Error()
+			}
+			send(f)
+			return
+		case <-t.C:
+			// Acks are sent even if nothing new was received, so that the
+			// client can tell that the connection is still alive.
+			send(ackFrame{Ack: body.n.Load()})
+		}
+	}
+}
+
+// authorize checks that the peer making r may upload recordings, and
+// returns its identity as recorded in the store's hash chain. The node and
+// user named in a recording's header are reported by the uploader, so they
+// are not trusted.
+func (rec *recorder) authorize(r *http.Request) (source string, err error) {
+	if rec.whoIs == nil {
+		return "", errors.New("peer identity unavailable")
+	}
+	who, err := rec.whoIs(r.Context(), r.RemoteAddr)
+	if err != nil {
+		rec.logf("rejecting recording from %s: WhoIs: %v", r.RemoteAddr, err)
+		return "", errors.New("unknown peer")
+	}
+	if who.Node == nil || who.UserProfile == nil {
+		return "", errors.New("unknown peer")
+	}
+	source = fmt.Sprintf("%s (%s) user %s at %s", who.Node.Name, who.Node.StableID, who.UserProfile.LoginName, r.RemoteAddr)
+	if !who.CapMap.HasCapability(tailcfg.PeerCapabilitySessionRecorder) {
+		rec.logf("rejecting recording from %s: missing capability %s", source, tailcfg.PeerCapabilitySessionRecorder)
+		return "", fmt.Errorf("peer not granted %s", tailcfg.PeerCapabilitySessionRecorder)
+	}
+	return source, nil
+}
+
+// storeRecording stores the recording read from r, uploaded from source as
+// returned by authorize. A recording that ends early is stored as far as it
+// was received.
+func (rec *recorder) storeRecording(source string, r io.Reader) error {
+	br := bufio.NewReaderSize(r, maxHeaderSize)
+	line, err := br.ReadSlice('\n')
+	if err != nil {
+		return fmt.Errorf("reading recording header: %w", err)
+	}
+	var ch sessionrecording.CastHeader
+	if err := json.Unmarshal(line, &ch); err != nil {
+		return fmt.Errorf("invalid recording header: %w", err)
+	}
+	prefix := "ssh-session"
+	if ch.Kubernetes != nil {
+		prefix = "k8s-session"
+	}
+	w, err := rec.store.CreateFrom(prefix, source)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(line)
+	var n int64
+	if err == nil {
+		n, err = io.Copy(w, br)
+		n += int64(len(line))
+	}
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	rec.logf("recording from %s (claimed node %q, user %q): %d bytes, err=%v", source, ch.SrcNode, ch.SrcNodeUser, n, err)
+	return err
+}
+
+// countingReader is an io.Reader that counts the bytes read.
+type countingReader struct {
+	r io.Reader
+	n atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,188 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/sessionrecording"
+	"tailscale.com/tailcfg"
+)
+
+// testSource is the source recorded for uploads to a test recorder.
+const testSource = "laptop.tail-scale.ts.net. (nLAPTOP) user alice@example.com at "
+
+// newTestRecorder returns a recorder whose peers are granted caps, and a
+// server for it.
+func newTestRecorder(t *testing.T, caps tailcfg.PeerCapMap) (*recorder, *httptest.Server) {
+	t.Helper()
+	store, err := sessionrecording.OpenLocalStore(t.TempDir(), sessionrecording.LocalStoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	rec := &recorder{
+		store:       store,
+		logf:        t.Logf,
+		ackInterval: 10 * time.Millisecond,
+		whoIs: func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+			return &apitype.WhoIsResponse{
+				Node: &tailcfg.Node{
+					Name:     "laptop.tail-scale.ts.net.",
+					StableID: "nLAPTOP",
+				},
+				UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+				CapMap:      caps,
+			}, nil
+		},
+	}
+	srv := httptest.NewServer(rec.handler())
+	t.Cleanup(srv.Close)
+	return rec, srv
+}
+
+var recorderCaps = tailcfg.PeerCapMap{tailcfg.PeerCapabilitySessionRecorder: nil}
+
+func testCast(t *testing.T) string {
+	t.Helper()
+	j, err := json.Marshal(sessionrecording.CastHeader{
+		Version:   2,
+		Timestamp: 1700000000,
+		SrcNode:   "laptop.tail-scale.ts.net",
+		SSHUser:   "alice",
+		LocalUser: "alice",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(j) + "\n" + `[0.5,"o","hello\r\n"]` + "\n"
+}
+
+// checkStored checks that the store of rec holds exactly one recording,
+// with contents want.
+func checkStored(t *testing.T, rec *recorder, want string) {
+	t.Helper()
+	entries, err := sessionrecording.VerifyLocalStore(rec.store.Dir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("got %d chain entries, want 1", len(entries))
+	}
+	got, err := os.ReadFile(filepath.Join(rec.store.Dir(), entries[0].File))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("stored recording = %q, want %q", got, want)
+	}
+	if !strings.HasPrefix(entries[0].File, "ssh-session-") {
+		t.Errorf("recording name = %q, want ssh-session- prefix", entries[0].File)
+	}
+	if !strings.HasPrefix(entries[0].Source, testSource) {
+		t.Errorf("recording source = %q, want prefix %q", entries[0].Source, testSource)
+	}
+}
+
+func TestRecorderV2(t *testing.T) {
+	rec, srv := newTestRecorder(t, recorderCaps)
+	ap := netip.MustParseAddrPort(srv.Listener.Addr().String())
+	var d net.Dialer
+	w, _, errc, err := sessionrecording.ConnectToRecorder(context.Background(), []netip.AddrPort{ap}, d.DialContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cast := testCast(t)
+	// Write the recording in pieces, slower than acks are sent.
+	for _, line := range strings.SplitAfter(cast, "\n") {
+		if _, err := fmt.Fprint(w, line); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatalf("upload: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for upload to finish")
+	}
+	checkStored(t, rec, cast)
+}
+
+func TestRecorderV1(t *testing.T) {
+	rec, srv := newTestRecorder(t, recorderCaps)
+	cast := testCast(t)
+	req, err := http.NewRequest("POST", srv.URL+"/record", strings.NewReader(cast))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Expect", "100-continue")
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %v, want 200", resp.Status)
+	}
+	checkStored(t, rec, cast)
+
+	resp, err = srv.Client().Post(srv.URL+"/record", "", strings.NewReader("not a recording\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("invalid recording: status = %v, want 500", resp.Status)
+	}
+}
+
+func TestRecorderUnauthorized(t *testing.T) {
+	rec, srv := newTestRecorder(t, nil)
+	ap := netip.MustParseAddrPort(srv.Listener.Addr().String())
+	var d net.Dialer
+	w, _, errc, err := sessionrecording.ConnectToRecorder(context.Background(), []netip.AddrPort{ap}, d.DialContext)
+	if err == nil {
+		fmt.Fprint(w, testCast(t))
+		w.Close()
+		err = <-errc
+	}
+	if err == nil {
+		t.Error("v2 upload without capability succeeded")
+	}
+
+	resp, err := srv.Client().Post(srv.URL+"/record", "", strings.NewReader(testCast(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("v1 upload without capability: status = %v, want 403", resp.Status)
+	}
+
+	entries, err := sessionrecording.VerifyLocalStore(rec.store.Dir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("got %d chain entries, want 0", len(entries))
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// The sessionrecorder command is a session recorder for Tailscale SSH and the
+// Kubernetes API server proxy. It accepts recordings uploaded over the
+// tailnet by nodes whose SSH policy lists it as a recorder, and stores them
+// in a local directory with a hash chain that makes tampering with them
+// detectable.
+//
+// Uploads are only accepted from nodes granted the
+// "tailscale.com/cap/session-recorder" capability to the recorder in the
+// tailnet policy file. The identity of the uploading node is recorded in
+// the hash chain.
+//
+// Run with --verify to check the recordings in a directory, as written by
+// sessionrecorder or by tailscaled's SSHRecording.Dir policy setting, against
+// their hash chain.
+//
+// Stored recordings can be worked with using the tools run as
+// "sessionrecorder TOOL":
+//
+//	sessionrecorder play [--speed=2] FILE[@TIME]  # replay in the terminal
+//	sessionrecorder transcript FILE              # print a plain-text transcript
+//	sessionrecorder search [--dir=DIR] QUERY     # search transcripts, printing FILE@TIME matches
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"tailscale.com/client/local"
+	"tailscale.com/hostinfo"
+	"tailscale.com/ipn"
+	"tailscale.com/sessionrecording"
+	"tailscale.com/tsnet"
+)
+
+var (
+	dir          = flag.String("dir", "", "directory to store recordings in (required)")
+	maxSize      = flag.Int64("max-size", 0, "total size in bytes of the recordings to keep, removing the oldest when exceeded; 0 for no limit")
+	maxAge       = flag.Duration("max-age", 0, "how long to keep recordings for; 0 for no limit")
+	verify       = flag.Bool("verify", false, "verify the recordings in --dir against their hash chain and exit")
+	hostname     = flag.String("hostname", "recorder", "hostname to use on the tailnet")
+	stateDir     = flag.String("state-dir", "", "path to directory in which to store tsnet state")
+	controlURL   = flag.String("login-server", ipn.DefaultControlURL, "the base URL of control server")
+	listenAddr   = flag.String("listen", "", "if non-empty, listen on this address instead of joining the tailnet, such as when running on a node alongside tailscaled, which is then used to identify uploaders")
+	verboseTSNet = flag.Bool("verbose-tsnet", false, "enable verbose logging in tsnet")
+)
+
+func main() {
+	if len(os.Args) > 1 && tools[os.Args[1]] != nil {
+		os.Exit(runTool(os.Args[1], os.Args[2:]))
+	}
+	flag.Parse()
+	if *dir == "" {
+		log.Fatal("--dir is required")
+	}
+	if *verify {
+		os.Exit(runVerify(*dir))
+	}
+	hostinfo.SetApp("sessionrecorder")
+
+	store, err := sessionrecording.OpenLocalStore(*dir, sessionrecording.LocalStoreOptions{
+		MaxSize: *maxSize,
+		MaxAge:  *maxAge,
+		Logf:    log.Printf,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+	rec := &recorder{
+		store:       store,
+		logf:        log.Printf,
+		ackInterval: 5 * time.Second,
+	}
+
+	var ln net.Listener
+	if *listenAddr != "" {
+		ln, err = net.Listen("tcp", *listenAddr)
+		rec.whoIs = new(local.Client).WhoIs
+	} else {
+		ts := &tsnet.Server{
+			Hostname:   *hostname,
+			Dir:        *stateDir,
+			ControlURL: *controlURL,
+		}
+		if *verboseTSNet {
+			ts.Logf = log.Printf
+		}
+		defer ts.Close()
+		// Recorders are dialed on port 80 of their Tailscale IPs.
+		ln, err = ts.Listen("tcp", ":80")
+		if err == nil {
+			var lc *local.Client
+			if lc, err = ts.LocalClient(); err == nil {
+				rec.whoIs = lc.WhoIs
+			}
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("storing recordings in %s; listening on %v", *dir, ln.Addr())
+
+	hs := &http.Server{
+		Handler:           rec.handler(),
+		ReadHeaderTimeout: 20 * time.Second,
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		hs.Shutdown(shutdownCtx)
+	}()
+	if err := hs.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+}
+
+// runVerify verifies the recordings in dir and returns the exit code.
+func runVerify(dir string) int {
+	entries, err := sessionrecording.VerifyLocalStore(dir)
+	if len(entries) > 0 {
+		last := entries[len(entries)-1]
+		fmt.Printf("%d chain entries; last entry %d at %v has hash %s\n", len(entries), last.Seq, last.Time.Format(time.RFC3339), last.Hash)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "verification failed: %v\n", err)
+		return 1
+	}
+	fmt.Println("OK")
+	return 0
+}
@@ -0,0 +1,158 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"tailscale.com/sessionrecording/cast"
+)
+
+// tools are the subcommands of sessionrecorder for working with stored
+// recordings, run as "sessionrecorder TOOL [flags] ARGS".
+var tools = map[string]func(args []string, stdout io.Writer) error{
+	"play":       runPlay,
+	"transcript": runTranscript,
+	"search":     runSearch,
+}
+
+// runTool runs the tool name with args, and returns the exit code.
+func runTool(name string, args []string) int {
+	err := tools[name](args, os.Stdout)
+	if err == flag.ErrHelp {
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sessionrecorder %s: %v\n", name, err)
+		return 1
+	}
+	return 0
+}
+
+// openRecording opens the recording at path.
+func openRecording(path string) (*cast.Reader, io.Closer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := cast.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return r, f, nil
+}
+
+// splitFileTime splits arg, a recording's path optionally followed by
+// "@TIME" as printed by the search tool, into the path and time.
+func splitFileTime(arg string) (path string, start time.Duration) {
+	i := strings.LastIndexByte(arg, '@')
+	if i < 0 {
+		return arg, 0
+	}
+	if _, err := os.Stat(arg); err == nil {
+		return arg, 0 // the file name contains '@'
+	}
+	d, err := time.ParseDuration(arg[i+1:])
+	if err != nil {
+		return arg, 0
+	}
+	return arg[:i], d
+}
+
+func runPlay(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("play", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: sessionrecorder play [flags] FILE[@TIME]\n\nReplays a recording in the terminal, starting at TIME if given.\n\n")
+		fs.PrintDefaults()
+	}
+	speed := fs.Float64("speed", 1, "playback speed factor, such as 2 for double speed")
+	maxIdle := fs.Duration("max-idle", 0, "if non-zero, shorten pauses between output to at most this, before --speed is applied")
+	start := fs.Duration("start", 0, "time into the recording at which to start playback; overrides @TIME")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	if *speed <= 0 {
+		return fmt.Errorf("--speed must be positive")
+	}
+	path, at := splitFileTime(fs.Arg(0))
+	if *start != 0 {
+		at = *start
+	}
+	r, c, err := openRecording(path)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	err = cast.Play(ctx, stdout, r, cast.PlayOptions{
+		Speed:   *speed,
+		MaxIdle: *maxIdle,
+		Start:   at,
+	})
+	if err == context.Canceled {
+		return nil
+	}
+	return err
+}
+
+func runTranscript(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("transcript", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: sessionrecorder transcript [flags] FILE\n\nPrints the plain-text transcript of a recording's output.\n\n")
+		fs.PrintDefaults()
+	}
+	timestamps := fs.Bool("timestamps", false, "prefix each line with the time into the recording it began")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	r, c, err := openRecording(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return cast.WriteTranscript(stdout, r, *timestamps)
+}
+
+func runSearch(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("search", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: sessionrecorder search [flags] QUERY\n\nSearches the transcripts of the recordings in a directory for QUERY, ignoring case,\nprinting matches as FILE@TIME, which can be passed to the play tool.\n\n")
+		fs.PrintDefaults()
+	}
+	dir := fs.String("dir", ".", "directory of recordings to search, including subdirectories")
+	verbose := fs.Bool("v", false, "also print the source node and users of each matching recording")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || fs.Arg(0) == "" {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	matches, err := cast.Search(*dir, fs.Arg(0))
+	for _, m := range matches {
+		if *verbose {
+			fmt.Fprintf(stdout, "%s (node %q, user %q as %q)\n", m, m.Header.SrcNode, m.Header.SSHUser, m.Header.LocalUser)
+		} else {
+			fmt.Fprintln(stdout, m)
+		}
+	}
+	return err
+}
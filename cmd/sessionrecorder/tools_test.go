@@ -0,0 +1,67 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitFileTime(t *testing.T) {
+	dir := t.TempDir()
+	withAt := filepath.Join(dir, "a@1s.cast")
+	if err := os.WriteFile(withAt, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		arg       string
+		wantPath  string
+		wantStart time.Duration
+	}{
+		{"x.cast", "x.cast", 0},
+		{"x.cast@1m2.5s", "x.cast", time.Minute + 2500*time.Millisecond},
+		{"user@host.cast", "user@host.cast", 0},
+		{withAt, withAt, 0},
+	}
+	for _, tt := range tests {
+		path, start := splitFileTime(tt.arg)
+		if path != tt.wantPath || start != tt.wantStart {
+			t.Errorf("splitFileTime(%q) = %q, %v; want %q, %v", tt.arg, path, start, tt.wantPath, tt.wantStart)
+		}
+	}
+}
+
+func TestTools(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ssh-session-1.cast")
+	if err := os.WriteFile(path, []byte(`{"version":2,"srcNode":"laptop","sshUser":"alice","localUser":"root"}
+[0.5,"o","$ whoami\r\n"]
+[0.75,"o","root\r\n"]
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	run := func(args ...string) string {
+		t.Helper()
+		var out strings.Builder
+		if err := tools[args[0]](args[1:], &out); err != nil {
+			t.Fatalf("%q: %v", args, err)
+		}
+		return out.String()
+	}
+
+	if got, want := run("transcript", "--timestamps", path), "[500ms] $ whoami\n[750ms] root\n"; got != want {
+		t.Errorf("transcript = %q, want %q", got, want)
+	}
+	got := run("search", "--dir", dir, "-v", "WHOAMI")
+	if want := path + `@500ms: $ whoami (node "laptop", user "alice" as "root")` + "\n"; got != want {
+		t.Errorf("search = %q, want %q", got, want)
+	}
+	// Search results can be passed to play, which starts at their time.
+	if got, want := run("play", "--speed", "1000", path+"@750ms"), "$ whoami\r\nroot\r\n"; got != want {
+		t.Errorf("play = %q, want %q", got, want)
+	}
+}
@@ -374,6 +374,12 @@ func debugCmd() *ffcli.Command {
 				ShortHelp:  "Print the current set of candidate peer relay servers",
 				Exec:       runPeerRelayServers,
 			},
+			{
+				Name:       "peer-relay-sessions",
+				ShortUsage: "tailscale debug peer-relay-sessions",
+				ShortHelp:  "Print the sessions relayed by this node's peer relay server, and their usage",
+				Exec:       runPeerRelaySessions,
+			},
 		}...),
 	}
 }
@@ -445,7 +451,7 @@ func runDebug(ctx context.Context, args []string) error {
 	if debugArgs.file != "" {
 		usedFlag = true // TODO(bradfitz): add "file" subcommand
 		if debugArgs.file == "get" {
-			wfs, err := localClient.WaitingFiles(ctx)
+			wfs, err := localClient.WaitingFilesAndTrees(ctx)
 			if err != nil {
 				fatalf("%v\n", err)
 			}
@@ -1403,3 +1409,17 @@ func runPeerRelayServers(ctx context.Context, args []string) error {
 	e.Encode(v)
 	return nil
 }
+
+func runPeerRelaySessions(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected arguments")
+	}
+	v, err := localClient.DebugPeerRelaySessions(ctx)
+	if err != nil {
+		return err
+	}
+	e := json.NewEncoder(os.Stdout)
+	e.SetIndent("", "  ")
+	e.Encode(v)
+	return nil
+}
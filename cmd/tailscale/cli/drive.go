@@ -5,16 +5,19 @@
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
 	"tailscale.com/drive"
 )
 
 const (
-	driveShareUsage   = "tailscale drive share <name> <path>"
+	driveShareUsage   = "tailscale drive share [--versions=<n>] [--versions-max-age=<duration>] <name> <path>"
 	driveRenameUsage  = "tailscale drive rename <oldname> <newname>"
 	driveUnshareUsage = "tailscale drive unshare <name>"
 	driveListUsage    = "tailscale drive list"
@@ -37,6 +40,12 @@
 			ShortUsage: driveShareUsage,
 			Exec:       runDriveShare,
 			ShortHelp:  "[ALPHA] Create or modify a share",
+			FlagSet: (func() *flag.FlagSet {
+				fs := newFlagSet("share")
+				fs.IntVar(&driveShareArgs.versions, "versions", 0, "if positive, keep up to this many previous versions of each file that is overwritten or deleted, available read-only under the share's .versions folder")
+				fs.DurationVar(&driveShareArgs.versionsMaxAge, "versions-max-age", 0, "if positive, how long to keep previous versions; requires --versions")
+				return fs
+			})(),
 		},
 		{
 			Name:       "rename",
@@ -59,11 +68,22 @@
 	},
 }
 
+var driveShareArgs struct {
+	versions       int
+	versionsMaxAge time.Duration
+}
+
 // runDriveShare is the entry point for the "tailscale drive share" command.
 func runDriveShare(ctx context.Context, args []string) error {
 	if len(args) != 2 {
 		return fmt.Errorf("usage: %s", driveShareUsage)
 	}
+	if driveShareArgs.versions < 0 || driveShareArgs.versionsMaxAge < 0 {
+		return fmt.Errorf("--versions and --versions-max-age must not be negative")
+	}
+	if driveShareArgs.versionsMaxAge > 0 && driveShareArgs.versions == 0 {
+		return fmt.Errorf("--versions-max-age requires --versions")
+	}
 
 	name, path := args[0], args[1]
 
@@ -73,11 +93,16 @@ func runDriveShare(ctx context.Context, args []string) error {
 	}
 
 	err = localClient.DriveShareSet(ctx, &drive.Share{
-		Name: name,
-		Path: absolutePath,
+		Name:           name,
+		Path:           absolutePath,
+		Versions:       driveShareArgs.versions,
+		VersionsMaxAge: driveShareArgs.versionsMaxAge,
 	})
 	if err == nil {
 		fmt.Printf("Sharing %q as %q\n", path, name)
+		if driveShareArgs.versions > 0 {
+			fmt.Printf("Keeping up to %d previous versions of each file in %q\n", driveShareArgs.versions, drive.VersionsDir)
+		}
 	}
 	return err
 }
@@ -136,16 +161,29 @@ func runDriveList(ctx context.Context, args []string) error {
 			longestAs = len(share.As)
 		}
 	}
-	formatString := fmt.Sprintf("%%-%ds    %%-%ds    %%s\n", longestName, longestPath)
-	fmt.Printf(formatString, "name", "path", "as")
-	fmt.Printf(formatString, strings.Repeat("-", longestName), strings.Repeat("-", longestPath), strings.Repeat("-", longestAs))
+	formatString := fmt.Sprintf("%%-%ds    %%-%ds    %%-%ds    %%s\n", longestName, longestPath, longestAs)
+	fmt.Printf(formatString, "name", "path", "as", "versions")
+	fmt.Printf(formatString, strings.Repeat("-", longestName), strings.Repeat("-", longestPath), strings.Repeat("-", longestAs), strings.Repeat("-", 8))
 	for _, share := range shares {
-		fmt.Printf(formatString, share.Name, share.Path, share.As)
+		fmt.Printf(formatString, share.Name, share.Path, share.As, shareVersionsString(share))
 	}
 
 	return nil
 }
 
+// shareVersionsString describes how many previous versions of files share
+// keeps, and for how long.
+func shareVersionsString(share *drive.Share) string {
+	if share.Versions <= 0 {
+		return ""
+	}
+	s := strconv.Itoa(share.Versions)
+	if share.VersionsMaxAge > 0 {
+		s += " for " + share.VersionsMaxAge.String()
+	}
+	return s
+}
+
 func buildShareLongHelp() string {
 	longHelpAs := ""
 	if drive.AllowShareAs() {
@@ -217,6 +255,12 @@ func buildShareLongHelp() string {
 	  }
 	}]
 
+To keep previous versions of files that remote writers overwrite or delete, you can make a share versioned. For example, to keep up to 10 versions of each file for 30 days:
+
+  $ tailscale drive share --versions=10 --versions-max-age=720h builds /srv/builds
+
+Previous versions are available read-only in the share's .versions folder, named by the time at which they were replaced, and can be restored by copying them out of it.
+
 You can rename shares, for example you could rename the above share by running:
 
   $ tailscale drive rename docs newdocs
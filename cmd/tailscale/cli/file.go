@@ -8,10 +8,13 @@
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"mime"
 	"net/http"
@@ -70,8 +73,16 @@ func (c *countingReader) Read(buf []byte) (int, error) {
 var fileCpCmd = &ffcli.Command{
 	Name:       "cp",
 	ShortUsage: "tailscale file cp <files...> <target>:",
-	ShortHelp:  "Copy file(s) to a host",
-	Exec:       runCp,
+	ShortHelp:  "Copy file(s) or directories to a host",
+	LongHelp: strings.TrimSpace(`
+
+The 'tailscale file cp' command sends files to another node. Directories are
+sent with the relative paths, permissions and modification times of the
+files within them preserved. If a transfer is interrupted, running the same
+command again resumes it.
+
+`),
+	Exec: runCp,
 	FlagSet: (func() *flag.FlagSet {
 		fs := newFlagSet("cp")
 		fs.StringVar(&cpArgs.name, "name", "", "alternate filename to use, especially useful when <file> is \"-\" (stdin)")
@@ -159,7 +170,13 @@ func runCp(ctx context.Context, args []string) error {
 				return err
 			}
 			if fi.IsDir() {
-				return errors.New("directories not supported")
+				if name == "" {
+					name = filepath.Base(fileArg)
+				}
+				if err := runCpTree(ctx, stableID, fileArg, name); err != nil {
+					return err
+				}
+				continue
 			}
 			contentLength = fi.Size()
 			fileContents = &countingReader{Reader: io.LimitReader(f, contentLength)}
@@ -196,6 +213,123 @@ func runCp(ctx context.Context, args []string) error {
 	return nil
 }
 
+// runCpTree sends the directory dir as name, preserving the relative
+// paths, permissions and modification times of the files within it.
+func runCpTree(ctx context.Context, stableID tailcfg.StableNodeID, dir, name string) error {
+	if cpArgs.verbose {
+		log.Printf("hashing %q ...", dir)
+	}
+	fsys := os.DirFS(dir)
+	tree, err := taildropTree(fsys, name)
+	if err != nil {
+		return err
+	}
+	var size int64
+	for _, f := range tree.Files {
+		size += f.Size
+	}
+	if cpArgs.verbose {
+		log.Printf("sending %q (%d files, %d bytes) to %v ...", name, len(tree.Files), size, stableID)
+	}
+
+	counting := &countingFS{FS: fsys}
+	var group syncs.WaitGroup
+	ctxProgress, cancelProgress := context.WithCancel(ctx)
+	defer cancelProgress()
+	if isatty.IsTerminal(os.Stderr.Fd()) {
+		group.Go(func() { progressPrinter(ctxProgress, name, counting.n.Load, size) })
+	}
+
+	err = localClient.PushFileTree(ctx, stableID, tree, counting)
+	cancelProgress()
+	group.Wait() // wait for progress printer to stop before reporting the error
+	if err != nil {
+		return err
+	}
+	if cpArgs.verbose {
+		log.Printf("sent %q", name)
+	}
+	return nil
+}
+
+// taildropTree returns the manifest of the directory tree fsys, to be
+// sent as name. Anything other than regular files and directories,
+// such as symlinks, is skipped.
+func taildropTree(fsys fs.FS, name string) (*apitype.TaildropTree, error) {
+	tree := &apitype.TaildropTree{Name: name}
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == "." {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		f := apitype.TaildropTreeFile{
+			Path:    p,
+			Mode:    fi.Mode() & (fs.ModeDir | fs.ModePerm),
+			ModTime: fi.ModTime(),
+		}
+		switch {
+		case d.IsDir():
+		case d.Type().IsRegular():
+			if f.SHA256, f.Size, err = hashFSFile(fsys, p); err != nil {
+				return err
+			}
+		default:
+			fmt.Fprintf(Stderr, "# warning: skipping %s: not a regular file or directory\n", p)
+			return nil
+		}
+		tree.Files = append(tree.Files, f)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
+
+// hashFSFile returns the hex-encoded SHA-256 hash and length of the
+// named file in fsys.
+func hashFSFile(fsys fs.FS, name string) (string, int64, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// countingFS is an fs.FS that counts the bytes read from its files.
+type countingFS struct {
+	fs.FS
+	n atomic.Int64
+}
+
+func (c *countingFS) Open(name string) (fs.File, error) {
+	f, err := c.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return countingFile{f, &c.n}, nil
+}
+
+type countingFile struct {
+	fs.File
+	n *atomic.Int64
+}
+
+func (f countingFile) Read(buf []byte) (int, error) {
+	n, err := f.File.Read(buf)
+	f.n.Add(int64(n))
+	return n, err
+}
+
 func progressPrinter(ctx context.Context, name string, contentCount func() int64, contentLength int64) {
 	var rateValueFast, rateValueSlow tsrate.Value
 	rateValueFast.HalfLife = 1 * time.Second  // fast response for rate measurement
@@ -526,7 +660,17 @@ func receiveFile(ctx context.Context, wf apitype.WaitingFile, dir string) (targe
 		return "", 0, fmt.Errorf("opening inbox file %q: %w", wf.Name, err)
 	}
 	defer rc.Close()
-	f, err := openFileOrSubstitute(dir, wf.Name, getArgs.conflict)
+	// Files received as part of a directory are named by their path.
+	if !filepath.IsLocal(filepath.FromSlash(wf.Name)) {
+		return "", 0, fmt.Errorf("invalid inbox file name %q", wf.Name)
+	}
+	base := filepath.FromSlash(wf.Name)
+	if subdir := filepath.Dir(base); subdir != "." {
+		if err := os.MkdirAll(filepath.Join(dir, subdir), 0755); err != nil {
+			return "", 0, err
+		}
+	}
+	f, err := openFileOrSubstitute(dir, base, getArgs.conflict)
 	if err != nil {
 		return "", 0, err
 	}
@@ -539,7 +683,21 @@ func receiveFile(ctx context.Context, wf apitype.WaitingFile, dir string) (targe
 		f.Close()
 		return "", 0, fmt.Errorf("failed to write %v: %v", f.Name(), err)
 	}
-	return f.Name(), size, f.Close()
+	if wf.Mode != 0 {
+		if err := f.Chmod(wf.Mode.Perm()); err != nil {
+			f.Close()
+			return "", 0, err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return "", 0, err
+	}
+	if !wf.ModTime.IsZero() {
+		if err := os.Chtimes(f.Name(), wf.ModTime, wf.ModTime); err != nil {
+			return "", 0, err
+		}
+	}
+	return f.Name(), size, nil
 }
 
 func runFileGetOneBatch(ctx context.Context, dir string) []error {
@@ -547,7 +705,7 @@ func runFileGetOneBatch(ctx context.Context, dir string) []error {
 	var err error
 	var errs []error
 	for len(errs) == 0 {
-		wfs, err = localClient.WaitingFiles(ctx)
+		wfs, err = localClient.WaitingFilesAndTrees(ctx)
 		if err != nil {
 			errs = append(errs, fmt.Errorf("getting WaitingFiles: %w", err))
 			break
@@ -643,7 +801,7 @@ func wipeInbox(ctx context.Context) error {
 	if getArgs.wait {
 		return errors.New("can't use --wait with /dev/null target")
 	}
-	wfs, err := localClient.WaitingFiles(ctx)
+	wfs, err := localClient.WaitingFilesAndTrees(ctx)
 	if err != nil {
 		return fmt.Errorf("getting WaitingFiles: %w", err)
 	}
@@ -665,7 +823,7 @@ func wipeInbox(ctx context.Context) error {
 
 func waitForFile(ctx context.Context) error {
 	for {
-		ff, err := localClient.AwaitWaitingFiles(ctx, time.Hour)
+		ff, err := localClient.AwaitWaitingFilesAndTrees(ctx, time.Hour)
 		if len(ff) > 0 {
 			return nil
 		}
@@ -0,0 +1,339 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"tailscale.com/tka"
+	"tailscale.com/types/key"
+	"tailscale.com/util/prompt"
+)
+
+// The commands in this file support signing changes with tailnet lock keys
+// which are kept on a separate, possibly air-gapped, machine rather than on
+// a node:
+//
+//  1. 'tailscale lock request' writes an unsigned request to a file.
+//  2. 'tailscale lock sign-request' signs it on the offline machine; it
+//     doesn't need tailscaled, only the key.
+//  3. 'tailscale lock submit' validates the signed request against the
+//     node's view of the authority and submits it to the control plane.
+
+var nlRequestArgs struct {
+	out string
+}
+
+func nlRequestFlagSet(name string) *flag.FlagSet {
+	fs := newFlagSet(name)
+	fs.StringVar(&nlRequestArgs.out, "out", "", "write the request to this file instead of stdout")
+	return fs
+}
+
+var nlRequestCmd = &ffcli.Command{
+	Name:       "request",
+	ShortUsage: "tailscale lock request <subcommand> [arguments...]",
+	ShortHelp:  "Generate an unsigned request for signing with an offline tailnet lock key",
+	LongHelp: strings.TrimSpace(`
+
+The 'tailscale lock request' commands write a request for a change to
+tailnet lock, to be signed by a trusted tailnet lock key held on another
+machine using 'tailscale lock sign-request'.
+
+The request is text which can be copied by hand or encoded as a QR code.
+Once signed, submit it with 'tailscale lock submit'.
+
+`),
+	Subcommands: []*ffcli.Command{
+		{
+			Name:       "add",
+			ShortUsage: "tailscale lock request add [--out=<file>] <public-key>...",
+			ShortHelp:  "Request adding one or more trusted signing keys",
+			FlagSet:    nlRequestFlagSet("lock request add"),
+			Exec: func(ctx context.Context, args []string) error {
+				return runNetworkLockModifyRequest(ctx, args, nil)
+			},
+		},
+		{
+			Name:       "remove",
+			ShortUsage: "tailscale lock request remove [--out=<file>] <public-key>...",
+			ShortHelp:  "Request removing one or more trusted signing keys",
+			LongHelp: strings.TrimSpace(`
+
+Unlike 'tailscale lock remove', node-key signatures made by the removed
+keys are not re-signed.
+
+`),
+			FlagSet: nlRequestFlagSet("lock request remove"),
+			Exec: func(ctx context.Context, args []string) error {
+				return runNetworkLockModifyRequest(ctx, nil, args)
+			},
+		},
+		{
+			Name:       "sign",
+			ShortUsage: "tailscale lock request sign [--out=<file>] <node-key> [<rotation-key>]",
+			ShortHelp:  "Request signing a node key",
+			LongHelp:   "This command does not need tailscaled to be running.",
+			FlagSet:    nlRequestFlagSet("lock request sign"),
+			Exec:       runNetworkLockSignRequest,
+		},
+	},
+	Exec: func(ctx context.Context, args []string) error {
+		return flag.ErrHelp
+	},
+}
+
+func runNetworkLockModifyRequest(ctx context.Context, addArgs, removeArgs []string) error {
+	if len(addArgs) == 0 && len(removeArgs) == 0 {
+		return errors.New("no keys specified")
+	}
+	addKeys, _, err := parseNLArgs(addArgs, true, false)
+	if err != nil {
+		return err
+	}
+	removeKeys, _, err := parseNLArgs(removeArgs, true, false)
+	if err != nil {
+		return err
+	}
+
+	req, err := localClient.NetworkLockModifyRequest(ctx, addKeys, removeKeys)
+	if err != nil {
+		return fixTailscaledConnectError(err)
+	}
+	return writeSigningRequest(req)
+}
+
+func runNetworkLockSignRequest(ctx context.Context, args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return errors.New("usage: tailscale lock request sign <node-key> [<rotation-key>]")
+	}
+	var (
+		nodeKey     key.NodePublic
+		rotationKey key.NLPublic
+	)
+	if err := nodeKey.UnmarshalText([]byte(args[0])); err != nil {
+		return fmt.Errorf("decoding node-key: %w", err)
+	}
+	if len(args) > 1 {
+		if err := rotationKey.UnmarshalText([]byte(args[1])); err != nil {
+			return fmt.Errorf("decoding rotation-key: %w", err)
+		}
+	}
+	p, err := nodeKey.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return writeSigningRequest(&tka.SigningRequest{
+		NodeKeySig: &tka.NodeKeySignature{
+			SigKind:        tka.SigDirect,
+			Pubkey:         p,
+			WrappingPubkey: []byte(rotationKey.Verifier()),
+		},
+	})
+}
+
+// writeSigningRequest writes the text encoding of req to the file named
+// by the --out flag, or stdout.
+func writeSigningRequest(req *tka.SigningRequest) error {
+	text := req.Text()
+	if nlRequestArgs.out == "" {
+		fmt.Fprint(Stdout, text)
+		return nil
+	}
+	if err := os.WriteFile(nlRequestArgs.out, []byte(text), 0644); err != nil {
+		return err
+	}
+	fmt.Fprintf(Stderr, "Wrote request to %s\n", nlRequestArgs.out)
+	return nil
+}
+
+// readSigningRequest reads the text encoding of a request from the named
+// file, or stdin if name is empty or "-".
+func readSigningRequest(name string) (*tka.SigningRequest, error) {
+	var (
+		b   []byte
+		err error
+	)
+	if name == "" || name == "-" {
+		b, err = io.ReadAll(io.LimitReader(os.Stdin, 1<<20))
+	} else {
+		b, err = os.ReadFile(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tka.ParseSigningRequest(string(b))
+}
+
+var nlSignRequestArgs struct {
+	key string
+	out string
+	yes bool
+}
+
+var nlSignRequestCmd = &ffcli.Command{
+	Name:       "sign-request",
+	ShortUsage: "tailscale lock sign-request --key=<key-file> [--out=<file>] [<request-file>]",
+	ShortHelp:  "Sign a request using an offline tailnet lock key",
+	LongHelp: strings.TrimSpace(`
+
+The 'tailscale lock sign-request' command signs a request generated by
+'tailscale lock request' with the tailnet lock private key (tlpriv:...)
+read from the file given by --key. A new key can be generated with
+'tailscale lock generate-key'.
+
+This command does not need tailscaled to be running, so it can be used on
+an air-gapped machine. The request is read from the named file, or stdin.
+The changes are printed for review before they are signed.
+
+`),
+	Exec: runNetworkLockSignOffline,
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("lock sign-request")
+		fs.StringVar(&nlSignRequestArgs.key, "key", "", "file containing the tailnet lock private key to sign with")
+		fs.StringVar(&nlSignRequestArgs.out, "out", "", "write the signed request to this file instead of stdout")
+		fs.BoolVar(&nlSignRequestArgs.yes, "yes", false, "sign without asking for confirmation")
+		return fs
+	})(),
+}
+
+func runNetworkLockSignOffline(ctx context.Context, args []string) error {
+	if nlSignRequestArgs.key == "" {
+		return errors.New("--key is required")
+	}
+	if len(args) > 1 {
+		return errors.New("usage: tailscale lock sign-request --key=<key-file> [<request-file>]")
+	}
+	keyText, err := os.ReadFile(nlSignRequestArgs.key)
+	if err != nil {
+		return err
+	}
+	var priv key.NLPrivate
+	if err := priv.UnmarshalText([]byte(strings.TrimSpace(string(keyText)))); err != nil {
+		return fmt.Errorf("decoding key: %w", err)
+	}
+	var reqFile string
+	if len(args) > 0 {
+		reqFile = args[0]
+	}
+	req, err := readSigningRequest(reqFile)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(Stderr, "Signing with tlpub:%x:\n%s", []byte(priv.KeyID()), req.Describe())
+	if !nlSignRequestArgs.yes {
+		if reqFile == "" || reqFile == "-" {
+			return errors.New("refusing to sign a request read from stdin without --yes")
+		}
+		if !prompt.YesNo("Sign these changes?") {
+			return errors.New("aborted")
+		}
+	}
+	if err := req.Sign(priv); err != nil {
+		return err
+	}
+
+	text := req.Text()
+	if nlSignRequestArgs.out == "" {
+		fmt.Fprint(Stdout, text)
+		return nil
+	}
+	if err := os.WriteFile(nlSignRequestArgs.out, []byte(text), 0644); err != nil {
+		return err
+	}
+	fmt.Fprintf(Stderr, "Wrote signed request to %s\n", nlSignRequestArgs.out)
+	return nil
+}
+
+var nlSubmitCmd = &ffcli.Command{
+	Name:       "submit",
+	ShortUsage: "tailscale lock submit [<signed-request-file>]",
+	ShortHelp:  "Submit a request signed with an offline tailnet lock key",
+	LongHelp: strings.TrimSpace(`
+
+The 'tailscale lock submit' command checks that a request signed with
+'tailscale lock sign-request' is valid for the current tailnet lock
+state, and submits it to the coordination server.
+
+The signed request is read from the named file, or stdin.
+
+`),
+	Exec: runNetworkLockSubmit,
+}
+
+func runNetworkLockSubmit(ctx context.Context, args []string) error {
+	if len(args) > 1 {
+		return errors.New("usage: tailscale lock submit [<signed-request-file>]")
+	}
+	var reqFile string
+	if len(args) > 0 {
+		reqFile = args[0]
+	}
+	req, err := readSigningRequest(reqFile)
+	if err != nil {
+		return err
+	}
+	if !req.Signed() {
+		return errors.New("request is not signed; sign it with 'tailscale lock sign-request' first")
+	}
+	if err := localClient.NetworkLockSubmitSigned(ctx, req); err != nil {
+		return fixTailscaledConnectError(err)
+	}
+	fmt.Fprint(Stdout, req.Describe())
+	fmt.Fprintln(Stdout, "Submitted.")
+	return nil
+}
+
+var nlGenerateKeyCmd = &ffcli.Command{
+	Name:       "generate-key",
+	ShortUsage: "tailscale lock generate-key <key-file>",
+	ShortHelp:  "Generate a tailnet lock key for offline signing",
+	LongHelp: strings.TrimSpace(`
+
+The 'tailscale lock generate-key' command writes a new tailnet lock private
+key to the named file, which must not exist, and prints its public key. The
+key can then be trusted with 'tailscale lock add' and used with
+'tailscale lock sign-request'.
+
+This command does not need tailscaled to be running.
+
+`),
+	Exec: runNetworkLockGenerateKey,
+}
+
+func runNetworkLockGenerateKey(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: tailscale lock generate-key <key-file>")
+	}
+	priv := key.NewNLPrivate()
+	text, err := priv.MarshalText()
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(text, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	pub, err := priv.Public().MarshalText()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(Stdout, string(pub))
+	return nil
+}
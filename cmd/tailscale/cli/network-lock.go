@@ -43,6 +43,10 @@
 		nlLogCmd,
 		nlLocalDisableCmd,
 		nlRevokeKeysCmd,
+		nlRequestCmd,
+		nlSignRequestCmd,
+		nlSubmitCmd,
+		nlGenerateKeyCmd,
 	},
 	Exec: runNetworkLockNoSubcommand,
 }
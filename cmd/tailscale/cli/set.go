@@ -21,6 +21,7 @@
 	"tailscale.com/ipn"
 	"tailscale.com/net/netutil"
 	"tailscale.com/net/tsaddr"
+	"tailscale.com/net/udprelay/status"
 	"tailscale.com/safesocket"
 	"tailscale.com/types/opt"
 	"tailscale.com/types/ptr"
@@ -43,28 +44,31 @@
 }
 
 type setArgsT struct {
-	acceptRoutes           bool
-	acceptDNS              bool
-	exitNodeIP             string
-	exitNodeAllowLANAccess bool
-	shieldsUp              bool
-	runSSH                 bool
-	runWebClient           bool
-	hostname               string
-	advertiseRoutes        string
-	advertiseDefaultRoute  bool
-	advertiseConnector     bool
-	opUser                 string
-	acceptedRisks          string
-	profileName            string
-	forceDaemon            bool
-	updateCheck            bool
-	updateApply            bool
-	reportPosture          bool
-	snat                   bool
-	statefulFiltering      bool
-	netfilterMode          string
-	relayServerPort        string
+	acceptRoutes              bool
+	acceptDNS                 bool
+	exitNodeIP                string
+	exitNodeAllowLANAccess    bool
+	shieldsUp                 bool
+	runSSH                    bool
+	runWebClient              bool
+	hostname                  string
+	advertiseRoutes           string
+	advertiseDefaultRoute     bool
+	advertiseConnector        bool
+	opUser                    string
+	acceptedRisks             string
+	profileName               string
+	forceDaemon               bool
+	updateCheck               bool
+	updateApply               bool
+	reportPosture             bool
+	snat                      bool
+	statefulFiltering         bool
+	netfilterMode             string
+	relayServerPort           string
+	relayServerMaxEndpoints   int
+	relayServerMaxBytesPerSec int
+	relayServerEviction       string
 }
 
 func newSetFlagSet(goos string, setArgs *setArgsT) *flag.FlagSet {
@@ -86,6 +90,9 @@ func newSetFlagSet(goos string, setArgs *setArgsT) *flag.FlagSet {
 	setf.BoolVar(&setArgs.reportPosture, "report-posture", false, "allow management plane to gather device posture information")
 	setf.BoolVar(&setArgs.runWebClient, "webclient", false, "expose the web interface for managing this node over Tailscale at port 5252")
 	setf.StringVar(&setArgs.relayServerPort, "relay-server-port", "", hidden+"UDP port number (0 will pick a random unused port) for the relay server to bind to, on all interfaces, or empty string to disable relay server functionality")
+	setf.IntVar(&setArgs.relayServerMaxEndpoints, "relay-server-max-endpoints", 0, hidden+"maximum number of relay server endpoints each peer may have allocated at once, or 0 for no limit")
+	setf.IntVar(&setArgs.relayServerMaxBytesPerSec, "relay-server-max-bytes-per-sec", 0, hidden+"maximum rate in bytes per second at which the relay server relays packets for each peer, or 0 for no limit")
+	setf.StringVar(&setArgs.relayServerEviction, "relay-server-eviction", "", hidden+`what to do when a peer at the relay server's endpoint limit requests another: "idlest" evicts its idlest endpoint, or empty string to reject the request`)
 
 	ffcomplete.Flag(setf, "exit-node", func(args []string) ([]string, ffcomplete.ShellCompDirective, error) {
 		st, err := localClient.Status(context.Background())
@@ -156,8 +163,11 @@ func runSet(ctx context.Context, args []string) (retErr error) {
 			AppConnector: ipn.AppConnectorPrefs{
 				Advertise: setArgs.advertiseConnector,
 			},
-			PostureChecking:     setArgs.reportPosture,
-			NoStatefulFiltering: opt.NewBool(!setArgs.statefulFiltering),
+			PostureChecking:           setArgs.reportPosture,
+			NoStatefulFiltering:       opt.NewBool(!setArgs.statefulFiltering),
+			RelayServerMaxEndpoints:   setArgs.relayServerMaxEndpoints,
+			RelayServerMaxBytesPerSec: setArgs.relayServerMaxBytesPerSec,
+			RelayServerEviction:       setArgs.relayServerEviction,
 		},
 	}
 
@@ -251,6 +261,17 @@ func runSet(ctx context.Context, args []string) (retErr error) {
 		}
 		maskedPrefs.Prefs.RelayServerPort = ptr.To(int(uport))
 	}
+	if setArgs.relayServerMaxEndpoints < 0 {
+		return errors.New("--relay-server-max-endpoints must not be negative")
+	}
+	if setArgs.relayServerMaxBytesPerSec < 0 {
+		return errors.New("--relay-server-max-bytes-per-sec must not be negative")
+	}
+	switch status.EvictionPolicy(setArgs.relayServerEviction) {
+	case status.EvictNone, status.EvictIdlest:
+	default:
+		return fmt.Errorf("invalid --relay-server-eviction %q; must be %q or empty", setArgs.relayServerEviction, status.EvictIdlest)
+	}
 
 	checkPrefs := curPrefs.Clone()
 	checkPrefs.ApplyEdits(maskedPrefs)
@@ -782,6 +782,9 @@ func init() {
 	addPrefFlagMapping("advertise-connector", "AppConnector")
 	addPrefFlagMapping("report-posture", "PostureChecking")
 	addPrefFlagMapping("relay-server-port", "RelayServerPort")
+	addPrefFlagMapping("relay-server-max-endpoints", "RelayServerMaxEndpoints")
+	addPrefFlagMapping("relay-server-max-bytes-per-sec", "RelayServerMaxBytesPerSec")
+	addPrefFlagMapping("relay-server-eviction", "RelayServerEviction")
 }
 
 func addPrefFlagMapping(flagName string, prefNames ...string) {
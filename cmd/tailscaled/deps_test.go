@@ -27,3 +27,16 @@ func TestOmitSSH(t *testing.T) {
 		},
 	}.Check(t)
 }
+
+func TestOmitBbolt(t *testing.T) {
+	const msg = "unexpected with ts_omit_bbolt"
+	deptest.DepChecker{
+		GOOS:   "linux",
+		GOARCH: "amd64",
+		Tags:   "ts_omit_bbolt",
+		BadDeps: map[string]string{
+			"tailscale.com/tka/boltchonk": msg,
+			"go.etcd.io/bbolt":            msg,
+		},
+	}.Check(t)
+}
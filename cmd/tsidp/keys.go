@@ -0,0 +1,229 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+	"tailscale.com/atomicfile"
+)
+
+// Signing key rotation works as follows. At any time there is exactly one
+// active key, used to sign new tokens. When the active key is within
+// keyPrepublishPeriod of being keyRotationInterval old, a successor is
+// generated and published in the JWKS, but not used until its activeAt time
+// so that relying parties caching the JWKS see it first. Once the successor
+// becomes active, the old key stays published until every token it signed
+// has expired and is then dropped.
+
+const (
+	// maxKeyPrepublishPeriod is the longest a new signing key is published
+	// in the JWKS before being used.
+	maxKeyPrepublishPeriod = 24 * time.Hour
+
+	// retiredKeyGrace is how long a superseded key remains published after
+	// its successor becomes active: the lifetime of the ID tokens it
+	// signed, plus allowed clock skew. Access and refresh tokens are opaque
+	// and never signed.
+	retiredKeyGrace = accessTokenTTL + jwt.DefaultLeeway
+)
+
+// signingKeysJSON is the on-disk format of oidcKeysFile.
+type signingKeysJSON struct {
+	Keys []*signingKey
+}
+
+// keyPrepublishPeriod returns how long before activation new signing keys are
+// published.
+func (s *idpServer) keyPrepublishPeriod() time.Duration {
+	return min(maxKeyPrepublishPeriod, s.keyRotationInterval/2)
+}
+
+// keyID returns the "kid" of sk as used in JWT headers and the JWKS.
+func (sk *signingKey) keyID() string {
+	return strconv.FormatUint(sk.kid, 10)
+}
+
+// joseSigner returns a signer for sk.
+func (sk *signingKey) joseSigner() (jose.Signer, error) {
+	return sk.signer.GetErr(func() (jose.Signer, error) {
+		return jose.NewSigner(jose.SigningKey{
+			Algorithm: jose.RS256,
+			Key:       sk.k,
+		}, &jose.SignerOptions{EmbedJWK: false, ExtraHeaders: map[jose.HeaderKey]any{
+			jose.HeaderType: "JWT",
+			"kid":           sk.keyID(),
+		}})
+	})
+}
+
+// oidcSigner returns a signer for the currently active signing key.
+func (s *idpServer) oidcSigner() (jose.Signer, error) {
+	s.keyMu.Lock()
+	defer s.keyMu.Unlock()
+	if err := s.updateSigningKeysLocked(time.Now()); err != nil {
+		return nil, err
+	}
+	return s.activeSigningKeyLocked(time.Now()).joseSigner()
+}
+
+// publishedSigningKeys returns all the signing keys that should be published
+// in the JWKS: the active key, its successor if one was generated, and any
+// retired keys whose tokens might still be valid.
+func (s *idpServer) publishedSigningKeys() ([]*signingKey, error) {
+	s.keyMu.Lock()
+	defer s.keyMu.Unlock()
+	if err := s.updateSigningKeysLocked(time.Now()); err != nil {
+		return nil, err
+	}
+	return slices.Clone(s.signingKeys), nil
+}
+
+// signingKeyByID returns the published signing key with the given kid.
+func (s *idpServer) signingKeyByID(kid string) (*signingKey, error) {
+	keys, err := s.publishedSigningKeys()
+	if err != nil {
+		return nil, err
+	}
+	for _, sk := range keys {
+		if sk.keyID() == kid {
+			return sk, nil
+		}
+	}
+	return nil, fmt.Errorf("tsidp: unknown signing key %q", kid)
+}
+
+// activeSigningKeyLocked returns the newest key that is active at now.
+// s.keyMu must be held and s.signingKeys must be non-empty.
+func (s *idpServer) activeSigningKeyLocked(now time.Time) *signingKey {
+	active := s.signingKeys[0]
+	for _, sk := range s.signingKeys[1:] {
+		if !sk.activeAt.After(now) {
+			active = sk
+		}
+	}
+	return active
+}
+
+// updateSigningKeysLocked loads the signing keys from disk if needed, then
+// generates, retires and drops keys as needed at time now, persisting any
+// changes. s.keyMu must be held.
+func (s *idpServer) updateSigningKeysLocked(now time.Time) error {
+	if s.signingKeys == nil {
+		keys, err := s.loadSigningKeys(now)
+		if err != nil {
+			return err
+		}
+		s.signingKeys = keys
+	}
+
+	changed := false
+	if len(s.signingKeys) == 0 {
+		id, k := mustGenRSAKey(2048)
+		s.signingKeys = append(s.signingKeys, &signingKey{k: k, kid: id, activeAt: now})
+		changed = true
+	}
+
+	active := s.activeSigningKeyLocked(now)
+	last := s.signingKeys[len(s.signingKeys)-1]
+	if s.keyRotationInterval > 0 && last == active {
+		pre := s.keyPrepublishPeriod()
+		if !now.Before(active.activeAt.Add(s.keyRotationInterval - pre)) {
+			id, k := mustGenRSAKey(2048)
+			s.signingKeys = append(s.signingKeys, &signingKey{k: k, kid: id, activeAt: now.Add(pre)})
+			log.Printf("generated new signing key %d, active at %v", id, now.Add(pre))
+			changed = true
+		}
+	}
+
+	// Every key before the active one has been superseded; schedule its
+	// retirement and drop it once that has passed.
+	kept := s.signingKeys[:0]
+	for i, sk := range s.signingKeys {
+		if sk != active && i+1 < len(s.signingKeys) && !s.signingKeys[i+1].activeAt.After(now) {
+			if sk.retireAt.IsZero() {
+				sk.retireAt = s.signingKeys[i+1].activeAt.Add(retiredKeyGrace)
+				changed = true
+			}
+			if !sk.retireAt.After(now) {
+				log.Printf("retired signing key %d", sk.kid)
+				changed = true
+				continue
+			}
+		}
+		kept = append(kept, sk)
+	}
+	s.signingKeys = kept
+
+	if !changed {
+		return nil
+	}
+	return s.storeSigningKeysLocked()
+}
+
+// loadSigningKeys reads the persisted signing keys, migrating from the
+// single-key oidcKeyFile if oidcKeysFile does not exist yet. A migrated key
+// is treated as having become active at now, as when it was used is unknown.
+// It returns an empty, non-nil slice if there are no keys yet.
+func (s *idpServer) loadSigningKeys(now time.Time) ([]*signingKey, error) {
+	keysPath, err := getConfigFilePath(s.rootPath, oidcKeysFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not get OIDC keys file path: %w", err)
+	}
+	b, err := os.ReadFile(keysPath)
+	if err == nil {
+		var v signingKeysJSON
+		if err := json.Unmarshal(b, &v); err != nil {
+			return nil, fmt.Errorf("could not parse %s: %w", keysPath, err)
+		}
+		slices.SortStableFunc(v.Keys, func(a, b *signingKey) int {
+			return a.activeAt.Compare(b.activeAt)
+		})
+		return append([]*signingKey{}, v.Keys...), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	keyPath, err := getConfigFilePath(s.rootPath, oidcKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not get OIDC key file path: %w", err)
+	}
+	b, err = os.ReadFile(keyPath)
+	if err != nil {
+		return []*signingKey{}, nil
+	}
+	sk := new(signingKey)
+	if err := sk.UnmarshalJSON(b); err != nil || sk.k == nil {
+		log.Printf("Error unmarshaling key: %v", err)
+		return []*signingKey{}, nil
+	}
+	log.Printf("migrating signing key %d from %s", sk.kid, keyPath)
+	if sk.activeAt.IsZero() {
+		sk.activeAt = now
+	}
+	return []*signingKey{sk}, nil
+}
+
+// storeSigningKeysLocked persists s.signingKeys. s.keyMu must be held.
+func (s *idpServer) storeSigningKeysLocked() error {
+	b, err := json.Marshal(signingKeysJSON{Keys: s.signingKeys})
+	if err != nil {
+		return err
+	}
+	keysPath, err := getConfigFilePath(s.rootPath, oidcKeysFile)
+	if err != nil {
+		return fmt.Errorf("could not get OIDC keys file path: %w", err)
+	}
+	return atomicfile.WriteFile(keysPath, b, 0600)
+}
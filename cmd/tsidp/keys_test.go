@@ -0,0 +1,101 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSigningKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	s := &idpServer{
+		rootPath:            dir,
+		keyRotationInterval: 48 * time.Hour,
+	}
+	t0 := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	update := func(now time.Time) (published []uint64, active uint64) {
+		t.Helper()
+		s.keyMu.Lock()
+		defer s.keyMu.Unlock()
+		if err := s.updateSigningKeysLocked(now); err != nil {
+			t.Fatal(err)
+		}
+		for _, sk := range s.signingKeys {
+			published = append(published, sk.kid)
+		}
+		return published, s.activeSigningKeyLocked(now).kid
+	}
+
+	keys, first := update(t0)
+	if len(keys) != 1 {
+		t.Fatalf("initial keys = %v; want 1", keys)
+	}
+
+	// Halfway through, nothing happens yet.
+	if keys, active := update(t0.Add(12 * time.Hour)); len(keys) != 1 || active != first {
+		t.Fatalf("at 12h: keys = %v, active = %d", keys, active)
+	}
+
+	// Within the prepublish period, a successor is published but unused.
+	keys, active := update(t0.Add(24 * time.Hour))
+	if len(keys) != 2 || active != first {
+		t.Fatalf("at 24h: keys = %v, active = %d; want 2 keys, active %d", keys, active, first)
+	}
+	second := keys[1]
+
+	// The state must survive a restart.
+	s2 := &idpServer{rootPath: dir, keyRotationInterval: s.keyRotationInterval}
+	s2.keyMu.Lock()
+	loaded, err := s2.loadSigningKeys(t0)
+	s2.keyMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != 2 || loaded[0].kid != first || loaded[1].kid != second {
+		t.Fatalf("loaded keys from disk do not match")
+	}
+
+	// Once the successor is active, the old key remains published until
+	// its tokens have expired.
+	if keys, active := update(t0.Add(48 * time.Hour)); len(keys) != 2 || active != second {
+		t.Fatalf("at 48h: keys = %v, active = %d; want 2 keys, active %d", keys, active, second)
+	}
+	if keys, _ := update(t0.Add(48*time.Hour + accessTokenTTL)); !slices.Contains(keys, first) {
+		t.Fatalf("at ID token expiry: keys = %v; want %d still published", keys, first)
+	}
+	if keys, active := update(t0.Add(48*time.Hour + retiredKeyGrace)); slices.Contains(keys, first) || active != second {
+		t.Fatalf("after grace: keys = %v, active = %d; want %d dropped, active %d", keys, active, first, second)
+	}
+}
+
+func TestSigningKeyMigration(t *testing.T) {
+	dir := t.TempDir()
+	old := &signingKey{k: mustGeneratePrivateKey(t), kid: 42}
+	b, err := old.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, oidcKeyFile), b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The migrated key has no activation time, but must not be rotated as
+	// if it were arbitrarily old.
+	s := &idpServer{rootPath: dir, keyRotationInterval: 24 * time.Hour}
+	keys, err := s.publishedSigningKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].kid != 42 {
+		t.Fatalf("got %d keys; want migrated key 42", len(keys))
+	}
+	if keys[0].activeAt.IsZero() {
+		t.Error("migrated key has zero activeAt")
+	}
+}
@@ -0,0 +1,563 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"time"
+
+	"gopkg.in/square/go-jose.v2/jwt"
+	"tailscale.com/atomicfile"
+	"tailscale.com/tailcfg"
+	"tailscale.com/util/mak"
+)
+
+// This file implements the endpoints that let relying parties manage tokens
+// after they have been issued: RFC 7662 token introspection, RFC 7009 token
+// revocation and OpenID Connect RP-initiated logout.
+//
+// Access and refresh tokens are opaque and checked against in-memory state,
+// while ID tokens are self-contained JWTs. Revoking any of them means
+// remembering it until it would have expired; all revocations are persisted
+// to revocationsFile.
+
+var errInvalidClient = errors.New("tsidp: invalid client credentials")
+
+// introspectionResponse is the response to a token introspection request, as
+// described in RFC 7662 section 2.2. Fields other than Active are omitted for
+// inactive tokens.
+type introspectionResponse struct {
+	Active    bool         `json:"active"`
+	ClientID  string       `json:"client_id,omitempty"`
+	Username  string       `json:"username,omitempty"`
+	TokenType string       `json:"token_type,omitempty"`
+	Expiry    int64        `json:"exp,omitempty"`
+	IssuedAt  int64        `json:"iat,omitempty"`
+	Subject   string       `json:"sub,omitempty"`
+	Audience  jwt.Audience `json:"aud,omitempty"`
+	Issuer    string       `json:"iss,omitempty"`
+	JTI       string       `json:"jti,omitempty"`
+
+	// Tailscale extensions, named as in tailscaleClaims.
+	NodeID   tailcfg.NodeID `json:"nid,omitempty"`
+	NodeName string         `json:"node,omitempty"`
+	Tags     []string       `json:"tags,omitempty"`
+}
+
+// tokenCaller is the authenticated caller of the introspection or revocation
+// endpoints. Exactly one of its fields is set.
+type tokenCaller struct {
+	// client is the Funnel client calling over Funnel. It may manage the
+	// tokens issued to it.
+	client *funnelClient
+
+	// local is whether the caller is on loopback. It may manage the tokens
+	// issued to local relying parties.
+	local bool
+
+	// subject is the "sub" of the tailnet node calling, if it does not have
+	// the allowTokenAdmin capability. It may manage the tokens issued for
+	// that subject.
+	subject string
+
+	// admin is whether the caller is a tailnet node with the
+	// allowTokenAdmin capability. It may manage any token.
+	admin bool
+}
+
+// authenticateClient authenticates the caller of the introspection or
+// revocation endpoints.
+//
+// Callers on the tailnet or on loopback are authenticated by their network
+// identity. Callers over Funnel must present the credentials of a registered
+// Funnel client.
+func (s *idpServer) authenticateClient(r *http.Request) (*tokenCaller, error) {
+	if !isFunnelRequest(r) {
+		remoteAddr := s.remoteAddr(r)
+		if ap, err := netip.ParseAddrPort(remoteAddr); err == nil && ap.Addr().IsLoopback() {
+			return &tokenCaller{local: true}, nil
+		}
+		who, err := s.lc.WhoIs(r.Context(), remoteAddr)
+		if err != nil {
+			return nil, fmt.Errorf("tsidp: error getting WhoIs: %w", err)
+		}
+		rules, err := tailcfg.UnmarshalCapJSON[capRule](who.CapMap, tailcfg.PeerCapabilityTsIDP)
+		if err != nil {
+			return nil, fmt.Errorf("tsidp: failed to unmarshal capability: %w", err)
+		}
+		if slices.ContainsFunc(rules, func(r capRule) bool { return r.AllowTokenAdmin }) {
+			return &tokenCaller{admin: true}, nil
+		}
+		return &tokenCaller{subject: subjectOf(who.Node)}, nil
+	}
+	clientID, clientSecret := clientCredentialsFromRequest(r)
+	s.mu.Lock()
+	c, ok := s.funnelClients[clientID]
+	s.mu.Unlock()
+	if !ok {
+		return nil, errInvalidClient
+	}
+	if !c.Public && subtle.ConstantTimeCompare([]byte(clientSecret), []byte(c.Secret)) != 1 {
+		return nil, errInvalidClient
+	}
+	return &tokenCaller{client: c}, nil
+}
+
+// subjectOf returns the "sub" of tokens issued for n.
+func subjectOf(n *tailcfg.Node) string {
+	if n.IsTagged() {
+		return string(n.StableID)
+	}
+	return n.User.String()
+}
+
+// mayManage reports whether the tokens issued for ar may be introspected or
+// revoked by caller.
+func (caller *tokenCaller) mayManage(ar *authRequest) bool {
+	switch {
+	case caller.admin:
+		return true
+	case caller.client != nil:
+		return ar.funnelRP != nil && ar.funnelRP.ID == caller.client.ID
+	case caller.local:
+		return ar.localRP
+	}
+	return caller.subject != "" && subjectOf(ar.remoteUser.Node) == caller.subject
+}
+
+// mayManageIDToken reports whether the ID token with the given claims may be
+// introspected or revoked by caller.
+func (s *idpServer) mayManageIDToken(caller *tokenCaller, claims *tailscaleClaims) bool {
+	switch {
+	case caller.admin:
+		return true
+	case caller.client != nil:
+		return claims.Audience.Contains(caller.client.ID)
+	case caller.local:
+		return s.loopbackURL != "" && claims.Issuer == s.loopbackURL
+	}
+	return caller.subject != "" && claims.Subject == caller.subject
+}
+
+// issuer returns the "iss" value used for tokens issued for ar.
+func (s *idpServer) issuer(ar *authRequest) string {
+	if ar.localRP {
+		return s.loopbackURL
+	}
+	return s.serverURL
+}
+
+// verifyIDToken parses and verifies the signature, issuer and expiry of an
+// ID token previously issued by s.
+func (s *idpServer) verifyIDToken(raw string) (*tailscaleClaims, error) {
+	tok, err := jwt.ParseSigned(raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(tok.Headers) != 1 {
+		return nil, errors.New("tsidp: unexpected number of JWT signatures")
+	}
+	sk, err := s.signingKeyByID(tok.Headers[0].KeyID)
+	if err != nil {
+		return nil, err
+	}
+	var claims tailscaleClaims
+	if err := tok.Claims(sk.k.Public(), &claims); err != nil {
+		return nil, err
+	}
+	if claims.Issuer != s.serverURL && (s.loopbackURL == "" || claims.Issuer != s.loopbackURL) {
+		return nil, fmt.Errorf("tsidp: unexpected issuer %q", claims.Issuer)
+	}
+	if err := claims.ValidateWithLeeway(jwt.Expected{Time: time.Now()}, 0); err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
+
+func (s *idpServer) serveIntrospect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "tsidp: method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	caller, err := s.authenticateClient(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if caller.client != nil && caller.client.Public {
+		http.Error(w, "tsidp: public clients may not introspect tokens", http.StatusUnauthorized)
+		return
+	}
+	tk := r.FormValue("token")
+	if tk == "" {
+		http.Error(w, "tsidp: token is required", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.introspect(tk, caller)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// introspect returns the introspection response for tk, which may be an
+// access token, refresh token or ID token, as seen by caller.
+func (s *idpServer) introspect(tk string, caller *tokenCaller) introspectionResponse {
+	now := time.Now()
+	var inactive introspectionResponse
+
+	s.mu.Lock()
+	ar, ok := s.accessToken[tk]
+	isAccessToken := ok
+	if !ok {
+		ar, ok = s.refreshToken[tk]
+	}
+	if ok && s.revoked.isTokenRevoked(tk, ar) {
+		ok = false
+	}
+	s.mu.Unlock()
+	if ok {
+		if ar.validTill.Before(now) || !caller.mayManage(ar) {
+			return inactive
+		}
+		n := ar.remoteUser.Node
+		resp := introspectionResponse{
+			Active:   true,
+			ClientID: ar.clientID,
+			Username: ar.remoteUser.UserProfile.LoginName,
+			Expiry:   ar.validTill.Unix(),
+			Issuer:   s.issuer(ar),
+			NodeID:   n.ID,
+			NodeName: n.Name,
+			Tags:     n.Tags,
+		}
+		if ar.clientID != "" {
+			resp.Audience = jwt.Audience{ar.clientID}
+		}
+		if isAccessToken {
+			resp.TokenType = "Bearer"
+		}
+		resp.Subject = subjectOf(n)
+		return resp
+	}
+
+	claims, err := s.verifyIDToken(tk)
+	if err != nil || s.isRevoked(claims.ID) {
+		return inactive
+	}
+	if !s.mayManageIDToken(caller, claims) {
+		return inactive
+	}
+	return introspectionResponse{
+		Active:   true,
+		Username: claims.Email,
+		Expiry:   claims.Expiry.Time().Unix(),
+		IssuedAt: claims.IssuedAt.Time().Unix(),
+		Subject:  claims.Subject,
+		Audience: claims.Audience,
+		Issuer:   claims.Issuer,
+		JTI:      claims.ID,
+		NodeID:   claims.NodeID,
+		NodeName: claims.NodeName,
+	}
+}
+
+func (s *idpServer) serveRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "tsidp: method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	caller, err := s.authenticateClient(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	tk := r.FormValue("token")
+	if tk == "" {
+		http.Error(w, "tsidp: token is required", http.StatusBadRequest)
+		return
+	}
+	if err := s.revokeToken(tk, caller); err != nil {
+		log.Printf("could not revoke token: %v", err)
+		http.Error(w, "tsidp: could not revoke token", http.StatusInternalServerError)
+		return
+	}
+	// Per RFC 7009 section 2.2, invalid or unknown tokens also get a 200.
+	w.WriteHeader(http.StatusOK)
+}
+
+// revokeToken revokes tk on behalf of caller. Revoking a refresh token also
+// revokes every other token issued from the same grant. Unknown tokens, and
+// tokens that caller may not manage, are ignored.
+func (s *idpServer) revokeToken(tk string, caller *tokenCaller) error {
+	s.mu.Lock()
+	if ar, ok := s.accessToken[tk]; ok {
+		if !caller.mayManage(ar) {
+			s.mu.Unlock()
+			return nil
+		}
+		delete(s.accessToken, tk)
+		mak.Set(&s.revoked.Token, tokenHash(tk), ar.validTill)
+		s.mu.Unlock()
+		return s.storeRevocations()
+	}
+	if ar, ok := s.refreshToken[tk]; ok {
+		if !caller.mayManage(ar) {
+			s.mu.Unlock()
+			return nil
+		}
+		s.revokeGrantLocked(ar.grant)
+		s.mu.Unlock()
+		return s.storeRevocations()
+	}
+	s.mu.Unlock()
+
+	claims, err := s.verifyIDToken(tk)
+	if err != nil {
+		// Invalid or already expired; nothing to revoke.
+		return nil
+	}
+	if !s.mayManageIDToken(caller, claims) {
+		return nil
+	}
+	s.mu.Lock()
+	mak.Set(&s.revoked.JTI, claims.ID, claims.Expiry.Time())
+	s.mu.Unlock()
+	return s.storeRevocations()
+}
+
+// revokeGrantLocked deletes all access and refresh tokens issued from grant,
+// and records the grant as revoked until the last of them would have
+// expired. s.mu must be held.
+func (s *idpServer) revokeGrantLocked(grant string) {
+	if grant == "" {
+		return
+	}
+	exp := s.revoked.Grant[grant]
+	for _, m := range []map[string]*authRequest{s.accessToken, s.refreshToken} {
+		for _, ar := range m {
+			if ar.grant == grant && ar.validTill.After(exp) {
+				exp = ar.validTill
+			}
+		}
+	}
+	mak.Set(&s.revoked.Grant, grant, exp)
+	for tk, ar := range s.accessToken {
+		if ar.grant == grant {
+			delete(s.accessToken, tk)
+		}
+	}
+	for tk, ar := range s.refreshToken {
+		if ar.grant == grant {
+			delete(s.refreshToken, tk)
+		}
+	}
+}
+
+// serveEndSession implements OpenID Connect RP-Initiated Logout 1.0.
+//
+// tsidp keeps no browser session of its own, as users are authenticated by
+// their tailnet identity on every authorization request. Ending a session
+// therefore means revoking the tokens the relying party holds for the user
+// named by id_token_hint.
+func (s *idpServer) serveEndSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "tsidp: method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	hint := r.FormValue("id_token_hint")
+	redirectURI := r.FormValue("post_logout_redirect_uri")
+	if hint == "" {
+		if redirectURI != "" {
+			http.Error(w, "tsidp: id_token_hint is required with post_logout_redirect_uri", http.StatusBadRequest)
+			return
+		}
+		io.WriteString(w, "You have been logged out.\n")
+		return
+	}
+
+	claims, err := s.verifyIDToken(hint)
+	if err != nil {
+		log.Printf("invalid id_token_hint: %v", err)
+		http.Error(w, "tsidp: invalid id_token_hint", http.StatusBadRequest)
+		return
+	}
+	if cid := r.FormValue("client_id"); cid != "" && !claims.Audience.Contains(cid) {
+		http.Error(w, "tsidp: client_id does not match id_token_hint", http.StatusBadRequest)
+		return
+	}
+	if redirectURI != "" {
+		if err := s.validatePostLogoutRedirect(claims, redirectURI); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := s.endSession(claims); err != nil {
+		log.Printf("could not end session: %v", err)
+		http.Error(w, "tsidp: could not end session", http.StatusInternalServerError)
+		return
+	}
+
+	if redirectURI == "" {
+		io.WriteString(w, "You have been logged out.\n")
+		return
+	}
+	u, _ := url.Parse(redirectURI) // validated above
+	if state := r.FormValue("state"); state != "" {
+		q := u.Query()
+		q.Set("state", state)
+		u.RawQuery = q.Encode()
+	}
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// validatePostLogoutRedirect reports whether the user may be sent to
+// redirectURI after logging out of the relying party that received the ID
+// token with the given claims. The URI must exactly match one of the
+// post_logout_redirect_uris registered for a funnel client in the token's
+// audience.
+func (s *idpServer) validatePostLogoutRedirect(claims *tailscaleClaims, redirectURI string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, aud := range claims.Audience {
+		c, ok := s.funnelClients[aud]
+		if ok && slices.Contains(c.PostLogoutRedirectURIs, redirectURI) {
+			return nil
+		}
+	}
+	return errors.New("tsidp: post_logout_redirect_uri not registered for client")
+}
+
+// endSession revokes the ID token with the given claims along with every
+// access and refresh token held by its audience for the same user.
+func (s *idpServer) endSession(claims *tailscaleClaims) error {
+	s.mu.Lock()
+	var grants []string
+	for _, m := range []map[string]*authRequest{s.accessToken, s.refreshToken} {
+		for _, ar := range m {
+			if ar.remoteUser.Node.User == claims.UserID && claims.Audience.Contains(ar.clientID) {
+				grants = append(grants, ar.grant)
+			}
+		}
+	}
+	for _, g := range grants {
+		s.revokeGrantLocked(g)
+	}
+	if claims.ID != "" && claims.Expiry.Time().After(time.Now()) {
+		mak.Set(&s.revoked.JTI, claims.ID, claims.Expiry.Time())
+	}
+	s.mu.Unlock()
+	return s.storeRevocations()
+}
+
+// isRevoked reports whether the ID token with the given jti was revoked.
+func (s *idpServer) isRevoked(jti string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.revoked.JTI[jti]
+	return ok
+}
+
+// revocations is the set of revoked tokens that have not yet expired, as
+// persisted to revocationsFile. Each map value is when the revoked tokens
+// expire, after which they need not be remembered.
+type revocations struct {
+	// JTI is keyed by the "jti" of revoked ID tokens.
+	JTI map[string]time.Time `json:"jti,omitempty"`
+
+	// Token is keyed by the tokenHash of individually revoked access
+	// tokens.
+	Token map[string]time.Time `json:"token,omitempty"`
+
+	// Grant is keyed by the grants whose access and refresh tokens were
+	// all revoked.
+	Grant map[string]time.Time `json:"grant,omitempty"`
+}
+
+// tokenHash returns the hash of an access or refresh token under which its
+// revocation is recorded, so that revocationsFile holds no usable tokens.
+func tokenHash(tk string) string {
+	sum := sha256.Sum256([]byte(tk))
+	return hex.EncodeToString(sum[:])
+}
+
+// isTokenRevoked reports whether tk, an access or refresh token issued for
+// ar, was revoked.
+func (rv *revocations) isTokenRevoked(tk string, ar *authRequest) bool {
+	if _, ok := rv.Token[tokenHash(tk)]; ok {
+		return true
+	}
+	_, ok := rv.Grant[ar.grant]
+	return ok && ar.grant != ""
+}
+
+// prune deletes the revocations of tokens that expired before now.
+func (rv *revocations) prune(now time.Time) {
+	for _, m := range []map[string]time.Time{rv.JTI, rv.Token, rv.Grant} {
+		for k, exp := range m {
+			if exp.Before(now) {
+				delete(m, k)
+			}
+		}
+	}
+}
+
+// loadRevocations reads the set of revoked tokens persisted by
+// storeRevocations, skipping those that have since expired.
+func (s *idpServer) loadRevocations() error {
+	path, err := getConfigFilePath(s.rootPath, revocationsFile)
+	if err != nil {
+		return err
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var revoked revocations
+	if err := json.Unmarshal(b, &revoked); err != nil {
+		return fmt.Errorf("could not parse %s: %w", path, err)
+	}
+	revoked.prune(time.Now())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.revoked = revoked
+	return nil
+}
+
+// storeRevocations prunes expired entries from the set of revoked tokens and
+// writes the remainder to disk. It must not be called with s.mu held.
+func (s *idpServer) storeRevocations() error {
+	// Hold revocationsMu across the write, so that an older snapshot can't
+	// overwrite a newer one, but not s.mu, so that the disk write does not
+	// block token requests.
+	s.revocationsMu.Lock()
+	defer s.revocationsMu.Unlock()
+	s.mu.Lock()
+	s.revoked.prune(time.Now())
+	b, err := json.Marshal(s.revoked)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	path, err := getConfigFilePath(s.rootPath, revocationsFile)
+	if err != nil {
+		return fmt.Errorf("storeRevocations: %v", err)
+	}
+	return atomicfile.WriteFile(path, b, 0600)
+}
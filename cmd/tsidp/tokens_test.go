@@ -0,0 +1,304 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2/jwt"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// newTestTokenServer returns an idpServer with a single pending authorization
+// code "valid-code" for a localhost relying party.
+func newTestTokenServer(t *testing.T, rootPath string) *idpServer {
+	t.Helper()
+	s := &idpServer{
+		rootPath:    rootPath,
+		loopbackURL: "http://localhost:8080",
+		code: map[string]*authRequest{
+			"valid-code": {
+				clientID:    "client-id",
+				redirectURI: "https://rp.example.com/callback",
+				grant:       "grant-1",
+				localRP:     true,
+				remoteUser: &apitype.WhoIsResponse{
+					Node: &tailcfg.Node{
+						ID:   123,
+						Name: "test-node.test.ts.net.",
+						User: 456,
+					},
+					UserProfile: &tailcfg.UserProfile{
+						LoginName: "alice@example.com",
+					},
+				},
+			},
+		},
+	}
+	s.signingKeys = oidcTestingSigningKeys(t)
+	return s
+}
+
+func postForm(t *testing.T, h http.HandlerFunc, path string, form url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.RemoteAddr = "127.0.0.1:12345"
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	h(rr, req)
+	return rr
+}
+
+func TestIntrospectAndRevoke(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestTokenServer(t, dir)
+
+	rr := postForm(t, s.serveToken, "/token", url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {"valid-code"},
+		"redirect_uri": {"https://rp.example.com/callback"},
+	})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("token: got %d: %s", rr.Code, rr.Body.String())
+	}
+	var tokens oidcTokenResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &tokens); err != nil {
+		t.Fatal(err)
+	}
+
+	introspect := func(s *idpServer, tk string) introspectionResponse {
+		t.Helper()
+		rr := postForm(t, s.serveIntrospect, "/introspect", url.Values{"token": {tk}})
+		if rr.Code != http.StatusOK {
+			t.Fatalf("introspect: got %d: %s", rr.Code, rr.Body.String())
+		}
+		var resp introspectionResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	for _, tk := range []string{tokens.AccessToken, tokens.RefreshToken, tokens.IDToken} {
+		resp := introspect(s, tk)
+		if !resp.Active {
+			t.Fatalf("token %q not active", tk)
+		}
+		if resp.Subject != "userid:456" {
+			t.Errorf("sub = %q; want userid:456", resp.Subject)
+		}
+	}
+	if resp := introspect(s, "bogus"); resp.Active {
+		t.Error("bogus token is active")
+	}
+
+	// Revoking the refresh token also revokes the access token from the
+	// same grant.
+	if rr := postForm(t, s.serveRevoke, "/revoke", url.Values{"token": {tokens.RefreshToken}}); rr.Code != http.StatusOK {
+		t.Fatalf("revoke: got %d: %s", rr.Code, rr.Body.String())
+	}
+	if introspect(s, tokens.RefreshToken).Active || introspect(s, tokens.AccessToken).Active {
+		t.Error("tokens still active after revoking refresh token")
+	}
+
+	if rr := postForm(t, s.serveRevoke, "/revoke", url.Values{"token": {tokens.IDToken}}); rr.Code != http.StatusOK {
+		t.Fatalf("revoke: got %d: %s", rr.Code, rr.Body.String())
+	}
+	if introspect(s, tokens.IDToken).Active {
+		t.Error("ID token still active after revocation")
+	}
+
+	// The revocations must survive a restart, even if the access and
+	// refresh tokens are presented again.
+	s2 := newTestTokenServer(t, dir)
+	if err := s2.loadRevocations(); err != nil {
+		t.Fatal(err)
+	}
+	ar := s2.code["valid-code"]
+	ar.validTill = time.Now().Add(time.Hour)
+	s2.accessToken = map[string]*authRequest{tokens.AccessToken: ar}
+	s2.refreshToken = map[string]*authRequest{tokens.RefreshToken: ar}
+	for _, tk := range []string{tokens.AccessToken, tokens.RefreshToken, tokens.IDToken} {
+		if introspect(s2, tk).Active {
+			t.Errorf("token %q active after reloading revocations", tk)
+		}
+	}
+}
+
+func TestRevokeAccessTokenPersisted(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestTokenServer(t, dir)
+	ar := s.code["valid-code"]
+	ar.validTill = time.Now().Add(time.Hour)
+	s.accessToken = map[string]*authRequest{"access": ar}
+	if err := s.revokeToken("access", &tokenCaller{local: true}); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.accessToken) != 0 {
+		t.Error("access token not deleted")
+	}
+
+	s2 := newTestTokenServer(t, dir)
+	if err := s2.loadRevocations(); err != nil {
+		t.Fatal(err)
+	}
+	s2.mu.Lock()
+	revoked := s2.revoked.isTokenRevoked("access", ar)
+	s2.mu.Unlock()
+	if !revoked {
+		t.Error("access token revocation not persisted")
+	}
+}
+
+func TestTokenCallerMayManage(t *testing.T) {
+	s := newTestTokenServer(t, t.TempDir())
+	rr := postForm(t, s.serveToken, "/token", url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {"valid-code"},
+		"redirect_uri": {"https://rp.example.com/callback"},
+	})
+	var tokens oidcTokenResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &tokens); err != nil {
+		t.Fatal(err)
+	}
+	claims, err := s.verifyIDToken(tokens.IDToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ar := s.refreshToken[tokens.RefreshToken]
+	funnelClient := &funnelClient{ID: "client-id"}
+
+	tests := []struct {
+		name   string
+		caller *tokenCaller
+		want   bool
+	}{
+		{"admin", &tokenCaller{admin: true}, true},
+		{"local", &tokenCaller{local: true}, true},
+		{"same-user", &tokenCaller{subject: "userid:456"}, true},
+		{"other-user", &tokenCaller{subject: "userid:789"}, false},
+		{"tagged-node", &tokenCaller{subject: "nodeid-1"}, false},
+		{"funnel-client", &tokenCaller{client: funnelClient}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.caller.mayManage(ar); got != tt.want {
+				t.Errorf("mayManage = %v, want %v", got, tt.want)
+			}
+			// The Funnel client shares the ID token's audience, but the
+			// token was not issued to it over Funnel.
+			want := tt.want || tt.name == "funnel-client"
+			if got := s.mayManageIDToken(tt.caller, claims); got != want {
+				t.Errorf("mayManageIDToken = %v, want %v", got, want)
+			}
+		})
+	}
+
+	// A caller that may not manage the tokens can't revoke them.
+	if err := s.revokeToken(tokens.RefreshToken, &tokenCaller{subject: "userid:789"}); err != nil {
+		t.Fatal(err)
+	}
+	if resp := s.introspect(tokens.AccessToken, &tokenCaller{admin: true}); !resp.Active {
+		t.Error("access token revoked by another user")
+	}
+}
+
+func TestEndSession(t *testing.T) {
+	s := newTestTokenServer(t, t.TempDir())
+	s.funnelClients = map[string]*funnelClient{
+		"client-id": {
+			ID:                     "client-id",
+			RedirectURI:            "https://rp.example.com/callback",
+			PostLogoutRedirectURIs: []string{"https://rp.example.com/"},
+		},
+	}
+	rr := postForm(t, s.serveToken, "/token", url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {"valid-code"},
+		"redirect_uri": {"https://rp.example.com/callback"},
+	})
+	var tokens oidcTokenResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &tokens); err != nil {
+		t.Fatal(err)
+	}
+
+	endSession := func(hint, redirectURI string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/end_session?"+url.Values{
+			"id_token_hint":            {hint},
+			"post_logout_redirect_uri": {redirectURI},
+			"state":                    {"xyz"},
+		}.Encode(), nil)
+		rr := httptest.NewRecorder()
+		s.serveEndSession(rr, req)
+		return rr
+	}
+
+	// Only URIs registered for the hinted client are redirected to, even
+	// on the same origin.
+	for _, u := range []string{"https://attacker.example.net/", "https://rp.example.com/other"} {
+		if rr := endSession(tokens.IDToken, u); rr.Code != http.StatusBadRequest {
+			t.Errorf("end_session to %q: got %d; want %d", u, rr.Code, http.StatusBadRequest)
+		}
+	}
+
+	// Expired hints are rejected.
+	expired := expiredIDToken(t, s, tokens.IDToken)
+	if rr := endSession(expired, "https://rp.example.com/"); rr.Code != http.StatusBadRequest {
+		t.Errorf("end_session with expired hint: got %d; want %d", rr.Code, http.StatusBadRequest)
+	}
+	if len(s.accessToken) == 0 {
+		t.Fatal("rejected end_session revoked tokens")
+	}
+
+	rr = endSession(tokens.IDToken, "https://rp.example.com/")
+	if rr.Code != http.StatusFound {
+		t.Fatalf("end_session: got %d: %s", rr.Code, rr.Body.String())
+	}
+	if got, want := rr.Header().Get("Location"), "https://rp.example.com/?state=xyz"; got != want {
+		t.Errorf("Location = %q; want %q", got, want)
+	}
+	if len(s.accessToken) != 0 || len(s.refreshToken) != 0 {
+		t.Errorf("tokens remain after end_session: %d access, %d refresh", len(s.accessToken), len(s.refreshToken))
+	}
+	if !s.isRevoked(mustJTI(t, tokens.IDToken)) {
+		t.Error("ID token not revoked after end_session")
+	}
+}
+
+func mustJTI(t *testing.T, idToken string) string {
+	t.Helper()
+	s := newTestTokenServer(t, t.TempDir())
+	claims, err := s.verifyIDToken(idToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return claims.ID
+}
+
+// expiredIDToken returns a copy of idToken, signed by s, that expired an
+// hour ago.
+func expiredIDToken(t *testing.T, s *idpServer, idToken string) string {
+	t.Helper()
+	claims, err := s.verifyIDToken(idToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims.Expiry = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+	signer, err := s.signingKeys[0].joseSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tok
+}
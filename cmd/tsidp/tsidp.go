@@ -11,6 +11,7 @@
 	"context"
 	crand "crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/subtle"
 	"crypto/tls"
 	"crypto/x509"
@@ -61,9 +62,30 @@ type ctxConn struct{
 // accessing the IDP over Funnel are persisted.
 const funnelClientsFile = "oidc-funnel-clients.json"
 
-// oidcKeyFile is where the OIDC private key is persisted.
+// oidcKeyFile is where the OIDC private key was persisted before key
+// rotation was supported. It is only read, to migrate to oidcKeysFile.
 const oidcKeyFile = "oidc-key.json"
 
+// oidcKeysFile is where the set of OIDC signing keys is persisted.
+const oidcKeysFile = "oidc-keys.json"
+
+// revocationsFile is where revoked, not yet expired tokens are persisted.
+const revocationsFile = "oidc-revocations.json"
+
+const (
+	// accessTokenTTL is how long access and ID tokens are valid for.
+	accessTokenTTL = 5 * time.Minute
+
+	// expireTokensInterval is how often expired access and refresh tokens
+	// are deleted.
+	expireTokensInterval = time.Minute
+
+	// refreshTokenTTL is how long a refresh token may be used to obtain new
+	// tokens. Each use rotates the refresh token, so an actively used
+	// session can last indefinitely.
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
 var (
 	flagVerbose            = flag.Bool("verbose", false, "be verbose")
 	flagPort               = flag.Int("port", 443, "port to listen on")
@@ -73,6 +95,7 @@ type ctxConn struct{
 	flagHostname           = flag.String("hostname", "idp", "tsnet hostname to use instead of idp")
 	flagDir                = flag.String("dir", "", "tsnet state directory; a default one will be created if not provided")
 	flagControlURL         = flag.String("login-server", "", "optional alternate control server base URL. If empty, the default Tailscale control plane is used.")
+	flagKeyRotation        = flag.Duration("key-rotation-interval", 0, "how often to rotate the OIDC signing key; new keys are published in the JWKS before use. Zero disables rotation.")
 )
 
 func main() {
@@ -177,10 +200,11 @@ func main() {
 	}
 
 	srv := &idpServer{
-		lc:          lc,
-		funnel:      *flagFunnel,
-		localTSMode: *flagUseLocalTailscaled,
-		rootPath:    rootPath,
+		lc:                  lc,
+		funnel:              *flagFunnel,
+		localTSMode:         *flagUseLocalTailscaled,
+		rootPath:            rootPath,
+		keyRotationInterval: *flagKeyRotation,
 	}
 
 	if *flagPort != 443 {
@@ -205,6 +229,11 @@ func main() {
 		log.Fatalf("could not open %s: %v", funnelClientsFilePath, err)
 	}
 
+	if err := srv.loadRevocations(); err != nil {
+		log.Fatalf("could not load revocations: %v", err)
+	}
+	go srv.expireTokensPeriodically(ctx)
+
 	log.Printf("Running tsidp at %s ...", srv.serverURL)
 
 	if *flagLocalPort != -1 {
@@ -316,14 +345,23 @@ type idpServer struct {
 	localTSMode bool
 	rootPath    string // root path, used for storing state files
 
-	lazyMux        lazy.SyncValue[*http.ServeMux]
-	lazySigningKey lazy.SyncValue[*signingKey]
-	lazySigner     lazy.SyncValue[jose.Signer]
+	// keyRotationInterval is how long each signing key is used for before
+	// it is replaced. Zero means the signing key is never rotated.
+	keyRotationInterval time.Duration
+
+	lazyMux lazy.SyncValue[*http.ServeMux]
+
+	keyMu       sync.Mutex    // guards signingKeys
+	signingKeys []*signingKey // nil until loaded; sorted by activeAt
 
 	mu            sync.Mutex               // guards the fields below
 	code          map[string]*authRequest  // keyed by random hex
 	accessToken   map[string]*authRequest  // keyed by random hex
+	refreshToken  map[string]*authRequest  // keyed by random hex
 	funnelClients map[string]*funnelClient // keyed by client ID
+	revoked       revocations              // revoked tokens that have not expired
+
+	revocationsMu sync.Mutex // serializes writes of revocationsFile; acquired before mu
 }
 
 type authRequest struct {
@@ -351,15 +389,58 @@ type authRequest struct {
 	// redirectURI is the redirect_uri presented in the request.
 	redirectURI string
 
+	// codeChallenge is the PKCE "code_challenge" presented in the authorize
+	// request, if any. Only the S256 method is supported, so this is the
+	// unpadded base64url encoding of the SHA-256 of the code verifier.
+	codeChallenge string
+
+	// grant identifies the authorization grant that this request belongs
+	// to. All access and refresh tokens issued from the same authorization
+	// code share a grant, so that revoking one refresh token revokes all of
+	// them.
+	grant string
+
+	// clientCredentials is whether this request was created by the
+	// client_credentials grant, in which case remoteUser is the calling
+	// node itself rather than a user authenticated by a relying party.
+	clientCredentials bool
+
 	// remoteUser is the user who is being authenticated.
 	remoteUser *apitype.WhoIsResponse
 
 	// validTill is the time until which the token is valid.
 	// As of 2023-11-14, it is 5 minutes.
-	// TODO: add routine to delete expired tokens.
 	validTill time.Time
 }
 
+// expireTokensPeriodically calls expireTokens every expireTokensInterval
+// until ctx is done.
+func (s *idpServer) expireTokensPeriodically(ctx context.Context) {
+	t := time.NewTicker(expireTokensInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			s.expireTokens(now)
+		}
+	}
+}
+
+// expireTokens deletes the access and refresh tokens that expired before now.
+func (s *idpServer) expireTokens(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range []map[string]*authRequest{s.accessToken, s.refreshToken} {
+		for tk, ar := range m {
+			if ar.validTill.Before(now) {
+				delete(m, tk)
+			}
+		}
+	}
+}
+
 // allowRelyingParty validates that a relying party identified either by a
 // known remoteAddr or a valid client ID/secret pair is allowed to proceed
 // with the authorization flow associated with this authRequest.
@@ -375,12 +456,16 @@ func (ar *authRequest) allowRelyingParty(r *http.Request, lc *local.Client) erro
 		return nil
 	}
 	if ar.funnelRP != nil {
-		clientID, clientSecret, ok := r.BasicAuth()
-		if !ok {
-			clientID = r.FormValue("client_id")
-			clientSecret = r.FormValue("client_secret")
-		}
+		clientID, clientSecret := clientCredentialsFromRequest(r)
 		clientIDcmp := subtle.ConstantTimeCompare([]byte(clientID), []byte(ar.funnelRP.ID))
+		if ar.funnelRP.Public {
+			// Public clients have no secret; possession of the PKCE code
+			// verifier or refresh token is what authenticates them.
+			if clientIDcmp != 1 {
+				return fmt.Errorf("tsidp: invalid client credentials")
+			}
+			return nil
+		}
 		clientSecretcmp := subtle.ConstantTimeCompare([]byte(clientSecret), []byte(ar.funnelRP.Secret))
 		if clientIDcmp != 1 || clientSecretcmp != 1 {
 			return fmt.Errorf("tsidp: invalid client credentials")
@@ -397,6 +482,53 @@ func (ar *authRequest) allowRelyingParty(r *http.Request, lc *local.Client) erro
 	return nil
 }
 
+// clientCredentialsFromRequest returns the client ID and secret presented in
+// r, either with HTTP Basic authentication or as form values.
+func clientCredentialsFromRequest(r *http.Request) (clientID, clientSecret string) {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.FormValue("client_id")
+		clientSecret = r.FormValue("client_secret")
+	}
+	return clientID, clientSecret
+}
+
+// verifyCodeVerifier checks the PKCE code verifier presented to the token
+// endpoint against the code challenge presented to the authorize endpoint, as
+// described in RFC 7636. If no challenge was presented, verifier must be
+// empty.
+func (ar *authRequest) verifyCodeVerifier(verifier string) error {
+	if ar.codeChallenge == "" {
+		if verifier != "" {
+			return fmt.Errorf("tsidp: code_verifier sent without code_challenge")
+		}
+		return nil
+	}
+	if verifier == "" {
+		return fmt.Errorf("tsidp: code_verifier is required")
+	}
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return fmt.Errorf("tsidp: invalid code_verifier length")
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	want := base64.RawURLEncoding.EncodeToString(sum[:])
+	if subtle.ConstantTimeCompare([]byte(want), []byte(ar.codeChallenge)) != 1 {
+		return fmt.Errorf("tsidp: code_verifier mismatch")
+	}
+	return nil
+}
+
+// remoteAddr returns the address of the client that made r.
+func (s *idpServer) remoteAddr(r *http.Request) string {
+	if s.localTSMode {
+		// in local tailscaled mode, the local tailscaled is forwarding us
+		// HTTP requests, so reading r.RemoteAddr will just get us our own
+		// address.
+		return r.Header.Get("X-Forwarded-For")
+	}
+	return r.RemoteAddr
+}
+
 func (s *idpServer) authorize(w http.ResponseWriter, r *http.Request) {
 	// This URL is visited by the user who is being authenticated. If they are
 	// visiting the URL over Funnel, that means they are not part of the
@@ -414,16 +546,19 @@ func (s *idpServer) authorize(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var remoteAddr string
-	if s.localTSMode {
-		// in local tailscaled mode, the local tailscaled is forwarding us
-		// HTTP requests, so reading r.RemoteAddr will just get us our own
-		// address.
-		remoteAddr = r.Header.Get("X-Forwarded-For")
-	} else {
-		remoteAddr = r.RemoteAddr
+	codeChallenge := uq.Get("code_challenge")
+	if codeChallenge != "" {
+		if m := uq.Get("code_challenge_method"); m != "S256" {
+			http.Error(w, "tsidp: code_challenge_method must be S256", http.StatusBadRequest)
+			return
+		}
+		if b, err := base64.RawURLEncoding.DecodeString(codeChallenge); err != nil || len(b) != sha256.Size {
+			http.Error(w, "tsidp: invalid code_challenge", http.StatusBadRequest)
+			return
+		}
 	}
-	who, err := s.lc.WhoIs(r.Context(), remoteAddr)
+
+	who, err := s.lc.WhoIs(r.Context(), s.remoteAddr(r))
 	if err != nil {
 		log.Printf("Error getting WhoIs: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -432,10 +567,12 @@ func (s *idpServer) authorize(w http.ResponseWriter, r *http.Request) {
 
 	code := rands.HexString(32)
 	ar := &authRequest{
-		nonce:       uq.Get("nonce"),
-		remoteUser:  who,
-		redirectURI: redirectURI,
-		clientID:    uq.Get("client_id"),
+		nonce:         uq.Get("nonce"),
+		remoteUser:    who,
+		redirectURI:   redirectURI,
+		clientID:      uq.Get("client_id"),
+		codeChallenge: codeChallenge,
+		grant:         rands.HexString(16),
 	}
 
 	if r.URL.Path == "/authorize/funnel" {
@@ -450,6 +587,10 @@ func (s *idpServer) authorize(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "tsidp: redirect_uri mismatch", http.StatusBadRequest)
 			return
 		}
+		if c.Public && ar.codeChallenge == "" {
+			http.Error(w, "tsidp: code_challenge is required for public clients", http.StatusBadRequest)
+			return
+		}
 		ar.funnelRP = c
 	} else if r.URL.Path == "/authorize/localhost" {
 		ar.localRP = true
@@ -484,6 +625,9 @@ func (s *idpServer) newMux() *http.ServeMux {
 	mux.HandleFunc("/authorize/", s.authorize)
 	mux.HandleFunc("/userinfo", s.serveUserInfo)
 	mux.HandleFunc("/token", s.serveToken)
+	mux.HandleFunc("/introspect", s.serveIntrospect)
+	mux.HandleFunc("/revoke", s.serveRevoke)
+	mux.HandleFunc("/end_session", s.serveEndSession)
 	mux.HandleFunc("/clients/", s.serveClients)
 	mux.HandleFunc("/", s.handleUI)
 	return mux
@@ -507,6 +651,7 @@ func (s *idpServer) serveUserInfo(w http.ResponseWriter, r *http.Request) {
 
 	s.mu.Lock()
 	ar, ok := s.accessToken[tk]
+	ok = ok && !s.revoked.isTokenRevoked(tk, ar)
 	s.mu.Unlock()
 	if !ok {
 		http.Error(w, "tsidp: invalid token", http.StatusBadRequest)
@@ -572,6 +717,10 @@ type userInfo struct {
 type capRule struct {
 	IncludeInUserInfo bool           `json:"includeInUserInfo"`
 	ExtraClaims       map[string]any `json:"extraClaims,omitempty"` // list of features peer is allowed to edit
+
+	// AllowTokenAdmin lets the peer introspect and revoke tokens issued
+	// for any user, rather than only its own.
+	AllowTokenAdmin bool `json:"allowTokenAdmin,omitempty"`
 }
 
 // flattenExtraClaims merges all ExtraClaims from a slice of capRule into a single map.
@@ -708,10 +857,19 @@ func (s *idpServer) serveToken(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "tsidp: method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	if r.FormValue("grant_type") != "authorization_code" {
+	switch r.FormValue("grant_type") {
+	case "authorization_code":
+		s.serveAuthorizationCodeGrant(w, r)
+	case "refresh_token":
+		s.serveRefreshTokenGrant(w, r)
+	case "client_credentials":
+		s.serveClientCredentialsGrant(w, r)
+	default:
 		http.Error(w, "tsidp: grant_type not supported", http.StatusBadRequest)
-		return
 	}
+}
+
+func (s *idpServer) serveAuthorizationCodeGrant(w http.ResponseWriter, r *http.Request) {
 	code := r.FormValue("code")
 	if code == "" {
 		http.Error(w, "tsidp: code is required", http.StatusBadRequest)
@@ -736,6 +894,101 @@ func (s *idpServer) serveToken(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "tsidp: redirect_uri mismatch", http.StatusBadRequest)
 		return
 	}
+	if err := ar.verifyCodeVerifier(r.FormValue("code_verifier")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.issueTokens(w, ar)
+}
+
+func (s *idpServer) serveRefreshTokenGrant(w http.ResponseWriter, r *http.Request) {
+	rt := r.FormValue("refresh_token")
+	if rt == "" {
+		http.Error(w, "tsidp: refresh_token is required", http.StatusBadRequest)
+		return
+	}
+	// Refresh tokens are single use: a successful refresh issues a new one.
+	// The token is also revoked if it is presented by the wrong client, as
+	// recommended by RFC 6749 section 10.4.
+	s.mu.Lock()
+	ar, ok := s.refreshToken[rt]
+	if ok {
+		delete(s.refreshToken, rt)
+		ok = !s.revoked.isTokenRevoked(rt, ar)
+	}
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, "tsidp: invalid refresh_token", http.StatusBadRequest)
+		return
+	}
+	if ar.validTill.Before(time.Now()) {
+		http.Error(w, "tsidp: refresh_token expired", http.StatusBadRequest)
+		return
+	}
+	if cid := r.FormValue("client_id"); cid != "" && cid != ar.clientID {
+		http.Error(w, "tsidp: client_id mismatch", http.StatusForbidden)
+		return
+	}
+	if err := ar.allowRelyingParty(r, s.lc); err != nil {
+		log.Printf("Error allowing relying party: %v", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	// The nonce only belongs in the ID token issued for the original
+	// authentication request (OpenID Connect Core 1.0, section 12.2).
+	ar.nonce = ""
+	s.issueTokens(w, ar)
+}
+
+// serveClientCredentialsGrant issues an access token bound to the identity of
+// the tailnet node making the request. It lets services on the tailnet obtain
+// tokens for themselves without a user in the loop. The client must be a
+// registered confidential client and authenticate with its secret.
+func (s *idpServer) serveClientCredentialsGrant(w http.ResponseWriter, r *http.Request) {
+	if isFunnelRequest(r) {
+		http.Error(w, "tsidp: client_credentials not available over Funnel", http.StatusUnauthorized)
+		return
+	}
+	clientID, clientSecret := clientCredentialsFromRequest(r)
+	s.mu.Lock()
+	c, ok := s.funnelClients[clientID]
+	s.mu.Unlock()
+	if !ok || c.Public || c.Secret == "" || subtle.ConstantTimeCompare([]byte(clientSecret), []byte(c.Secret)) != 1 {
+		http.Error(w, "tsidp: invalid client credentials", http.StatusUnauthorized)
+		return
+	}
+	who, err := s.lc.WhoIs(r.Context(), s.remoteAddr(r))
+	if err != nil {
+		log.Printf("Error getting WhoIs: %v", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	at := rands.HexString(32)
+	s.mu.Lock()
+	mak.Set(&s.accessToken, at, &authRequest{
+		rpNodeID:          who.Node.ID,
+		clientID:          clientID,
+		remoteUser:        who,
+		grant:             rands.HexString(16),
+		clientCredentials: true,
+		validTill:         time.Now().Add(accessTokenTTL),
+	})
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(oidcTokenResponse{
+		AccessToken: at,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(accessTokenTTL.Seconds()),
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// issueTokens mints a new ID token, access token and refresh token for the
+// user authenticated by ar and writes them to w.
+func (s *idpServer) issueTokens(w http.ResponseWriter, ar *authRequest) {
 	signer, err := s.oidcSigner()
 	if err != nil {
 		log.Printf("Error getting signer: %v", err)
@@ -758,7 +1011,7 @@ func (s *idpServer) serveToken(w http.ResponseWriter, r *http.Request) {
 	tsClaims := tailscaleClaims{
 		Claims: jwt.Claims{
 			Audience:  jwt.Audience{ar.clientID},
-			Expiry:    jwt.NewNumericDate(now.Add(5 * time.Minute)),
+			Expiry:    jwt.NewNumericDate(now.Add(accessTokenTTL)),
 			ID:        jti,
 			IssuedAt:  jwt.NewNumericDate(now),
 			Issuer:    s.serverURL,
@@ -801,25 +1054,34 @@ func (s *idpServer) serveToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The access and refresh tokens get their own copies of ar so that
+	// their expiry times are tracked independently.
+	atr := *ar
+	atr.validTill = now.Add(accessTokenTTL)
+	rtr := *ar
+	rtr.validTill = now.Add(refreshTokenTTL)
+
 	at := rands.HexString(32)
+	rt := rands.HexString(32)
 	s.mu.Lock()
-	ar.validTill = now.Add(5 * time.Minute)
-	mak.Set(&s.accessToken, at, ar)
+	mak.Set(&s.accessToken, at, &atr)
+	mak.Set(&s.refreshToken, rt, &rtr)
 	s.mu.Unlock()
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(oidcTokenResponse{
-		AccessToken: at,
-		TokenType:   "Bearer",
-		ExpiresIn:   5 * 60,
-		IDToken:     token,
+		AccessToken:  at,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(accessTokenTTL.Seconds()),
+		IDToken:      token,
+		RefreshToken: rt,
 	}); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
 type oidcTokenResponse struct {
-	IDToken      string `json:"id_token"`
+	IDToken      string `json:"id_token,omitempty"`
 	TokenType    string `json:"token_type"`
 	AccessToken  string `json:"access_token"`
 	RefreshToken string `json:"refresh_token,omitempty"`
@@ -831,76 +1093,30 @@ type oidcTokenResponse struct {
 	oidcConfigPath = "/.well-known/openid-configuration"
 )
 
-func (s *idpServer) oidcSigner() (jose.Signer, error) {
-	return s.lazySigner.GetErr(func() (jose.Signer, error) {
-		sk, err := s.oidcPrivateKey()
-		if err != nil {
-			return nil, err
-		}
-		return jose.NewSigner(jose.SigningKey{
-			Algorithm: jose.RS256,
-			Key:       sk.k,
-		}, &jose.SignerOptions{EmbedJWK: false, ExtraHeaders: map[jose.HeaderKey]any{
-			jose.HeaderType: "JWT",
-			"kid":           fmt.Sprint(sk.kid),
-		}})
-	})
-}
-
-func (s *idpServer) oidcPrivateKey() (*signingKey, error) {
-	return s.lazySigningKey.GetErr(func() (*signingKey, error) {
-		keyPath, err := getConfigFilePath(s.rootPath, oidcKeyFile)
-		if err != nil {
-			return nil, fmt.Errorf("could not get OIDC key file path: %w", err)
-		}
-		var sk signingKey
-		b, err := os.ReadFile(keyPath)
-		if err == nil {
-			if err := sk.UnmarshalJSON(b); err == nil {
-				return &sk, nil
-			} else {
-				log.Printf("Error unmarshaling key: %v", err)
-			}
-		}
-		id, k := mustGenRSAKey(2048)
-		sk.k = k
-		sk.kid = id
-		b, err = sk.MarshalJSON()
-		if err != nil {
-			log.Fatalf("Error marshaling key: %v", err)
-		}
-		if err := os.WriteFile(keyPath, b, 0600); err != nil {
-			log.Fatalf("Error writing key: %v", err)
-		}
-		return &sk, nil
-	})
-}
-
 func (s *idpServer) serveJWKS(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path != oidcJWKSPath {
 		http.Error(w, "tsidp: not found", http.StatusNotFound)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	sk, err := s.oidcPrivateKey()
+	keys, err := s.publishedSigningKeys()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	// TODO(maisem): maybe only marshal this once and reuse?
-	// TODO(maisem): implement key rotation.
+	var jwks jose.JSONWebKeySet
+	for _, sk := range keys {
+		jwks.Keys = append(jwks.Keys, jose.JSONWebKey{
+			Key:       sk.k.Public(),
+			Algorithm: string(jose.RS256),
+			Use:       "sig",
+			KeyID:     sk.keyID(),
+		})
+	}
 	je := json.NewEncoder(w)
 	je.SetIndent("", "  ")
-	if err := je.Encode(jose.JSONWebKeySet{
-		Keys: []jose.JSONWebKey{
-			{
-				Key:       sk.k.Public(),
-				Algorithm: string(jose.RS256),
-				Use:       "sig",
-				KeyID:     fmt.Sprint(sk.kid),
-			},
-		},
-	}); err != nil {
+	if err := je.Encode(jwks); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
@@ -917,7 +1133,12 @@ type openIDProviderMetadata struct {
 	ResponseTypesSupported           views.Slice[string] `json:"response_types_supported"`
 	SubjectTypesSupported            views.Slice[string] `json:"subject_types_supported"`
 	ClaimsSupported                  views.Slice[string] `json:"claims_supported"`
+	IntrospectionEndpoint            string              `json:"introspection_endpoint,omitempty"`
+	RevocationEndpoint               string              `json:"revocation_endpoint,omitempty"`
+	EndSessionEndpoint               string              `json:"end_session_endpoint,omitempty"`
 	IDTokenSigningAlgValuesSupported views.Slice[string] `json:"id_token_signing_alg_values_supported"`
+	GrantTypesSupported              views.Slice[string] `json:"grant_types_supported,omitempty"`
+	CodeChallengeMethodsSupported    views.Slice[string] `json:"code_challenge_methods_supported,omitempty"`
 	// TODO(maisem): maybe add other fields?
 	// Currently we fill out the REQUIRED fields, scopes_supported and claims_supported.
 }
@@ -963,6 +1184,12 @@ type tailscaleClaims struct {
 	// The algo used for signing. The OpenID spec says "The algorithm RS256 MUST be included."
 	// https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderMetadata
 	openIDSupportedSigningAlgos = views.SliceOf([]string{string(jose.RS256)})
+
+	// The grant types accepted by the token endpoint.
+	openIDSupportedGrantTypes = views.SliceOf([]string{"authorization_code", "refresh_token", "client_credentials"})
+
+	// PKCE code challenge methods. We deliberately do not support "plain".
+	openIDSupportedCodeChallengeMethods = views.SliceOf([]string{"S256"})
 )
 
 func (s *idpServer) serveOpenIDConfig(w http.ResponseWriter, r *http.Request) {
@@ -1011,11 +1238,16 @@ func (s *idpServer) serveOpenIDConfig(w http.ResponseWriter, r *http.Request) {
 		JWKS_URI:                         rpEndpoint + oidcJWKSPath,
 		UserInfoEndpoint:                 rpEndpoint + "/userinfo",
 		TokenEndpoint:                    rpEndpoint + "/token",
+		IntrospectionEndpoint:            rpEndpoint + "/introspect",
+		RevocationEndpoint:               rpEndpoint + "/revoke",
+		EndSessionEndpoint:               rpEndpoint + "/end_session",
 		ScopesSupported:                  openIDSupportedScopes,
 		ResponseTypesSupported:           openIDSupportedReponseTypes,
 		SubjectTypesSupported:            openIDSupportedSubjectTypes,
 		ClaimsSupported:                  openIDSupportedClaims,
 		IDTokenSigningAlgValuesSupported: openIDSupportedSigningAlgos,
+		GrantTypesSupported:              openIDSupportedGrantTypes,
+		CodeChallengeMethodsSupported:    openIDSupportedCodeChallengeMethods,
 	}); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
@@ -1028,6 +1260,15 @@ type funnelClient struct {
 	Secret      string `json:"client_secret,omitempty"`
 	Name        string `json:"name,omitempty"`
 	RedirectURI string `json:"redirect_uri"`
+
+	// PostLogoutRedirectURIs are the URIs the client may ask to have the
+	// user sent to after logging out, with post_logout_redirect_uri.
+	PostLogoutRedirectURIs []string `json:"post_logout_redirect_uris,omitempty"`
+
+	// Public is whether the client is a public client (RFC 6749 section
+	// 2.1) that cannot keep a secret, such as a single-page or native app.
+	// Public clients have no secret and must use PKCE.
+	Public bool `json:"public,omitempty"`
 }
 
 // /clients is a privileged endpoint that allows the visitor to create new
@@ -1063,10 +1304,12 @@ func (s *idpServer) serveClients(w http.ResponseWriter, r *http.Request) {
 		s.serveDeleteClient(w, r, path)
 	case "GET":
 		json.NewEncoder(w).Encode(&funnelClient{
-			ID:          c.ID,
-			Name:        c.Name,
-			Secret:      "",
-			RedirectURI: c.RedirectURI,
+			ID:                     c.ID,
+			Name:                   c.Name,
+			Secret:                 "",
+			RedirectURI:            c.RedirectURI,
+			PostLogoutRedirectURIs: c.PostLogoutRedirectURIs,
+			Public:                 c.Public,
 		})
 	default:
 		http.Error(w, "tsidp: method not allowed", http.StatusMethodNotAllowed)
@@ -1083,13 +1326,26 @@ func (s *idpServer) serveNewClient(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "tsidp: must provide redirect_uri", http.StatusBadRequest)
 		return
 	}
+	public := r.FormValue("public") == "true"
 	clientID := rands.HexString(32)
-	clientSecret := rands.HexString(64)
+	var clientSecret string
+	if !public {
+		clientSecret = rands.HexString(64)
+	}
+	postLogoutRedirectURIs := r.Form["post_logout_redirect_uri"]
+	for _, u := range postLogoutRedirectURIs {
+		if errMsg := validateRedirectURI(u); errMsg != "" {
+			http.Error(w, "tsidp: invalid post_logout_redirect_uri: "+errMsg, http.StatusBadRequest)
+			return
+		}
+	}
 	newClient := funnelClient{
-		ID:          clientID,
-		Secret:      clientSecret,
-		Name:        r.FormValue("name"),
-		RedirectURI: redirectURI,
+		ID:                     clientID,
+		Secret:                 clientSecret,
+		Name:                   r.FormValue("name"),
+		RedirectURI:            redirectURI,
+		PostLogoutRedirectURIs: postLogoutRedirectURIs,
+		Public:                 public,
 	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -1114,10 +1370,12 @@ func (s *idpServer) serveGetClientsList(w http.ResponseWriter, r *http.Request)
 	redactedClients := make([]funnelClient, 0, len(s.funnelClients))
 	for _, c := range s.funnelClients {
 		redactedClients = append(redactedClients, funnelClient{
-			ID:          c.ID,
-			Name:        c.Name,
-			Secret:      "",
-			RedirectURI: c.RedirectURI,
+			ID:                     c.ID,
+			Name:                   c.Name,
+			Secret:                 "",
+			RedirectURI:            c.RedirectURI,
+			PostLogoutRedirectURIs: c.PostLogoutRedirectURIs,
+			Public:                 c.Public,
 		})
 	}
 	s.mu.Unlock()
@@ -1200,13 +1458,27 @@ func readUint64(r io.Reader) (uint64, error) {
 // rsaPrivateKeyJSONWrapper is the the JSON serialization
 // format used by RSAPrivateKey.
 type rsaPrivateKeyJSONWrapper struct {
-	Key string
-	ID  uint64
+	Key      string
+	ID       uint64
+	ActiveAt time.Time `json:",omitzero"`
+	RetireAt time.Time `json:",omitzero"`
 }
 
 type signingKey struct {
 	k   *rsa.PrivateKey
 	kid uint64
+
+	// activeAt is when the key starts being used to sign tokens. Until then
+	// it is only published in the JWKS, so that relying parties can learn
+	// about it ahead of time. The zero value means it was always active.
+	activeAt time.Time
+
+	// retireAt is when the key stops being published in the JWKS, after
+	// all tokens it signed have expired. The zero value means the key has
+	// not been superseded yet.
+	retireAt time.Time
+
+	signer lazy.SyncValue[jose.Signer]
 }
 
 func (sk *signingKey) MarshalJSON() ([]byte, error) {
@@ -1216,8 +1488,10 @@ func (sk *signingKey) MarshalJSON() ([]byte, error) {
 	}
 	bts := pem.EncodeToMemory(&b)
 	return json.Marshal(rsaPrivateKeyJSONWrapper{
-		Key: base64.URLEncoding.EncodeToString(bts),
-		ID:  sk.kid,
+		Key:      base64.URLEncoding.EncodeToString(bts),
+		ID:       sk.kid,
+		ActiveAt: sk.activeAt,
+		RetireAt: sk.retireAt,
 	})
 }
 
@@ -1240,6 +1514,8 @@ func (sk *signingKey) UnmarshalJSON(b []byte) error {
 	}
 	sk.k = k
 	sk.kid = wrapper.ID
+	sk.activeAt = wrapper.ActiveAt
+	sk.retireAt = wrapper.RetireAt
 	return nil
 }
 
@@ -22,7 +22,6 @@
 	"testing"
 	"time"
 
-	"gopkg.in/square/go-jose.v2"
 	"gopkg.in/square/go-jose.v2/jwt"
 	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/tailcfg"
@@ -68,14 +67,9 @@ func mustMarshalJSON(t *testing.T, v any) tailcfg.RawMessage {
 
 var privateKey *rsa.PrivateKey = nil
 
-func oidcTestingSigner(t *testing.T) jose.Signer {
+func oidcTestingSigningKeys(t *testing.T) []*signingKey {
 	t.Helper()
-	privKey := mustGeneratePrivateKey(t)
-	sig, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: privKey}, nil)
-	if err != nil {
-		t.Fatalf("failed to create signer: %v", err)
-	}
-	return sig
+	return []*signingKey{{k: mustGeneratePrivateKey(t), kid: 1}}
 }
 
 func oidcTestingPublicKey(t *testing.T) *rsa.PublicKey {
@@ -587,8 +581,8 @@ func TestServeToken(t *testing.T) {
 					},
 				},
 			}
-			// Inject a working signer
-			s.lazySigner.Set(oidcTestingSigner(t))
+			// Inject a working signing key
+			s.signingKeys = oidcTestingSigningKeys(t)
 
 			form := url.Values{}
 			form.Set("grant_type", tt.grantType)
@@ -963,3 +957,203 @@ func TestFunnelClientsPersistence(t *testing.T) {
 		}
 	})
 }
+
+func TestVerifyCodeVerifier(t *testing.T) {
+	// Example from RFC 7636 Appendix B.
+	const (
+		verifier  = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+		challenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+	)
+	tests := []struct {
+		name      string
+		challenge string
+		verifier  string
+		wantErr   bool
+	}{
+		{name: "no-pkce"},
+		{name: "valid", challenge: challenge, verifier: verifier},
+		{name: "missing-verifier", challenge: challenge, wantErr: true},
+		{name: "wrong-verifier", challenge: challenge, verifier: strings.Repeat("a", 43), wantErr: true},
+		{name: "short-verifier", challenge: challenge, verifier: "abc", wantErr: true},
+		{name: "verifier-without-challenge", verifier: verifier, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ar := &authRequest{codeChallenge: tt.challenge}
+			err := ar.verifyCodeVerifier(tt.verifier)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifyCodeVerifier = %v; wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRefreshTokenGrant(t *testing.T) {
+	remoteUser := &apitype.WhoIsResponse{
+		Node: &tailcfg.Node{
+			ID:   123,
+			Name: "test-node.test.ts.net.",
+			User: 456,
+		},
+		UserProfile: &tailcfg.UserProfile{
+			LoginName: "alice@example.com",
+		},
+	}
+	s := &idpServer{
+		code: map[string]*authRequest{
+			"valid-code": {
+				clientID:    "client-id",
+				nonce:       "the-nonce",
+				redirectURI: "https://rp.example.com/callback",
+				remoteUser:  remoteUser,
+				localRP:     true,
+			},
+		},
+	}
+	s.signingKeys = oidcTestingSigningKeys(t)
+	nonce := func(idToken string) string {
+		t.Helper()
+		tok, err := jwt.ParseSigned(idToken)
+		if err != nil {
+			t.Fatalf("failed to parse ID token: %v", err)
+		}
+		var claims tailscaleClaims
+		if err := tok.Claims(oidcTestingPublicKey(t), &claims); err != nil {
+			t.Fatalf("failed to extract claims: %v", err)
+		}
+		return claims.Nonce
+	}
+
+	doToken := func(form url.Values) (*httptest.ResponseRecorder, oidcTokenResponse) {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+		req.RemoteAddr = "127.0.0.1:12345"
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		s.serveToken(rr, req)
+		var resp oidcTokenResponse
+		if rr.Code == http.StatusOK {
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed to unmarshal response: %v", err)
+			}
+		}
+		return rr, resp
+	}
+
+	rr, first := doToken(url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {"valid-code"},
+		"redirect_uri": {"https://rp.example.com/callback"},
+	})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("authorization_code: got %d: %s", rr.Code, rr.Body.String())
+	}
+	if first.RefreshToken == "" {
+		t.Fatal("authorization_code: no refresh_token issued")
+	}
+
+	rr, second := doToken(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {first.RefreshToken},
+	})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("refresh_token: got %d: %s", rr.Code, rr.Body.String())
+	}
+	if second.RefreshToken == "" || second.RefreshToken == first.RefreshToken {
+		t.Errorf("refresh_token was not rotated: %q", second.RefreshToken)
+	}
+	if second.IDToken == "" || second.AccessToken == "" {
+		t.Fatalf("refresh_token: missing tokens in response: %+v", second)
+	}
+	if got := nonce(first.IDToken); got != "the-nonce" {
+		t.Errorf("authorization_code: nonce = %q, want %q", got, "the-nonce")
+	}
+	if got := nonce(second.IDToken); got != "" {
+		t.Errorf("refresh_token: nonce = %q, want none", got)
+	}
+
+	// The old refresh token must no longer work.
+	if rr, _ := doToken(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {first.RefreshToken},
+	}); rr.Code == http.StatusOK {
+		t.Error("reusing rotated refresh_token succeeded")
+	}
+
+	// Presenting the token as a different client revokes it.
+	if rr, _ := doToken(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {second.RefreshToken},
+		"client_id":     {"other-client"},
+	}); rr.Code == http.StatusOK {
+		t.Error("refresh_token accepted for wrong client_id")
+	}
+	if rr, _ := doToken(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {second.RefreshToken},
+	}); rr.Code == http.StatusOK {
+		t.Error("refresh_token still valid after presentation by wrong client")
+	}
+}
+
+func TestExpireTokens(t *testing.T) {
+	now := time.Now()
+	s := &idpServer{
+		accessToken: map[string]*authRequest{
+			"expired": {validTill: now.Add(-time.Second)},
+			"valid":   {validTill: now.Add(time.Minute)},
+		},
+		refreshToken: map[string]*authRequest{
+			"expired": {validTill: now.Add(-time.Second)},
+			"valid":   {validTill: now.Add(refreshTokenTTL)},
+		},
+	}
+	s.expireTokens(now)
+	for name, m := range map[string]map[string]*authRequest{"access": s.accessToken, "refresh": s.refreshToken} {
+		if _, ok := m["expired"]; ok {
+			t.Errorf("expired %s token not deleted", name)
+		}
+		if _, ok := m["valid"]; !ok {
+			t.Errorf("valid %s token deleted", name)
+		}
+	}
+}
+
+func TestClientCredentialsGrant(t *testing.T) {
+	s := &idpServer{
+		funnelClients: map[string]*funnelClient{
+			"confidential": {ID: "confidential", Secret: "secret"},
+			"public":       {ID: "public", Public: true},
+		},
+	}
+	tests := []struct {
+		name         string
+		clientID     string
+		clientSecret string
+	}{
+		{name: "no-client"},
+		{name: "unknown-client", clientID: "unknown", clientSecret: "secret"},
+		{name: "missing-secret", clientID: "confidential"},
+		{name: "wrong-secret", clientID: "confidential", clientSecret: "wrong"},
+		{name: "public-client", clientID: "public"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{
+				"grant_type":    {"client_credentials"},
+				"client_id":     {tt.clientID},
+				"client_secret": {tt.clientSecret},
+			}
+			req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rr := httptest.NewRecorder()
+			s.serveToken(rr, req)
+			if rr.Code != http.StatusUnauthorized {
+				t.Errorf("got %d, want %d: %s", rr.Code, http.StatusUnauthorized, rr.Body.String())
+			}
+			if len(s.accessToken) != 0 {
+				t.Errorf("access token issued")
+			}
+		})
+	}
+}
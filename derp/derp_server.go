@@ -29,6 +29,7 @@
 	"os"
 	"os/exec"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -37,6 +38,7 @@
 
 	"go4.org/mem"
 	"golang.org/x/sync/errgroup"
+	xrate "golang.org/x/time/rate"
 	"tailscale.com/client/local"
 	"tailscale.com/client/tailscale"
 	"tailscale.com/derp/derpconst"
@@ -134,13 +136,21 @@ type Server struct {
 	publicKey   key.NodePublic
 	logf        logger.Logf
 	memSys0     uint64 // runtime.MemStats.Sys at start (or early-ish)
-	meshKey     key.DERPMesh
 	limitedLogf logger.Logf
 	metaCert    []byte // the encoded x509 cert to send after LetsEncrypt cert+intermediate
 	dupPolicy   dupPolicy
 	debug       bool
 	localClient local.Client
 
+	// meshKeyMu guards the mesh keys, which may change while serving.
+	// The previous key is still accepted from mesh peers until
+	// prevMeshKeyExpiry; see RotateMeshKey.
+	meshKeyMu         sync.Mutex
+	meshKey           key.DERPMesh
+	prevMeshKey       key.DERPMesh
+	prevMeshKeyExpiry time.Time
+	prevMeshKeyTimer  tstime.TimerController // closes prevMeshKey conns at expiry, or nil
+
 	// Counters:
 	packetsSent, bytesSent     expvar.Int
 	packetsRecv, bytesRecv     expvar.Int
@@ -168,6 +178,7 @@ type Server struct {
 	multiForwarderDeleted      expvar.Int
 	removePktForwardOther      expvar.Int
 	sclientWriteTimeouts       expvar.Int
+	rateLimitedClients         expvar.Int       // current number of clients with rate limiters
 	avgQueueDuration           *uint64          // In milliseconds; accessed atomically
 	tcpRtt                     metrics.LabelMap // histogram
 	meshUpdateBatchSize        *metrics.Histogram
@@ -205,6 +216,18 @@ type Server struct {
 	// Sets the client send queue depth for the server.
 	perClientSendQueueDepth int
 
+	// Per-client (by node key) limits on the traffic that non-mesh
+	// clients may send through the server. Zero rates mean unlimited.
+	clientBytesPerSec   xrate.Limit
+	clientBytesBurst    int
+	clientPacketsPerSec xrate.Limit
+	clientPacketsBurst  int
+
+	// fairQueuing is whether to queue non-disco packets to each client
+	// per source, serving sources round-robin, instead of in a single
+	// FIFO queue.
+	fairQueuing bool
+
 	tcpWriteTimeout time.Duration
 
 	clock tstime.Clock
@@ -243,6 +266,14 @@ type clientSet struct {
 	//
 	// dup is guarded by Server.mu.
 	dup *dupClientSet
+
+	// sendLim, if non-nil, limits the rate at which all connections for
+	// the public key may send packets. It is shared across connections so
+	// that reconnecting or connecting multiple times doesn't increase a
+	// client's allowance.
+	//
+	// sendLim is guarded by Server.mu.
+	sendLim *clientSendLimiter
 }
 
 // Len returns the number of clients in s, which can be
@@ -443,6 +474,7 @@ func genDroppedCounters() {
 		dropReasonQueueTail,
 		dropReasonWriteError,
 		dropReasonDupClient,
+		dropReasonRateLimited,
 	}
 
 	for _, dr := range dropReasons {
@@ -473,6 +505,58 @@ func (s *Server) SetMeshKey(v string) error {
 	return nil
 }
 
+// RotateMeshKey replaces the mesh key with v. Mesh peers presenting the
+// previous key are still accepted for the given grace period, so that the
+// servers in a region need not all switch keys at the same instant.
+//
+// Unlike SetMeshKey, it may be called while serving. Mesh connections that
+// are already established keep working until the grace period ends, at
+// which point those still authenticated with the previous key are closed.
+func (s *Server) RotateMeshKey(v string, grace time.Duration) error {
+	k, err := key.ParseDERPMesh(v)
+	if err != nil {
+		return err
+	}
+	s.meshKeyMu.Lock()
+	if k.Equal(s.meshKey) {
+		s.meshKeyMu.Unlock()
+		return nil
+	}
+	s.prevMeshKey = s.meshKey
+	s.prevMeshKeyExpiry = s.clock.Now().Add(grace)
+	s.meshKey = k
+	if s.prevMeshKeyTimer != nil {
+		s.prevMeshKeyTimer.Stop()
+		s.prevMeshKeyTimer = nil
+	}
+	if grace > 0 {
+		s.prevMeshKeyTimer = s.clock.AfterFunc(grace, s.closeStaleMeshConns)
+	}
+	s.meshKeyMu.Unlock()
+
+	if grace <= 0 {
+		s.closeStaleMeshConns()
+	}
+	return nil
+}
+
+// closeStaleMeshConns closes the connections of mesh peers that are not
+// using the current mesh key. It runs when the previous key's grace period
+// ends.
+func (s *Server) closeStaleMeshConns() {
+	meshKey := s.MeshKey()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, cs := range s.clients {
+		cs.ForeachClient(func(c *sclient) {
+			if c.canMesh && !c.info.MeshKey.Equal(meshKey) {
+				c.logf("closing mesh connection using an expired mesh key")
+				c.nc.Close()
+			}
+		})
+	}
+}
+
 // SetVerifyClients sets whether this DERP server verifies clients through tailscaled.
 //
 // It must be called before serving begins.
@@ -510,11 +594,48 @@ func (s *Server) SetTCPWriteTimeout(d time.Duration) {
 	s.tcpWriteTimeout = d
 }
 
+// SetPerClientRateLimit sets the rate, in bytes per second, at which each
+// client (by node key) may send packets through the server, and the burst
+// size in bytes. Packets in excess of the limit are dropped. A burst smaller
+// than MaxPacketSize is rounded up to it. A rate of zero, the default,
+// disables the limit. Mesh peers are never limited.
+//
+// It must be called before serving begins.
+func (s *Server) SetPerClientRateLimit(bytesPerSec float64, burst int) {
+	s.clientBytesPerSec = xrate.Limit(bytesPerSec)
+	s.clientBytesBurst = max(burst, MaxPacketSize)
+}
+
+// SetPerClientPacketRateLimit sets the rate, in packets per second, at which
+// each client (by node key) may send packets through the server, and the
+// burst size in packets. Packets in excess of the limit are dropped. A rate
+// of zero, the default, disables the limit. Mesh peers are never limited.
+//
+// It must be called before serving begins.
+func (s *Server) SetPerClientPacketRateLimit(packetsPerSec float64, burst int) {
+	s.clientPacketsPerSec = xrate.Limit(packetsPerSec)
+	s.clientPacketsBurst = max(burst, 1)
+}
+
+// SetFairQueuing sets whether packets queued to each client are served
+// round-robin by source, so that a single busy sender cannot starve others
+// sending to the same client. Disco packets have their own queue and are not
+// affected.
+//
+// It must be called before serving begins.
+func (s *Server) SetFairQueuing(v bool) {
+	s.fairQueuing = v
+}
+
 // HasMeshKey reports whether the server is configured with a mesh key.
-func (s *Server) HasMeshKey() bool { return !s.meshKey.IsZero() }
+func (s *Server) HasMeshKey() bool { return !s.MeshKey().IsZero() }
 
 // MeshKey returns the configured mesh key, if any.
-func (s *Server) MeshKey() key.DERPMesh { return s.meshKey }
+func (s *Server) MeshKey() key.DERPMesh {
+	s.meshKeyMu.Lock()
+	defer s.meshKeyMu.Unlock()
+	return s.meshKey
+}
 
 // PrivateKey returns the server's private key.
 func (s *Server) PrivateKey() key.NodePrivate { return s.privateKey }
@@ -709,6 +830,14 @@ func (s *Server) registerClient(c *sclient) {
 
 	cs.activeClient.Store(c)
 
+	if cs.sendLim == nil && !c.canMesh {
+		cs.sendLim = s.newClientSendLimiter()
+		if cs.sendLim != nil {
+			s.rateLimitedClients.Add(1)
+		}
+	}
+	c.sendLim = cs.sendLim
+
 	if _, ok := s.clientsMesh[c.key]; !ok {
 		s.clientsMesh[c.key] = nil // just for varz of total users in cluster
 	}
@@ -763,6 +892,9 @@ func (s *Server) unregisterClient(c *sclient) {
 		c.debugLogf("removed connection")
 		set.activeClient.Store(nil)
 		delete(s.clients, c.key)
+		if set.sendLim != nil {
+			s.rateLimitedClients.Add(-1)
+		}
 		if v, ok := s.clientsMesh[c.key]; ok && v == nil {
 			delete(s.clientsMesh, c.key)
 			s.notePeerGoneFromRegionLocked(c.key)
@@ -957,6 +1089,9 @@ func (s *Server) accept(ctx context.Context, nc Conn, brw *bufio.ReadWriter, rem
 		peerGoneLim:    rate.NewLimiter(rate.Every(time.Second), 3),
 	}
 
+	if s.fairQueuing {
+		c.fairSendQueue = newFairQueue(s.perClientSendQueueDepth)
+	}
 	if c.canMesh {
 		c.meshUpdate = make(chan struct{}, 1) // must be buffered; >1 is fine but wasteful
 	}
@@ -1187,6 +1322,12 @@ func (c *sclient) handleFrameSendPacket(ft frameType, fl uint32) error {
 		return fmt.Errorf("client %v: recvPacket: %v", c.key, err)
 	}
 
+	if !c.sendLim.allow(s.clock.Now(), len(contents)) {
+		s.recordDrop(contents, c.key, dstKey, dropReasonRateLimited)
+		c.debugLogf("SendPacket for %s, dropping; rate limited", dstKey.ShortString())
+		return nil
+	}
+
 	var fwd PacketForwarder
 	var dstLen int
 	var dst *sclient
@@ -1254,6 +1395,7 @@ type dropReasonKindLabels struct {
 	dropReasonQueueTail        dropReason = "queue_tail"          // destination queue is full, dropped packet at queue tail
 	dropReasonWriteError       dropReason = "write_error"         // OS write() failed
 	dropReasonDupClient        dropReason = "dup_client"          // the public key is connected 2+ times (active/active, fighting)
+	dropReasonRateLimited      dropReason = "rate_limited"        // the sending client exceeded its per-client rate limit
 )
 
 func (s *Server) recordDrop(packetBytes []byte, srcKey, dstKey key.NodePublic, reason dropReason) {
@@ -1290,6 +1432,19 @@ func (c *sclient) sendPkt(dst *sclient, p pkt) error {
 	sendQueue := dst.sendQueue
 	if disco.LooksLikeDiscoWrapper(p.bs) {
 		sendQueue = dst.discoSendQueue
+	} else if dst.fairSendQueue != nil {
+		select {
+		case <-dst.done:
+			s.recordDrop(p.bs, c.key, dstKey, dropReasonGoneDisconnected)
+			dst.debugLogf("sendPkt dropped, dst gone")
+			return nil
+		default:
+		}
+		if dropped, ok := dst.fairSendQueue.enqueue(p); ok {
+			s.recordDrop(dropped.bs, dropped.src, dstKey, dropReasonQueueHead)
+			c.recordQueueTime(dropped.enqueuedAt)
+		}
+		return nil
 	}
 	for attempt := 0; attempt < 3; attempt++ {
 		select {
@@ -1368,7 +1523,14 @@ func (s *Server) isMeshPeer(info *clientInfo) bool {
 		return false
 	}
 
-	return s.meshKey.Equal(info.MeshKey)
+	s.meshKeyMu.Lock()
+	defer s.meshKeyMu.Unlock()
+	if s.meshKey.Equal(info.MeshKey) {
+		return true
+	}
+	return !s.prevMeshKey.IsZero() &&
+		s.clock.Now().Before(s.prevMeshKeyExpiry) &&
+		s.prevMeshKey.Equal(info.MeshKey)
 }
 
 // verifyClient checks whether the client is allowed to connect to the derper,
@@ -1635,6 +1797,7 @@ type sclient struct {
 	remoteIPPort   netip.AddrPort   // zero if remoteAddr is not ip:port.
 	sendQueue      chan pkt         // packets queued to this client; never closed
 	discoSendQueue chan pkt         // important packets queued to this client; never closed
+	fairSendQueue  *fairQueue       // if non-nil, used instead of sendQueue
 	sendPongCh     chan [8]byte     // pong replies to send to the client; never closed
 	peerGone       chan peerGoneMsg // write request that a peer is not at this server (not used by mesh peers)
 	meshUpdate     chan struct{}    // write request to write peerStateChange
@@ -1665,6 +1828,10 @@ type sclient struct {
 	// client that it's trying to establish a direct connection
 	// through us with a peer we have no record of.
 	peerGoneLim *rate.Limiter
+
+	// sendLim is the clientSet's sendLim, set at registration. It is nil
+	// if the client is not rate limited.
+	sendLim *clientSendLimiter
 }
 
 func (c *sclient) presentFlags() PeerPresentFlags {
@@ -1713,6 +1880,140 @@ type peerGoneMsg struct {
 	reason PeerGoneReasonType
 }
 
+// clientSendLimiter limits the rate at which a client may send packets
+// through the server, in both bytes and packets.
+type clientSendLimiter struct {
+	bytes   *xrate.Limiter // or nil if unlimited
+	packets *xrate.Limiter // or nil if unlimited
+}
+
+// newClientSendLimiter returns a new limiter according to the server's
+// configured per-client limits, or nil if clients are not limited.
+func (s *Server) newClientSendLimiter() *clientSendLimiter {
+	if s.clientBytesPerSec == 0 && s.clientPacketsPerSec == 0 {
+		return nil
+	}
+	l := new(clientSendLimiter)
+	if s.clientBytesPerSec != 0 {
+		l.bytes = xrate.NewLimiter(s.clientBytesPerSec, s.clientBytesBurst)
+	}
+	if s.clientPacketsPerSec != 0 {
+		l.packets = xrate.NewLimiter(s.clientPacketsPerSec, s.clientPacketsBurst)
+	}
+	return l
+}
+
+// allow reports whether a packet of n bytes may be sent at time now,
+// consuming from l's allowance if so. A nil limiter allows everything.
+func (l *clientSendLimiter) allow(now time.Time, n int) bool {
+	if l == nil {
+		return true
+	}
+	if l.packets != nil && !l.packets.AllowN(now, 1) {
+		return false
+	}
+	if l.bytes != nil && !l.bytes.AllowN(now, n) {
+		return false
+	}
+	return true
+}
+
+// fairQueue is a bounded queue of packets to a single client that serves
+// packets from each source round-robin, so that a single busy source cannot
+// monopolize the destination's queue. When full, it drops the oldest packet
+// of the source with the most packets queued.
+type fairQueue struct {
+	// ready has a value buffered whenever the queue may be non-empty.
+	// The sender should receive from it and then call dequeue.
+	ready chan struct{}
+
+	mu    sync.Mutex
+	max   int                      // maximum number of queued packets
+	n     int                      // number of queued packets
+	bySrc map[key.NodePublic][]pkt // non-empty queues by source
+	order []key.NodePublic         // round-robin order of keys in bySrc
+}
+
+func newFairQueue(max int) *fairQueue {
+	return &fairQueue{
+		ready: make(chan struct{}, 1),
+		max:   max,
+		bySrc: map[key.NodePublic][]pkt{},
+	}
+}
+
+// signalLocked marks q as ready, if it isn't already. q.mu must be held.
+func (q *fairQueue) signalLocked() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// enqueue adds p to q. If q was full, it returns the packet that was dropped
+// to make room and true.
+func (q *fairQueue) enqueue(p pkt) (dropped pkt, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.n >= q.max {
+		var longest key.NodePublic
+		for _, src := range q.order {
+			if len(q.bySrc[src]) > len(q.bySrc[longest]) {
+				longest = src
+			}
+		}
+		dropped, ok = q.popLocked(longest)
+	}
+	sq, had := q.bySrc[p.src]
+	if !had {
+		q.order = append(q.order, p.src)
+	}
+	q.bySrc[p.src] = append(sq, p)
+	q.n++
+	q.signalLocked()
+	return dropped, ok
+}
+
+// dequeue removes and returns the next packet to send, moving its source to
+// the back of the round-robin order. It reports false if q is empty.
+func (q *fairQueue) dequeue() (p pkt, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.order) == 0 {
+		return p, false
+	}
+	src := q.order[0]
+	p, ok = q.popLocked(src)
+	if _, more := q.bySrc[src]; more {
+		q.order = append(q.order[1:], src)
+	}
+	if q.n > 0 {
+		q.signalLocked()
+	}
+	return p, ok
+}
+
+// popLocked removes the oldest packet from src's queue, removing src
+// entirely if that empties it. q.mu must be held.
+func (q *fairQueue) popLocked(src key.NodePublic) (p pkt, ok bool) {
+	sq := q.bySrc[src]
+	if len(sq) == 0 {
+		return p, false
+	}
+	p = sq[0]
+	sq[0] = pkt{} // release memory
+	q.n--
+	if len(sq) > 1 {
+		q.bySrc[src] = sq[1:]
+		return p, true
+	}
+	delete(q.bySrc, src)
+	if i := slices.Index(q.order, src); i >= 0 {
+		q.order = slices.Delete(q.order, i, i+1)
+	}
+	return p, true
+}
+
 func (c *sclient) setPreferred(v bool) {
 	if c.preferred == v {
 		return
@@ -1772,6 +2073,15 @@ func (c *sclient) onSendLoopDone() {
 	}
 
 	// Drain the send queue to count dropped packets
+	if c.fairSendQueue != nil {
+		for {
+			pkt, ok := c.fairSendQueue.dequeue()
+			if !ok {
+				break
+			}
+			c.s.recordDrop(pkt.bs, pkt.src, c.key, dropReasonGoneDisconnected)
+		}
+	}
 	for {
 		select {
 		case pkt := <-c.sendQueue:
@@ -1792,6 +2102,11 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 	keepAliveTick, keepAliveTickChannel := c.s.clock.NewTicker(KeepAlive + jitter)
 	defer keepAliveTick.Stop()
 
+	var fairReady <-chan struct{} // nil (blocks forever) unless fair queuing
+	if c.fairSendQueue != nil {
+		fairReady = c.fairSendQueue.ready
+	}
+
 	var werr error // last write error
 	inBatch := -1  // for bufferedWriteFrames
 	for {
@@ -1818,6 +2133,9 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 			werr = c.sendPacket(msg.src, msg.bs)
 			c.recordQueueTime(msg.enqueuedAt)
 			continue
+		case <-fairReady:
+			werr = c.sendFairQueued()
+			continue
 		case msg := <-c.sendPongCh:
 			werr = c.sendPong(msg)
 			continue
@@ -1850,6 +2168,8 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 		case msg := <-c.discoSendQueue:
 			werr = c.sendPacket(msg.src, msg.bs)
 			c.recordQueueTime(msg.enqueuedAt)
+		case <-fairReady:
+			werr = c.sendFairQueued()
 		case msg := <-c.sendPongCh:
 			werr = c.sendPong(msg)
 		case <-keepAliveTickChannel:
@@ -1858,6 +2178,18 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 	}
 }
 
+// sendFairQueued sends the next packet from c.fairSendQueue, if any, without
+// flushing.
+func (c *sclient) sendFairQueued() error {
+	msg, ok := c.fairSendQueue.dequeue()
+	if !ok {
+		return nil
+	}
+	err := c.sendPacket(msg.src, msg.bs)
+	c.recordQueueTime(msg.enqueuedAt)
+	return err
+}
+
 func (c *sclient) setWriteDeadline() {
 	d := c.s.tcpWriteTimeout
 	if c.canMesh {
@@ -2220,6 +2552,7 @@ func (s *Server) ExpVar() expvar.Var {
 	m.Set("multiforwarder_deleted", &s.multiForwarderDeleted)
 	m.Set("packet_forwarder_delete_other_value", &s.removePktForwardOther)
 	m.Set("sclient_write_timeouts", &s.sclientWriteTimeouts)
+	m.Set("gauge_rate_limited_clients", &s.rateLimitedClients)
 	m.Set("average_queue_duration_ms", expvar.Func(func() any {
 		return math.Float64frombits(atomic.LoadUint64(s.avgQueueDuration))
 	}))
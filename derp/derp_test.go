@@ -22,6 +22,7 @@
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -1353,6 +1354,84 @@ func TestLimiter(t *testing.T) {
 	}
 }
 
+func TestFairQueue(t *testing.T) {
+	noisy, quiet := pubAll(1), pubAll(2)
+	q := newFairQueue(4)
+
+	// The noisy source fills the queue.
+	for i := range 4 {
+		if _, dropped := q.enqueue(pkt{src: noisy, bs: []byte{byte(i)}}); dropped {
+			t.Fatalf("unexpected drop enqueuing noisy packet %d", i)
+		}
+	}
+	// A packet from the quiet source evicts the noisy source's oldest.
+	dropped, ok := q.enqueue(pkt{src: quiet, bs: []byte{100}})
+	if !ok || dropped.src != noisy || dropped.bs[0] != 0 {
+		t.Fatalf("enqueue dropped %v, %v; want noisy packet 0", dropped, ok)
+	}
+
+	// Sources are served round-robin.
+	var got []byte
+	for {
+		select {
+		case <-q.ready:
+		default:
+			t.Fatalf("queue not ready with %d packets left", q.n)
+		}
+		p, ok := q.dequeue()
+		if !ok {
+			t.Fatal("dequeue failed on ready queue")
+		}
+		got = append(got, p.bs[0])
+		if q.n == 0 {
+			break
+		}
+	}
+	if want := []byte{1, 100, 2, 3}; !bytes.Equal(got, want) {
+		t.Errorf("dequeue order = %v; want %v", got, want)
+	}
+	if _, ok := q.dequeue(); ok {
+		t.Error("dequeue succeeded on empty queue")
+	}
+}
+
+func TestClientSendLimiter(t *testing.T) {
+	s := NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	if l := s.newClientSendLimiter(); l != nil {
+		t.Fatal("got limiter with no limits configured")
+	}
+	var nilLim *clientSendLimiter
+	if !nilLim.allow(time.Now(), MaxPacketSize) {
+		t.Fatal("nil limiter denied packet")
+	}
+
+	s.SetPerClientPacketRateLimit(1, 2)
+	l := s.newClientSendLimiter()
+	now := time.Now()
+	for i := range 2 {
+		if !l.allow(now, 100) {
+			t.Fatalf("packet %d within burst denied", i)
+		}
+	}
+	if l.allow(now, 100) {
+		t.Fatal("packet beyond burst allowed")
+	}
+	if !l.allow(now.Add(time.Second), 100) {
+		t.Fatal("packet after refill denied")
+	}
+
+	s.SetPerClientPacketRateLimit(0, 0)
+	s.SetPerClientRateLimit(1000, 0)
+	l = s.newClientSendLimiter()
+	if !l.allow(now, MaxPacketSize) {
+		t.Fatal("max size packet within burst denied")
+	}
+	if l.allow(now, 1) {
+		t.Fatal("packet beyond byte burst allowed")
+	}
+}
+
 // BenchmarkConcurrentStreams exercises mutex contention on a
 // single Server instance with multiple concurrent client flows.
 func BenchmarkConcurrentStreams(b *testing.B) {
@@ -1707,6 +1786,92 @@ func TestSetMeshKey(t *testing.T) {
 	}
 }
 
+func TestRotateMeshKey(t *testing.T) {
+	const newMeshKey = "6d529e9d4ef632d22d4a4214cb49da8f1ba1b72697061fb24e312984c35ec8d8"
+	clock := tstest.NewClock(tstest.ClockOpts{})
+	s := &Server{clock: clock}
+	if err := s.SetMeshKey(testMeshKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RotateMeshKey(newMeshKey, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.MeshKey().String(); got != newMeshKey {
+		t.Errorf("MeshKey = %v; want %v", got, newMeshKey)
+	}
+
+	isMeshPeer := func(k string) bool {
+		return s.isMeshPeer(&clientInfo{MeshKey: must.Get(key.ParseDERPMesh(k))})
+	}
+	if !isMeshPeer(testMeshKey) || !isMeshPeer(newMeshKey) {
+		t.Errorf("during grace period, got old=%v new=%v; want both accepted", isMeshPeer(testMeshKey), isMeshPeer(newMeshKey))
+	}
+	clock.Advance(2 * time.Minute)
+	if isMeshPeer(testMeshKey) {
+		t.Error("old mesh key accepted after grace period")
+	}
+	if !isMeshPeer(newMeshKey) {
+		t.Error("new mesh key not accepted")
+	}
+
+	if err := s.RotateMeshKey("badf00d", time.Minute); err == nil {
+		t.Error("RotateMeshKey accepted invalid key")
+	}
+}
+
+// closeRecordingConn is a Conn that records whether it was closed.
+type closeRecordingConn struct {
+	Conn
+	closed atomic.Bool
+}
+
+func (c *closeRecordingConn) Close() error {
+	c.closed.Store(true)
+	return nil
+}
+
+func TestRotateMeshKeyClosesStaleConns(t *testing.T) {
+	const newMeshKey = "6d529e9d4ef632d22d4a4214cb49da8f1ba1b72697061fb24e312984c35ec8d8"
+	clock := tstest.NewClock(tstest.ClockOpts{})
+	s := &Server{clock: clock, clients: make(map[key.NodePublic]*clientSet)}
+	if err := s.SetMeshKey(testMeshKey); err != nil {
+		t.Fatal(err)
+	}
+	addClient := func(b byte, meshKey string) *closeRecordingConn {
+		nc := &closeRecordingConn{}
+		c := &sclient{nc: nc, logf: t.Logf, canMesh: meshKey != ""}
+		if meshKey != "" {
+			c.info.MeshKey = must.Get(key.ParseDERPMesh(meshKey))
+		}
+		cs := &clientSet{}
+		cs.activeClient.Store(c)
+		s.clients[pubAll(b)] = cs
+		return nc
+	}
+	oldPeer := addClient(1, testMeshKey)
+	regular := addClient(2, "")
+
+	if err := s.RotateMeshKey(newMeshKey, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	newPeer := addClient(3, newMeshKey)
+
+	clock.Advance(30 * time.Second)
+	if oldPeer.closed.Load() {
+		t.Fatal("old-key mesh peer closed during grace period")
+	}
+	clock.Advance(time.Minute)
+	if !oldPeer.closed.Load() {
+		t.Error("old-key mesh peer not closed after grace period")
+	}
+	if newPeer.closed.Load() {
+		t.Error("new-key mesh peer closed")
+	}
+	if regular.closed.Load() {
+		t.Error("regular client closed")
+	}
+}
+
 func TestIsMeshPeer(t *testing.T) {
 	s := &Server{}
 	err := s.SetMeshKey(testMeshKey)
@@ -5,6 +5,10 @@
 
 package drive
 
+import (
+	"time"
+)
+
 // Clone makes a deep copy of Share.
 // The result aliases no memory with the original.
 func (src *Share) Clone() *Share {
@@ -19,10 +23,12 @@ func (src *Share) Clone() *Share {
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _ShareCloneNeedsRegeneration = Share(struct {
-	Name         string
-	Path         string
-	As           string
-	BookmarkData []byte
+	Name           string
+	Path           string
+	As             string
+	BookmarkData   []byte
+	Versions       int
+	VersionsMaxAge time.Duration
 }{})
 
 // Clone duplicates src into dst and reports whether it succeeded.
@@ -8,6 +8,7 @@
 import (
 	jsonv1 "encoding/json"
 	"errors"
+	"time"
 
 	jsonv2 "github.com/go-json-experiment/json"
 	"github.com/go-json-experiment/json/jsontext"
@@ -89,11 +90,15 @@ func (v ShareView) As() string   { return v.ж.As }
 func (v ShareView) BookmarkData() views.ByteSlice[[]byte] {
 	return views.ByteSliceOf(v.ж.BookmarkData)
 }
+func (v ShareView) Versions() int                 { return v.ж.Versions }
+func (v ShareView) VersionsMaxAge() time.Duration { return v.ж.VersionsMaxAge }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _ShareViewNeedsRegeneration = Share(struct {
-	Name         string
-	Path         string
-	As           string
-	BookmarkData []byte
+	Name           string
+	Path           string
+	As             string
+	BookmarkData   []byte
+	Versions       int
+	VersionsMaxAge time.Duration
 }{})
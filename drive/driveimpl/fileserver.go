@@ -11,9 +11,11 @@
 	"net"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/tailscale/xnet/webdav"
 	"tailscale.com/drive/driveimpl/shared"
+	"tailscale.com/drive/driveimpl/versionfs"
 )
 
 // FileServer is a standalone WebDAV server that dynamically serves up shares.
@@ -107,6 +109,22 @@ func (s *FileServer) AddShareLocked(share, path string) {
 	}
 }
 
+// AddVersionedShareLocked adds a share that keeps previous versions of files
+// that are overwritten or deleted to the map of shares, assuming that
+// LockShares() has been called first. Previous versions are exposed read-only
+// under the versionfs.VersionsDir folder of the share. Positive maxVersions
+// and maxAge limit how many versions of each file are kept, and for how long.
+func (s *FileServer) AddVersionedShareLocked(share, path string, maxVersions int, maxAge time.Duration) {
+	s.shareHandlers[share] = &webdav.Handler{
+		FileSystem: &birthTimingFS{&versionfs.FS{
+			Dir:         path,
+			MaxVersions: maxVersions,
+			MaxAge:      maxAge,
+		}},
+		LockSystem: webdav.NewMemLS(),
+	}
+}
+
 // SetShares sets the full map of shares to the new value, mapping name->path.
 func (s *FileServer) SetShares(shares map[string]string) {
 	s.LockShares()
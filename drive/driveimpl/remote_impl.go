@@ -328,10 +328,7 @@ func (s *userServer) runLoop() {
 // userServers anyway.
 func (s *userServer) run() error {
 	// set up the command
-	args := []string{"serve-taildrive"}
-	for _, s := range s.shares {
-		args = append(args, s.Name, s.Path)
-	}
+	args := serveArgs(s.shares)
 	var cmd *exec.Cmd
 
 	if s.canSudo() {
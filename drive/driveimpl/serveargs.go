@@ -0,0 +1,95 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package driveimpl
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"tailscale.com/drive"
+)
+
+const (
+	versionsFlag       = "--versions="
+	versionsMaxAgeFlag = "--versions-max-age="
+)
+
+// serveArgs returns the arguments to tailscaled serve-taildrive that serve
+// the given shares, as parsed by [FileServer.SetSharesFromArgs].
+func serveArgs(shares []*drive.Share) []string {
+	args := []string{"serve-taildrive"}
+	for _, s := range shares {
+		if s.Versions > 0 {
+			args = append(args, versionsFlag+strconv.Itoa(s.Versions))
+		}
+		if s.VersionsMaxAge > 0 {
+			args = append(args, versionsMaxAgeFlag+s.VersionsMaxAge.String())
+		}
+		args = append(args, s.Name, s.Path)
+	}
+	return args
+}
+
+// SetSharesFromArgs sets the full set of shares from the arguments to
+// tailscaled serve-taildrive. These are <sharename> <path> pairs, each of
+// which may be preceded by --versions=<n> and --versions-max-age=<duration>
+// options to make it a versioned share.
+func (s *FileServer) SetSharesFromArgs(args []string) error {
+	shares, err := parseServeArgs(args)
+	if err != nil {
+		return err
+	}
+	s.LockShares()
+	defer s.UnlockShares()
+	s.ClearSharesLocked()
+	for _, share := range shares {
+		if share.Versions > 0 {
+			s.AddVersionedShareLocked(share.Name, share.Path, share.Versions, share.VersionsMaxAge)
+		} else {
+			s.AddShareLocked(share.Name, share.Path)
+		}
+	}
+	return nil
+}
+
+func parseServeArgs(args []string) ([]*drive.Share, error) {
+	var shares []*drive.Share
+	share := &drive.Share{}
+	for len(args) > 0 {
+		arg := args[0]
+		switch {
+		case strings.HasPrefix(arg, versionsFlag):
+			n, err := strconv.Atoi(strings.TrimPrefix(arg, versionsFlag))
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid %q", arg)
+			}
+			share.Versions = n
+			args = args[1:]
+		case strings.HasPrefix(arg, versionsMaxAgeFlag):
+			d, err := time.ParseDuration(strings.TrimPrefix(arg, versionsMaxAgeFlag))
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid %q", arg)
+			}
+			share.VersionsMaxAge = d
+			args = args[1:]
+		case len(args) < 2:
+			return nil, errors.New("need <sharename> <path> pairs")
+		default:
+			share.Name, share.Path = args[0], args[1]
+			if share.VersionsMaxAge > 0 && share.Versions == 0 {
+				return nil, fmt.Errorf("share %q: %w", share.Name, drive.ErrInvalidShareVersions)
+			}
+			shares = append(shares, share)
+			share = &drive.Share{}
+			args = args[2:]
+		}
+	}
+	if share.Versions > 0 || share.VersionsMaxAge > 0 {
+		return nil, errors.New("options must precede a <sharename> <path> pair")
+	}
+	return shares, nil
+}
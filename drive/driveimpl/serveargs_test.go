@@ -0,0 +1,50 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package driveimpl
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"tailscale.com/drive"
+)
+
+func TestServeArgs(t *testing.T) {
+	shares := []*drive.Share{
+		{Name: "a", Path: "/a"},
+		{Name: "builds", Path: "/srv/builds", Versions: 10, VersionsMaxAge: 720 * time.Hour},
+		{Name: "c", Path: "--versions=1", Versions: 3},
+	}
+	args := serveArgs(shares)
+	want := []string{
+		"serve-taildrive",
+		"a", "/a",
+		"--versions=10", "--versions-max-age=720h0m0s", "builds", "/srv/builds",
+		"--versions=3", "c", "--versions=1",
+	}
+	if !slices.Equal(args, want) {
+		t.Fatalf("serveArgs = %q, want %q", args, want)
+	}
+	got, err := parseServeArgs(args[1:])
+	if err != nil {
+		t.Fatalf("parseServeArgs: %v", err)
+	}
+	if !slices.EqualFunc(got, shares, drive.SharesEqual) {
+		t.Errorf("parseServeArgs = %v, want %v", got, shares)
+	}
+
+	for _, bad := range [][]string{
+		{"a"},
+		{"--versions=1"},
+		{"--versions=0", "a", "/a"},
+		{"--versions=x", "a", "/a"},
+		{"--versions-max-age=1h", "a", "/a"},
+		{"--versions=1", "--versions-max-age=-1h", "a", "/a"},
+	} {
+		if _, err := parseServeArgs(bad); err == nil {
+			t.Errorf("parseServeArgs(%q) succeeded, want error", bad)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package versionfs
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// keep moves the regular file at local path p into the store, returning
+// the path of the new version.
+func (vfs *FS) keep(p string) (version string, err error) {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	return vfs.keepLocked(p)
+}
+
+func (vfs *FS) keepLocked(p string) (version string, err error) {
+	dir, version, err := vfs.newVersionLocked(p)
+	if err != nil {
+		return "", err
+	}
+	if err := os.Rename(p, version); err != nil {
+		// p may be on another file system mounted within Dir.
+		if err := copyFile(p, version); err != nil {
+			os.Remove(version)
+			return "", err
+		}
+		if err := os.Remove(p); err != nil {
+			os.Remove(version)
+			return "", err
+		}
+	}
+	vfs.pruneLocked(dir)
+	vfs.maybeSweepLocked()
+	return version, nil
+}
+
+// keepCopy copies the regular file at local path p into the store, leaving
+// p in place.
+func (vfs *FS) keepCopy(p string) error {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	dir, version, err := vfs.newVersionLocked(p)
+	if err != nil {
+		return err
+	}
+	if err := copyFile(p, version); err != nil {
+		os.Remove(version)
+		return err
+	}
+	vfs.pruneLocked(dir)
+	vfs.maybeSweepLocked()
+	return nil
+}
+
+// keepAll moves all regular files within local path p, which may be a file
+// or a directory, into the store. If any cannot be kept, those already moved
+// are put back.
+func (vfs *FS) keepAll(p string) error {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	type kept struct{ path, version string }
+	var done []kept
+	err := filepath.WalkDir(p, func(path string, d fs.DirEntry, err error) error {
+		if os.IsNotExist(err) && path == p {
+			return nil // nothing to remove
+		}
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		version, err := vfs.keepLocked(path)
+		if err != nil {
+			return err
+		}
+		done = append(done, kept{path, version})
+		return nil
+	})
+	if err != nil {
+		for _, k := range slices.Backward(done) {
+			os.Rename(k.version, k.path)
+		}
+	}
+	return err
+}
+
+// restore moves version back to local path p, after the operation that
+// kept it failed.
+func (vfs *FS) restore(version, p string) {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	os.Rename(version, p)
+}
+
+// newVersionLocked returns the directory in the store holding the versions
+// of the file at local path p, creating it if necessary, and an unused path
+// within it for a new version.
+func (vfs *FS) newVersionLocked(p string) (dir, version string, err error) {
+	rel, err := filepath.Rel(vfs.Dir, p)
+	if err != nil {
+		return "", "", err
+	}
+	dir = filepath.Join(vfs.storePath(), rel)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", "", err
+	}
+	base := filepath.Base(p)
+	for t := vfs.now().UTC(); ; t = t.Add(time.Millisecond) {
+		version = filepath.Join(dir, t.Format(versionTimeFormat)+"_"+base)
+		if _, err := os.Lstat(version); os.IsNotExist(err) {
+			return dir, version, nil
+		} else if err != nil {
+			return "", "", err
+		}
+	}
+}
+
+// versionTime returns the time at which the version with the given file
+// name was replaced.
+func versionTime(name string) (time.Time, bool) {
+	ts, _, ok := strings.Cut(name, "_")
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(versionTimeFormat, ts)
+	return t, err == nil
+}
+
+// pruneLocked removes the versions in dir, a directory in the store, that
+// exceed the retention limits. It then removes dir and its parents within
+// the store if they are empty.
+func (vfs *FS) pruneLocked(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	// Entries are sorted by name, and so oldest first.
+	var versions []fs.DirEntry
+	for _, e := range entries {
+		if _, ok := versionTime(e.Name()); ok && e.Type().IsRegular() {
+			versions = append(versions, e)
+		}
+	}
+	now := vfs.now()
+	for i, e := range versions {
+		t, _ := versionTime(e.Name())
+		tooMany := vfs.MaxVersions > 0 && i < len(versions)-vfs.MaxVersions
+		tooOld := vfs.MaxAge > 0 && now.Sub(t) > vfs.MaxAge
+		if tooMany || tooOld {
+			os.Remove(filepath.Join(dir, e.Name()))
+		}
+	}
+	for store := vfs.storePath(); dir != store && strings.HasPrefix(dir, store); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break // not empty
+		}
+	}
+}
+
+// maybeSweep prunes all versions in the store if it has not done so
+// within sweepInterval, so that versions of files that are not replaced
+// again still expire.
+func (vfs *FS) maybeSweep() {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	vfs.maybeSweepLocked()
+}
+
+func (vfs *FS) maybeSweepLocked() {
+	if vfs.MaxAge <= 0 {
+		return
+	}
+	now := vfs.now()
+	if !vfs.lastSweep.IsZero() && now.Sub(vfs.lastSweep) < sweepInterval {
+		return
+	}
+	vfs.lastSweep = now
+
+	var dirs []string
+	filepath.WalkDir(vfs.storePath(), func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	// Prune the deepest directories first, so that emptied parents are
+	// removed too.
+	for _, dir := range slices.Backward(dirs) {
+		vfs.pruneLocked(dir)
+	}
+}
+
+// copyFile copies the regular file at src to the new file dst, preserving
+// its modification time.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, time.Time{}, fi.ModTime())
+}
@@ -0,0 +1,363 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package versionfs provides a webdav.FileSystem for a local directory that
+// keeps previous versions of files that are overwritten or deleted, and
+// exposes them read-only through a virtual folder.
+package versionfs
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tailscale/xnet/webdav"
+	"tailscale.com/drive"
+	"tailscale.com/drive/driveimpl/shared"
+	"tailscale.com/tstime"
+)
+
+const (
+	// VersionsDir is the name of the virtual read-only folder in the root of
+	// an FS through which previous versions are exposed. It shadows any
+	// file or folder of the same name in the shared directory.
+	//
+	// Within it, each file that has previous versions is represented by a
+	// folder at the same path, holding one file per version named
+	// "<time>_<name>", with the UTC time at which the version was replaced.
+	// For example, the version of "docs/report.txt" that was overwritten
+	// at noon on 2 January 2025 is
+	// ".versions/docs/report.txt/2025-01-02T12-00-00.000Z_report.txt".
+	VersionsDir = drive.VersionsDir
+
+	// storeDir is the name of the hidden folder in the root of the shared
+	// directory in which previous versions are stored, laid out as they
+	// appear in VersionsDir. It is not accessible through the FS.
+	storeDir = ".tailscale-versions"
+
+	// versionTimeFormat is the format of the time in version names. It sorts
+	// chronologically and avoids characters that are invalid in Windows
+	// file names.
+	versionTimeFormat = "2006-01-02T15-04-05.000Z"
+
+	// sweepInterval is how often all versions are checked against the
+	// retention limits, rather than just those of a file being replaced.
+	sweepInterval = time.Hour
+)
+
+// FS is a webdav.FileSystem for the local directory Dir that keeps previous
+// versions of files when they are overwritten, deleted, or replaced by a
+// rename. Previous versions are available read-only under VersionsDir, and
+// can be recovered by copying them out of it.
+//
+// If a previous version cannot be kept, the operation that would have
+// replaced it fails, so that writers cannot destroy history.
+type FS struct {
+	// Dir is the local directory being served.
+	Dir string
+
+	// MaxVersions, if positive, is the maximum number of previous versions
+	// kept of each file. The oldest are removed first.
+	MaxVersions int
+
+	// MaxAge, if positive, is how long previous versions are kept after
+	// they were replaced.
+	MaxAge time.Duration
+
+	// Clock, if given, determines the current time.
+	Clock tstime.Clock
+
+	// mu serializes changes to the store.
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+var _ webdav.FileSystem = (*FS)(nil)
+
+func (vfs *FS) now() time.Time {
+	if vfs.Clock != nil {
+		return vfs.Clock.Now()
+	}
+	return time.Now()
+}
+
+// pathKind is the kind of path within an FS.
+type pathKind int
+
+const (
+	kindShared   pathKind = iota // in the shared directory
+	kindVersions                 // in VersionsDir
+	kindStore                    // in storeDir, which is hidden
+)
+
+// resolve returns the kind of name, and its local path. For names within
+// VersionsDir, this is the corresponding path within the store. It returns
+// an empty path if name is invalid.
+func (vfs *FS) resolve(name string) (pathKind, string) {
+	if filepath.Separator != '/' && strings.ContainsRune(name, filepath.Separator) {
+		return kindShared, ""
+	}
+	name = path.Clean("/" + name)
+	first, rest, _ := strings.Cut(name[1:], "/")
+	// Compare case-insensitively, in case the file system is too.
+	switch {
+	case strings.EqualFold(first, storeDir):
+		return kindStore, ""
+	case strings.EqualFold(first, VersionsDir):
+		return kindVersions, filepath.Join(vfs.storePath(), filepath.FromSlash(rest))
+	}
+	return kindShared, filepath.Join(vfs.Dir, filepath.FromSlash(name))
+}
+
+func (vfs *FS) storePath() string {
+	return filepath.Join(vfs.Dir, storeDir)
+}
+
+// Mkdir implements webdav.FileSystem.
+func (vfs *FS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	kind, p := vfs.resolve(name)
+	if kind != kindShared {
+		return os.ErrPermission
+	}
+	if p == "" {
+		return os.ErrNotExist
+	}
+	return os.Mkdir(p, perm)
+}
+
+// OpenFile implements webdav.FileSystem.
+func (vfs *FS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	isWrite := flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0
+	kind, p := vfs.resolve(name)
+	switch {
+	case kind == kindStore:
+		if isWrite {
+			return nil, os.ErrPermission
+		}
+		return nil, os.ErrNotExist
+	case kind == kindVersions:
+		if isWrite {
+			return nil, os.ErrPermission
+		}
+		vfs.maybeSweep()
+		return vfs.openVersions(ctx, name, p)
+	case p == "":
+		return nil, os.ErrNotExist
+	}
+
+	if !isWrite {
+		f, err := openFile(p, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		if p == filepath.Clean(vfs.Dir) {
+			return &rootFile{File: f, vfs: vfs}, nil
+		}
+		return f, nil
+	}
+
+	fi, err := os.Lstat(p)
+	if err != nil || !fi.Mode().IsRegular() || flag&os.O_EXCL != 0 {
+		// Nothing to keep.
+		return openFile(p, flag, perm)
+	}
+	if flag&os.O_TRUNC == 0 {
+		// Keep a copy of the file before it is first written to.
+		f, err := openFile(p, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		return &copyOnWriteFile{File: f, vfs: vfs, path: p}, nil
+	}
+	// Keep the file by moving it aside, to be replaced by a new one.
+	version, err := vfs.keep(p)
+	if err != nil {
+		return nil, err
+	}
+	f, err := openFile(p, flag, perm)
+	if err != nil {
+		vfs.restore(version, p)
+		return nil, err
+	}
+	return f, nil
+}
+
+// openFile is like os.OpenFile, but returns a webdav.File.
+func openFile(name string, flag int, perm os.FileMode) (webdav.File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// RemoveAll implements webdav.FileSystem.
+func (vfs *FS) RemoveAll(ctx context.Context, name string) error {
+	kind, p := vfs.resolve(name)
+	switch {
+	case kind == kindStore:
+		return os.ErrNotExist
+	case kind == kindVersions:
+		return os.ErrPermission
+	case p == "":
+		return os.ErrNotExist
+	case p == filepath.Clean(vfs.Dir):
+		// Prohibit removing the virtual root directory.
+		return os.ErrInvalid
+	}
+	if err := vfs.keepAll(p); err != nil {
+		return err
+	}
+	return os.RemoveAll(p)
+}
+
+// Rename implements webdav.FileSystem.
+func (vfs *FS) Rename(ctx context.Context, oldName, newName string) error {
+	oldKind, oldPath := vfs.resolve(oldName)
+	newKind, newPath := vfs.resolve(newName)
+	switch {
+	case oldKind != kindShared || newKind != kindShared:
+		return os.ErrPermission
+	case oldPath == "" || newPath == "":
+		return os.ErrNotExist
+	case oldPath == filepath.Clean(vfs.Dir) || newPath == filepath.Clean(vfs.Dir):
+		// Prohibit renaming from or to the virtual root directory.
+		return os.ErrInvalid
+	}
+	if fi, err := os.Lstat(newPath); err == nil && fi.Mode().IsRegular() {
+		version, err := vfs.keep(newPath)
+		if err != nil {
+			return err
+		}
+		if err := os.Rename(oldPath, newPath); err != nil {
+			vfs.restore(version, newPath)
+			return err
+		}
+		return nil
+	}
+	return os.Rename(oldPath, newPath)
+}
+
+// Stat implements webdav.FileSystem.
+func (vfs *FS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	kind, p := vfs.resolve(name)
+	switch {
+	case kind == kindStore, p == "":
+		return nil, os.ErrNotExist
+	case kind == kindVersions:
+		return vfs.statVersions(name, p)
+	}
+	return os.Stat(p)
+}
+
+// statVersions returns the FileInfo for name within VersionsDir, whose path
+// in the store is p.
+func (vfs *FS) statVersions(name, p string) (fs.FileInfo, error) {
+	fi, err := os.Stat(p)
+	if p != vfs.storePath() {
+		return readOnlyInfo(fi), err
+	}
+	// VersionsDir exists even if nothing was kept yet.
+	if os.IsNotExist(err) {
+		return shared.ReadOnlyDirInfo(VersionsDir, vfs.now()), nil
+	} else if err != nil {
+		return nil, err
+	}
+	return shared.ReadOnlyDirInfo(VersionsDir, fi.ModTime()), nil
+}
+
+// openVersions opens name within VersionsDir, whose path in the store is p.
+func (vfs *FS) openVersions(ctx context.Context, name, p string) (webdav.File, error) {
+	fi, err := vfs.statVersions(name, p)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return openFile(p, os.O_RDONLY, 0)
+	}
+	return &shared.DirFile{
+		Info: fi,
+		LoadChildren: func() ([]fs.FileInfo, error) {
+			entries, err := os.ReadDir(p)
+			if os.IsNotExist(err) && p == vfs.storePath() {
+				return nil, nil
+			} else if err != nil {
+				return nil, err
+			}
+			infos := make([]fs.FileInfo, 0, len(entries))
+			for _, e := range entries {
+				fi, err := e.Info()
+				if err != nil {
+					continue
+				}
+				infos = append(infos, readOnlyInfo(fi))
+			}
+			return infos, nil
+		},
+	}, nil
+}
+
+// readOnlyInfo returns a FileInfo like fi, but without write permissions.
+func readOnlyInfo(fi fs.FileInfo) fs.FileInfo {
+	if fi == nil {
+		return nil
+	}
+	return &shared.StaticFileInfo{
+		Named:      fi.Name(),
+		Sized:      fi.Size(),
+		Moded:      fi.Mode() &^ 0o222,
+		ModdedTime: fi.ModTime(),
+		Dir:        fi.IsDir(),
+	}
+}
+
+// rootFile is the root directory of an FS, which lists VersionsDir but not
+// the store.
+type rootFile struct {
+	webdav.File
+	vfs *FS
+
+	listedVersions bool
+}
+
+func (f *rootFile) Readdir(count int) ([]fs.FileInfo, error) {
+	fis, err := f.File.Readdir(count)
+	fis = slices.DeleteFunc(fis, func(fi fs.FileInfo) bool {
+		return strings.EqualFold(fi.Name(), storeDir) || strings.EqualFold(fi.Name(), VersionsDir)
+	})
+	if !f.listedVersions {
+		f.listedVersions = true
+		vi, verr := f.vfs.statVersions(VersionsDir, f.vfs.storePath())
+		if verr == nil {
+			fis = append(fis, vi)
+		}
+	}
+	return fis, err
+}
+
+// copyOnWriteFile is a file opened for writing without truncation, which
+// keeps a copy of its contents before it is first written to.
+type copyOnWriteFile struct {
+	webdav.File // not *os.File, so that io.Copy cannot bypass Write
+	vfs         *FS
+	path        string
+
+	once    sync.Once
+	keepErr error
+}
+
+func (f *copyOnWriteFile) Write(b []byte) (int, error) {
+	f.once.Do(func() {
+		f.keepErr = f.vfs.keepCopy(f.path)
+	})
+	if f.keepErr != nil {
+		return 0, f.keepErr
+	}
+	return f.File.Write(b)
+}
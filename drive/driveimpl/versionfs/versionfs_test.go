@@ -0,0 +1,297 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package versionfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tailscale/xnet/webdav"
+	"tailscale.com/tstest"
+	"tailscale.com/util/must"
+)
+
+var start = time.Date(2025, 1, 2, 12, 0, 0, 0, time.UTC)
+
+func newTestFS(t *testing.T) (*FS, *tstest.Clock) {
+	clock := tstest.NewClock(tstest.ClockOpts{Start: start})
+	return &FS{Dir: t.TempDir(), Clock: clock}, clock
+}
+
+func writeFile(t *testing.T, vfs *FS, name, contents string) {
+	t.Helper()
+	f, err := vfs.OpenFile(context.Background(), name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		t.Fatalf("opening %s: %v", name, err)
+	}
+	must.Get(io.WriteString(f, contents))
+	must.Do(f.Close())
+}
+
+func readFile(t *testing.T, vfs *FS, name string) string {
+	t.Helper()
+	f, err := vfs.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("opening %s: %v", name, err)
+	}
+	defer f.Close()
+	return string(must.Get(io.ReadAll(f)))
+}
+
+// listVersions returns the names of the versions of name, oldest first.
+func listVersions(t *testing.T, vfs *FS, name string) []string {
+	t.Helper()
+	f, err := vfs.OpenFile(context.Background(), VersionsDir+"/"+name, os.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		t.Fatalf("opening versions of %s: %v", name, err)
+	}
+	defer f.Close()
+	var names []string
+	for _, fi := range must.Get(f.Readdir(0)) {
+		if !fi.IsDir() {
+			names = append(names, fi.Name())
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+func TestKeepVersions(t *testing.T) {
+	ctx := context.Background()
+	vfs, clock := newTestFS(t)
+	must.Do(vfs.Mkdir(ctx, "docs", 0o755))
+
+	writeFile(t, vfs, "docs/report.txt", "v1")
+	if got := listVersions(t, vfs, "docs/report.txt"); len(got) != 0 {
+		t.Errorf("versions after create = %q, want none", got)
+	}
+
+	// Overwrite.
+	writeFile(t, vfs, "docs/report.txt", "v2")
+	want := []string{"2025-01-02T12-00-00.000Z_report.txt"}
+	if got := listVersions(t, vfs, "docs/report.txt"); !slices.Equal(got, want) {
+		t.Fatalf("versions after overwrite = %q, want %q", got, want)
+	}
+	if got := readFile(t, vfs, VersionsDir+"/docs/report.txt/"+want[0]); got != "v1" {
+		t.Errorf("kept version = %q, want %q", got, "v1")
+	}
+
+	// Overwrite within the same millisecond.
+	writeFile(t, vfs, "docs/report.txt", "v3")
+	want = append(want, "2025-01-02T12-00-00.001Z_report.txt")
+	if got := listVersions(t, vfs, "docs/report.txt"); !slices.Equal(got, want) {
+		t.Fatalf("versions after second overwrite = %q, want %q", got, want)
+	}
+
+	// Write in place.
+	clock.Advance(time.Second)
+	f := must.Get(vfs.OpenFile(ctx, "docs/report.txt", os.O_RDWR, 0))
+	must.Get(f.Seek(0, io.SeekEnd))
+	must.Get(io.WriteString(f, "+"))
+	must.Get(io.WriteString(f, "+"))
+	must.Do(f.Close())
+	want = append(want, "2025-01-02T12-00-01.000Z_report.txt")
+	if got := listVersions(t, vfs, "docs/report.txt"); !slices.Equal(got, want) {
+		t.Fatalf("versions after write in place = %q, want %q", got, want)
+	}
+	if got := readFile(t, vfs, VersionsDir+"/docs/report.txt/"+want[2]); got != "v3" {
+		t.Errorf("kept version = %q, want %q", got, "v3")
+	}
+	if got := readFile(t, vfs, "docs/report.txt"); got != "v3++" {
+		t.Errorf("current version = %q, want %q", got, "v3++")
+	}
+
+	// Rename over.
+	clock.Advance(time.Second)
+	writeFile(t, vfs, "docs/new.txt", "v4")
+	must.Do(vfs.Rename(ctx, "docs/new.txt", "docs/report.txt"))
+	want = append(want, "2025-01-02T12-00-02.000Z_report.txt")
+	if got := listVersions(t, vfs, "docs/report.txt"); !slices.Equal(got, want) {
+		t.Fatalf("versions after rename = %q, want %q", got, want)
+	}
+
+	// Delete the whole directory.
+	clock.Advance(time.Second)
+	must.Do(vfs.Mkdir(ctx, "docs/sub", 0o755))
+	writeFile(t, vfs, "docs/sub/other.txt", "other")
+	must.Do(vfs.RemoveAll(ctx, "docs"))
+	if _, err := vfs.Stat(ctx, "docs"); !os.IsNotExist(err) {
+		t.Errorf("Stat after RemoveAll = %v, want not exist", err)
+	}
+	want = append(want, "2025-01-02T12-00-03.000Z_report.txt")
+	if got := listVersions(t, vfs, "docs/report.txt"); !slices.Equal(got, want) {
+		t.Fatalf("versions after delete = %q, want %q", got, want)
+	}
+	if got := readFile(t, vfs, VersionsDir+"/docs/report.txt/"+want[4]); got != "v4" {
+		t.Errorf("kept version = %q, want %q", got, "v4")
+	}
+	if got := listVersions(t, vfs, "docs/sub/other.txt"); len(got) != 1 {
+		t.Errorf("versions of other.txt = %q, want one", got)
+	}
+}
+
+func TestVersionsReadOnly(t *testing.T) {
+	ctx := context.Background()
+	vfs, _ := newTestFS(t)
+	writeFile(t, vfs, "a.txt", "v1")
+	writeFile(t, vfs, "a.txt", "v2")
+	version := VersionsDir + "/a.txt/" + listVersions(t, vfs, "a.txt")[0]
+
+	for _, name := range []string{VersionsDir, VersionsDir + "/a.txt", version, VersionsDir + "/b.txt"} {
+		if _, err := vfs.OpenFile(ctx, name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644); !errors.Is(err, os.ErrPermission) {
+			t.Errorf("OpenFile(%q) for writing = %v, want ErrPermission", name, err)
+		}
+		if err := vfs.RemoveAll(ctx, name); !errors.Is(err, os.ErrPermission) {
+			t.Errorf("RemoveAll(%q) = %v, want ErrPermission", name, err)
+		}
+		if err := vfs.Mkdir(ctx, name+"/dir", 0o755); !errors.Is(err, os.ErrPermission) {
+			t.Errorf("Mkdir(%q) = %v, want ErrPermission", name, err)
+		}
+	}
+	if err := vfs.Rename(ctx, version, "restored.txt"); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("Rename out of versions = %v, want ErrPermission", err)
+	}
+	if err := vfs.Rename(ctx, "a.txt", VersionsDir+"/x"); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("Rename into versions = %v, want ErrPermission", err)
+	}
+	fi := must.Get(vfs.Stat(ctx, version))
+	if fi.Mode().Perm()&0o222 != 0 {
+		t.Errorf("version mode = %v, want read-only", fi.Mode())
+	}
+}
+
+func TestStoreHidden(t *testing.T) {
+	ctx := context.Background()
+	vfs, _ := newTestFS(t)
+
+	// The versions folder is listed even before anything is kept.
+	rootNames := func() []string {
+		f := must.Get(vfs.OpenFile(ctx, "/", os.O_RDONLY, 0))
+		defer f.Close()
+		var names []string
+		for _, fi := range must.Get(f.Readdir(0)) {
+			names = append(names, fi.Name())
+		}
+		slices.Sort(names)
+		return names
+	}
+	if got, want := rootNames(), []string{VersionsDir}; !slices.Equal(got, want) {
+		t.Errorf("root = %q, want %q", got, want)
+	}
+	fi := must.Get(vfs.Stat(ctx, VersionsDir))
+	if !fi.IsDir() {
+		t.Errorf("%s is not a directory", VersionsDir)
+	}
+
+	writeFile(t, vfs, "a.txt", "v1")
+	writeFile(t, vfs, "a.txt", "v2")
+	if got, want := rootNames(), []string{VersionsDir, "a.txt"}; !slices.Equal(got, want) {
+		t.Errorf("root = %q, want %q", got, want)
+	}
+	for _, name := range []string{storeDir, strings.ToUpper(storeDir), storeDir + "/a.txt"} {
+		if _, err := vfs.Stat(ctx, name); !os.IsNotExist(err) {
+			t.Errorf("Stat(%q) = %v, want not exist", name, err)
+		}
+		if _, err := vfs.OpenFile(ctx, name, os.O_RDONLY, 0); !os.IsNotExist(err) {
+			t.Errorf("OpenFile(%q) = %v, want not exist", name, err)
+		}
+		if err := vfs.RemoveAll(ctx, name); !os.IsNotExist(err) {
+			t.Errorf("RemoveAll(%q) = %v, want not exist", name, err)
+		}
+	}
+	if err := vfs.RemoveAll(ctx, "/"); err == nil {
+		t.Error("RemoveAll of the root succeeded")
+	}
+}
+
+func TestRetention(t *testing.T) {
+	vfs, clock := newTestFS(t)
+	vfs.MaxVersions = 2
+	vfs.MaxAge = 24 * time.Hour
+
+	for i := range 4 {
+		writeFile(t, vfs, "a.txt", strings.Repeat("a", i+1))
+		clock.Advance(time.Minute)
+	}
+	want := []string{"2025-01-02T12-02-00.000Z_a.txt", "2025-01-02T12-03-00.000Z_a.txt"}
+	if got := listVersions(t, vfs, "a.txt"); !slices.Equal(got, want) {
+		t.Fatalf("versions = %q, want %q", got, want)
+	}
+	if got := readFile(t, vfs, VersionsDir+"/a.txt/"+want[0]); got != "aa" {
+		t.Errorf("oldest kept version = %q, want %q", got, "aa")
+	}
+
+	// Versions expire, even if the file is not replaced again.
+	writeFile(t, vfs, "b.txt", "b")
+	must.Do(vfs.RemoveAll(context.Background(), "b.txt"))
+	clock.Advance(25 * time.Hour)
+	if got := listVersions(t, vfs, "a.txt"); len(got) != 0 {
+		t.Errorf("versions after expiry = %q, want none", got)
+	}
+	if got := listVersions(t, vfs, "b.txt"); len(got) != 0 {
+		t.Errorf("versions after expiry = %q, want none", got)
+	}
+	if _, err := os.Stat(filepath.Join(vfs.Dir, storeDir, "b.txt")); !os.IsNotExist(err) {
+		t.Errorf("expired version folder remains: %v", err)
+	}
+}
+
+func TestWebDAV(t *testing.T) {
+	vfs, clock := newTestFS(t)
+	srv := httptest.NewServer(&webdav.Handler{FileSystem: vfs, LockSystem: webdav.NewMemLS()})
+	defer srv.Close()
+
+	do := func(method, name, body string, wantStatus int, hdrs ...string) {
+		t.Helper()
+		req := must.Get(http.NewRequest(method, srv.URL+"/"+name, strings.NewReader(body)))
+		for i := 0; i+1 < len(hdrs); i += 2 {
+			req.Header.Set(hdrs[i], hdrs[i+1])
+		}
+		resp := must.Get(srv.Client().Do(req))
+		resp.Body.Close()
+		if resp.StatusCode != wantStatus {
+			t.Fatalf("%s %s = %v, want %v", method, name, resp.StatusCode, wantStatus)
+		}
+	}
+	do("PUT", "a.txt", "v1", http.StatusCreated)
+	clock.Advance(time.Second)
+	do("PUT", "a.txt", "v2", http.StatusCreated)
+	clock.Advance(time.Second)
+	do("PUT", "b.txt", "b", http.StatusCreated)
+	do("COPY", "b.txt", "", http.StatusNoContent, "Destination", srv.URL+"/a.txt")
+	clock.Advance(time.Second)
+	do("DELETE", "a.txt", "", http.StatusNoContent)
+	do("DELETE", VersionsDir, "", http.StatusMethodNotAllowed)
+	do("PUT", VersionsDir+"/a.txt", "x", http.StatusNotFound)
+
+	versions := listVersions(t, vfs, "a.txt")
+	var got []string
+	for _, v := range versions {
+		got = append(got, readFile(t, vfs, VersionsDir+"/a.txt/"+v))
+	}
+	if want := []string{"v1", "v2", "b"}; !slices.Equal(got, want) {
+		t.Errorf("kept versions = %q, want %q", got, want)
+	}
+
+	// Versions can be restored by copying them out.
+	do("COPY", VersionsDir+"/a.txt/"+versions[0], "", http.StatusCreated, "Destination", srv.URL+"/a.txt")
+	if got := readFile(t, vfs, "a.txt"); got != "v1" {
+		t.Errorf("restored = %q, want %q", got, "v1")
+	}
+	if _, err := fs.Stat(os.DirFS(vfs.Dir), storeDir); err != nil {
+		t.Errorf("store: %v", err)
+	}
+}
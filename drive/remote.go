@@ -11,16 +11,22 @@
 	"net/http"
 	"regexp"
 	"strings"
+	"time"
 )
 
 var (
 	// DisallowShareAs forcibly disables sharing as a specific user, only used
 	// for testing.
-	DisallowShareAs     = false
-	ErrDriveNotEnabled  = errors.New("Taildrive not enabled")
-	ErrInvalidShareName = errors.New("Share names may only contain the letters a-z, underscore _, parentheses (), or spaces")
+	DisallowShareAs         = false
+	ErrDriveNotEnabled      = errors.New("Taildrive not enabled")
+	ErrInvalidShareName     = errors.New("Share names may only contain the letters a-z, underscore _, parentheses (), or spaces")
+	ErrInvalidShareVersions = errors.New("Share versions must not be negative, and a maximum version age requires versions")
 )
 
+// VersionsDir is the name of the read-only folder in the root of a versioned
+// share through which previous versions of its files are available.
+const VersionsDir = ".versions"
+
 var (
 	shareNameRegex = regexp.MustCompile(`^[a-z0-9_\(\) ]+$`)
 )
@@ -51,6 +57,17 @@ type Share struct {
 	// hold on to a security-scoped bookmark. That bookmark is stored here. See
 	// https://developer.apple.com/documentation/security/app_sandbox/accessing_files_from_the_macos_app_sandbox#4144043
 	BookmarkData []byte `json:"bookmarkData,omitempty"`
+
+	// Versions, if positive, makes this a versioned share that keeps up to
+	// this many previous versions of each file that is overwritten or
+	// deleted. Previous versions are available read-only under the .versions
+	// folder of the share, so that remote writers cannot destroy history.
+	Versions int `json:"versions,omitempty"`
+
+	// VersionsMaxAge, if positive, is how long previous versions of files in
+	// a versioned share are kept after they were replaced. It requires
+	// Versions to be set.
+	VersionsMaxAge time.Duration `json:"versionsMaxAge,omitempty"`
 }
 
 func ShareViewsEqual(a, b ShareView) bool {
@@ -60,7 +77,8 @@ func ShareViewsEqual(a, b ShareView) bool {
 	if !a.Valid() || !b.Valid() {
 		return false
 	}
-	return a.Name() == b.Name() && a.Path() == b.Path() && a.As() == b.As() && a.BookmarkData().Equal(b.ж.BookmarkData)
+	return a.Name() == b.Name() && a.Path() == b.Path() && a.As() == b.As() && a.BookmarkData().Equal(b.ж.BookmarkData) &&
+		a.Versions() == b.Versions() && a.VersionsMaxAge() == b.VersionsMaxAge()
 }
 
 func SharesEqual(a, b *Share) bool {
@@ -70,7 +88,8 @@ func SharesEqual(a, b *Share) bool {
 	if a == nil || b == nil {
 		return false
 	}
-	return a.Name == b.Name && a.Path == b.Path && a.As == b.As && bytes.Equal(a.BookmarkData, b.BookmarkData)
+	return a.Name == b.Name && a.Path == b.Path && a.As == b.As && bytes.Equal(a.BookmarkData, b.BookmarkData) &&
+		a.Versions == b.Versions && a.VersionsMaxAge == b.VersionsMaxAge
 }
 
 func CompareShares(a, b *Share) int {
@@ -6,14 +6,19 @@
 package relayserver
 
 import (
+	"encoding/json"
+	"net/http"
 	"sync"
 
 	"tailscale.com/disco"
 	"tailscale.com/feature"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnext"
+	"tailscale.com/ipn/ipnlocal"
+	"tailscale.com/ipn/localapi"
 	"tailscale.com/net/udprelay"
 	"tailscale.com/net/udprelay/endpoint"
+	"tailscale.com/net/udprelay/status"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
@@ -29,6 +34,7 @@
 func init() {
 	feature.Register(featureName)
 	ipnext.RegisterExtension(featureName, newExtension)
+	localapi.Register("debug-peer-relay-sessions", serveDebugPeerRelaySessions)
 }
 
 // newExtension is an [ipnext.NewExtensionFn] that creates a new relay server
@@ -53,11 +59,20 @@ type extension struct {
 	disconnectFromBusCh           chan struct{} // non-nil if consumeEventbusTopics is running, closed to signal it to return
 	busDoneCh                     chan struct{} // non-nil if consumeEventbusTopics is running, closed when it returns
 	hasNodeAttrDisableRelayServer bool          // tailcfg.NodeAttrDisableRelayServer
+
+	// serverMu guards the following fields. It may be acquired while holding
+	// mu, but not the reverse, as consumeEventbusTopics acquires it while
+	// mu's holder may be waiting for it to return.
+	serverMu sync.Mutex
+	server   relayServer   // nil if consumeEventbusTopics has not started one
+	limits   status.Limits // from ipn.Prefs.RelayServerMax*
 }
 
 // relayServer is the interface of [udprelay.Server].
 type relayServer interface {
-	AllocateEndpoint(discoA key.DiscoPublic, discoB key.DiscoPublic) (endpoint.ServerEndpoint, error)
+	AllocateEndpointForPeer(peer key.NodePublic, discoA key.DiscoPublic, discoB key.DiscoPublic) (endpoint.ServerEndpoint, error)
+	SetLimits(status.Limits)
+	Status() status.ServerStatus
 	Close() error
 }
 
@@ -112,9 +127,47 @@ func (e *extension) profileStateChanged(_ ipn.LoginProfileView, prefs ipn.PrefsV
 			e.port = ptr.To(newPort)
 		}
 	}
+	e.setLimits(status.Limits{
+		MaxEndpoints:   prefs.RelayServerMaxEndpoints(),
+		MaxBytesPerSec: prefs.RelayServerMaxBytesPerSec(),
+		Eviction:       status.EvictionPolicy(prefs.RelayServerEviction()),
+	})
 	e.handleBusLifetimeLocked()
 }
 
+// setLimits sets the per-peer limits of the relay server, including one that
+// is already running.
+func (e *extension) setLimits(limits status.Limits) {
+	e.serverMu.Lock()
+	defer e.serverMu.Unlock()
+	e.limits = limits
+	if e.server != nil {
+		e.server.SetLimits(limits)
+	}
+}
+
+// setServer records rs as the running relay server, applying the current
+// limits to it, or records that none is running if rs is nil.
+func (e *extension) setServer(rs relayServer) {
+	e.serverMu.Lock()
+	defer e.serverMu.Unlock()
+	e.server = rs
+	if rs != nil {
+		rs.SetLimits(e.limits)
+	}
+}
+
+// serverStatus returns the status of the relay server. Only its Limits are
+// set if it is not running.
+func (e *extension) serverStatus() status.ServerStatus {
+	e.serverMu.Lock()
+	defer e.serverMu.Unlock()
+	if e.server == nil {
+		return status.ServerStatus{Limits: e.limits}
+	}
+	return e.server.Status()
+}
+
 func (e *extension) consumeEventbusTopics(port int) {
 	defer close(e.busDoneCh)
 
@@ -126,6 +179,7 @@ func (e *extension) consumeEventbusTopics(port int) {
 	var rs relayServer // lazily initialized
 	defer func() {
 		if rs != nil {
+			e.setServer(nil)
 			rs.Close()
 		}
 	}()
@@ -145,8 +199,9 @@ func (e *extension) consumeEventbusTopics(port int) {
 					e.logf("error initializing server: %v", err)
 					continue
 				}
+				e.setServer(rs)
 			}
-			se, err := rs.AllocateEndpoint(req.Message.ClientDisco[0], req.Message.ClientDisco[1])
+			se, err := rs.AllocateEndpointForPeer(req.RxFromNodeKey, req.Message.ClientDisco[0], req.Message.ClientDisco[1])
 			if err != nil {
 				e.logf("error allocating endpoint: %v", err)
 				continue
@@ -188,3 +243,28 @@ func (e *extension) Shutdown() error {
 	e.shutdown = true
 	return nil
 }
+
+// serveDebugPeerRelaySessions serves the status of this node's relay server,
+// including the sessions it is relaying and the resource usage of the peers
+// that own them, as JSON.
+//
+// URL format:
+//
+//   - GET /localapi/v0/debug-peer-relay-sessions
+func serveDebugPeerRelaySessions(h *localapi.Handler, w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "debug access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ext, ok := ipnlocal.GetExt[*extension](h.LocalBackend())
+	if !ok {
+		http.Error(w, "misconfigured relayserver extension", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ext.serverStatus())
+}
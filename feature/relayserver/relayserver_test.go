@@ -7,6 +7,7 @@
 	"testing"
 
 	"tailscale.com/ipn"
+	"tailscale.com/net/udprelay/status"
 	"tailscale.com/tsd"
 	"tailscale.com/types/ptr"
 	"tailscale.com/util/eventbus"
@@ -168,3 +169,47 @@ func Test_extension_handleBusLifetimeLocked(t *testing.T) {
 		})
 	}
 }
+
+type fakeRelayServer struct {
+	relayServer
+	limits status.Limits
+}
+
+func (s *fakeRelayServer) SetLimits(limits status.Limits) { s.limits = limits }
+
+func (s *fakeRelayServer) Status() status.ServerStatus {
+	return status.ServerStatus{UDPPort: ptr.To(1), Limits: s.limits}
+}
+
+func Test_extension_limits(t *testing.T) {
+	e := &extension{bus: eventbus.New()}
+	defer e.disconnectFromBusLocked()
+	prefs := ipn.Prefs{
+		RelayServerMaxEndpoints:   4,
+		RelayServerMaxBytesPerSec: 1 << 20,
+		RelayServerEviction:       "idlest",
+	}
+	e.profileStateChanged(ipn.LoginProfileView{}, prefs.View(), true)
+	want := status.Limits{
+		MaxEndpoints:   4,
+		MaxBytesPerSec: 1 << 20,
+		Eviction:       status.EvictIdlest,
+	}
+	if got := e.serverStatus(); got.UDPPort != nil || got.Limits != want {
+		t.Errorf("serverStatus without server = %+v, want limits %+v", got, want)
+	}
+
+	// A server that starts later gets the current limits, and a running
+	// one gets new limits as the prefs change.
+	rs := &fakeRelayServer{}
+	e.setServer(rs)
+	if rs.limits != want {
+		t.Errorf("started server limits = %+v, want %+v", rs.limits, want)
+	}
+	prefs.RelayServerMaxEndpoints = 0
+	want.MaxEndpoints = 0
+	e.profileStateChanged(ipn.LoginProfileView{}, prefs.View(), true)
+	if got := e.serverStatus(); got.UDPPort == nil || got.Limits != want {
+		t.Errorf("serverStatus with server = %+v, want limits %+v", got, want)
+	}
+}
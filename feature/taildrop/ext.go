@@ -76,6 +76,10 @@ type Extension struct {
 	// This is currently being used for Android to use the Storage Access Framework.
 	fileOps FileOps
 
+	// receiveRulesOverride, if non-nil, are the receive rules to use
+	// instead of those from policy. See [Extension.SetReceiveRules].
+	receiveRulesOverride receiveRules
+
 	nodeBackendForTest ipnext.NodeBackend // if non-nil, pretend we're this node state for tests
 
 	mu             sync.Mutex // Lock order: lb.mu > e.mu
@@ -278,13 +282,42 @@ func (e *Extension) WaitingFiles() ([]apitype.WaitingFile, error) {
 	return e.manager().WaitingFiles()
 }
 
+// WaitingFilesAndTrees is like WaitingFiles but also returns the files
+// within received directory trees, whose names contain slashes.
+func (e *Extension) WaitingFilesAndTrees() ([]apitype.WaitingFile, error) {
+	m := e.manager()
+	files, err := m.WaitingFiles()
+	if err != nil {
+		return nil, err
+	}
+	treeFiles, err := m.WaitingTreeFiles()
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, treeFiles...)
+	slices.SortFunc(files, func(a, b apitype.WaitingFile) int { return cmp.Compare(a.Name, b.Name) })
+	return files, nil
+}
+
 // AwaitWaitingFiles is like WaitingFiles but blocks while ctx is not done,
 // waiting for any files to be available.
 //
 // On return, exactly one of the results will be non-empty or non-nil,
 // respectively.
 func (e *Extension) AwaitWaitingFiles(ctx context.Context) ([]apitype.WaitingFile, error) {
-	if ff, err := e.WaitingFiles(); err != nil || len(ff) > 0 {
+	return e.awaitWaitingFiles(ctx, e.WaitingFiles)
+}
+
+// AwaitWaitingFilesAndTrees is like AwaitWaitingFiles but also returns,
+// and waits for, the files within received directory trees.
+func (e *Extension) AwaitWaitingFilesAndTrees(ctx context.Context) ([]apitype.WaitingFile, error) {
+	return e.awaitWaitingFiles(ctx, e.WaitingFilesAndTrees)
+}
+
+// awaitWaitingFiles blocks while ctx is not done, until list returns any
+// files.
+func (e *Extension) awaitWaitingFiles(ctx context.Context, list func() ([]apitype.WaitingFile, error)) ([]apitype.WaitingFile, error) {
+	if ff, err := list(); err != nil || len(ff) > 0 {
 		return ff, err
 	}
 	if err := ctx.Err(); err != nil {
@@ -300,13 +333,13 @@ func (e *Extension) AwaitWaitingFiles(ctx context.Context) ([]apitype.WaitingFil
 		// Now that we've registered ourselves, check again, in case
 		// of race. Otherwise there's a small window where we could
 		// miss a file arrival and wait forever.
-		if ff, err := e.WaitingFiles(); err != nil || len(ff) > 0 {
+		if ff, err := list(); err != nil || len(ff) > 0 {
 			return ff, err
 		}
 
 		select {
 		case <-gotFile.Done():
-			if ff, err := e.WaitingFiles(); err != nil || len(ff) > 0 {
+			if ff, err := list(); err != nil || len(ff) > 0 {
 				return ff, err
 			}
 		case <-ctx.Done():
@@ -38,4 +38,15 @@ type FileOps interface {
 	OpenReader(name string) (io.ReadCloser, error)
 }
 
+// localFileOps is implemented by FileOps on the local filesystem, which can
+// receive directory trees, staged and assembled directly in a local
+// directory, and move received files into other directories.
+// The Android Storage Access Framework implementation does not support it.
+type localFileOps interface {
+	FileOps
+
+	// localDir returns the local directory that names are relative to.
+	localDir() string
+}
+
 var newFileOps func(dir string) (FileOps, error)
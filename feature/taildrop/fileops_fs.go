@@ -37,6 +37,8 @@ func init() {
 	}
 }
 
+func (f fsFileOps) localDir() string { return f.rootDir }
+
 func (f fsFileOps) OpenWriter(name string, offset int64, perm os.FileMode) (io.WriteCloser, string, error) {
 	path, err := joinDir(f.rootDir, name)
 	if err != nil {
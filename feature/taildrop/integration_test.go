@@ -6,10 +6,14 @@
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"testing"
+	"testing/fstest"
 	"time"
 
 	"tailscale.com/client/local"
@@ -191,6 +195,50 @@ func testTaildropIntegration(t *testing.T, freshProfiles bool) {
 	}
 	wantNoWaitingFiles(c2)
 
+	// Send a directory tree.
+	mtime := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	fsys := fstest.MapFS{
+		"sub":       {Mode: fs.ModeDir | 0o755, ModTime: mtime},
+		"sub/a.txt": {Data: []byte("file a"), Mode: 0o600, ModTime: mtime},
+		"b.txt":     {Data: []byte("file b"), Mode: 0o644, ModTime: mtime},
+	}
+	tree := &apitype.TaildropTree{Name: "tree"}
+	for _, p := range []string{"b.txt", "sub", "sub/a.txt"} {
+		f := fsys[p]
+		tf := apitype.TaildropTreeFile{Path: p, Mode: f.Mode, ModTime: f.ModTime}
+		if !f.Mode.IsDir() {
+			sum := sha256.Sum256(f.Data)
+			tf.Size, tf.SHA256 = int64(len(f.Data)), hex.EncodeToString(sum[:])
+		}
+		tree.Files = append(tree.Files, tf)
+	}
+	if err := c1.PushFileTree(ctx, n2ID, tree, fsys); err != nil {
+		t.Fatalf("PushFileTree from n1->n2: %v", err)
+	}
+	// Older clients don't see files within trees.
+	wantNoWaitingFiles(c2)
+	files, err = c2.WaitingFilesAndTrees(ctx)
+	if err != nil {
+		t.Fatalf("c2.WaitingFilesAndTrees: %v", err)
+	}
+	wantFiles := []apitype.WaitingFile{
+		{Name: "tree/b.txt", Size: 6, Mode: 0o644, ModTime: mtime},
+		{Name: "tree/sub/a.txt", Size: 6, Mode: 0o600, ModTime: mtime},
+	}
+	if len(files) != len(wantFiles) {
+		t.Fatalf("c2.WaitingFilesAndTrees: got %+v; want %+v", files, wantFiles)
+	}
+	for i, got := range files {
+		want := wantFiles[i]
+		if got.Name != want.Name || got.Size != want.Size || got.Mode != want.Mode || !got.ModTime.Equal(want.ModTime) {
+			t.Errorf("c2.WaitingFilesAndTrees[%d]: got %+v; want %+v", i, got, want)
+		}
+		if err := c2.DeleteWaitingFile(ctx, got.Name); err != nil {
+			t.Fatalf("c2.DeleteWaitingFile: %v", err)
+		}
+	}
+	wantNoWaitingFiles(c2)
+
 	d1.MustCleanShutdown(t)
 	d2.MustCleanShutdown(t)
 }
@@ -33,12 +33,14 @@
 
 func init() {
 	localapi.Register("file-put/", serveFilePut)
+	localapi.Register("file-put-tree/", serveFilePutTree)
 	localapi.Register("files/", serveFiles)
 	localapi.Register("file-targets", serveFileTargets)
 }
 
 var (
-	metricFilePutCalls = clientmetric.NewCounter("localapi_file_put")
+	metricFilePutCalls     = clientmetric.NewCounter("localapi_file_put")
+	metricFilePutTreeCalls = clientmetric.NewCounter("localapi_file_put_tree")
 )
 
 // serveFilePut sends a file to another node.
@@ -86,12 +88,6 @@ func serveFilePut(h *localapi.Handler, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fts, err := ext.FileTargets()
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
 	upath, ok := strings.CutPrefix(r.URL.EscapedPath(), "/localapi/v0/file-put/")
 	if !ok {
 		http.Error(w, "misconfigured", http.StatusInternalServerError)
@@ -110,6 +106,39 @@ func serveFilePut(h *localapi.Handler, w http.ResponseWriter, r *http.Request) {
 	}
 	peerID := tailcfg.StableNodeID(peerIDStr)
 
+	dstURL, ok := fileTargetURL(ext, w, peerID)
+	if !ok {
+		return
+	}
+
+	progressUpdates := ext.trackOutgoingFiles()
+	defer close(progressUpdates)
+
+	switch r.Method {
+	case "PUT":
+		file := ipn.OutgoingFile{
+			ID:           rands.HexString(30),
+			PeerID:       peerID,
+			Name:         filenameEscaped,
+			DeclaredSize: r.ContentLength,
+		}
+		singleFilePut(h, r.Context(), progressUpdates, w, r.Body, dstURL, "/v0/put/"+filenameEscaped, file)
+	case "POST":
+		multiFilePost(h, progressUpdates, w, r, peerID, dstURL)
+	default:
+		http.Error(w, "want PUT to put file", http.StatusBadRequest)
+		return
+	}
+}
+
+// fileTargetURL returns the PeerAPI URL of the file target with the given
+// ID. If there is none, it writes an error to w and returns false.
+func fileTargetURL(ext *Extension, w http.ResponseWriter, peerID tailcfg.StableNodeID) (*url.URL, bool) {
+	fts, err := ext.FileTargets()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
 	var ft *apitype.FileTarget
 	for _, x := range fts {
 		if x.Node.StableID == peerID {
@@ -119,23 +148,27 @@ func serveFilePut(h *localapi.Handler, w http.ResponseWriter, r *http.Request) {
 	}
 	if ft == nil {
 		http.Error(w, "node not found", http.StatusNotFound)
-		return
+		return nil, false
 	}
 	dstURL, err := url.Parse(ft.PeerAPIURL)
 	if err != nil {
 		http.Error(w, "bogus peer URL", http.StatusInternalServerError)
-		return
+		return nil, false
 	}
+	return dstURL, true
+}
 
-	// Periodically report progress of outgoing files.
+// trackOutgoingFiles returns a channel on which to send the progress of
+// outgoing files, which is periodically reported until the channel is
+// closed.
+func (e *Extension) trackOutgoingFiles() chan ipn.OutgoingFile {
 	outgoingFiles := make(map[string]*ipn.OutgoingFile)
 	t := time.NewTicker(1 * time.Second)
 	progressUpdates := make(chan ipn.OutgoingFile)
-	defer close(progressUpdates)
 
 	go func() {
 		defer t.Stop()
-		defer ext.updateOutgoingFiles(outgoingFiles)
+		defer e.updateOutgoingFiles(outgoingFiles)
 		for {
 			select {
 			case u, ok := <-progressUpdates:
@@ -144,26 +177,11 @@ func serveFilePut(h *localapi.Handler, w http.ResponseWriter, r *http.Request) {
 				}
 				outgoingFiles[u.ID] = &u
 			case <-t.C:
-				ext.updateOutgoingFiles(outgoingFiles)
+				e.updateOutgoingFiles(outgoingFiles)
 			}
 		}
 	}()
-
-	switch r.Method {
-	case "PUT":
-		file := ipn.OutgoingFile{
-			ID:           rands.HexString(30),
-			PeerID:       peerID,
-			Name:         filenameEscaped,
-			DeclaredSize: r.ContentLength,
-		}
-		singleFilePut(h, r.Context(), progressUpdates, w, r.Body, dstURL, file)
-	case "POST":
-		multiFilePost(h, progressUpdates, w, r, peerID, dstURL)
-	default:
-		http.Error(w, "want PUT to put file", http.StatusBadRequest)
-		return
-	}
+	return progressUpdates
 }
 
 func multiFilePost(h *localapi.Handler, progressUpdates chan (ipn.OutgoingFile), w http.ResponseWriter, r *http.Request, peerID tailcfg.StableNodeID, dstURL *url.URL) {
@@ -215,7 +233,8 @@ func multiFilePost(h *localapi.Handler, progressUpdates chan (ipn.OutgoingFile),
 			continue
 		}
 
-		if !singleFilePut(h, r.Context(), progressUpdates, ww, part, dstURL, outgoingFilesByName[part.FileName()]) {
+		file := outgoingFilesByName[part.FileName()]
+		if !singleFilePut(h, r.Context(), progressUpdates, ww, part, dstURL, "/v0/put/"+file.Name, file) {
 			return
 		}
 
@@ -275,6 +294,7 @@ func singleFilePut(
 	w http.ResponseWriter,
 	body io.Reader,
 	dstURL *url.URL,
+	putPath string, // e.g. "/v0/put/foo.jpg"
 	outgoingFile ipn.OutgoingFile,
 ) bool {
 	outgoingFile.Started = time.Now()
@@ -299,7 +319,7 @@ func singleFilePut(
 		Transport: h.LocalBackend().Dialer().PeerAPITransport(),
 		Timeout:   10 * time.Second,
 	}
-	req, err := http.NewRequestWithContext(ctx, "GET", dstURL.String()+"/v0/put/"+outgoingFile.Name, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", dstURL.String()+putPath, nil)
 	if err != nil {
 		http.Error(w, "bogus peer URL", http.StatusInternalServerError)
 		fail()
@@ -329,7 +349,7 @@ func singleFilePut(
 		resumeDuration = time.Since(resumeStart).Round(time.Millisecond)
 	}
 
-	outReq, err := http.NewRequestWithContext(ctx, "PUT", "http://peer/v0/put/"+outgoingFile.Name, remainingBody)
+	outReq, err := http.NewRequestWithContext(ctx, "PUT", "http://peer"+putPath, remainingBody)
 	if err != nil {
 		http.Error(w, "bogus outreq", http.StatusInternalServerError)
 		fail()
@@ -356,6 +376,99 @@ func singleFilePut(
 	return true
 }
 
+// serveFilePutTree sends a directory tree to another node. Like
+// serveFilePut, it relays the request to the target's PeerAPI
+// (/v0/put-tree/), resuming any file that was partially sent before.
+//
+// The manifest is sent first. Its response lists the files that are still
+// needed, which are then PUT one at a time, and the tree is committed with
+// a final POST once they have all been sent.
+//
+// URL format:
+//
+//   - POST /localapi/v0/file-put-tree/:stableID with a JSON apitype.TaildropTree
+//   - PUT /localapi/v0/file-put-tree/:stableID/:escaped-name/:escaped-path
+//   - POST /localapi/v0/file-put-tree/:stableID/:escaped-name
+func serveFilePutTree(h *localapi.Handler, w http.ResponseWriter, r *http.Request) {
+	metricFilePutTreeCalls.Add(1)
+
+	if !h.PermitWrite {
+		http.Error(w, "file access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "PUT" && r.Method != "POST" {
+		http.Error(w, "want PUT or POST to put directory", http.StatusBadRequest)
+		return
+	}
+
+	ext, ok := ipnlocal.GetExt[*Extension](h.LocalBackend())
+	if !ok {
+		http.Error(w, "misconfigured taildrop extension", http.StatusInternalServerError)
+		return
+	}
+
+	upath, ok := strings.CutPrefix(r.URL.EscapedPath(), "/localapi/v0/file-put-tree/")
+	if !ok {
+		http.Error(w, "misconfigured", http.StatusInternalServerError)
+		return
+	}
+	peerIDStr, rest, _ := strings.Cut(upath, "/")
+	peerID := tailcfg.StableNodeID(peerIDStr)
+	nameEscaped, pathEscaped, hasPath := strings.Cut(rest, "/")
+
+	dstURL, ok := fileTargetURL(ext, w, peerID)
+	if !ok {
+		return
+	}
+	rp := httputil.NewSingleHostReverseProxy(dstURL)
+	rp.Transport = h.LocalBackend().Dialer().PeerAPITransport()
+
+	switch {
+	case r.Method == "POST" && rest == "":
+		var tree apitype.TaildropTree
+		if err := json.NewDecoder(r.Body).Decode(&tree); err != nil {
+			http.Error(w, fmt.Sprintf("invalid manifest: %s", err), http.StatusBadRequest)
+			return
+		}
+		manifest, err := json.Marshal(tree)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		outReq, err := http.NewRequestWithContext(r.Context(), "PUT", "http://peer/v0/put-tree/"+url.PathEscape(tree.Name), bytes.NewReader(manifest))
+		if err != nil {
+			http.Error(w, "bogus outreq", http.StatusInternalServerError)
+			return
+		}
+		outReq.Header.Set("Content-Type", "application/json")
+		rp.ServeHTTP(w, outReq)
+	case r.Method == "POST" && nameEscaped != "" && !hasPath:
+		outReq, err := http.NewRequestWithContext(r.Context(), "POST", "http://peer/v0/put-tree/"+nameEscaped, nil)
+		if err != nil {
+			http.Error(w, "bogus outreq", http.StatusInternalServerError)
+			return
+		}
+		rp.ServeHTTP(w, outReq)
+	case r.Method == "PUT" && nameEscaped != "" && pathEscaped != "":
+		name, err := url.PathUnescape(nameEscaped + "/" + pathEscaped)
+		if err != nil {
+			http.Error(w, "bad filename", http.StatusBadRequest)
+			return
+		}
+		progressUpdates := ext.trackOutgoingFiles()
+		defer close(progressUpdates)
+		file := ipn.OutgoingFile{
+			ID:           rands.HexString(30),
+			PeerID:       peerID,
+			Name:         name,
+			DeclaredSize: r.ContentLength,
+		}
+		singleFilePut(h, r.Context(), progressUpdates, w, r.Body, dstURL, "/v0/put-tree/"+nameEscaped+"/"+pathEscaped, file)
+	default:
+		http.Error(w, "bogus URL", http.StatusBadRequest)
+	}
+}
+
 func serveFiles(h *localapi.Handler, w http.ResponseWriter, r *http.Request) {
 	if !h.PermitWrite {
 		http.Error(w, "file access denied", http.StatusForbidden)
@@ -379,6 +492,12 @@ func serveFiles(h *localapi.Handler, w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		ctx := r.Context()
+		// Files within received trees have names containing slashes,
+		// which only clients asking for them expect.
+		list, await := ext.WaitingFiles, ext.AwaitWaitingFiles
+		if r.FormValue("trees") == "true" {
+			list, await = ext.WaitingFilesAndTrees, ext.AwaitWaitingFilesAndTrees
+		}
 		var wfs []apitype.WaitingFile
 		if s := r.FormValue("waitsec"); s != "" && s != "0" {
 			d, err := strconv.Atoi(s)
@@ -390,14 +509,14 @@ func serveFiles(h *localapi.Handler, w http.ResponseWriter, r *http.Request) {
 			var cancel context.CancelFunc
 			ctx, cancel = context.WithDeadline(ctx, deadline)
 			defer cancel()
-			wfs, err = ext.AwaitWaitingFiles(ctx)
+			wfs, err = await(ctx)
 			if err != nil && ctx.Err() == nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
 		} else {
 			var err error
-			wfs, err = ext.WaitingFiles()
+			wfs, err = list()
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
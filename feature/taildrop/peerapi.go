@@ -5,6 +5,7 @@
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -12,6 +13,7 @@
 	"strings"
 	"time"
 
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/ipn/ipnlocal"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tstime"
@@ -21,10 +23,12 @@
 
 func init() {
 	ipnlocal.RegisterPeerAPIHandler("/v0/put/", handlePeerPut)
+	ipnlocal.RegisterPeerAPIHandler("/v0/put-tree/", handlePeerPutTree)
 }
 
 var (
-	metricPutCalls = clientmetric.NewCounter("peerapi_put")
+	metricPutCalls     = clientmetric.NewCounter("peerapi_put")
+	metricPutTreeCalls = clientmetric.NewCounter("peerapi_put_tree")
 )
 
 // canPutFile reports whether h can put a file ("Taildrop") to this node.
@@ -51,26 +55,106 @@ type extensionForPut interface {
 	manager() *manager
 	hasCapFileSharing() bool
 	Clock() tstime.Clock
+	receiveRules() (receiveRules, error)
 }
 
-func handlePeerPutWithBackend(h ipnlocal.PeerAPIHandler, ext extensionForPut, w http.ResponseWriter, r *http.Request) {
-	if r.Method == "PUT" {
-		metricPutCalls.Add(1)
-	}
-
+// putManager returns the taildrop manager to put files with, or nil
+// if h may not put files, in which case an error has been written to w.
+func putManager(h ipnlocal.PeerAPIHandler, ext extensionForPut, w http.ResponseWriter) *manager {
 	taildropMgr := ext.manager()
 	if taildropMgr == nil {
 		h.Logf("taildrop: no taildrop manager")
 		http.Error(w, "failed to get taildrop manager", http.StatusInternalServerError)
-		return
+		return nil
 	}
 
 	if !canPutFile(h) {
 		http.Error(w, ErrNoTaildrop.Error(), http.StatusForbidden)
-		return
+		return nil
 	}
 	if !ext.hasCapFileSharing() {
 		http.Error(w, ErrNoTaildrop.Error(), http.StatusForbidden)
+		return nil
+	}
+	return taildropMgr
+}
+
+// receiveRuleFor returns the receive rule that applies to the named file
+// of the given size from h, or nil if none does. The size may be negative
+// if it is not yet known. It returns an error if the file must not be
+// received.
+func receiveRuleFor(h ipnlocal.PeerAPIHandler, ext extensionForPut, name string, size int64) (*receiveRule, error) {
+	rules, err := ext.receiveRules()
+	if err != nil {
+		// Refuse everything rather than receiving files that valid
+		// rules might have rejected.
+		h.Logf("invalid receive rules: %v", err)
+		return nil, errReceiveRejected
+	}
+	return rules.ruleFor(h, name, size)
+}
+
+// receiveRuleForTree is like receiveRuleFor, but for the directory tree t.
+// The paths of the files within the tree are matched against the rules as
+// well as its name: each file must be allowed by the rule it matches, and
+// that rule must put it where the tree's rule puts the tree. A tree's name
+// thus cannot bring in files that the rules would not receive.
+func receiveRuleForTree(h ipnlocal.PeerAPIHandler, ext extensionForPut, t *apitype.TaildropTree) (*receiveRule, error) {
+	rules, err := ext.receiveRules()
+	if err != nil {
+		h.Logf("invalid receive rules: %v", err)
+		return nil, errReceiveRejected
+	}
+	var size int64
+	for _, f := range t.Files {
+		size += max(f.Size, 0)
+	}
+	rule, err := rules.ruleFor(h, t.Name, size)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range t.Files {
+		if f.Mode.IsDir() {
+			continue
+		}
+		fileRule, err := rules.ruleFor(h, t.Name+"/"+f.Path, f.Size)
+		if err != nil {
+			return nil, err
+		}
+		if !fileRule.sameDestination(rule) {
+			h.Logf("rejected put of directory %q from %v/%v: %q is received elsewhere", t.Name, senderOf(h), h.Peer().ComputedName(), f.Path)
+			return nil, errReceiveRejected
+		}
+	}
+	return rule, nil
+}
+
+// ruleFor is the implementation of receiveRuleFor, for the rules rs.
+func (rs receiveRules) ruleFor(h ipnlocal.PeerAPIHandler, name string, size int64) (*receiveRule, error) {
+	sender := senderOf(h)
+	rule := rs.match(sender, name)
+	switch {
+	case rule == nil:
+		return nil, nil
+	case rule.action == receiveReject:
+		h.Logf("rejected put from %v/%v by receive rule %q", sender, h.Peer().ComputedName(), rule.spec)
+		return nil, errReceiveRejected
+	case rule.maxSize > 0 && size < 0:
+		return nil, errReceiveSizeUnknown
+	case rule.maxSize > 0 && size > rule.maxSize:
+		h.Logf("rejected put of %s from %v/%v by receive rule %q", approxSize(size), sender, h.Peer().ComputedName(), rule.spec)
+		return nil, errReceiveTooLarge
+	}
+	return rule, nil
+}
+
+func handlePeerPutWithBackend(h ipnlocal.PeerAPIHandler, ext extensionForPut, w http.ResponseWriter, r *http.Request) {
+	if r.Method == "PUT" {
+		metricPutCalls.Add(1)
+	}
+
+	taildropMgr := putManager(h, ext, w)
+	if taildropMgr == nil {
 		return
 	}
 	rawPath := r.URL.EscapedPath()
@@ -138,7 +222,21 @@ func handlePeerPutWithBackend(h ipnlocal.PeerAPIHandler, ext extensionForPut, w
 			}
 			offset = ranges[0].Start
 		}
-		n, err := taildropMgr.PutFile(clientID(fmt.Sprint(id)), baseName, r.Body, offset, r.ContentLength)
+		size := int64(-1)
+		if r.ContentLength >= 0 {
+			size = offset + r.ContentLength
+		}
+		rule, err := receiveRuleFor(h, ext, baseName, size)
+		if err != nil {
+			writePutError(w, err)
+			return
+		}
+		var n int64
+		if rule != nil && rule.action == receiveAccept {
+			n, err = taildropMgr.AcceptFile(clientID(fmt.Sprint(id)), baseName, r.Body, offset, r.ContentLength, rule.dir)
+		} else {
+			n, err = taildropMgr.PutFile(clientID(fmt.Sprint(id)), baseName, r.Body, offset, r.ContentLength)
+		}
 		switch err {
 		case nil:
 			d := ext.Clock().Since(t0).Round(time.Second / 10)
@@ -158,6 +256,168 @@ func handlePeerPutWithBackend(h ipnlocal.PeerAPIHandler, ext extensionForPut, w
 	}
 }
 
+func handlePeerPutTree(h ipnlocal.PeerAPIHandler, w http.ResponseWriter, r *http.Request) {
+	ext, ok := ipnlocal.GetExt[*Extension](h.LocalBackend())
+	if !ok {
+		http.Error(w, "miswired", http.StatusInternalServerError)
+		return
+	}
+	handlePeerPutTreeWithBackend(h, ext, w, r)
+}
+
+// handlePeerPutTreeWithBackend receives directory trees.
+//
+// URL format:
+//
+//   - PUT /v0/put-tree/:name with a JSON apitype.TaildropTree manifest,
+//     which returns a JSON apitype.TaildropTreeStatus
+//   - GET /v0/put-tree/:name/:escaped-path to stream the block hashes
+//     of a partially received file
+//   - PUT /v0/put-tree/:name/:escaped-path with the contents of a file,
+//     optionally with a Range header to resume
+//   - POST /v0/put-tree/:name to verify the received tree and move it
+//     into place
+func handlePeerPutTreeWithBackend(h ipnlocal.PeerAPIHandler, ext extensionForPut, w http.ResponseWriter, r *http.Request) {
+	if r.Method == "PUT" {
+		metricPutTreeCalls.Add(1)
+	}
+
+	taildropMgr := putManager(h, ext, w)
+	if taildropMgr == nil {
+		return
+	}
+	rawPath, ok := strings.CutPrefix(r.URL.EscapedPath(), "/v0/put-tree/")
+	if !ok {
+		http.Error(w, "misconfigured internals", http.StatusForbidden)
+		return
+	}
+	nameEscaped, pathEscaped, hasPath := strings.Cut(rawPath, "/")
+	name, err := url.PathUnescape(nameEscaped)
+	if err != nil {
+		http.Error(w, ErrInvalidFileName.Error(), http.StatusBadRequest)
+		return
+	}
+	filePath, err := url.PathUnescape(pathEscaped)
+	if err != nil {
+		http.Error(w, ErrInvalidFileName.Error(), http.StatusBadRequest)
+		return
+	}
+	id := clientID(h.Peer().StableID())
+
+	switch {
+	case r.Method == "PUT" && !hasPath:
+		var tree apitype.TaildropTree
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxTreeManifestSize)).Decode(&tree); err != nil {
+			http.Error(w, "invalid manifest: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if tree.Name != name {
+			http.Error(w, "manifest name does not match URL", http.StatusBadRequest)
+			return
+		}
+		if _, err := receiveRuleForTree(h, ext, &tree); err != nil {
+			writePutError(w, err)
+			return
+		}
+		status, err := taildropMgr.PutTree(id, &tree)
+		if err != nil {
+			writePutError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	case r.Method == "POST" && !hasPath:
+		t0 := ext.Clock().Now()
+		// The rules may have changed since the manifest was put, so check
+		// them again. The contents must match the manifest.
+		dest := func(t *apitype.TaildropTree) (dstDir string, err error) {
+			rule, err := receiveRuleForTree(h, ext, t)
+			if err != nil {
+				return "", err
+			}
+			if rule != nil && rule.action == receiveAccept {
+				dstDir = rule.dir
+			}
+			return dstDir, nil
+		}
+		if _, err := taildropMgr.CommitTree(id, name, dest); err != nil {
+			writePutError(w, err)
+			return
+		}
+		d := ext.Clock().Since(t0).Round(time.Second / 10)
+		h.Logf("got put of directory in %v from %v/%v", d, h.RemoteAddr().Addr(), h.Peer().ComputedName)
+		io.WriteString(w, "{}\n")
+	case r.Method == "GET" && hasPath:
+		next, close, err := taildropMgr.HashTreeFile(id, name, filePath)
+		if err != nil {
+			writePutError(w, err)
+			return
+		}
+		defer close()
+		enc := json.NewEncoder(w)
+		for {
+			switch cs, err := next(); {
+			case err == io.EOF:
+				return
+			case err != nil:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				h.Logf("HashTreeFile.next error: %v", err)
+				return
+			default:
+				if err := enc.Encode(cs); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					h.Logf("json.Encoder.Encode error: %v", err)
+					return
+				}
+			}
+		}
+	case r.Method == "PUT" && hasPath:
+		var offset int64
+		if rangeHdr := r.Header.Get("Range"); rangeHdr != "" {
+			ranges, ok := httphdr.ParseRange(rangeHdr)
+			if !ok || len(ranges) != 1 || ranges[0].Length != 0 {
+				http.Error(w, "invalid Range header", http.StatusBadRequest)
+				return
+			}
+			offset = ranges[0].Start
+		}
+		if _, err := taildropMgr.PutTreeFile(id, name, filePath, r.Body, offset, r.ContentLength); err != nil {
+			writePutError(w, err)
+			return
+		}
+		io.WriteString(w, "{}\n")
+	default:
+		http.Error(w, "expected method GET, PUT or POST", http.StatusMethodNotAllowed)
+	}
+}
+
+// maxTreeManifestSize is the maximum size of a tree's JSON manifest, which
+// is enough for maxTreeFiles files with paths of typical length.
+const maxTreeManifestSize = 16 << 20
+
+// writePutError writes err, from putting a tree or checking receive rules,
+// with a corresponding status code.
+func writePutError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrNoTaildrop), errors.Is(err, ErrNotAccessible), errors.Is(err, errReceiveRejected):
+		code = http.StatusForbidden
+	case errors.Is(err, ErrInvalidFileName), errors.Is(err, errTreeUnsupported):
+		code = http.StatusBadRequest
+	case errors.Is(err, ErrFileExists):
+		code = http.StatusConflict
+	case errors.Is(err, errTreeNotFound):
+		code = http.StatusNotFound
+	case errors.Is(err, errTreeIncomplete), errors.Is(err, errTreeMismatch):
+		code = http.StatusPreconditionFailed
+	case errors.Is(err, errReceiveSizeUnknown):
+		code = http.StatusLengthRequired
+	case errors.Is(err, errReceiveTooLarge):
+		code = http.StatusRequestEntityTooLarge
+	}
+	http.Error(w, err.Error(), code)
+}
+
 func approxSize(n int64) string {
 	if n <= 1<<10 {
 		return "<=1KB"
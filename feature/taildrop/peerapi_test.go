@@ -33,12 +33,15 @@ type peerAPIHandler struct {
 	isSelf     bool             // whether peerNode is owned by same user as this node
 	selfNode   tailcfg.NodeView // this node; always non-nil
 	peerNode   tailcfg.NodeView // peerNode is who's making the request
+	peerUser   tailcfg.UserProfile
+	caps       tailcfg.PeerCapMap
 }
 
 func (h *peerAPIHandler) IsSelfUntagged() bool {
 	return !h.selfNode.IsTagged() && !h.peerNode.IsTagged() && h.isSelf
 }
 func (h *peerAPIHandler) Peer() tailcfg.NodeView               { return h.peerNode }
+func (h *peerAPIHandler) PeerUser() tailcfg.UserProfile        { return h.peerUser }
 func (h *peerAPIHandler) Self() tailcfg.NodeView               { return h.selfNode }
 func (h *peerAPIHandler) RemoteAddr() netip.AddrPort           { return h.remoteAddr }
 func (h *peerAPIHandler) LocalBackend() *ipnlocal.LocalBackend { panic("unexpected") }
@@ -47,7 +50,7 @@ func (h *peerAPIHandler) Logf(format string, a ...any) {
 }
 
 func (h *peerAPIHandler) PeerCaps() tailcfg.PeerCapMap {
-	return nil
+	return h.caps
 }
 
 type fakeExtension struct {
@@ -55,6 +58,7 @@ type fakeExtension struct {
 	capFileSharing bool
 	clock          tstime.Clock
 	taildrop       *manager
+	rules          receiveRules
 }
 
 func (lb *fakeExtension) manager() *manager {
@@ -64,6 +68,9 @@ func (lb *fakeExtension) Clock() tstime.Clock { return lb.clock }
 func (lb *fakeExtension) hasCapFileSharing() bool {
 	return lb.capFileSharing
 }
+func (lb *fakeExtension) receiveRules() (receiveRules, error) {
+	return lb.rules, nil
+}
 
 type peerAPITestEnv struct {
 	taildrop *manager
@@ -86,7 +86,13 @@ func (m *manager) HashPartialFile(id clientID, baseName string) (next func() (bl
 		}
 		return nil, nil, redactError(err)
 	}
+	next, close = hashBlocks(f)
+	return next, close, nil
+}
 
+// hashBlocks returns a function that hashes the next block read from f,
+// and a function that closes f.
+func hashBlocks(f io.ReadCloser) (next func() (blockChecksum, error), close func() error) {
 	b := make([]byte, blockSize) // TODO: Pool this?
 	next = func() (blockChecksum, error) {
 		switch n, err := io.ReadFull(f, b); {
@@ -98,8 +104,7 @@ func (m *manager) HashPartialFile(id clientID, baseName string) (next func() (bl
 			return blockChecksum{hash(b[:n]), hashAlgorithm, int64(n)}, nil
 		}
 	}
-	close = f.Close
-	return next, close, nil
+	return next, f.Close
 }
 
 // resumeReader reads and discards the leading content of r
@@ -11,6 +11,7 @@
 	"os"
 	"runtime"
 	"sort"
+	"strings"
 	"time"
 
 	"tailscale.com/client/tailscale/apitype"
@@ -60,7 +61,8 @@ func (m *manager) HasFilesWaiting() bool {
 }
 
 // WaitingFiles returns the list of files that have been sent by a
-// peer that are waiting in [Handler.Dir].
+// peer that are waiting in [Handler.Dir], excluding the files within
+// received trees; see [manager.WaitingTreeFiles].
 // This always returns nil when [Handler.DirectFileMode] is false.
 func (m *manager) WaitingFiles() ([]apitype.WaitingFile, error) {
 	if m == nil || m.opts.fileOps == nil {
@@ -104,6 +106,9 @@ func (m *manager) DeleteFile(baseName string) error {
 	if m.opts.DirectFileMode {
 		return errors.New("deletes not allowed in direct mode")
 	}
+	if strings.Contains(baseName, "/") {
+		return m.deleteTreeFile(baseName)
+	}
 
 	var bo *backoff.Backoff
 	logf := m.opts.Logf
@@ -158,6 +163,9 @@ func (m *manager) OpenFile(baseName string) (rc io.ReadCloser, size int64, err e
 	if m.opts.DirectFileMode {
 		return nil, 0, errors.New("opens not allowed in direct mode")
 	}
+	if strings.Contains(baseName, "/") {
+		return m.openTreeFile(baseName)
+	}
 	if _, err := m.opts.fileOps.Stat(baseName + deletedSuffix); err == nil {
 		return nil, 0, redactError(&fs.PathError{Op: "open", Path: baseName, Err: fs.ErrNotExist})
 	}
@@ -0,0 +1,254 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package taildrop
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"tailscale.com/ipn/ipnlocal"
+	"tailscale.com/util/syspolicy"
+)
+
+// Receive rules decide what happens to files sent to this node, based on
+// who sent them and their name. Each rule is a list of space-separated
+// key=value fields:
+//
+//	from=<sender>      who the rule applies to; "*" (the default) for anyone,
+//	                   "tag:<name>" for nodes with that tag, or the login name
+//	                   of the user owning an untagged node. May be repeated.
+//	name=<pattern>     the names the rule applies to, as a [path.Match]
+//	                   pattern; "*" by default. For directory trees,
+//	                   the name of the tree and the path of every file
+//	                   within it, starting with the tree's name, are
+//	                   matched. Patterns without a slash match the last
+//	                   element of a path.
+//	max-size=<size>    the maximum size of a file or tree, in bytes or with
+//	                   a K, M, G or T suffix for powers of 1024.
+//	action=<action>    "inbox" (the default) to receive files as usual,
+//	                   "accept" to move them into dir once received,
+//	                   or "reject" to refuse them.
+//	dir=<path>         the absolute path of the directory to accept into.
+//
+// For example:
+//
+//	from=tag:ci name=*.tar.gz max-size=2G action=accept dir=/srv/artifacts
+//	from=* action=reject
+//
+// The first matching rule applies. If no rule matches, files are received
+// as usual, so a final catch-all rule is needed to reject everything else.
+// A directory tree is only received if every file within it is allowed
+// by the rule it matches, and that rule has the same action and dir as the
+// one matching the tree's name.
+
+// receiveAction is what to do with a file matched by a receive rule.
+type receiveAction string
+
+const (
+	receiveInbox  receiveAction = "inbox"
+	receiveAccept receiveAction = "accept"
+	receiveReject receiveAction = "reject"
+)
+
+var (
+	errReceiveRejected    = errors.New("file rejected by receive rules")
+	errReceiveTooLarge    = errors.New("file too large for receive rules")
+	errReceiveSizeUnknown = errors.New("file size required by receive rules")
+	errAcceptUnsupported  = errors.New("accepting files into a directory not supported")
+)
+
+// receiveRule is a parsed receive rule.
+type receiveRule struct {
+	spec    string   // as configured, for logging
+	from    []string // "*", "tag:<name>" or a login name
+	name    string   // path.Match pattern
+	maxSize int64    // or zero for no limit
+	action  receiveAction
+	dir     string // for receiveAccept
+}
+
+// receiveRules is an ordered list of receive rules.
+type receiveRules []*receiveRule
+
+// receiveSender identifies who is sending a file, for matching against
+// receive rules.
+type receiveSender struct {
+	tags  []string // of the sending node
+	login string   // of the sending node's owner, if it is untagged
+}
+
+func senderOf(h ipnlocal.PeerAPIHandler) receiveSender {
+	if tags := h.Peer().Tags(); tags.Len() > 0 {
+		return receiveSender{tags: tags.AsSlice()}
+	}
+	return receiveSender{login: h.PeerUser().LoginName}
+}
+
+func (s receiveSender) String() string {
+	if len(s.tags) > 0 {
+		return strings.Join(s.tags, ",")
+	}
+	return s.login
+}
+
+// parseReceiveRules parses the rules in specs, as described above.
+func parseReceiveRules(specs []string) (receiveRules, error) {
+	var rules receiveRules
+	for _, spec := range specs {
+		r, err := parseReceiveRule(spec)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func parseReceiveRule(spec string) (*receiveRule, error) {
+	r := &receiveRule{spec: spec, name: "*", action: receiveInbox}
+	fields := strings.Fields(spec)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("invalid receive rule %q: empty", spec)
+	}
+	for _, f := range fields {
+		k, v, ok := strings.Cut(f, "=")
+		if !ok || v == "" {
+			return nil, fmt.Errorf("invalid receive rule %q: expected key=value, got %q", spec, f)
+		}
+		switch k {
+		case "from":
+			r.from = append(r.from, v)
+		case "name":
+			if _, err := path.Match(v, ""); err != nil {
+				return nil, fmt.Errorf("invalid receive rule %q: bad name pattern %q", spec, v)
+			}
+			r.name = v
+		case "max-size":
+			n, err := parseSize(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid receive rule %q: %w", spec, err)
+			}
+			r.maxSize = n
+		case "action":
+			r.action = receiveAction(v)
+			if !slices.Contains([]receiveAction{receiveInbox, receiveAccept, receiveReject}, r.action) {
+				return nil, fmt.Errorf("invalid receive rule %q: unknown action %q", spec, v)
+			}
+		case "dir":
+			if !filepath.IsAbs(v) {
+				return nil, fmt.Errorf("invalid receive rule %q: dir %q is not absolute", spec, v)
+			}
+			r.dir = filepath.Clean(v)
+		default:
+			return nil, fmt.Errorf("invalid receive rule %q: unknown key %q", spec, k)
+		}
+	}
+	if len(r.from) == 0 {
+		r.from = []string{"*"}
+	}
+	if (r.action == receiveAccept) != (r.dir != "") {
+		return nil, fmt.Errorf("invalid receive rule %q: dir must be set with, and only with, action=accept", spec)
+	}
+	return r, nil
+}
+
+// parseSize parses a size in bytes, optionally with a K, M, G or T suffix.
+func parseSize(s string) (int64, error) {
+	num, shift := s, 0
+	if i := strings.IndexAny(s, "KMGT"); i >= 0 && i == len(s)-1 {
+		num, shift = s[:i], 10*(1+strings.IndexByte("KMGT", s[i]))
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n <= 0 || n > (1<<62)>>shift {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n << shift, nil
+}
+
+// matches reports whether r applies to the named file or tree from s.
+// The name of a file within a tree is its slash-separated path.
+func (r *receiveRule) matches(s receiveSender, name string) bool {
+	if !strings.Contains(r.name, "/") {
+		name = path.Base(name)
+	}
+	if ok, _ := path.Match(r.name, name); !ok {
+		return false
+	}
+	return slices.ContainsFunc(r.from, func(from string) bool {
+		switch {
+		case from == "*":
+			return true
+		case strings.HasPrefix(from, "tag:"):
+			return slices.Contains(s.tags, from)
+		default:
+			return len(s.tags) == 0 && s.login != "" && strings.EqualFold(from, s.login)
+		}
+	})
+}
+
+// sameDestination reports whether files received under r and o end up in
+// the same place. Either may be nil, for files received as usual.
+func (r *receiveRule) sameDestination(o *receiveRule) bool {
+	action := func(r *receiveRule) receiveAction {
+		if r == nil {
+			return receiveInbox
+		}
+		return r.action
+	}
+	dir := func(r *receiveRule) string {
+		if r == nil || r.action != receiveAccept {
+			return ""
+		}
+		return r.dir
+	}
+	return action(r) == action(o) && dir(r) == dir(o)
+}
+
+// match returns the first rule that applies to the named file or tree
+// from s, or nil if none does.
+func (rs receiveRules) match(s receiveSender, name string) *receiveRule {
+	for _, r := range rs {
+		if r.matches(s, name) {
+			return r
+		}
+	}
+	return nil
+}
+
+// SetReceiveRules sets the rules deciding what happens to received files,
+// overriding any configured by the [syspolicy.TaildropReceiveRules] policy
+// setting. See the syspolicy setting for the syntax of each rule.
+// A nil slice restores the use of the policy setting.
+//
+// It should only be called before the extension is initialized.
+func (e *Extension) SetReceiveRules(specs []string) error {
+	rules, err := parseReceiveRules(specs)
+	if err != nil {
+		return err
+	}
+	if specs == nil {
+		rules = nil
+	} else if rules == nil {
+		rules = receiveRules{}
+	}
+	e.receiveRulesOverride = rules
+	return nil
+}
+
+// receiveRules returns the rules deciding what happens to received files.
+func (e *Extension) receiveRules() (receiveRules, error) {
+	if e.receiveRulesOverride != nil {
+		return e.receiveRulesOverride, nil
+	}
+	specs, err := syspolicy.GetStringArray(syspolicy.TaildropReceiveRules, nil)
+	if err != nil {
+		return nil, err
+	}
+	return parseReceiveRules(specs)
+}
@@ -0,0 +1,297 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package taildrop
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstest"
+	"tailscale.com/util/must"
+)
+
+func TestParseReceiveRules(t *testing.T) {
+	tests := []struct {
+		spec string
+		ok   bool
+	}{
+		{"from=tag:ci name=*.tar.gz max-size=2G action=accept dir=/srv/artifacts", true},
+		{"from=tag:ci from=alice@example.com action=inbox", true},
+		{"from=* action=reject", true},
+		{"max-size=100", true},
+		{"", false},
+		{"from", false},
+		{"from=", false},
+		{"bogus=1", false},
+		{"action=delete", false},
+		{"action=accept", false},
+		{"action=reject dir=/tmp", false},
+		{"action=accept dir=relative", false},
+		{"name=[", false},
+		{"max-size=0", false},
+		{"max-size=-1", false},
+		{"max-size=1X", false},
+		{"max-size=9999999999T", false},
+	}
+	for _, tt := range tests {
+		_, err := parseReceiveRules([]string{tt.spec})
+		if (err == nil) != tt.ok {
+			t.Errorf("parseReceiveRules(%q) = %v, want ok=%v", tt.spec, err, tt.ok)
+		}
+	}
+
+	r := must.Get(parseReceiveRule("name=*.iso max-size=2G action=accept dir=/srv/isos/"))
+	if r.maxSize != 2<<30 || r.dir != filepath.Clean("/srv/isos") || r.from[0] != "*" {
+		t.Errorf("parsed rule = %+v", r)
+	}
+}
+
+func TestReceiveRulesMatch(t *testing.T) {
+	rules := must.Get(parseReceiveRules([]string{
+		"from=tag:ci name=*.tar.gz action=accept dir=/srv/artifacts",
+		"from=tag:ci action=reject",
+		"from=Alice@example.com from=tag:dev",
+		"from=* action=reject",
+	}))
+	ci := receiveSender{tags: []string{"tag:build", "tag:ci"}}
+	alice := receiveSender{login: "alice@example.com"}
+	bob := receiveSender{login: "bob@example.com"}
+	tests := []struct {
+		sender receiveSender
+		name   string
+		want   int // index of the matching rule
+	}{
+		{ci, "out.tar.gz", 0},
+		{ci, "out.zip", 1},
+		{alice, "out.tar.gz", 2},
+		{receiveSender{tags: []string{"tag:dev"}}, "x", 2},
+		{bob, "out.tar.gz", 3},
+		{receiveSender{tags: []string{"tag:Alice@example.com"}}, "x", 3},
+	}
+	for _, tt := range tests {
+		if got := rules.match(tt.sender, tt.name); got != rules[tt.want] {
+			t.Errorf("match(%v, %q) = %q, want %q", tt.sender, tt.name, got.spec, rules[tt.want].spec)
+		}
+	}
+	if got := rules[:2].match(bob, "x"); got != nil {
+		t.Errorf("match with no matching rule = %q, want nil", got.spec)
+	}
+}
+
+func TestHandlePeerPutReceiveRules(t *testing.T) {
+	inbox, artifacts := t.TempDir(), t.TempDir()
+	m := managerOptions{Logf: t.Logf, fileOps: must.Get(newFileOps(inbox))}.New()
+	defer m.Shutdown()
+	ext := &fakeExtension{
+		logf:           t.Logf,
+		capFileSharing: true,
+		clock:          &tstest.Clock{},
+		taildrop:       m,
+		rules: must.Get(parseReceiveRules([]string{
+			"from=tag:ci name=*.tar.gz max-size=10 action=accept dir=" + artifacts,
+			"from=alice@example.com",
+			"from=* action=reject",
+		})),
+	}
+	selfNode := (&tailcfg.Node{
+		Addresses: []netip.Prefix{netip.MustParsePrefix("100.100.100.101/32")},
+	}).View()
+	ci := &peerAPIHandler{
+		selfNode: selfNode,
+		peerNode: (&tailcfg.Node{ComputedName: "ci", Tags: []string{"tag:ci"}}).View(),
+		peerUser: tailcfg.UserProfile{LoginName: "tagged-devices"},
+	}
+	alice := &peerAPIHandler{
+		isSelf:   true,
+		selfNode: selfNode,
+		peerNode: (&tailcfg.Node{ComputedName: "alice"}).View(),
+		peerUser: tailcfg.UserProfile{LoginName: "alice@example.com"},
+	}
+	bob := &peerAPIHandler{
+		selfNode: selfNode,
+		peerNode: (&tailcfg.Node{ComputedName: "bob"}).View(),
+		peerUser: tailcfg.UserProfile{LoginName: "bob@example.com"},
+	}
+	// Let everyone send files, so that only the rules decide.
+	canSend := tailcfg.PeerCapMap{tailcfg.PeerCapabilityFileSharingSend: nil}
+	ci.caps, alice.caps, bob.caps = canSend, canSend, canSend
+
+	tests := []struct {
+		name   string
+		h      *peerAPIHandler
+		file   string
+		body   io.Reader
+		status int
+	}{
+		{"accept", ci, "a.tar.gz", strings.NewReader("artifact"), http.StatusOK},
+		{"accept-conflict", ci, "a.tar.gz", strings.NewReader("artifact2"), http.StatusOK},
+		{"too-large", ci, "b.tar.gz", strings.NewReader("much too large"), http.StatusRequestEntityTooLarge},
+		{"unknown-size", ci, "c.tar.gz", struct{ io.Reader }{strings.NewReader("chunked")}, http.StatusLengthRequired},
+		{"no-matching-name", ci, "a.zip", strings.NewReader("zip"), http.StatusForbidden},
+		{"inbox", alice, "a.txt", strings.NewReader("hello"), http.StatusOK},
+		{"reject", bob, "a.txt", strings.NewReader("hello"), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			handlePeerPutWithBackend(tt.h, ext, rr, httptest.NewRequest("PUT", "/v0/put/"+tt.file, tt.body))
+			if rr.Code != tt.status {
+				t.Errorf("status = %v, want %v: %s", rr.Code, tt.status, rr.Body)
+			}
+		})
+	}
+
+	for name, want := range map[string]string{
+		"a.tar.gz":     "artifact",
+		"a (1).tar.gz": "artifact2",
+	} {
+		if got, err := os.ReadFile(filepath.Join(artifacts, name)); err != nil || string(got) != want {
+			t.Errorf("accepted %s = %q, %v; want %q", name, got, err, want)
+		}
+	}
+	if entries := must.Get(os.ReadDir(artifacts)); len(entries) != 2 {
+		t.Errorf("got %d files in accept directory, want 2", len(entries))
+	}
+	wfs := must.Get(m.WaitingFiles())
+	if len(wfs) != 1 || wfs[0].Name != "a.txt" {
+		t.Errorf("WaitingFiles = %+v, want only a.txt", wfs)
+	}
+}
+
+func TestHandlePeerPutTreeReceiveRules(t *testing.T) {
+	artifacts := t.TempDir()
+	accept := " action=accept dir=" + artifacts
+	ci := &peerAPIHandler{
+		selfNode: (&tailcfg.Node{
+			Addresses: []netip.Prefix{netip.MustParsePrefix("100.100.100.101/32")},
+		}).View(),
+		peerNode: (&tailcfg.Node{ComputedName: "ci", Tags: []string{"tag:ci"}}).View(),
+		peerUser: tailcfg.UserProfile{LoginName: "tagged-devices"},
+		caps:     tailcfg.PeerCapMap{tailcfg.PeerCapabilityFileSharingSend: nil},
+	}
+	manifest := must.Get(json.Marshal(testTree(nil)))
+
+	tests := []struct {
+		name   string
+		rules  []string
+		status int
+	}{
+		{
+			// readme.txt isn't allowed, even though the tree's name is.
+			name:   "file-rejected",
+			rules:  []string{"name=photos" + accept, "name=*.jpg" + accept, "action=reject"},
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "all-allowed",
+			rules:  []string{"name=photos" + accept, "name=*.jpg" + accept, "name=photos/readme.txt" + accept, "action=reject"},
+			status: http.StatusOK,
+		},
+		{
+			// readme.txt would be received into the inbox instead.
+			name:   "file-elsewhere",
+			rules:  []string{"name=photos" + accept, "name=*.jpg" + accept, "name=*.txt", "action=reject"},
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "tree-rejected",
+			rules:  []string{"name=*.jpg" + accept, "name=*.txt" + accept, "action=reject"},
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "catch-all",
+			rules:  []string{"max-size=1M" + accept},
+			status: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := managerOptions{Logf: t.Logf, fileOps: must.Get(newFileOps(t.TempDir()))}.New()
+			defer m.Shutdown()
+			ext := &fakeExtension{
+				logf:           t.Logf,
+				capFileSharing: true,
+				clock:          &tstest.Clock{},
+				taildrop:       m,
+				rules:          must.Get(parseReceiveRules(tt.rules)),
+			}
+			rr := httptest.NewRecorder()
+			handlePeerPutTreeWithBackend(ci, ext, rr, httptest.NewRequest("PUT", "/v0/put-tree/photos", bytes.NewReader(manifest)))
+			if rr.Code != tt.status {
+				t.Errorf("status = %v, want %v: %s", rr.Code, tt.status, rr.Body)
+			}
+		})
+	}
+}
+
+func TestCommitTreeAccept(t *testing.T) {
+	contents := map[string]string{
+		"2024/a.jpg": "aaaa",
+		"2024/b.jpg": "bbbb",
+		"readme.txt": "hello",
+	}
+	inbox, dst := t.TempDir(), filepath.Join(t.TempDir(), "photos")
+	m := managerOptions{Logf: t.Logf, fileOps: must.Get(newFileOps(inbox))}.New()
+	defer m.Shutdown()
+	id := clientID("n123")
+
+	tree := testTree(contents)
+	status := must.Get(m.PutTree(id, tree))
+	for _, p := range status.Need {
+		must.Get(m.PutTreeFile(id, "photos", p, strings.NewReader(contents[p]), 0, -1))
+	}
+	finalPath := must.Get(m.CommitTree(id, "photos", func(*apitype.TaildropTree) (string, error) { return dst, nil }))
+	if want := filepath.Join(dst, "photos"); finalPath != want {
+		t.Errorf("CommitTree = %q, want %q", finalPath, want)
+	}
+	if got := must.Get(os.ReadFile(filepath.Join(finalPath, "2024", "a.jpg"))); string(got) != "aaaa" {
+		t.Errorf("got %q, want %q", got, "aaaa")
+	}
+	if wfs := must.Get(m.WaitingFiles()); len(wfs) != 0 {
+		t.Errorf("WaitingFiles = %+v, want none", wfs)
+	}
+	if entries := must.Get(os.ReadDir(inbox)); len(entries) != 0 {
+		t.Errorf("got %d entries left in %s", len(entries), inbox)
+	}
+}
+
+func TestCopyAll(t *testing.T) {
+	src := t.TempDir()
+	tree := testTree(map[string]string{"2024/a.jpg": "aaaa", "readme.txt": "hello"})
+	for _, f := range tree.Files {
+		p := filepath.Join(src, filepath.FromSlash(f.Path))
+		if f.Mode.IsDir() {
+			must.Do(os.MkdirAll(p, 0o700))
+		} else {
+			must.Do(os.WriteFile(p, []byte(f.Path), 0o600))
+		}
+	}
+	for _, f := range tree.Files {
+		p := filepath.Join(src, filepath.FromSlash(f.Path))
+		must.Do(os.Chmod(p, f.Mode.Perm()))
+		must.Do(os.Chtimes(p, f.ModTime, f.ModTime))
+	}
+
+	dst := filepath.Join(t.TempDir(), "copy")
+	must.Do(copyAll(src, dst))
+	for _, f := range tree.Files {
+		fi := must.Get(os.Stat(filepath.Join(dst, filepath.FromSlash(f.Path))))
+		if !fi.ModTime().Equal(f.ModTime) {
+			t.Errorf("%s: ModTime = %v, want %v", f.Path, fi.ModTime(), f.ModTime)
+		}
+		if fi.IsDir() != f.Mode.IsDir() {
+			t.Errorf("%s: IsDir = %v, want %v", f.Path, fi.IsDir(), f.Mode.IsDir())
+		}
+	}
+}
@@ -71,7 +71,17 @@ func (f *incomingFile) Write(p []byte) (n int, err error) {
 // a partial file. While resuming, PutFile may be called again with a non-zero
 // offset to specify where to resume receiving data at.
 func (m *manager) PutFile(id clientID, baseName string, r io.Reader, offset, length int64) (fileLength int64, err error) {
+	return m.putFile(id, baseName, r, offset, length, "")
+}
+
+// AcceptFile is like [manager.PutFile], but once received, the file is
+// moved into dstDir instead of being left for pick-up in [manager.Dir].
+// It is only supported by FileOps on the local filesystem.
+func (m *manager) AcceptFile(id clientID, baseName string, r io.Reader, offset, length int64, dstDir string) (fileLength int64, err error) {
+	return m.putFile(id, baseName, r, offset, length, dstDir)
+}
 
+func (m *manager) putFile(id clientID, baseName string, r io.Reader, offset, length int64, dstDir string) (fileLength int64, err error) {
 	switch {
 	case m == nil || m.opts.fileOps == nil:
 		return 0, ErrNoTaildrop
@@ -80,6 +90,9 @@ func (m *manager) PutFile(id clientID, baseName string, r io.Reader, offset, len
 	case distro.Get() == distro.Unraid && !m.opts.DirectFileMode:
 		return 0, ErrNotAccessible
 	}
+	if _, ok := m.opts.fileOps.(localFileOps); dstDir != "" && !ok {
+		return 0, errAcceptUnsupported
+	}
 
 	if err := validateBaseName(baseName); err != nil {
 		return 0, err
@@ -152,8 +165,14 @@ func (m *manager) PutFile(id clientID, baseName string, r io.Reader, offset, len
 	inFile.done = true
 	inFile.mu.Unlock()
 
-	// 6) Finalize (rename/move) the partial into place via FileOps.Rename
-	finalPath, err := m.opts.fileOps.Rename(partialPath, baseName)
+	// 6) Finalize (rename/move) the partial into place via FileOps.Rename,
+	// or into dstDir.
+	var finalPath string
+	if dstDir != "" {
+		finalPath, err = moveInto(partialPath, dstDir, baseName)
+	} else {
+		finalPath, err = m.opts.fileOps.Rename(partialPath, baseName)
+	}
 	if err != nil {
 		return 0, m.redactAndLogError("Rename", err)
 	}
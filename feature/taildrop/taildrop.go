@@ -19,6 +19,7 @@
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"unicode"
 	"unicode/utf8"
@@ -101,6 +102,9 @@ type manager struct {
 
 	// incomingFiles is a map of files actively being received.
 	incomingFiles syncs.Map[incomingFileKey, *incomingFile]
+	// treeMu guards the state of directory trees being received.
+	// See tree.go.
+	treeMu sync.Mutex
 	// deleter managers asynchronous deletion of files.
 	deleter fileDeleter
 
@@ -0,0 +1,893 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package taildrop
+
+import (
+	"cmp"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/envknob"
+	"tailscale.com/version/distro"
+)
+
+// Directory trees are sent as a manifest (an [apitype.TaildropTree]),
+// followed by the contents of each file, followed by a commit.
+// While being received, a tree is staged next to the received files in a
+// directory named "<name>.tree.<id>.partial", which holds:
+//
+//	manifest.json     the treeState
+//	<index>.partial   the contents of a file being received, named by its
+//	                  index in the manifest
+//	tree/             the tree being assembled
+//
+// A file is moved into tree/ once its contents match the SHA-256 in the
+// manifest, so an interrupted transfer resumes with the files that are
+// still needed, and within a file from where it stopped.
+// On commit, every file is hashed again and the hash of the whole tree is
+// compared against the manifest's before the file modes and modification
+// times are applied and tree/ is renamed into place as "<name>".
+
+var (
+	errTreeUnsupported = errors.New("directory transfers not supported")
+	errTreeNotFound    = errors.New("no such directory transfer")
+	errTreeIncomplete  = errors.New("directory transfer incomplete")
+	errTreeMismatch    = errors.New("received contents do not match manifest")
+)
+
+const (
+	treeSuffix       = ".tree"
+	treeManifestName = "manifest.json"
+	treeDirName      = "tree"
+
+	// maxTreeFiles is the maximum number of files and directories in a tree.
+	maxTreeFiles = 1 << 16
+)
+
+// treeState is the persisted state of a tree being received.
+type treeState struct {
+	Tree   apitype.TaildropTree
+	SHA256 checksum // of Tree; see treeHash
+
+	// Done are the files in tree/ whose contents were verified,
+	// keyed by path.
+	Done map[string]checksum
+}
+
+// validateTreePath reports whether p is a valid slash-separated path
+// within a tree.
+func validateTreePath(p string) error {
+	if p == "" || path.Clean(p) != p {
+		return ErrInvalidFileName
+	}
+	for elem := range strings.SplitSeq(p, "/") {
+		if err := validateBaseName(elem); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateTree(t *apitype.TaildropTree) error {
+	if err := validateBaseName(t.Name); err != nil {
+		return err
+	}
+	if len(t.Files) > maxTreeFiles {
+		return fmt.Errorf("too many files in tree: %d", len(t.Files))
+	}
+	isDir := make(map[string]bool, len(t.Files))
+	for _, f := range t.Files {
+		if err := validateTreePath(f.Path); err != nil {
+			return err
+		}
+		if _, dup := isDir[f.Path]; dup {
+			return fmt.Errorf("duplicate path in tree")
+		}
+		isDir[f.Path] = f.Mode.IsDir()
+		if f.Mode&^(fs.ModeDir|fs.ModePerm) != 0 {
+			return fmt.Errorf("invalid file mode %v", f.Mode)
+		}
+		var cs checksum
+		switch {
+		case f.Mode.IsDir() && (f.Size != 0 || f.SHA256 != ""):
+			return errors.New("directory with contents in tree")
+		case f.Mode.IsDir():
+		case f.Size < 0:
+			return fmt.Errorf("invalid file size %d", f.Size)
+		case cs.UnmarshalText([]byte(f.SHA256)) != nil:
+			return errors.New("invalid file hash")
+		}
+	}
+	for p := range isDir {
+		for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+			if d, ok := isDir[dir]; ok && !d {
+				return errors.New("file in tree is not within a directory")
+			}
+		}
+	}
+	return nil
+}
+
+// treeHash returns the hash of a tree with the given name and files,
+// covering the path, mode, modification time, size, and contents hash
+// of each file in order.
+func treeHash(name string, files []apitype.TaildropTreeFile) checksum {
+	h := sha256.New()
+	fmt.Fprintf(h, "%q\n", name)
+	for _, f := range files {
+		fmt.Fprintf(h, "%q %o %d %d %s\n", f.Path, uint32(f.Mode), f.ModTime.UnixNano(), f.Size, f.SHA256)
+	}
+	var cs checksum
+	h.Sum(cs.cs[:0])
+	return cs
+}
+
+// hashFile returns the SHA-256 hash and length of the named file.
+func hashFile(name string) (checksum, int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return checksum{}, 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return checksum{}, 0, err
+	}
+	var cs checksum
+	h.Sum(cs.cs[:0])
+	return cs, n, nil
+}
+
+// treeDir returns the local directory in which trees are received.
+func (m *manager) treeDir() (string, error) {
+	switch {
+	case m == nil || m.opts.fileOps == nil:
+		return "", ErrNoTaildrop
+	case !envknob.CanTaildrop():
+		return "", ErrNoTaildrop
+	case distro.Get() == distro.Unraid && !m.opts.DirectFileMode:
+		return "", ErrNotAccessible
+	}
+	fops, ok := m.opts.fileOps.(localFileOps)
+	if !ok {
+		return "", errTreeUnsupported
+	}
+	return fops.localDir(), nil
+}
+
+// stagingDir returns the directory in which the named tree from the
+// given client id is staged.
+func stagingDir(dir string, id clientID, name string) string {
+	return filepath.Join(dir, name+treeSuffix+id.partialSuffix())
+}
+
+// isStagingDir reports whether the base name of a directory
+// is that of a staging directory.
+func isStagingDir(base string) bool {
+	s, ok := strings.CutSuffix(base, partialSuffix)
+	if !ok {
+		return false
+	}
+	if strings.HasSuffix(s, treeSuffix) {
+		return true
+	}
+	if i := strings.LastIndexByte(s, '.'); i > 0 {
+		return strings.HasSuffix(s[:i], treeSuffix)
+	}
+	return false
+}
+
+func loadTreeState(staging string) (*treeState, error) {
+	b, err := os.ReadFile(filepath.Join(staging, treeManifestName))
+	if err != nil {
+		return nil, err
+	}
+	st := new(treeState)
+	if err := json.Unmarshal(b, st); err != nil {
+		return nil, err
+	}
+	if st.Done == nil {
+		st.Done = make(map[string]checksum)
+	}
+	return st, nil
+}
+
+func (st *treeState) save(staging string) error {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(staging, treeManifestName)
+	if err := os.WriteFile(name+".tmp", b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// file returns the manifest entry for the regular file at path p and its
+// index in the manifest.
+func (st *treeState) file(p string) (f apitype.TaildropTreeFile, i int, ok bool) {
+	for i, f := range st.Tree.Files {
+		if f.Path == p {
+			return f, i, !f.Mode.IsDir()
+		}
+	}
+	return apitype.TaildropTreeFile{}, 0, false
+}
+
+// treePartialName returns the name, within the staging directory, of the
+// partially received contents of the file at index i in the manifest.
+// Partial files are not named by their hash, as files with the same
+// contents may be received concurrently.
+func treePartialName(i int) string {
+	return strconv.Itoa(i) + partialSuffix
+}
+
+// removeStaleTreesLocked removes staging directories of transfers
+// that have made no progress for longer than deleteDelay.
+// m.treeMu must be held.
+func (m *manager) removeStaleTreesLocked(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	now := m.opts.Clock.Now()
+	for _, e := range entries {
+		if !e.IsDir() || !isStagingDir(e.Name()) {
+			continue
+		}
+		// The manifest is updated as each file completes, and partial
+		// files as their contents arrive.
+		staging := filepath.Join(dir, e.Name())
+		var lastModified time.Time
+		staged, _ := os.ReadDir(staging)
+		for _, e := range staged {
+			if fi, err := e.Info(); err == nil && fi.ModTime().After(lastModified) {
+				lastModified = fi.ModTime()
+			}
+		}
+		if now.Sub(lastModified) < deleteDelay {
+			continue
+		}
+		if err := os.RemoveAll(staging); err != nil {
+			m.opts.Logf("could not delete: %v", redactError(err))
+		}
+	}
+}
+
+// PutTree prepares to receive the directory tree described by t from the
+// given client id. If an earlier transfer of a tree with the same name
+// from the same client was interrupted, the files it received that are
+// unchanged in t are kept.
+//
+// It returns the hash of the tree and the paths of the files whose
+// contents are needed, which are then sent with [manager.PutTreeFile]
+// before the tree is made visible with [manager.CommitTree].
+func (m *manager) PutTree(id clientID, t *apitype.TaildropTree) (*apitype.TaildropTreeStatus, error) {
+	dir, err := m.treeDir()
+	if err != nil {
+		return nil, err
+	}
+	if err := validateTree(t); err != nil {
+		return nil, err
+	}
+	st := &treeState{
+		Tree:   *t,
+		SHA256: treeHash(t.Name, t.Files),
+		Done:   make(map[string]checksum),
+	}
+
+	m.treeMu.Lock()
+	defer m.treeMu.Unlock()
+	m.removeStaleTreesLocked(dir)
+
+	staging := stagingDir(dir, id, t.Name)
+	treeRoot := filepath.Join(staging, treeDirName)
+	old, err := loadTreeState(staging)
+	if err != nil {
+		// Without the old state, nothing already in the tree can be trusted.
+		if err := os.RemoveAll(staging); err != nil {
+			return nil, m.redactAndLogError("RemoveAll", err)
+		}
+	} else {
+		files := make(map[string]apitype.TaildropTreeFile, len(t.Files))
+		for _, f := range t.Files {
+			files[f.Path] = f
+		}
+		for p, cs := range old.Done {
+			if f, ok := files[p]; ok && !f.Mode.IsDir() && f.SHA256 == cs.String() {
+				st.Done[p] = cs
+				continue
+			}
+			if err := os.Remove(filepath.Join(treeRoot, filepath.FromSlash(p))); err != nil && !os.IsNotExist(err) {
+				return nil, m.redactAndLogError("Remove", err)
+			}
+		}
+		// Partial files are named by manifest index, so they only carry
+		// over to an identical manifest.
+		if old.SHA256 != st.SHA256 {
+			staged, _ := os.ReadDir(staging)
+			for _, e := range staged {
+				if !strings.HasSuffix(e.Name(), partialSuffix) {
+					continue
+				}
+				if err := os.Remove(filepath.Join(staging, e.Name())); err != nil && !os.IsNotExist(err) {
+					return nil, m.redactAndLogError("Remove", err)
+				}
+			}
+		}
+	}
+	if err := os.MkdirAll(treeRoot, 0o700); err != nil {
+		return nil, m.redactAndLogError("Mkdir", err)
+	}
+	if err := st.save(staging); err != nil {
+		return nil, m.redactAndLogError("Save", err)
+	}
+
+	status := &apitype.TaildropTreeStatus{SHA256: st.SHA256.String(), Need: []string{}}
+	for _, f := range t.Files {
+		if _, done := st.Done[f.Path]; !done && !f.Mode.IsDir() {
+			status.Need = append(status.Need, f.Path)
+		}
+	}
+	return status, nil
+}
+
+// treeFile returns the staging directory of the named tree from the
+// given client id, the manifest entry for the regular file at path p, and
+// the path of its partially received contents.
+func (m *manager) treeFile(id clientID, name, p string) (staging string, f apitype.TaildropTreeFile, partialPath string, err error) {
+	dir, err := m.treeDir()
+	if err != nil {
+		return "", f, "", err
+	}
+	if err := validateBaseName(name); err != nil {
+		return "", f, "", err
+	}
+	if err := validateTreePath(p); err != nil {
+		return "", f, "", err
+	}
+	staging = stagingDir(dir, id, name)
+
+	m.treeMu.Lock()
+	defer m.treeMu.Unlock()
+	st, err := loadTreeState(staging)
+	if os.IsNotExist(err) {
+		return "", f, "", errTreeNotFound
+	} else if err != nil {
+		return "", f, "", redactError(err)
+	}
+	f, i, ok := st.file(p)
+	if !ok {
+		return "", f, "", ErrInvalidFileName
+	}
+	return staging, f, filepath.Join(staging, treePartialName(i)), nil
+}
+
+// HashTreeFile is like [manager.HashPartialFile], but for the partially
+// received contents of the file at path p within the named tree.
+func (m *manager) HashTreeFile(id clientID, name, p string) (next func() (blockChecksum, error), close func() error, err error) {
+	_, _, partialPath, err := m.treeFile(id, name, p)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.Open(partialPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return func() (blockChecksum, error) { return blockChecksum{}, io.EOF }, func() error { return nil }, nil
+		}
+		return nil, nil, redactError(err)
+	}
+	next, close = hashBlocks(f)
+	return next, close, nil
+}
+
+// openTreePartial opens the named partial file for writing at offset,
+// truncating anything after it.
+func openTreePartial(name string, offset int64) (*os.File, error) {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err == nil && (offset < 0 || offset > size) {
+		err = fmt.Errorf("offset %d out of range", offset)
+	}
+	if err == nil {
+		_, err = f.Seek(offset, io.SeekStart)
+	}
+	if err == nil {
+		err = f.Truncate(offset)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// PutTreeFile stores the contents of the file at path p within the named
+// tree being received from the given client id. Like [manager.PutFile],
+// it may resume at a non-zero offset into the partially received
+// contents, and length may be negative if unknown.
+//
+// Once all of the contents are received, they are verified against the
+// hash in the manifest.
+func (m *manager) PutTreeFile(id clientID, name, p string, r io.Reader, offset, length int64) (fileLength int64, err error) {
+	staging, tf, partialPath, err := m.treeFile(id, name, p)
+	if err != nil {
+		return 0, err
+	}
+	wc, err := openTreePartial(partialPath, offset)
+	if err != nil {
+		return 0, m.redactAndLogError("Create", err)
+	}
+	defer wc.Close()
+
+	inFileKey := incomingFileKey{id, name + "/" + p}
+	inFile, loaded := m.incomingFiles.LoadOrInit(inFileKey, func() *incomingFile {
+		inFile := &incomingFile{
+			clock:          m.opts.Clock,
+			started:        m.opts.Clock.Now(),
+			size:           tf.Size,
+			w:              wc,
+			sendFileNotify: m.opts.SendFileNotify,
+		}
+		if m.opts.DirectFileMode {
+			inFile.partialPath = partialPath
+		}
+		return inFile
+	})
+	if loaded {
+		return 0, ErrFileExists
+	}
+	defer m.incomingFiles.Delete(inFileKey)
+
+	copyLength, err := io.Copy(inFile, r)
+	if err != nil {
+		return 0, m.redactAndLogError("Copy", err)
+	}
+	if length >= 0 && copyLength != length {
+		return 0, m.redactAndLogError("Copy", fmt.Errorf("copied %d bytes; expected %d", copyLength, length))
+	}
+	if err := wc.Close(); err != nil {
+		return 0, m.redactAndLogError("Close", err)
+	}
+	fileLength = offset + copyLength
+	if fileLength < tf.Size {
+		return 0, fmt.Errorf("received %d of %d bytes", fileLength, tf.Size)
+	}
+
+	cs, _, err := hashFile(partialPath)
+	if err != nil {
+		return 0, m.redactAndLogError("Hash", err)
+	}
+	if fileLength != tf.Size || cs.String() != tf.SHA256 {
+		os.Remove(partialPath)
+		return 0, errTreeMismatch
+	}
+	dst := filepath.Join(staging, treeDirName, filepath.FromSlash(p))
+	if err := os.MkdirAll(filepath.Dir(dst), 0o700); err != nil {
+		return 0, m.redactAndLogError("Mkdir", err)
+	}
+	if err := os.Rename(partialPath, dst); err != nil {
+		return 0, m.redactAndLogError("Rename", err)
+	}
+
+	inFile.mu.Lock()
+	inFile.done = true
+	inFile.mu.Unlock()
+
+	m.treeMu.Lock()
+	defer m.treeMu.Unlock()
+	st, err := loadTreeState(staging)
+	if err != nil {
+		return 0, m.redactAndLogError("Load", err)
+	}
+	if f, _, ok := st.file(p); !ok || f.SHA256 != tf.SHA256 {
+		// The manifest was replaced while the contents were received.
+		os.Remove(dst)
+		return 0, errTreeMismatch
+	}
+	st.Done[p] = cs
+	if err := st.save(staging); err != nil {
+		return 0, m.redactAndLogError("Save", err)
+	}
+	m.opts.SendFileNotify()
+	return fileLength, nil
+}
+
+// CommitTree verifies that all the files of the named tree from the given
+// client id were received with the expected contents, applies their modes
+// and modification times, and moves the tree into place.
+// It returns the path of the received tree.
+//
+// Once the contents are verified, dest is called with the tree's manifest
+// to decide whether to receive it. If the directory it returns is
+// non-empty, the tree is moved into that directory instead of being left
+// for pick-up with the other received files. A nil dest receives the tree
+// as usual.
+//
+// If any contents do not match, those files are discarded so they
+// can be sent again.
+func (m *manager) CommitTree(id clientID, name string, dest func(*apitype.TaildropTree) (dstDir string, err error)) (finalPath string, err error) {
+	dir, err := m.treeDir()
+	if err != nil {
+		return "", err
+	}
+	if err := validateBaseName(name); err != nil {
+		return "", err
+	}
+	staging := stagingDir(dir, id, name)
+	treeRoot := filepath.Join(staging, treeDirName)
+
+	// Hold the lock throughout so that the tree cannot change underfoot.
+	m.treeMu.Lock()
+	defer m.treeMu.Unlock()
+	st, err := loadTreeState(staging)
+	if os.IsNotExist(err) {
+		return "", errTreeNotFound
+	} else if err != nil {
+		return "", m.redactAndLogError("Load", err)
+	}
+	if err := pruneTree(treeRoot, st.Tree.Files); err != nil {
+		return "", m.redactAndLogError("Prune", err)
+	}
+
+	// Hash the received contents and compare the resulting tree hash
+	// against the manifest's.
+	got := slices.Clone(st.Tree.Files)
+	var missing int
+	for i, f := range got {
+		full := filepath.Join(treeRoot, filepath.FromSlash(f.Path))
+		if f.Mode.IsDir() {
+			if err := os.MkdirAll(full, 0o700); err != nil {
+				return "", m.redactAndLogError("Mkdir", err)
+			}
+			continue
+		}
+		if _, ok := st.Done[f.Path]; !ok {
+			missing++
+			continue
+		}
+		cs, n, err := hashFile(full)
+		if err != nil && !os.IsNotExist(err) {
+			return "", m.redactAndLogError("Hash", err)
+		}
+		got[i].SHA256, got[i].Size = cs.String(), n
+	}
+	if missing > 0 {
+		return "", fmt.Errorf("%w: %d files missing", errTreeIncomplete, missing)
+	}
+	if treeHash(name, got) != st.SHA256 {
+		for i, f := range got {
+			if f.SHA256 != st.Tree.Files[i].SHA256 {
+				delete(st.Done, f.Path)
+				os.Remove(filepath.Join(treeRoot, filepath.FromSlash(f.Path)))
+			}
+		}
+		if err := st.save(staging); err != nil {
+			m.opts.Logf("put Save error: %v", redactError(err))
+		}
+		return "", errTreeMismatch
+	}
+
+	var dstDir string
+	if dest != nil {
+		if dstDir, err = dest(&st.Tree); err != nil {
+			return "", err
+		}
+	}
+
+	// Apply the metadata, deepest paths first, so that the modification
+	// times of directories are not disturbed by changes within them.
+	files := slices.Clone(st.Tree.Files)
+	slices.SortStableFunc(files, func(a, b apitype.TaildropTreeFile) int {
+		return cmp.Compare(strings.Count(b.Path, "/"), strings.Count(a.Path, "/"))
+	})
+	for _, f := range files {
+		full := filepath.Join(treeRoot, filepath.FromSlash(f.Path))
+		if err := os.Chmod(full, f.Mode.Perm()); err != nil {
+			return "", m.redactAndLogError("Chmod", err)
+		}
+		if !f.ModTime.IsZero() {
+			if err := os.Chtimes(full, f.ModTime, f.ModTime); err != nil {
+				return "", m.redactAndLogError("Chtimes", err)
+			}
+		}
+	}
+	if err := os.Chmod(treeRoot, 0o755); err != nil {
+		return "", m.redactAndLogError("Chmod", err)
+	}
+
+	if dstDir != "" {
+		finalPath, err = moveInto(treeRoot, dstDir, name)
+	} else {
+		finalPath, err = renameNoReplace(treeRoot, dir, name)
+	}
+	if err != nil {
+		return "", m.redactAndLogError("Rename", err)
+	}
+	if err := os.RemoveAll(staging); err != nil {
+		m.opts.Logf("could not delete: %v", redactError(err))
+	}
+	m.totalReceived.Add(1)
+	m.opts.SendFileNotify()
+	return finalPath, nil
+}
+
+// pruneTree removes anything within root that is not one of files,
+// such as files left behind by an earlier version of the manifest.
+func pruneTree(root string, files []apitype.TaildropTreeFile) error {
+	isDir := make(map[string]bool, len(files))
+	for _, f := range files {
+		isDir[f.Path] = f.Mode.IsDir()
+		for dir := path.Dir(f.Path); dir != "."; dir = path.Dir(dir) {
+			isDir[dir] = true
+		}
+	}
+	var remove []string
+	err := filepath.WalkDir(root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil || name == root {
+			return err
+		}
+		rel, err := filepath.Rel(root, name)
+		if err != nil {
+			return err
+		}
+		if dir, ok := isDir[filepath.ToSlash(rel)]; !ok || dir != d.IsDir() || !(d.IsDir() || d.Type().IsRegular()) {
+			remove = append(remove, name)
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range remove {
+		if err := os.RemoveAll(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveMu serializes checking whether a destination exists with
+// renaming to it in renameNoReplace.
+var moveMu sync.Mutex
+
+// renameNoReplace renames the file or directory src into dir as name,
+// picking a new name if it already exists.
+func renameNoReplace(src, dir, name string) (string, error) {
+	const maxRetries = 10
+	dst := filepath.Join(dir, name)
+	moveMu.Lock()
+	defer moveMu.Unlock()
+	for range maxRetries {
+		if _, err := os.Lstat(dst); os.IsNotExist(err) {
+			if err := os.Rename(src, dst); err != nil {
+				return "", err
+			}
+			return dst, nil
+		} else if err != nil {
+			return "", err
+		}
+		dst = filepath.Join(dir, nextFilename(filepath.Base(dst)))
+	}
+	return "", fmt.Errorf("too many retries trying to rename %q to %q", src, name)
+}
+
+// moveInto is like renameNoReplace, but dir may be on another filesystem,
+// in which case src is first copied next to its destination under a
+// temporary name, preserving modes and modification times.
+func moveInto(src, dir, name string) (string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	tmp := filepath.Join(dir, name+"."+rand.Text()+partialSuffix)
+	if err := os.Rename(src, tmp); err != nil {
+		if err := copyAll(src, tmp); err != nil {
+			os.RemoveAll(tmp)
+			return "", err
+		}
+		if err := os.RemoveAll(src); err != nil {
+			os.RemoveAll(tmp)
+			return "", err
+		}
+	}
+	dst, err := renameNoReplace(tmp, dir, name)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	return dst, nil
+}
+
+// copyAll copies the regular file or directory tree src to dst,
+// preserving modes and modification times.
+func copyAll(src, dst string) error {
+	type dirInfo struct {
+		path string
+		fi   fs.FileInfo
+	}
+	var dirs []dirInfo
+	err := filepath.WalkDir(src, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, name)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			dirs = append(dirs, dirInfo{target, fi})
+			return os.Mkdir(target, 0o700)
+		case d.Type().IsRegular():
+			if err := copyFile(name, target, fi.Mode().Perm()); err != nil {
+				return err
+			}
+			return os.Chtimes(target, fi.ModTime(), fi.ModTime())
+		default:
+			return fmt.Errorf("cannot copy %q: not a regular file or directory", name)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	// Apply the metadata of directories after their contents are written,
+	// deepest first.
+	for _, d := range slices.Backward(dirs) {
+		if err := os.Chmod(d.path, d.fi.Mode().Perm()); err != nil {
+			return err
+		}
+		if err := os.Chtimes(d.path, d.fi.ModTime(), d.fi.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(src, dst string, perm fs.FileMode) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return os.Chmod(dst, perm) // not subject to the umask
+}
+
+// WaitingTreeFiles returns the files within received trees, which are
+// directories in the staging directory in buffered mode. They are listed
+// separately from [manager.WaitingFiles], as older clients do not expect
+// names containing slashes.
+func (m *manager) WaitingTreeFiles() ([]apitype.WaitingFile, error) {
+	if m == nil || m.opts.fileOps == nil {
+		return nil, ErrNoTaildrop
+	}
+	if m.opts.DirectFileMode {
+		return nil, nil
+	}
+	fops, ok := m.opts.fileOps.(localFileOps)
+	if !ok {
+		return nil, nil
+	}
+	dir := fops.localDir()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, redactError(err)
+	}
+	var ret []apitype.WaitingFile
+	for _, e := range entries {
+		if !e.IsDir() || validateBaseName(e.Name()) != nil {
+			continue
+		}
+		filepath.WalkDir(filepath.Join(dir, e.Name()), func(name string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return nil
+			}
+			fi, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			rel, err := filepath.Rel(dir, name)
+			if err != nil {
+				return nil
+			}
+			ret = append(ret, apitype.WaitingFile{
+				Name:    filepath.ToSlash(rel),
+				Size:    fi.Size(),
+				Mode:    fi.Mode().Perm(),
+				ModTime: fi.ModTime(),
+			})
+			return nil
+		})
+	}
+	return ret, nil
+}
+
+// treeFilePath returns the local directory holding received trees, and
+// the local path of the file with the given name within a received tree,
+// as listed by [manager.WaitingTreeFiles].
+func (m *manager) treeFilePath(name string) (dir, p string, err error) {
+	fops, ok := m.opts.fileOps.(localFileOps)
+	if !ok {
+		return "", "", errTreeUnsupported
+	}
+	if err := validateTreePath(name); err != nil {
+		return "", "", err
+	}
+	dir = fops.localDir()
+	return dir, filepath.Join(dir, filepath.FromSlash(name)), nil
+}
+
+// openTreeFile opens the named file within a received tree.
+func (m *manager) openTreeFile(name string) (rc io.ReadCloser, size int64, err error) {
+	_, p, err := m.treeFilePath(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, 0, redactError(err)
+	}
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		f.Close()
+		return nil, 0, redactError(&fs.PathError{Op: "open", Path: p, Err: fs.ErrNotExist})
+	}
+	return f, fi.Size(), nil
+}
+
+// deleteTreeFile deletes the named file within a received tree,
+// along with any directories left empty.
+func (m *manager) deleteTreeFile(name string) error {
+	dir, p, err := m.treeFilePath(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return redactError(err)
+	}
+	for d := path.Dir(name); d != "."; d = path.Dir(d) {
+		// Remove fails on directories which are not empty.
+		if os.Remove(filepath.Join(dir, filepath.FromSlash(d))) != nil {
+			break
+		}
+	}
+	return nil
+}
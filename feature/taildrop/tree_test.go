@@ -0,0 +1,274 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package taildrop
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tstime"
+	"tailscale.com/util/must"
+)
+
+func testTree(contents map[string]string) *apitype.TaildropTree {
+	mtime := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	tree := &apitype.TaildropTree{
+		Name: "photos",
+		Files: []apitype.TaildropTreeFile{
+			{Path: "2024", Mode: fs.ModeDir | 0o750, ModTime: mtime},
+			{Path: "empty", Mode: fs.ModeDir | 0o755, ModTime: mtime},
+		},
+	}
+	for _, p := range []string{"2024/a.jpg", "2024/b.jpg", "readme.txt"} {
+		sum := sha256.Sum256([]byte(contents[p]))
+		tree.Files = append(tree.Files, apitype.TaildropTreeFile{
+			Path:    p,
+			Mode:    0o640,
+			ModTime: mtime.Add(time.Hour),
+			Size:    int64(len(contents[p])),
+			SHA256:  hex.EncodeToString(sum[:]),
+		})
+	}
+	return tree
+}
+
+func TestPutTree(t *testing.T) {
+	contents := map[string]string{
+		"2024/a.jpg": strings.Repeat("a", 1000),
+		"2024/b.jpg": strings.Repeat("b", 2000),
+		"readme.txt": "hello",
+	}
+	dir := t.TempDir()
+	m := managerOptions{
+		Logf:    t.Logf,
+		Clock:   tstime.DefaultClock{},
+		fileOps: must.Get(newFileOps(dir)),
+	}.New()
+	defer m.Shutdown()
+	id := clientID("n123")
+
+	tree := testTree(contents)
+	status := must.Get(m.PutTree(id, tree))
+	if got, want := strings.Join(status.Need, ","), "2024/a.jpg,2024/b.jpg,readme.txt"; got != want {
+		t.Fatalf("Need = %q, want %q", got, want)
+	}
+
+	// Send the first file, and part of the second before being interrupted.
+	must.Get(m.PutTreeFile(id, "photos", "2024/a.jpg", strings.NewReader(contents["2024/a.jpg"]), 0, 1000))
+	if _, err := m.PutTreeFile(id, "photos", "2024/b.jpg", io.LimitReader(strings.NewReader(contents["2024/b.jpg"]), 500), 0, -1); err == nil {
+		t.Fatal("PutTreeFile of truncated contents succeeded")
+	}
+	if _, err := m.CommitTree(id, "photos", nil); !errors.Is(err, errTreeIncomplete) {
+		t.Fatalf("CommitTree of incomplete tree = %v, want %v", err, errTreeIncomplete)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "photos")); !os.IsNotExist(err) {
+		t.Fatalf("incomplete tree is visible: %v", err)
+	}
+
+	// Resuming only needs the remaining files, and the second from where
+	// it stopped.
+	status = must.Get(m.PutTree(id, tree))
+	if got, want := strings.Join(status.Need, ","), "2024/b.jpg,readme.txt"; got != want {
+		t.Fatalf("after resume, Need = %q, want %q", got, want)
+	}
+	next, close := must.Get2(m.HashTreeFile(id, "photos", "2024/b.jpg"))
+	offset, r, err := resumeReader(strings.NewReader(contents["2024/b.jpg"]), next)
+	must.Do(err)
+	must.Do(close())
+	if offset != 500 {
+		t.Errorf("resumed at offset %d, want 500", offset)
+	}
+	must.Get(m.PutTreeFile(id, "photos", "2024/b.jpg", r, offset, 2000-offset))
+	if _, err := m.PutTreeFile(id, "photos", "readme.txt", strings.NewReader("HELLO"), 0, 5); !errors.Is(err, errTreeMismatch) {
+		t.Fatalf("PutTreeFile of wrong contents = %v, want %v", err, errTreeMismatch)
+	}
+	must.Get(m.PutTreeFile(id, "photos", "readme.txt", strings.NewReader("hello"), 0, 5))
+
+	finalPath := must.Get(m.CommitTree(id, "photos", nil))
+	if want := filepath.Join(dir, "photos"); finalPath != want {
+		t.Errorf("CommitTree = %q, want %q", finalPath, want)
+	}
+	for _, f := range tree.Files {
+		fi, err := os.Stat(filepath.Join(finalPath, filepath.FromSlash(f.Path)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fi.ModTime().Equal(f.ModTime) {
+			t.Errorf("%s: ModTime = %v, want %v", f.Path, fi.ModTime(), f.ModTime)
+		}
+		if runtime.GOOS != "windows" && fi.Mode() != f.Mode {
+			t.Errorf("%s: Mode = %v, want %v", f.Path, fi.Mode(), f.Mode)
+		}
+		if want, ok := contents[f.Path]; ok {
+			if got := must.Get(os.ReadFile(filepath.Join(finalPath, f.Path))); string(got) != want {
+				t.Errorf("%s: contents mismatch", f.Path)
+			}
+		}
+	}
+	entries := must.Get(os.ReadDir(dir))
+	if len(entries) != 1 {
+		t.Errorf("got %d entries in %s, want only the tree", len(entries), dir)
+	}
+
+	// The files are waiting to be picked up, but are only listed
+	// separately from individually sent files.
+	if wfs := must.Get(m.WaitingFiles()); len(wfs) != 0 {
+		t.Errorf("WaitingFiles = %+v, want none", wfs)
+	}
+	if m.HasFilesWaiting() {
+		t.Error("HasFilesWaiting = true with only trees waiting")
+	}
+	wfs := must.Get(m.WaitingTreeFiles())
+	if len(wfs) != 3 || wfs[2].Name != "photos/readme.txt" || wfs[2].Mode != 0o640 || wfs[2].Size != 5 {
+		t.Fatalf("WaitingTreeFiles = %+v", wfs)
+	}
+	rc, size := must.Get2(m.OpenFile("photos/readme.txt"))
+	got := must.Get(io.ReadAll(rc))
+	rc.Close()
+	if string(got) != "hello" || size != 5 {
+		t.Errorf("OpenFile = %q, %d", got, size)
+	}
+	if _, _, err := m.OpenFile("photos/../photos/readme.txt"); err == nil {
+		t.Error("OpenFile of unclean path succeeded")
+	}
+	for _, wf := range wfs {
+		must.Do(m.DeleteFile(wf.Name))
+	}
+	if m.HasFilesWaiting() {
+		t.Error("HasFilesWaiting after deleting all files")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "photos", "2024")); !os.IsNotExist(err) {
+		t.Errorf("directory left behind after deleting its files: %v", err)
+	}
+}
+
+func TestPutTreeChangedManifest(t *testing.T) {
+	contents := map[string]string{
+		"2024/a.jpg": "aaaa",
+		"2024/b.jpg": "bbbb",
+		"readme.txt": "hello",
+	}
+	dir := t.TempDir()
+	m := managerOptions{Logf: t.Logf, fileOps: must.Get(newFileOps(dir))}.New()
+	defer m.Shutdown()
+	id := clientID("n123")
+
+	must.Get(m.PutTree(id, testTree(contents)))
+	for _, p := range []string{"2024/a.jpg", "2024/b.jpg"} {
+		must.Get(m.PutTreeFile(id, "photos", p, strings.NewReader(contents[p]), 0, -1))
+	}
+
+	// A file changed before the transfer was resumed, and another was
+	// only touched, so only the changed file is needed again.
+	contents["2024/b.jpg"] = "BBBB"
+	tree := testTree(contents)
+	tree.Files[2].ModTime = tree.Files[2].ModTime.Add(time.Minute)
+	status := must.Get(m.PutTree(id, tree))
+	if got, want := strings.Join(status.Need, ","), "2024/b.jpg,readme.txt"; got != want {
+		t.Fatalf("Need = %q, want %q", got, want)
+	}
+	for _, p := range status.Need {
+		must.Get(m.PutTreeFile(id, "photos", p, strings.NewReader(contents[p]), 0, -1))
+	}
+
+	// A file in the tree was changed after it was received.
+	staged := filepath.Join(stagingDir(dir, id, "photos"), treeDirName, "readme.txt")
+	must.Do(os.WriteFile(staged, []byte("jello"), 0o600))
+	if _, err := m.CommitTree(id, "photos", nil); !errors.Is(err, errTreeMismatch) {
+		t.Fatalf("CommitTree of modified tree = %v, want %v", err, errTreeMismatch)
+	}
+	status = must.Get(m.PutTree(id, tree))
+	if got, want := strings.Join(status.Need, ","), "readme.txt"; got != want {
+		t.Fatalf("after mismatch, Need = %q, want %q", got, want)
+	}
+	must.Get(m.PutTreeFile(id, "photos", "readme.txt", strings.NewReader(contents["readme.txt"]), 0, -1))
+
+	// An existing file or directory is not replaced.
+	must.Do(os.WriteFile(filepath.Join(dir, "photos"), nil, 0o600))
+	finalPath := must.Get(m.CommitTree(id, "photos", nil))
+	if want := filepath.Join(dir, "photos (1)"); finalPath != want {
+		t.Errorf("CommitTree = %q, want %q", finalPath, want)
+	}
+	if got := must.Get(os.ReadFile(filepath.Join(finalPath, "2024", "b.jpg"))); !bytes.Equal(got, []byte("BBBB")) {
+		t.Errorf("got %q, want %q", got, "BBBB")
+	}
+}
+
+func TestPutTreeIdenticalFiles(t *testing.T) {
+	same := strings.Repeat("x", 1000)
+	contents := map[string]string{"2024/a.jpg": same, "2024/b.jpg": same, "readme.txt": "hello"}
+	dir := t.TempDir()
+	m := managerOptions{Logf: t.Logf, fileOps: must.Get(newFileOps(dir))}.New()
+	defer m.Shutdown()
+	id := clientID("n123")
+
+	// Two files with the same contents are each received in part.
+	tree := testTree(contents)
+	must.Get(m.PutTree(id, tree))
+	for p, n := range map[string]int64{"2024/a.jpg": 300, "2024/b.jpg": 700} {
+		if _, err := m.PutTreeFile(id, "photos", p, io.LimitReader(strings.NewReader(same), n), 0, -1); err == nil {
+			t.Fatalf("PutTreeFile of truncated %s succeeded", p)
+		}
+	}
+
+	// Each resumes from where it stopped.
+	for p, want := range map[string]int64{"2024/a.jpg": 300, "2024/b.jpg": 700} {
+		next, close := must.Get2(m.HashTreeFile(id, "photos", p))
+		offset, r, err := resumeReader(strings.NewReader(same), next)
+		must.Do(err)
+		must.Do(close())
+		if offset != want {
+			t.Errorf("%s resumed at offset %d, want %d", p, offset, want)
+		}
+		must.Get(m.PutTreeFile(id, "photos", p, r, offset, -1))
+	}
+	must.Get(m.PutTreeFile(id, "photos", "readme.txt", strings.NewReader("hello"), 0, -1))
+
+	finalPath := must.Get(m.CommitTree(id, "photos", nil))
+	for _, p := range []string{"2024/a.jpg", "2024/b.jpg"} {
+		if got := must.Get(os.ReadFile(filepath.Join(finalPath, filepath.FromSlash(p)))); string(got) != same {
+			t.Errorf("%s: contents mismatch", p)
+		}
+	}
+}
+
+func TestValidateTree(t *testing.T) {
+	sum := strings.Repeat("00", sha256.Size)
+	tests := []struct {
+		name  string
+		files []apitype.TaildropTreeFile
+		ok    bool
+	}{
+		{"ok", []apitype.TaildropTreeFile{{Path: "a", Mode: fs.ModeDir | 0o755}, {Path: "a/b", Mode: 0o644, SHA256: sum}}, true},
+		{"implicit-dir", []apitype.TaildropTreeFile{{Path: "a/b", Mode: 0o644, SHA256: sum}}, true},
+		{"absolute", []apitype.TaildropTreeFile{{Path: "/a", Mode: 0o644, SHA256: sum}}, false},
+		{"dot-dot", []apitype.TaildropTreeFile{{Path: "../a", Mode: 0o644, SHA256: sum}}, false},
+		{"unclean", []apitype.TaildropTreeFile{{Path: "a//b", Mode: 0o644, SHA256: sum}}, false},
+		{"partial", []apitype.TaildropTreeFile{{Path: "a.partial", Mode: 0o644, SHA256: sum}}, false},
+		{"duplicate", []apitype.TaildropTreeFile{{Path: "a", Mode: 0o644, SHA256: sum}, {Path: "a", Mode: 0o644, SHA256: sum}}, false},
+		{"setuid", []apitype.TaildropTreeFile{{Path: "a", Mode: fs.ModeSetuid | 0o755, SHA256: sum}}, false},
+		{"symlink", []apitype.TaildropTreeFile{{Path: "a", Mode: fs.ModeSymlink | 0o755, SHA256: sum}}, false},
+		{"bad-hash", []apitype.TaildropTreeFile{{Path: "a", Mode: 0o644, SHA256: "abc"}}, false},
+		{"file-parent", []apitype.TaildropTreeFile{{Path: "a", Mode: 0o644, SHA256: sum}, {Path: "a/b", Mode: 0o644, SHA256: sum}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateTree(&apitype.TaildropTree{Name: "tree", Files: tt.files})
+			if (err == nil) != tt.ok {
+				t.Errorf("validateTree() = %v, want ok=%v", err, tt.ok)
+			}
+		})
+	}
+}
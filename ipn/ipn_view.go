@@ -216,45 +216,51 @@ func (v PrefsView) DriveShares() views.SliceView[*drive.Share, drive.ShareView]
 func (v PrefsView) RelayServerPort() views.ValuePointer[int] {
 	return views.ValuePointerOf(v.ж.RelayServerPort)
 }
+func (v PrefsView) RelayServerMaxEndpoints() int   { return v.ж.RelayServerMaxEndpoints }
+func (v PrefsView) RelayServerMaxBytesPerSec() int { return v.ж.RelayServerMaxBytesPerSec }
+func (v PrefsView) RelayServerEviction() string    { return v.ж.RelayServerEviction }
 
 func (v PrefsView) AllowSingleHosts() marshalAsTrueInJSON { return v.ж.AllowSingleHosts }
 func (v PrefsView) Persist() persist.PersistView          { return v.ж.Persist.View() }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _PrefsViewNeedsRegeneration = Prefs(struct {
-	ControlURL             string
-	RouteAll               bool
-	ExitNodeID             tailcfg.StableNodeID
-	ExitNodeIP             netip.Addr
-	AutoExitNode           ExitNodeExpression
-	InternalExitNodePrior  tailcfg.StableNodeID
-	ExitNodeAllowLANAccess bool
-	CorpDNS                bool
-	RunSSH                 bool
-	RunWebClient           bool
-	WantRunning            bool
-	LoggedOut              bool
-	ShieldsUp              bool
-	AdvertiseTags          []string
-	Hostname               string
-	NotepadURLs            bool
-	ForceDaemon            bool
-	Egg                    bool
-	AdvertiseRoutes        []netip.Prefix
-	AdvertiseServices      []string
-	NoSNAT                 bool
-	NoStatefulFiltering    opt.Bool
-	NetfilterMode          preftype.NetfilterMode
-	OperatorUser           string
-	ProfileName            string
-	AutoUpdate             AutoUpdatePrefs
-	AppConnector           AppConnectorPrefs
-	PostureChecking        bool
-	NetfilterKind          string
-	DriveShares            []*drive.Share
-	RelayServerPort        *int
-	AllowSingleHosts       marshalAsTrueInJSON
-	Persist                *persist.Persist
+	ControlURL                string
+	RouteAll                  bool
+	ExitNodeID                tailcfg.StableNodeID
+	ExitNodeIP                netip.Addr
+	AutoExitNode              ExitNodeExpression
+	InternalExitNodePrior     tailcfg.StableNodeID
+	ExitNodeAllowLANAccess    bool
+	CorpDNS                   bool
+	RunSSH                    bool
+	RunWebClient              bool
+	WantRunning               bool
+	LoggedOut                 bool
+	ShieldsUp                 bool
+	AdvertiseTags             []string
+	Hostname                  string
+	NotepadURLs               bool
+	ForceDaemon               bool
+	Egg                       bool
+	AdvertiseRoutes           []netip.Prefix
+	AdvertiseServices         []string
+	NoSNAT                    bool
+	NoStatefulFiltering       opt.Bool
+	NetfilterMode             preftype.NetfilterMode
+	OperatorUser              string
+	ProfileName               string
+	AutoUpdate                AutoUpdatePrefs
+	AppConnector              AppConnectorPrefs
+	PostureChecking           bool
+	NetfilterKind             string
+	DriveShares               []*drive.Share
+	RelayServerPort           *int
+	RelayServerMaxEndpoints   int
+	RelayServerMaxBytesPerSec int
+	RelayServerEviction       string
+	AllowSingleHosts          marshalAsTrueInJSON
+	Persist                   *persist.Persist
 }{})
 
 // View returns a read-only view of ServeConfig.
@@ -51,13 +51,17 @@ func (b *LocalBackend) DriveSetServerAddr(addr string) error {
 // DriveSetShare adds the given share if no share with that name exists, or
 // replaces the existing share if one with the same name already exists. To
 // avoid potential incompatibilities across file systems, share names are
-// limited to alphanumeric characters and the underscore _.
+// limited to alphanumeric characters and the underscore _. Versioned shares
+// must have non-negative version limits.
 func (b *LocalBackend) DriveSetShare(share *drive.Share) error {
 	var err error
 	share.Name, err = drive.NormalizeShareName(share.Name)
 	if err != nil {
 		return err
 	}
+	if share.Versions < 0 || share.VersionsMaxAge < 0 || (share.VersionsMaxAge > 0 && share.Versions == 0) {
+		return drive.ErrInvalidShareVersions
+	}
 
 	b.mu.Lock()
 	shares, err := b.driveSetShareLocked(share)
@@ -1095,6 +1095,7 @@ func (b *LocalBackend) Shutdown() {
 		b.sshServer = nil
 	}
 	b.closePeerAPIListenersLocked()
+	b.closeTKALocked()
 	if b.debugSink != nil {
 		b.e.InstallCaptureHook(nil)
 		b.debugSink.Close()
@@ -1983,6 +1984,15 @@ func (b *LocalBackend) sysPolicyChanged(policy *rsop.PolicyChange) {
 		b.mu.Unlock()
 	}
 
+	if policy.HasChangedAnyOf(syspolicy.AppConnectorRouteExpiry, syspolicy.AppConnectorAggregateThreshold) {
+		b.mu.Lock()
+		if b.appConnector != nil {
+			b.appConnector.SetRouteExpiry(appcRouteExpiry())
+			b.appConnector.SetRouteAggregation(appcAggregation())
+		}
+		b.mu.Unlock()
+	}
+
 	if policy.HasChanged(syspolicy.AllowedSuggestedExitNodes) {
 		b.refreshAllowedSuggestions()
 		// Re-evaluate exit node suggestion now that the policy setting has changed.
@@ -1996,6 +2006,12 @@ func (b *LocalBackend) sysPolicyChanged(policy *rsop.PolicyChange) {
 	if prefs, anyChange := b.reconcilePrefs(); anyChange {
 		b.logf("syspolicy: changed profile prefs: %v", prefs.Pretty())
 	}
+
+	if policy.HasChanged(syspolicy.NetworkLogSinks) {
+		// Reconfiguring the engine restarts network logging with the new
+		// local sinks.
+		b.authReconfig()
+	}
 }
 
 var _ controlclient.NetmapDeltaUpdater = (*LocalBackend)(nil)
@@ -4976,6 +4992,43 @@ func (b *LocalBackend) blockEngineUpdates(block bool) {
 	b.mu.Unlock()
 }
 
+// appcRouteExpiry returns how long learned app connector routes are kept
+// after they were last observed in a DNS response, as configured by the
+// [syspolicy.AppConnectorRouteExpiry] policy. Zero disables expiry.
+func appcRouteExpiry() time.Duration {
+	d, _ := syspolicy.GetDuration(syspolicy.AppConnectorRouteExpiry, 0)
+	return d
+}
+
+// appcAggregation returns the aggregation of learned app connector routes
+// configured by the [syspolicy.AppConnectorAggregateThreshold] policy.
+func appcAggregation() appc.AggregationConfig {
+	threshold, _ := syspolicy.GetUint64(syspolicy.AppConnectorAggregateThreshold, 0)
+	return appc.AggregationConfig{Threshold: int(min(threshold, math.MaxInt32))}
+}
+
+// setAppConnectorLocked replaces b.appConnector with ac, which may be nil.
+// The previous app connector, if any, is closed, and the packets forwarded
+// from peers are reported to ac so that it does not expire routes that are
+// in active use.
+// b.mu must be held.
+func (b *LocalBackend) setAppConnectorLocked(ac *appc.AppConnector) {
+	if b.appConnector == ac {
+		return
+	}
+	if b.appConnector != nil {
+		b.appConnector.Close()
+	}
+	b.appConnector = ac
+	if tunWrap, ok := b.sys.Tun.GetOK(); ok {
+		if ac != nil {
+			tunWrap.SetInboundDestinationHook(ac.NoteTraffic)
+		} else {
+			tunWrap.SetInboundDestinationHook(nil)
+		}
+	}
+}
+
 // reconfigAppConnectorLocked updates the app connector state based on the
 // current network map and preferences.
 // b.mu must be held.
@@ -4988,7 +5041,7 @@ func (b *LocalBackend) reconfigAppConnectorLocked(nm *netmap.NetworkMap, prefs i
 	}()
 
 	if !prefs.AppConnector().Advertise {
-		b.appConnector = nil
+		b.setAppConnectorLocked(nil)
 		return
 	}
 
@@ -5007,7 +5060,9 @@ func (b *LocalBackend) reconfigAppConnectorLocked(nm *netmap.NetworkMap, prefs i
 			}
 			storeFunc = b.storeRouteInfo
 		}
-		b.appConnector = appc.NewAppConnector(b.logf, b, ri, storeFunc)
+		b.setAppConnectorLocked(appc.NewAppConnector(b.logf, b, ri, storeFunc))
+		b.appConnector.SetRouteExpiry(appcRouteExpiry())
+		b.appConnector.SetRouteAggregation(appcAggregation())
 	}
 	if nm == nil {
 		return
@@ -7256,7 +7311,7 @@ func (b *LocalBackend) SwitchProfile(profile ipn.ProfileID) error {
 func (b *LocalBackend) initTKALocked() error {
 	cp := b.pm.CurrentProfile()
 	if cp.ID() == "" {
-		b.tka = nil
+		b.closeTKALocked()
 		return nil
 	}
 	if b.tka != nil {
@@ -7265,11 +7320,10 @@ func (b *LocalBackend) initTKALocked() error {
 			return nil
 		}
 		// As we're switching profiles, we need to reset the TKA to nil.
-		b.tka = nil
+		b.closeTKALocked()
 	}
 	root := b.TailscaleVarRoot()
 	if root == "" {
-		b.tka = nil
 		b.logf("network-lock unavailable; no state directory")
 		return nil
 	}
@@ -7277,12 +7331,15 @@ func (b *LocalBackend) initTKALocked() error {
 	chonkDir := b.chonkPathLocked()
 	if _, err := os.Stat(chonkDir); err == nil {
 		// The directory exists, which means network-lock has been initialized.
-		storage, err := tka.ChonkDir(chonkDir)
+		storage, err := b.openTKAStorage(chonkDir)
 		if err != nil {
 			return fmt.Errorf("opening tailchonk: %v", err)
 		}
 		authority, err := tka.Open(storage)
 		if err != nil {
+			if c, ok := storage.(io.Closer); ok {
+				c.Close()
+			}
 			return fmt.Errorf("initializing tka: %v", err)
 		}
 		if err := authority.Compact(storage, tkaCompactionDefaults); err != nil {
@@ -7294,6 +7351,7 @@ func (b *LocalBackend) initTKALocked() error {
 			authority: authority,
 			storage:   storage,
 		}
+		b.scheduleTKACompactionLocked()
 		b.logf("tka initialized at head %x", authority.Head())
 	}
 
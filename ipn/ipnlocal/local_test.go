@@ -4071,6 +4071,23 @@ func TestDriveManageShares(t *testing.T) {
 			add:    &drive.Share{Name: "$"},
 			expect: drive.ErrInvalidShareName,
 		},
+		{
+			name: "add_versioned",
+			add:  &drive.Share{Name: "a", Versions: 10, VersionsMaxAge: time.Hour},
+			expect: []*drive.Share{
+				{Name: "a", Versions: 10, VersionsMaxAge: time.Hour},
+			},
+		},
+		{
+			name:   "add_negative_versions",
+			add:    &drive.Share{Name: "a", Versions: -1},
+			expect: drive.ErrInvalidShareVersions,
+		},
+		{
+			name:   "add_max_age_without_versions",
+			add:    &drive.Share{Name: "a", VersionsMaxAge: time.Hour},
+			expect: drive.ErrInvalidShareVersions,
+		},
 		{
 			name:     "add_disabled",
 			disabled: true,
@@ -28,6 +28,7 @@
 	"tailscale.com/tailcfg"
 	"tailscale.com/tka"
 	"tailscale.com/tsconst"
+	"tailscale.com/tstime"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/netmap"
@@ -49,11 +50,60 @@
 	}
 )
 
+// tkaCompactionInterval is how often TKA storage is compacted while
+// network-lock is active, in addition to when it is first opened.
+const tkaCompactionInterval = 24 * time.Hour
+
 type tkaState struct {
 	profile   ipn.ProfileID
 	authority *tka.Authority
-	storage   *tka.FS
+	storage   tka.CompactableChonk
 	filtered  []ipnstate.TKAPeer
+
+	compactTimer tstime.TimerController // or nil if compaction is not scheduled
+}
+
+// close stops the periodic compaction of ts and closes its storage.
+func (ts *tkaState) close() error {
+	if ts.compactTimer != nil {
+		ts.compactTimer.Stop()
+	}
+	if c, ok := ts.storage.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// closeTKALocked closes the TKA state, if any, and sets b.tka to nil.
+//
+// b.mu must be held.
+func (b *LocalBackend) closeTKALocked() {
+	if b.tka == nil {
+		return
+	}
+	if err := b.tka.close(); err != nil {
+		b.logf("closing tka storage: %v", err)
+	}
+	b.tka = nil
+}
+
+// scheduleTKACompactionLocked arranges for the storage of b.tka to be
+// compacted every tkaCompactionInterval, until it is closed.
+//
+// b.mu must be held & TKA must be initialized.
+func (b *LocalBackend) scheduleTKACompactionLocked() {
+	ts := b.tka
+	ts.compactTimer = tstime.DefaultClock{Clock: b.clock}.AfterFunc(tkaCompactionInterval, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.tka != ts || b.shutdownCalled {
+			return
+		}
+		if err := ts.authority.Compact(ts.storage, tkaCompactionDefaults); err != nil {
+			b.logf("tka compaction failed: %v", err)
+		}
+		b.scheduleTKACompactionLocked()
+	})
 }
 
 // tkaFilterNetmapLocked checks the signatures on each node key, dropping
@@ -393,11 +443,8 @@ func (b *LocalBackend) tkaSyncLocked(ourNodeKey key.NodePublic) error {
 // b.mu must be held & TKA must be initialized.
 func (b *LocalBackend) tkaApplyDisablementLocked(secret []byte) error {
 	if b.tka.authority.ValidDisablement(secret) {
-		if err := os.RemoveAll(b.chonkPathLocked()); err != nil {
-			return err
-		}
-		b.tka = nil
-		return nil
+		b.closeTKALocked()
+		return os.RemoveAll(b.chonkPathLocked())
 	}
 	return errors.New("incorrect disablement secret")
 }
@@ -445,12 +492,15 @@ func (b *LocalBackend) tkaBootstrapFromGenesisLocked(g tkatype.MarshaledAUM, per
 		return fmt.Errorf("mkdir: %v", err)
 	}
 
-	chonk, err := tka.ChonkDir(chonkDir)
+	chonk, err := b.openTKAStorage(chonkDir)
 	if err != nil {
 		return fmt.Errorf("chonk: %v", err)
 	}
 	authority, err := tka.Bootstrap(chonk, genesis)
 	if err != nil {
+		if c, ok := chonk.(io.Closer); ok {
+			c.Close()
+		}
 		return fmt.Errorf("tka bootstrap: %v", err)
 	}
 
@@ -459,6 +509,7 @@ func (b *LocalBackend) tkaBootstrapFromGenesisLocked(g tkatype.MarshaledAUM, per
 		authority: authority,
 		storage:   chonk,
 	}
+	b.scheduleTKACompactionLocked()
 	return nil
 }
 
@@ -713,10 +764,10 @@ func (b *LocalBackend) NetworkLockForceLocalDisable() error {
 		return fmt.Errorf("saving prefs: %w", err)
 	}
 
+	b.closeTKALocked()
 	if err := os.RemoveAll(b.chonkPathLocked()); err != nil {
 		return fmt.Errorf("deleting TKA state: %w", err)
 	}
-	b.tka = nil
 	return nil
 }
 
@@ -828,7 +879,14 @@ func (b *LocalBackend) NetworkLockModify(addKeys, removeKeys []tka.Key) (err err
 	if len(aums) == 0 {
 		return nil
 	}
+	return b.tkaSubmitAUMsLocked(ourNodeKey, aums)
+}
 
+// tkaSubmitAUMsLocked submits a chain of AUMs, which must follow from the
+// current head of the authority, to the control plane.
+//
+// b.mu must be held; it is released while communicating with control.
+func (b *LocalBackend) tkaSubmitAUMsLocked(ourNodeKey key.NodePublic, aums []tka.AUM) error {
 	head := b.tka.authority.Head()
 	b.mu.Unlock()
 	resp, err := b.tkaDoSyncSend(ourNodeKey, head, aums, true)
@@ -850,6 +908,86 @@ func (b *LocalBackend) NetworkLockModify(addKeys, removeKeys []tka.Key) (err err
 	return nil
 }
 
+// NetworkLockModifyRequest returns a request to add and/or remove keys in
+// the tailnet's key authority, for signing by a trusted key held elsewhere,
+// such as on an air-gapped machine. The signed request is submitted with
+// NetworkLockSubmitSigned.
+func (b *LocalBackend) NetworkLockModifyRequest(addKeys, removeKeys []tka.Key) (*tka.SigningRequest, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tka == nil {
+		return nil, errNetworkLockNotActive
+	}
+
+	updater := b.tka.authority.NewUpdater(nil)
+	for _, addKey := range addKeys {
+		if err := updater.AddKey(addKey); err != nil {
+			return nil, err
+		}
+	}
+	for _, removeKey := range removeKeys {
+		keyID, err := removeKey.ID()
+		if err != nil {
+			return nil, err
+		}
+		if err := updater.RemoveKey(keyID); err != nil {
+			return nil, err
+		}
+	}
+
+	aums, err := updater.Finalize(b.tka.storage)
+	if err != nil {
+		return nil, err
+	}
+	if len(aums) == 0 {
+		return nil, errors.New("no changes to make")
+	}
+	return &tka.SigningRequest{AUMs: aums}, nil
+}
+
+// NetworkLockSubmitSigned validates a signing request which was signed
+// elsewhere against the current authority and submits it to the control
+// plane.
+func (b *LocalBackend) NetworkLockSubmitSigned(req *tka.SigningRequest) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var ourNodeKey key.NodePublic
+	if p := b.pm.CurrentPrefs(); p.Valid() && p.Persist().Valid() && !p.Persist().PrivateNodeKey().IsZero() {
+		ourNodeKey = p.Persist().PublicNodeKey()
+	}
+	if ourNodeKey.IsZero() {
+		return errors.New("no node-key: is tailscale logged in?")
+	}
+	if b.tka == nil {
+		return errNetworkLockNotActive
+	}
+
+	if len(req.AUMs) > 0 {
+		if err := b.tka.authority.CheckUpdates(req.AUMs); err != nil {
+			return fmt.Errorf("signed updates are not valid: %w", err)
+		}
+		return b.tkaSubmitAUMsLocked(ourNodeKey, req.AUMs)
+	}
+
+	if req.NodeKeySig == nil {
+		return errors.New("empty signing request")
+	}
+	var nodeKey key.NodePublic
+	if err := nodeKey.UnmarshalBinary(req.NodeKeySig.Pubkey); err != nil {
+		return fmt.Errorf("decoding node key: %w", err)
+	}
+	sig := req.NodeKeySig.Serialize()
+	if err := b.tka.authority.NodeKeyAuthorized(nodeKey, sig); err != nil {
+		return fmt.Errorf("signature is not valid: %w", err)
+	}
+	b.mu.Unlock()
+	defer b.mu.Lock()
+	b.logf("Submitting offline network-lock signature for %v to control plane", nodeKey)
+	_, err := b.tkaSubmitSignature(ourNodeKey, sig)
+	return err
+}
+
 // NetworkLockDisable disables network-lock using the provided disablement secret.
 func (b *LocalBackend) NetworkLockDisable(secret []byte) error {
 	var (
@@ -0,0 +1,42 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !js && !plan9 && !ts_omit_bbolt
+
+package ipnlocal
+
+import (
+	"path/filepath"
+
+	"tailscale.com/tka"
+	"tailscale.com/tka/boltchonk"
+)
+
+// openTKAStorage opens the TKA storage in the directory dir, a single
+// database file in which all AUMs are kept.
+//
+// State stored by older versions as one file per AUM (tka.ChonkDir) is
+// imported into the database once. The old files are left in place, so
+// that older versions and builds without bbolt can still use them. If the
+// import fails, the old state is used as-is and the import is retried next
+// time.
+func (b *LocalBackend) openTKAStorage(dir string) (tka.CompactableChonk, error) {
+	old, err := tka.ChonkDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	c, err := boltchonk.Open(filepath.Join(dir, "tailchonk.db"))
+	if err != nil {
+		return nil, err
+	}
+	imported, err := c.Imported()
+	if err == nil && !imported {
+		err = c.Import(old)
+	}
+	if err != nil {
+		b.logf("tka: importing %s into database failed, using it as-is: %v", dir, err)
+		c.Close()
+		return old, nil
+	}
+	return c, nil
+}
@@ -0,0 +1,15 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build js || plan9 || ts_omit_bbolt
+
+package ipnlocal
+
+import "tailscale.com/tka"
+
+// openTKAStorage opens the TKA storage in the directory dir. bbolt is
+// not supported on this platform or omitted from the build, so one file is
+// used per AUM.
+func (b *LocalBackend) openTKAStorage(dir string) (tka.CompactableChonk, error) {
+	return tka.ChonkDir(dir)
+}
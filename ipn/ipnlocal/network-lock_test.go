@@ -874,6 +874,139 @@ func TestTKASign(t *testing.T) {
 	}
 }
 
+func TestTKASubmitSigned(t *testing.T) {
+	nodePriv := key.NewNode()
+	toSign := key.NewNode()
+	// The node's own key is not trusted: changes are signed with a key
+	// held elsewhere.
+	nlPriv := key.NewNLPrivate()
+	offlinePriv := key.NewNLPrivate()
+
+	pm := must.Get(newProfileManager(new(mem.Store), t.Logf, new(health.Tracker)))
+	must.Do(pm.SetPrefs((&ipn.Prefs{
+		Persist: &persist.Persist{
+			PrivateNodeKey: nodePriv,
+			NetworkLockKey: nlPriv,
+		},
+	}).View(), ipn.NetworkProfile{}))
+
+	disablementSecret := bytes.Repeat([]byte{0xa5}, 32)
+	offlineKey := tka.Key{Kind: tka.Key25519, Public: offlinePriv.Public().Verifier(), Votes: 2}
+	state := tka.State{
+		Keys:               []tka.Key{offlineKey},
+		DisablementSecrets: [][]byte{tka.DisablementKDF(disablementSecret)},
+	}
+	chonk, err := tka.ChonkDir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	authority, genesis, err := tka.Create(chonk, state, offlinePriv)
+	if err != nil {
+		t.Fatalf("tka.Create() failed: %v", err)
+	}
+	controlStorage := &tka.Mem{}
+	controlAuthority, err := tka.Bootstrap(controlStorage, genesis)
+	if err != nil {
+		t.Fatalf("tka.Bootstrap() failed: %v", err)
+	}
+
+	var gotSig bool
+	ts, client := fakeNoiseServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		switch r.URL.Path {
+		case "/machine/tka/sign":
+			body := new(tailcfg.TKASubmitSignatureRequest)
+			if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+				t.Fatal(err)
+			}
+			if err := controlAuthority.NodeKeyAuthorized(toSign.Public(), body.Signature); err != nil {
+				t.Errorf("signature does not verify: %v", err)
+			}
+			gotSig = true
+			w.WriteHeader(200)
+			if err := json.NewEncoder(w).Encode(tailcfg.TKASubmitSignatureResponse{}); err != nil {
+				t.Fatal(err)
+			}
+
+		case "/machine/tka/sync/send":
+			body := new(tailcfg.TKASyncSendRequest)
+			if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+				t.Fatal(err)
+			}
+			toApply := make([]tka.AUM, len(body.MissingAUMs))
+			for i, a := range body.MissingAUMs {
+				if err := toApply[i].Unserialize(a); err != nil {
+					t.Fatalf("decoding missingAUM[%d]: %v", i, err)
+				}
+			}
+			if err := controlAuthority.Inform(controlStorage, toApply); err != nil {
+				t.Fatalf("control.Inform(%+v) failed: %v", toApply, err)
+			}
+			head, err := controlAuthority.Head().MarshalText()
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.WriteHeader(200)
+			if err := json.NewEncoder(w).Encode(tailcfg.TKASyncSendResponse{
+				Head: string(head),
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+		default:
+			t.Errorf("unhandled endpoint path: %v", r.URL.Path)
+			w.WriteHeader(404)
+		}
+	}))
+	defer ts.Close()
+	cc := fakeControlClient(t, client)
+	b := LocalBackend{
+		varRoot: t.TempDir(),
+		cc:      cc,
+		ccAuto:  cc,
+		logf:    t.Logf,
+		tka: &tkaState{
+			authority: authority,
+			storage:   chonk,
+		},
+		pm:    pm,
+		store: pm.Store(),
+	}
+
+	// Node-key signatures.
+	nkBytes := must.Get(toSign.Public().MarshalBinary())
+	req := &tka.SigningRequest{NodeKeySig: &tka.NodeKeySignature{SigKind: tka.SigDirect, Pubkey: nkBytes}}
+	if err := b.NetworkLockSubmitSigned(req); err == nil {
+		t.Error("NetworkLockSubmitSigned() of unsigned request succeeded, want error")
+	}
+	untrusted := &tka.SigningRequest{NodeKeySig: &tka.NodeKeySignature{SigKind: tka.SigDirect, Pubkey: nkBytes}}
+	must.Do(untrusted.Sign(nlPriv))
+	if err := b.NetworkLockSubmitSigned(untrusted); err == nil {
+		t.Error("NetworkLockSubmitSigned() of request signed by untrusted key succeeded, want error")
+	}
+	must.Do(req.Sign(offlinePriv))
+	if err := b.NetworkLockSubmitSigned(req); err != nil {
+		t.Errorf("NetworkLockSubmitSigned() failed: %v", err)
+	}
+	if !gotSig {
+		t.Error("signature was not submitted to control")
+	}
+
+	// Changes to the authority.
+	newKey := tka.Key{Kind: tka.Key25519, Public: key.NewNLPrivate().Public().Verifier(), Votes: 1}
+	req, err = b.NetworkLockModifyRequest([]tka.Key{newKey}, nil)
+	if err != nil {
+		t.Fatalf("NetworkLockModifyRequest() failed: %v", err)
+	}
+	must.Do(req.Sign(offlinePriv))
+	if err := b.NetworkLockSubmitSigned(req); err != nil {
+		t.Fatalf("NetworkLockSubmitSigned() failed: %v", err)
+	}
+	if !controlAuthority.KeyTrusted(newKey.MustID()) {
+		t.Error("control does not trust the added key")
+	}
+}
+
 func TestTKAForceDisable(t *testing.T) {
 	nodePriv := key.NewNode()
 
@@ -975,6 +1108,71 @@ func TestTKAForceDisable(t *testing.T) {
 	}
 }
 
+func TestTKAInitMigratesChonkDir(t *testing.T) {
+	nodePriv := key.NewNode()
+	nlPriv := key.NewNLPrivate()
+	key := tka.Key{Kind: tka.Key25519, Public: nlPriv.Public().Verifier(), Votes: 2}
+
+	pm := must.Get(newProfileManager(new(mem.Store), t.Logf, new(health.Tracker)))
+	must.Do(pm.SetPrefs((&ipn.Prefs{
+		Persist: &persist.Persist{
+			PrivateNodeKey: nodePriv,
+			NetworkLockKey: nlPriv,
+			NodeID:         "node1",
+			UserProfile:    tailcfg.UserProfile{LoginName: "user@example.com"},
+		},
+	}).View(), ipn.NetworkProfile{}))
+	sys := tsd.NewSystem()
+	sys.Set(pm.Store())
+	b := newTestLocalBackendWithSys(t, sys)
+	b.SetVarRoot(t.TempDir())
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pm = pm
+	tkaPath := b.chonkPathLocked()
+	must.Do(os.MkdirAll(tkaPath, 0755))
+
+	// Seed state in the one-file-per-AUM format used by older versions.
+	chonk, err := tka.ChonkDir(tkaPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authority, _, err := tka.Create(chonk, tka.State{
+		Keys:               []tka.Key{key},
+		DisablementSecrets: [][]byte{bytes.Repeat([]byte{0xa5}, 32)},
+	}, nlPriv)
+	if err != nil {
+		t.Fatalf("tka.Create() failed: %v", err)
+	}
+
+	for range 2 {
+		if err := b.initTKALocked(); err != nil {
+			t.Fatalf("initTKALocked() failed: %v", err)
+		}
+		if b.tka == nil {
+			t.Fatal("tka was not initialized")
+		}
+		if got, want := b.tka.authority.Head(), authority.Head(); got != want {
+			t.Errorf("head = %v, want %v", got, want)
+		}
+		if _, err := os.Stat(filepath.Join(tkaPath, "tailchonk.db")); err != nil {
+			t.Errorf("database not created: %v", err)
+		}
+		// The old state is kept for older versions and builds without
+		// bbolt.
+		if old, err := tka.Open(chonk); err != nil {
+			t.Errorf("opening old state: %v", err)
+		} else if got, want := old.Head(), authority.Head(); got != want {
+			t.Errorf("old state head = %v, want %v", got, want)
+		}
+
+		// Closing the state must release the database, so that it can be
+		// opened again.
+		b.closeTKALocked()
+	}
+}
+
 func TestTKAAffectedSigs(t *testing.T) {
 	nodePriv := key.NewNode()
 	// toSign := key.NewNode()
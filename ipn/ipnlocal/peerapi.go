@@ -224,6 +224,7 @@ type peerAPIHandler struct {
 // module features registered via tailscale.com/feature/*.
 type PeerAPIHandler interface {
 	Peer() tailcfg.NodeView
+	PeerUser() tailcfg.UserProfile // profile of Peer's owner
 	PeerCaps() tailcfg.PeerCapMap
 	Self() tailcfg.NodeView
 	LocalBackend() *LocalBackend
@@ -235,10 +236,11 @@ type PeerAPIHandler interface {
 func (h *peerAPIHandler) IsSelfUntagged() bool {
 	return !h.selfNode.IsTagged() && !h.peerNode.IsTagged() && h.isSelf
 }
-func (h *peerAPIHandler) Peer() tailcfg.NodeView      { return h.peerNode }
-func (h *peerAPIHandler) Self() tailcfg.NodeView      { return h.selfNode }
-func (h *peerAPIHandler) RemoteAddr() netip.AddrPort  { return h.remoteAddr }
-func (h *peerAPIHandler) LocalBackend() *LocalBackend { return h.ps.b }
+func (h *peerAPIHandler) Peer() tailcfg.NodeView        { return h.peerNode }
+func (h *peerAPIHandler) PeerUser() tailcfg.UserProfile { return h.peerUser }
+func (h *peerAPIHandler) Self() tailcfg.NodeView        { return h.selfNode }
+func (h *peerAPIHandler) RemoteAddr() netip.AddrPort    { return h.remoteAddr }
+func (h *peerAPIHandler) LocalBackend() *LocalBackend   { return h.ps.b }
 func (h *peerAPIHandler) Logf(format string, a ...any) {
 	h.logf(format, a...)
 }
@@ -140,9 +140,11 @@
 	"tka/init":                     (*Handler).serveTKAInit,
 	"tka/log":                      (*Handler).serveTKALog,
 	"tka/modify":                   (*Handler).serveTKAModify,
+	"tka/modify-request":           (*Handler).serveTKAModifyRequest,
 	"tka/sign":                     (*Handler).serveTKASign,
 	"tka/status":                   (*Handler).serveTKAStatus,
 	"tka/submit-recovery-aum":      (*Handler).serveTKASubmitRecoveryAUM,
+	"tka/submit-signed":            (*Handler).serveTKASubmitSigned,
 	"tka/verify-deeplink":          (*Handler).serveTKAVerifySigningDeeplink,
 	"tka/wrap-preauth-key":         (*Handler).serveTKAWrapPreauthKey,
 	"update/check":                 (*Handler).serveUpdateCheck,
@@ -2108,6 +2110,64 @@ type modifyRequest struct {
 	w.WriteHeader(204)
 }
 
+func (h *Handler) serveTKAModifyRequest(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "network-lock modify access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != httpm.POST {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	type modifyRequest struct {
+		AddKeys    []tka.Key
+		RemoveKeys []tka.Key
+	}
+	var req modifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	res, err := h.b.NetworkLockModifyRequest(req.AddKeys, req.RemoveKeys)
+	if err != nil {
+		http.Error(w, "network-lock modify failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(res.Serialize())
+}
+
+func (h *Handler) serveTKASubmitSigned(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "network-lock modify access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != httpm.POST {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body := io.LimitReader(r.Body, 1024*1024)
+	reqBytes, err := io.ReadAll(body)
+	if err != nil {
+		http.Error(w, "reading signing request", http.StatusBadRequest)
+		return
+	}
+	var req tka.SigningRequest
+	if err := req.Unserialize(reqBytes); err != nil {
+		http.Error(w, "decoding signing request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.b.NetworkLockSubmitSigned(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
 func (h *Handler) serveTKAWrapPreauthKey(w http.ResponseWriter, r *http.Request) {
 	if !h.PermitWrite {
 		http.Error(w, "network-lock modify access denied", http.StatusForbidden)
@@ -2772,6 +2832,10 @@ func (h *Handler) serveShares(w http.ResponseWriter, r *http.Request) {
 				http.Error(w, "invalid share name", http.StatusBadRequest)
 				return
 			}
+			if errors.Is(err, drive.ErrInvalidShareVersions) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -277,6 +277,22 @@ type Prefs struct {
 	// non-nil/enabled.
 	RelayServerPort *int `json:",omitempty"`
 
+	// RelayServerMaxEndpoints is the maximum number of endpoints each peer
+	// may have allocated on the relay server at once, or zero for no limit.
+	RelayServerMaxEndpoints int `json:",omitempty"`
+
+	// RelayServerMaxBytesPerSec is the maximum rate, in bytes per second, at
+	// which the relay server relays packets through the endpoints allocated
+	// by each peer, or zero for no limit. Packets in excess of it are
+	// dropped.
+	RelayServerMaxBytesPerSec int `json:",omitempty"`
+
+	// RelayServerEviction is what the relay server does when a peer that has
+	// RelayServerMaxEndpoints endpoints allocated requests another: the empty
+	// string rejects the request, and "idlest" evicts the peer's endpoint
+	// that has been idle the longest.
+	RelayServerEviction string `json:",omitempty"`
+
 	// AllowSingleHosts was a legacy field that was always true
 	// for the past 4.5 years. It controlled whether Tailscale
 	// peers got /32 or /127 routes for each other.
@@ -339,37 +355,40 @@ type AppConnectorPrefs struct {
 type MaskedPrefs struct {
 	Prefs
 
-	ControlURLSet             bool                `json:",omitempty"`
-	RouteAllSet               bool                `json:",omitempty"`
-	ExitNodeIDSet             bool                `json:",omitempty"`
-	ExitNodeIPSet             bool                `json:",omitempty"`
-	AutoExitNodeSet           bool                `json:",omitempty"`
-	InternalExitNodePriorSet  bool                `json:",omitempty"` // Internal; can't be set by LocalAPI clients
-	ExitNodeAllowLANAccessSet bool                `json:",omitempty"`
-	CorpDNSSet                bool                `json:",omitempty"`
-	RunSSHSet                 bool                `json:",omitempty"`
-	RunWebClientSet           bool                `json:",omitempty"`
-	WantRunningSet            bool                `json:",omitempty"`
-	LoggedOutSet              bool                `json:",omitempty"`
-	ShieldsUpSet              bool                `json:",omitempty"`
-	AdvertiseTagsSet          bool                `json:",omitempty"`
-	HostnameSet               bool                `json:",omitempty"`
-	NotepadURLsSet            bool                `json:",omitempty"`
-	ForceDaemonSet            bool                `json:",omitempty"`
-	EggSet                    bool                `json:",omitempty"`
-	AdvertiseRoutesSet        bool                `json:",omitempty"`
-	AdvertiseServicesSet      bool                `json:",omitempty"`
-	NoSNATSet                 bool                `json:",omitempty"`
-	NoStatefulFilteringSet    bool                `json:",omitempty"`
-	NetfilterModeSet          bool                `json:",omitempty"`
-	OperatorUserSet           bool                `json:",omitempty"`
-	ProfileNameSet            bool                `json:",omitempty"`
-	AutoUpdateSet             AutoUpdatePrefsMask `json:",omitempty"`
-	AppConnectorSet           bool                `json:",omitempty"`
-	PostureCheckingSet        bool                `json:",omitempty"`
-	NetfilterKindSet          bool                `json:",omitempty"`
-	DriveSharesSet            bool                `json:",omitempty"`
-	RelayServerPortSet        bool                `json:",omitempty"`
+	ControlURLSet                bool                `json:",omitempty"`
+	RouteAllSet                  bool                `json:",omitempty"`
+	ExitNodeIDSet                bool                `json:",omitempty"`
+	ExitNodeIPSet                bool                `json:",omitempty"`
+	AutoExitNodeSet              bool                `json:",omitempty"`
+	InternalExitNodePriorSet     bool                `json:",omitempty"` // Internal; can't be set by LocalAPI clients
+	ExitNodeAllowLANAccessSet    bool                `json:",omitempty"`
+	CorpDNSSet                   bool                `json:",omitempty"`
+	RunSSHSet                    bool                `json:",omitempty"`
+	RunWebClientSet              bool                `json:",omitempty"`
+	WantRunningSet               bool                `json:",omitempty"`
+	LoggedOutSet                 bool                `json:",omitempty"`
+	ShieldsUpSet                 bool                `json:",omitempty"`
+	AdvertiseTagsSet             bool                `json:",omitempty"`
+	HostnameSet                  bool                `json:",omitempty"`
+	NotepadURLsSet               bool                `json:",omitempty"`
+	ForceDaemonSet               bool                `json:",omitempty"`
+	EggSet                       bool                `json:",omitempty"`
+	AdvertiseRoutesSet           bool                `json:",omitempty"`
+	AdvertiseServicesSet         bool                `json:",omitempty"`
+	NoSNATSet                    bool                `json:",omitempty"`
+	NoStatefulFilteringSet       bool                `json:",omitempty"`
+	NetfilterModeSet             bool                `json:",omitempty"`
+	OperatorUserSet              bool                `json:",omitempty"`
+	ProfileNameSet               bool                `json:",omitempty"`
+	AutoUpdateSet                AutoUpdatePrefsMask `json:",omitempty"`
+	AppConnectorSet              bool                `json:",omitempty"`
+	PostureCheckingSet           bool                `json:",omitempty"`
+	NetfilterKindSet             bool                `json:",omitempty"`
+	DriveSharesSet               bool                `json:",omitempty"`
+	RelayServerPortSet           bool                `json:",omitempty"`
+	RelayServerMaxEndpointsSet   bool                `json:",omitempty"`
+	RelayServerMaxBytesPerSecSet bool                `json:",omitempty"`
+	RelayServerEvictionSet       bool                `json:",omitempty"`
 }
 
 // SetsInternal reports whether mp has any of the Internal*Set field bools set
@@ -594,6 +613,15 @@ func (p *Prefs) pretty(goos string) string {
 	if p.RelayServerPort != nil {
 		fmt.Fprintf(&sb, "relayServerPort=%d ", *p.RelayServerPort)
 	}
+	if p.RelayServerMaxEndpoints != 0 {
+		fmt.Fprintf(&sb, "relayServerMaxEndpoints=%d ", p.RelayServerMaxEndpoints)
+	}
+	if p.RelayServerMaxBytesPerSec != 0 {
+		fmt.Fprintf(&sb, "relayServerMaxBytesPerSec=%d ", p.RelayServerMaxBytesPerSec)
+	}
+	if p.RelayServerEviction != "" {
+		fmt.Fprintf(&sb, "relayServerEviction=%s ", p.RelayServerEviction)
+	}
 	if p.Persist != nil {
 		sb.WriteString(p.Persist.Pretty())
 	} else {
@@ -657,7 +685,10 @@ func (p *Prefs) Equals(p2 *Prefs) bool {
 		p.PostureChecking == p2.PostureChecking &&
 		slices.EqualFunc(p.DriveShares, p2.DriveShares, drive.SharesEqual) &&
 		p.NetfilterKind == p2.NetfilterKind &&
-		compareIntPtrs(p.RelayServerPort, p2.RelayServerPort)
+		compareIntPtrs(p.RelayServerPort, p2.RelayServerPort) &&
+		p.RelayServerMaxEndpoints == p2.RelayServerMaxEndpoints &&
+		p.RelayServerMaxBytesPerSec == p2.RelayServerMaxBytesPerSec &&
+		p.RelayServerEviction == p2.RelayServerEviction
 }
 
 func (au AutoUpdatePrefs) Pretty() string {
@@ -67,6 +67,9 @@ func TestPrefsEqual(t *testing.T) {
 		"NetfilterKind",
 		"DriveShares",
 		"RelayServerPort",
+		"RelayServerMaxEndpoints",
+		"RelayServerMaxBytesPerSec",
+		"RelayServerEviction",
 		"AllowSingleHosts",
 		"Persist",
 	}
@@ -367,6 +370,21 @@ func TestPrefsEqual(t *testing.T) {
 			&Prefs{RelayServerPort: relayServerPort(1)},
 			false,
 		},
+		{
+			&Prefs{RelayServerMaxEndpoints: 8},
+			&Prefs{RelayServerMaxEndpoints: 8},
+			true,
+		},
+		{
+			&Prefs{RelayServerMaxBytesPerSec: 1 << 20},
+			&Prefs{},
+			false,
+		},
+		{
+			&Prefs{RelayServerEviction: "idlest"},
+			&Prefs{RelayServerEviction: ""},
+			false,
+		},
 	}
 	for i, tt := range tests {
 		got := tt.a.Equals(tt.b)
@@ -0,0 +1,152 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package encstore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// A KeyProvider provides the key used to encrypt a state file.
+type KeyProvider interface {
+	// Key returns the 32-byte encryption key for a state file with the
+	// given salt. It must return the same key for the same salt.
+	Key(salt []byte) ([]byte, error)
+}
+
+var (
+	providersMu sync.Mutex
+	providers   = map[string]func(arg string) (KeyProvider, error){
+		"systemd-creds": newSystemdCredsProvider,
+		"keyfile":       newKeyFileProvider,
+		"env":           newEnvProvider,
+	}
+)
+
+// RegisterKeyProvider registers a KeyProvider constructor for the given
+// name, for use as "enc:<name>[=<arg>],<path>". The arg, possibly empty, is
+// passed to newFn.
+//
+// It panics if name is already registered.
+func RegisterKeyProvider(name string, newFn func(arg string) (KeyProvider, error)) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	if _, ok := providers[name]; ok {
+		panic("encstore: duplicate key provider " + name)
+	}
+	providers[name] = newFn
+}
+
+func newKeyProvider(name, arg string) (KeyProvider, error) {
+	providersMu.Lock()
+	newFn, ok := providers[name]
+	providersMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("encstore: unknown key provider %q", name)
+	}
+	return newFn(arg)
+}
+
+const (
+	// minSecretLen is the minimum length of secrets read by the
+	// systemd-creds and keyfile providers.
+	minSecretLen = 32
+
+	// defaultCredName is the default credential name for systemd-creds.
+	defaultCredName = "tailscaled-state-key"
+
+	// defaultPassphraseEnv is the default environment variable for env.
+	defaultPassphraseEnv = "TS_STATE_PASSPHRASE"
+
+	// hkdfInfo is the HKDF info string for keys derived from secrets.
+	hkdfInfo = "tailscale state encryption"
+)
+
+// secretProvider is a KeyProvider that derives keys from a high-entropy
+// secret with HKDF-SHA256.
+type secretProvider struct {
+	secret []byte
+}
+
+func (p secretProvider) Key(salt []byte) ([]byte, error) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, p.secret, salt, []byte(hkdfInfo)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// newSecretFileProvider returns a secretProvider for the secret in the file
+// at path. Surrounding whitespace is ignored.
+func newSecretFileProvider(path string) (KeyProvider, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	secret := bytes.TrimSpace(bs)
+	if len(secret) < minSecretLen {
+		return nil, fmt.Errorf("secret in %q is too short; need at least %d bytes", path, minSecretLen)
+	}
+	return secretProvider{secret: secret}, nil
+}
+
+// newSystemdCredsProvider returns a provider for the systemd credential
+// named arg, or "tailscaled-state-key" if arg is empty, as passed with
+// LoadCredential= or LoadCredentialEncrypted= in the unit file.
+func newSystemdCredsProvider(arg string) (KeyProvider, error) {
+	dir := os.Getenv("CREDENTIALS_DIRECTORY")
+	if dir == "" {
+		return nil, errors.New("systemd-creds: $CREDENTIALS_DIRECTORY is not set; is tailscaled running under systemd with a LoadCredential= setting?")
+	}
+	name := arg
+	if name == "" {
+		name = defaultCredName
+	}
+	if name != filepath.Base(name) {
+		return nil, fmt.Errorf("systemd-creds: invalid credential name %q", name)
+	}
+	return newSecretFileProvider(filepath.Join(dir, name))
+}
+
+// newKeyFileProvider returns a provider for the secret in the file at arg.
+func newKeyFileProvider(arg string) (KeyProvider, error) {
+	if arg == "" {
+		return nil, errors.New("keyfile: missing key file path; use keyfile=<path>")
+	}
+	return newSecretFileProvider(arg)
+}
+
+// passphraseProvider is a KeyProvider that derives keys from a passphrase
+// with Argon2id.
+type passphraseProvider struct {
+	passphrase []byte
+}
+
+func (p passphraseProvider) Key(salt []byte) ([]byte, error) {
+	return argon2.IDKey(p.passphrase, salt, 1, 64*1024, 4, chacha20poly1305.KeySize), nil
+}
+
+// newEnvProvider returns a provider for the passphrase in the environment
+// variable arg, or TS_STATE_PASSPHRASE if arg is empty.
+func newEnvProvider(arg string) (KeyProvider, error) {
+	name := arg
+	if name == "" {
+		name = defaultPassphraseEnv
+	}
+	v := os.Getenv(name)
+	if v == "" {
+		return nil, fmt.Errorf("env: $%s is not set", name)
+	}
+	return passphraseProvider{passphrase: []byte(v)}, nil
+}
@@ -0,0 +1,249 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package encstore contains an ipn.StateStore implementation that keeps the
+// state in a local file encrypted with XChaCha20-Poly1305, using a key
+// obtained from a pluggable KeyProvider.
+//
+// It is meant for machines without a TPM (see feature/tpm), where the
+// encryption key can still be kept apart from the state file, for example
+// in a systemd credential or on a separate volume.
+package encstore
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"iter"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"tailscale.com/atomicfile"
+	"tailscale.com/ipn"
+	"tailscale.com/paths"
+	"tailscale.com/types/logger"
+)
+
+// Prefix is the ipn/store path prefix for encrypted state files.
+//
+// The full form is "enc:<provider>[=<arg>],<path>", where provider names a
+// registered KeyProvider, arg is passed to it and must not contain a comma,
+// and path is the state file. A comma is used rather than a colon so that
+// both arg and path may be Windows paths. For example:
+//
+//	enc:systemd-creds,/var/lib/tailscale/tailscaled.state
+//	enc:keyfile=/run/keys/tailscaled.key,/var/lib/tailscale/tailscaled.state
+//	enc:keyfile=D:\tailscale.key,C:\ProgramData\Tailscale\server-state.conf
+//	enc:env=TS_STATE_PASSPHRASE,/var/lib/tailscale/tailscaled.state
+const Prefix = "enc:"
+
+const (
+	// formatVersion is the version of encryptedFile written by this package.
+	formatVersion = 1
+
+	// saltLen is the length of the random per-file salt passed to
+	// KeyProviders.
+	saltLen = 16
+)
+
+// additionalData is the AEAD additional data for encrypted state files.
+var additionalData = []byte("tailscale encrypted state v1")
+
+// encryptedFile is the on-disk format of an encrypted state file.
+type encryptedFile struct {
+	Version  int    `json:"encstoreVersion"`
+	Provider string `json:"provider"` // name of the KeyProvider, informational
+	Salt     []byte `json:"salt"`
+	Nonce    []byte `json:"nonce"`
+	Data     []byte `json:"data"` // sealed JSON of map[ipn.StateKey][]byte
+}
+
+// New returns a new encrypted file store for arg, which must be of the form
+// described on Prefix.
+//
+// If the state file exists but is a plaintext state file, as written by
+// store.FileStore, it is encrypted in place.
+func New(logf logger.Logf, arg string) (ipn.StateStore, error) {
+	providerName, providerArg, path, err := parseArg(arg)
+	if err != nil {
+		return nil, err
+	}
+	kp, err := newKeyProvider(providerName, providerArg)
+	if err != nil {
+		return nil, err
+	}
+	return newStore(logf, path, providerName, kp)
+}
+
+// parseArg splits a store argument of the form described on Prefix.
+func parseArg(arg string) (provider, providerArg, path string, err error) {
+	rest, ok := strings.CutPrefix(arg, Prefix)
+	if !ok {
+		return "", "", "", fmt.Errorf("encstore: %q does not start with %q", arg, Prefix)
+	}
+	spec, path, ok := strings.Cut(rest, ",")
+	if !ok || spec == "" || path == "" {
+		return "", "", "", fmt.Errorf("encstore: %q is not of the form %s<provider>[=<arg>],<path>", arg, Prefix)
+	}
+	provider, providerArg, _ = strings.Cut(spec, "=")
+	return provider, providerArg, path, nil
+}
+
+func newStore(logf logger.Logf, path, providerName string, kp KeyProvider) (*encStore, error) {
+	if err := paths.MkStateDir(filepath.Dir(path)); err != nil {
+		return nil, fmt.Errorf("creating state directory: %w", err)
+	}
+	s := &encStore{
+		logf:     logf,
+		path:     path,
+		provider: providerName,
+		cache:    make(map[ipn.StateKey][]byte),
+	}
+
+	bs, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(bs) == 0 {
+		// Missing or empty (see store.NewFileStore) file; start afresh.
+		if err := s.init(kp, nil); err != nil {
+			return nil, err
+		}
+		logf("encstore: initializing state file %q", path)
+		return s, s.writeLocked()
+	}
+
+	var f encryptedFile
+	if err := json.Unmarshal(bs, &f); err != nil {
+		return nil, fmt.Errorf("encstore: parsing %q: %w", path, err)
+	}
+	if f.Version == 0 {
+		// Not encrypted: a plaintext FileStore file. Migrate it.
+		if err := json.Unmarshal(bs, &s.cache); err != nil {
+			return nil, fmt.Errorf("encstore: parsing plaintext state file %q: %w", path, err)
+		}
+		if err := s.init(kp, nil); err != nil {
+			return nil, err
+		}
+		if err := s.writeLocked(); err != nil {
+			return nil, fmt.Errorf("encstore: encrypting plaintext state file %q: %w", path, err)
+		}
+		logf("encstore: migrated %q from plaintext to encrypted format", path)
+		return s, nil
+	}
+	if f.Version != formatVersion {
+		return nil, fmt.Errorf("encstore: %q has unsupported format version %d", path, f.Version)
+	}
+	if f.Provider != "" && f.Provider != providerName {
+		logf("encstore: %q was written with key provider %q, now using %q", path, f.Provider, providerName)
+	}
+	if err := s.init(kp, f.Salt); err != nil {
+		return nil, err
+	}
+	if len(f.Nonce) != s.aead.NonceSize() {
+		return nil, fmt.Errorf("encstore: %q has a corrupt nonce", path)
+	}
+	plain, err := s.aead.Open(nil, f.Nonce, f.Data, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("encstore: decrypting %q failed; wrong key?", path)
+	}
+	if err := json.Unmarshal(plain, &s.cache); err != nil {
+		return nil, fmt.Errorf("encstore: parsing decrypted state: %w", err)
+	}
+	return s, nil
+}
+
+// encStore is an ipn.StateStore that stores the state in an encrypted file.
+type encStore struct {
+	ipn.EncryptedStateStore
+
+	logf     logger.Logf
+	path     string
+	provider string // KeyProvider name, recorded in the file
+	salt     []byte
+	aead     cipher.AEAD
+
+	mu    sync.RWMutex
+	cache map[ipn.StateKey][]byte
+}
+
+// init sets up the cipher for the file, using salt or, if nil, a new random
+// salt.
+func (s *encStore) init(kp KeyProvider, salt []byte) error {
+	if salt == nil {
+		salt = make([]byte, saltLen)
+		rand.Read(salt)
+	}
+	key, err := kp.Key(salt)
+	if err != nil {
+		return fmt.Errorf("encstore: getting key from provider %q: %w", s.provider, err)
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return err
+	}
+	s.salt, s.aead = salt, aead
+	return nil
+}
+
+func (s *encStore) String() string { return fmt.Sprintf("encstore(%q)", s.path) }
+
+func (s *encStore) ReadState(k ipn.StateKey) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.cache[k]
+	if !ok {
+		return nil, ipn.ErrStateNotExist
+	}
+	return bytes.Clone(v), nil
+}
+
+func (s *encStore) WriteState(k ipn.StateKey, bs []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if bytes.Equal(s.cache[k], bs) {
+		return nil
+	}
+	s.cache[k] = bytes.Clone(bs)
+	return s.writeLocked()
+}
+
+// writeLocked encrypts the cache with a fresh nonce and writes it to disk.
+// s.mu must be held, or s not yet shared.
+func (s *encStore) writeLocked() error {
+	plain, err := json.Marshal(s.cache)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	rand.Read(nonce)
+	buf, err := json.Marshal(encryptedFile{
+		Version:  formatVersion,
+		Provider: s.provider,
+		Salt:     s.salt,
+		Nonce:    nonce,
+		Data:     s.aead.Seal(nil, nonce, plain, additionalData),
+	})
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(s.path, buf, 0600)
+}
+
+func (s *encStore) All() iter.Seq2[ipn.StateKey, []byte] {
+	return func(yield func(ipn.StateKey, []byte) bool) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		for k, v := range s.cache {
+			if !yield(k, v) {
+				break
+			}
+		}
+	}
+}
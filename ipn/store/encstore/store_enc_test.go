@@ -0,0 +1,155 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package encstore
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"tailscale.com/ipn"
+)
+
+func writeKeyFile(t *testing.T, secret string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(path, []byte(secret+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestStoreRoundTrip(t *testing.T) {
+	keyPath := writeKeyFile(t, strings.Repeat("k", 32))
+	arg := Prefix + "keyfile=" + keyPath + "," + filepath.Join(t.TempDir(), "state", "tailscaled.state")
+
+	s, err := New(t.Logf, arg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ReadState("foo"); !errors.Is(err, ipn.ErrStateNotExist) {
+		t.Fatalf("ReadState on empty store: got %v; want ErrStateNotExist", err)
+	}
+	if err := s.WriteState("foo", []byte("secret-value")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.(ipn.EncryptedStateStore); !ok {
+		t.Error("store does not implement ipn.EncryptedStateStore")
+	}
+
+	path := s.(*encStore).path
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("secret-value")) || bytes.Contains(raw, []byte("c2VjcmV0LXZhbHVl")) {
+		t.Fatalf("state file contains plaintext: %s", raw)
+	}
+
+	s2, err := New(t.Logf, arg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := s2.ReadState("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "secret-value" {
+		t.Errorf("after reopening, got %q; want %q", got, "secret-value")
+	}
+
+	wrongKey := writeKeyFile(t, strings.Repeat("x", 32))
+	if _, err := New(t.Logf, Prefix+"keyfile="+wrongKey+","+path); err == nil {
+		t.Error("opening with the wrong key succeeded")
+	}
+}
+
+func TestMigratePlaintext(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tailscaled.state")
+	if err := os.WriteFile(path, []byte(`{"foo":"YmFy"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_PASSPHRASE", "correct horse battery staple")
+
+	s, err := New(t.Logf, Prefix+"env=TEST_PASSPHRASE,"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.ReadState("foo"); err != nil || string(got) != "bar" {
+		t.Fatalf("ReadState after migration = %q, %v; want %q", got, err, "bar")
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(raw, []byte(`"encstoreVersion":1`)) {
+		t.Errorf("state file not encrypted after migration: %s", raw)
+	}
+
+	t.Setenv("TEST_PASSPHRASE", "wrong")
+	if _, err := New(t.Logf, Prefix+"env=TEST_PASSPHRASE,"+path); err == nil {
+		t.Error("opening with the wrong passphrase succeeded")
+	}
+}
+
+func TestSystemdCredsProvider(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, defaultCredName), []byte(strings.Repeat("s", 32)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "short"), []byte("too short"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CREDENTIALS_DIRECTORY", dir)
+
+	if _, err := newKeyProvider("systemd-creds", ""); err != nil {
+		t.Errorf("default credential: %v", err)
+	}
+	if _, err := newKeyProvider("systemd-creds", "short"); err == nil {
+		t.Error("short credential accepted")
+	}
+	if _, err := newKeyProvider("systemd-creds", "../"+defaultCredName); err == nil {
+		t.Error("credential name with path accepted")
+	}
+	t.Setenv("CREDENTIALS_DIRECTORY", "")
+	if _, err := newKeyProvider("systemd-creds", ""); err == nil {
+		t.Error("got no error without $CREDENTIALS_DIRECTORY")
+	}
+}
+
+func TestParseArg(t *testing.T) {
+	tests := []struct {
+		in                   string
+		provider, parg, path string
+		wantErr              bool
+	}{
+		{in: "enc:systemd-creds,/var/lib/tailscale/tailscaled.state", provider: "systemd-creds", path: "/var/lib/tailscale/tailscaled.state"},
+		{in: "enc:keyfile=/run/key,/state", provider: "keyfile", parg: "/run/key", path: "/state"},
+		{in: "enc:env=VAR,C:\\state", provider: "env", parg: "VAR", path: "C:\\state"},
+		{in: "enc:keyfile=D:\\state.key,C:\\state", provider: "keyfile", parg: "D:\\state.key", path: "C:\\state"},
+		{in: "enc:/state", wantErr: true},
+		{in: "enc:,/state", wantErr: true},
+		{in: "enc:systemd-creds:/state", wantErr: true},
+		{in: "tpmseal:/state", wantErr: true},
+	}
+	for _, tt := range tests {
+		provider, parg, path, err := parseArg(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseArg(%q) succeeded; want error", tt.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseArg(%q): %v", tt.in, err)
+			continue
+		}
+		if provider != tt.provider || parg != tt.parg || path != tt.path {
+			t.Errorf("parseArg(%q) = %q, %q, %q; want %q, %q, %q", tt.in, provider, parg, path, tt.provider, tt.parg, tt.path)
+		}
+	}
+}
@@ -0,0 +1,441 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package httpstore contains an ipn.StateStore implementation that keeps the
+// state on a generic HTTP server.
+//
+// The server exposes each state key as a resource under a base URL:
+//
+//	GET <base>/          all keys, as a JSON object mapping each key to
+//	                     {"value": <base64>, "etag": <etag>}
+//	GET <base>/<key>     the raw value of key, with an ETag header;
+//	                     404 if the key does not exist
+//	PUT <base>/<key>     set the raw value of key; the request has an
+//	                     If-Match header with the last known ETag, or
+//	                     If-None-Match: * if the key is new. The server
+//	                     replies 412 if the precondition fails, and with
+//	                     the new ETag on success.
+//
+// Requests carry an "Authorization: Bearer" token if one is configured. See
+// tailscale.com/tstest/statestore for a reference implementation.
+//
+// If a cache file is configured, the state is also kept on local disk, so
+// that tailscaled can start with its last known state while the server is
+// unreachable.
+package httpstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/atomicfile"
+	"tailscale.com/ipn"
+	"tailscale.com/types/logger"
+)
+
+// TokenEnv is the environment variable consulted for the bearer token if no
+// tokenFile option is given.
+const TokenEnv = "TS_STATE_HTTP_TOKEN"
+
+// requestTimeout is the timeout for each request to the server.
+const requestTimeout = 30 * time.Second
+
+// ErrConflict is returned by WriteState when the value on the server was
+// changed by someone else since it was last read.
+var ErrConflict = errors.New("state was modified concurrently on the server")
+
+// Option defines a functional option type for configuring the store.
+type Option func(*storeOptions)
+
+// storeOptions holds optional settings for creating a new Store.
+type storeOptions struct {
+	tokenFile string
+	cacheFile string
+	client    *http.Client
+}
+
+// WithTokenFile returns an Option that reads the bearer token from the file
+// at path. The file is reread for every request, so the token can be rotated
+// without restarting.
+func WithTokenFile(path string) Option {
+	return func(o *storeOptions) {
+		o.tokenFile = path
+	}
+}
+
+// WithCacheFile returns an Option that keeps a copy of the state in the file
+// at path, which is rewritten after every change. If the server cannot be
+// reached when the Store is created, the state is loaded from the file
+// instead. The file holds the node's private keys and is written with
+// mode 0600.
+func WithCacheFile(path string) Option {
+	return func(o *storeOptions) {
+		o.cacheFile = path
+	}
+}
+
+// WithHTTPClient returns an Option that uses c to make requests.
+func WithHTTPClient(c *http.Client) Option {
+	return func(o *storeOptions) {
+		o.client = c
+	}
+}
+
+// ParseURLAndOpts parses a base URL and optional URL-encoded parameters from
+// arg. The supported parameters are "tokenFile", the path of a file
+// containing the bearer token, and "cacheFile", the path of a local cache of
+// the state; see WithCacheFile.
+func ParseURLAndOpts(arg string) (baseURL string, opts []Option, err error) {
+	u, err := url.Parse(arg)
+	if err != nil {
+		return "", nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", nil, fmt.Errorf("httpstore: unsupported URL scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return "", nil, fmt.Errorf("httpstore: missing host in %q", arg)
+	}
+	for k := range u.Query() {
+		switch k {
+		default:
+			return "", nil, fmt.Errorf("unknown http store option parameter %q", k)
+		case "tokenFile":
+			opts = append(opts, WithTokenFile(u.Query().Get(k)))
+		case "cacheFile":
+			opts = append(opts, WithCacheFile(u.Query().Get(k)))
+		}
+	}
+	u.RawQuery = ""
+	return u.String(), opts, nil
+}
+
+// entry is a cached state value.
+type entry struct {
+	value []byte
+	etag  string // ETag of value on the server; empty if unknown
+}
+
+// jsonEntry is the JSON form of an entry, as served by the server for the
+// base URL and as stored in the cache file.
+type jsonEntry struct {
+	Value []byte `json:"value"`
+	ETag  string `json:"etag"`
+}
+
+// Store is an ipn.StateStore backed by an HTTP server. All state is loaded
+// when the Store is created; reads are served from a local cache, and
+// writes go to the server before updating the cache.
+type Store struct {
+	logf      logger.Logf
+	base      *url.URL // always ends in a slash
+	tokenFile string
+	cacheFile string // or empty for none
+	client    *http.Client
+
+	// writeMu serializes WriteState calls, so that the cache is updated in
+	// the order the writes reached the server. It is acquired before mu.
+	writeMu sync.Mutex
+
+	mu    sync.Mutex
+	cache map[ipn.StateKey]entry
+}
+
+// New returns a new Store for the base URL baseURL, loading the existing
+// state from the server, or if the server cannot be reached, from the
+// WithCacheFile file. Errors returned by the server, such as for a rejected
+// token, are returned as is.
+//
+// If no WithTokenFile option is given, the bearer token is taken from the
+// TS_STATE_HTTP_TOKEN environment variable, if set.
+func New(logf logger.Logf, baseURL string, opts ...Option) (*Store, error) {
+	var so storeOptions
+	for _, opt := range opts {
+		opt(&so)
+	}
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+		u.RawPath = ""
+	}
+	if u.Scheme == "http" && (so.tokenFile != "" || os.Getenv(TokenEnv) != "") {
+		logf("httpstore: warning: sending bearer token over unencrypted HTTP to %s", u.Host)
+	}
+	s := &Store{
+		logf:      logf,
+		base:      u,
+		tokenFile: so.tokenFile,
+		cacheFile: so.cacheFile,
+		client:    so.client,
+		cache:     make(map[ipn.StateKey]entry),
+	}
+	if s.client == nil {
+		s.client = http.DefaultClient
+	}
+	if err := s.LoadState(); err != nil {
+		if s.cacheFile == "" || !isTransportError(err) {
+			return nil, err
+		}
+		if cerr := s.loadCacheFile(); cerr != nil {
+			return nil, fmt.Errorf("%w; and reading cache: %w", err, cerr)
+		}
+		logf("httpstore: %v; using cached state from %s", err, s.cacheFile)
+	}
+	return s, nil
+}
+
+// isTransportError reports whether err is from failing to talk to the server
+// at all, such as a dial error or timeout, rather than an error response.
+func isTransportError(err error) bool {
+	var ue *url.Error
+	return errors.As(err, &ue)
+}
+
+func (s *Store) String() string { return fmt.Sprintf("httpstore(%q)", s.base.Redacted()) }
+
+// LoadState replaces the cache with the current state on the server.
+func (s *Store) LoadState() error {
+	res, err := s.do(http.MethodGet, s.base, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return httpError(res)
+	}
+	var all map[ipn.StateKey]jsonEntry
+	if err := json.NewDecoder(res.Body).Decode(&all); err != nil {
+		return fmt.Errorf("httpstore: decoding state from %s: %w", s.base.Redacted(), err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setCacheLocked(all)
+	s.writeCacheFileLocked()
+	return nil
+}
+
+// setCacheLocked replaces the cache with all.
+// s.mu must be held.
+func (s *Store) setCacheLocked(all map[ipn.StateKey]jsonEntry) {
+	clear(s.cache)
+	for k, v := range all {
+		s.cache[k] = entry{value: v.Value, etag: v.ETag}
+	}
+}
+
+// loadCacheFile replaces the cache with the contents of the cache file.
+func (s *Store) loadCacheFile() error {
+	bs, err := os.ReadFile(s.cacheFile)
+	if err != nil {
+		return err
+	}
+	var all map[ipn.StateKey]jsonEntry
+	if err := json.Unmarshal(bs, &all); err != nil {
+		return fmt.Errorf("httpstore: decoding %s: %w", s.cacheFile, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setCacheLocked(all)
+	return nil
+}
+
+// writeCacheFileLocked writes the cache to the cache file, if any. Failures
+// are logged, as the server has the authoritative copy.
+// s.mu must be held.
+func (s *Store) writeCacheFileLocked() {
+	if s.cacheFile == "" {
+		return
+	}
+	all := make(map[ipn.StateKey]jsonEntry, len(s.cache))
+	for k, e := range s.cache {
+		all[k] = jsonEntry{Value: e.value, ETag: e.etag}
+	}
+	bs, err := json.Marshal(all)
+	if err == nil {
+		err = atomicfile.WriteFile(s.cacheFile, bs, 0600)
+	}
+	if err != nil {
+		s.logf("httpstore: writing cache file: %v", err)
+	}
+}
+
+// ReadState implements the ipn.StateStore interface.
+func (s *Store) ReadState(id ipn.StateKey) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.cache[id]
+	if !ok {
+		return nil, ipn.ErrStateNotExist
+	}
+	return bytes.Clone(e.value), nil
+}
+
+// WriteState implements the ipn.StateStore interface.
+//
+// If the key was changed on the server since it was last read, WriteState
+// returns an error wrapping ErrConflict, and the next ReadState of the key
+// returns the value from the server.
+func (s *Store) WriteState(id ipn.StateKey, bs []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	// The request is made without holding mu, so that a slow server does
+	// not block ReadState.
+	s.mu.Lock()
+	e, ok := s.cache[id]
+	s.mu.Unlock()
+	if ok && bytes.Equal(e.value, bs) {
+		return nil
+	}
+	bs = bytes.Clone(bs)
+
+	h := make(http.Header)
+	switch {
+	case !ok:
+		h.Set("If-None-Match", "*")
+	case e.etag != "":
+		h.Set("If-Match", e.etag)
+	}
+	res, err := s.do(http.MethodPut, s.keyURL(id), h, bs)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+	case http.StatusPreconditionFailed:
+		if err := s.refresh(id); err != nil {
+			s.logf("httpstore: refreshing %q after conflict: %v", id, err)
+		}
+		return fmt.Errorf("httpstore: writing %q: %w", id, ErrConflict)
+	default:
+		return httpError(res)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Without an ETag, the next write is unconditional.
+	s.cache[id] = entry{value: bs, etag: res.Header.Get("ETag")}
+	s.writeCacheFileLocked()
+	return nil
+}
+
+// refresh rereads key id from the server into the cache.
+func (s *Store) refresh(id ipn.StateKey) error {
+	res, err := s.do(http.MethodGet, s.keyURL(id), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	var v []byte
+	switch res.StatusCode {
+	case http.StatusOK:
+		v, err = io.ReadAll(res.Body)
+		if err != nil {
+			return err
+		}
+	case http.StatusNotFound:
+	default:
+		return httpError(res)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if res.StatusCode == http.StatusNotFound {
+		delete(s.cache, id)
+	} else {
+		s.cache[id] = entry{value: v, etag: res.Header.Get("ETag")}
+	}
+	s.writeCacheFileLocked()
+	return nil
+}
+
+// All implements the store.ExportableStore interface.
+func (s *Store) All() iter.Seq2[ipn.StateKey, []byte] {
+	return func(yield func(ipn.StateKey, []byte) bool) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		for k, e := range s.cache {
+			if !yield(k, e.value) {
+				break
+			}
+		}
+	}
+}
+
+func (s *Store) keyURL(id ipn.StateKey) *url.URL {
+	return s.base.JoinPath(string(id))
+}
+
+// token returns the bearer token to send, or the empty string for none.
+func (s *Store) token() (string, error) {
+	if s.tokenFile == "" {
+		return os.Getenv(TokenEnv), nil
+	}
+	b, err := os.ReadFile(s.tokenFile)
+	if err != nil {
+		return "", fmt.Errorf("httpstore: reading token: %w", err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func (s *Store) do(method string, u *url.URL, h http.Header, body []byte) (*http.Response, error) {
+	tok, err := s.token()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	for k, v := range h {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	if tok != "" {
+		req.Header.Set("Authorization", "Bearer "+tok)
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	res.Body = cancelOnClose{res.Body, cancel}
+	return res, nil
+}
+
+// cancelOnClose is an io.ReadCloser that cancels a request context when
+// closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+func httpError(res *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 1<<10))
+	return fmt.Errorf("httpstore: %s %s: %s: %s", res.Request.Method, res.Request.URL.Redacted(), res.Status, bytes.TrimSpace(msg))
+}
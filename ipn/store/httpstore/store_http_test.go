@@ -0,0 +1,210 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package httpstore
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"tailscale.com/ipn"
+	"tailscale.com/tstest/statestore"
+)
+
+func TestStore(t *testing.T) {
+	srv := &statestore.Server{Token: "secret"}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	base := ts.URL + "/nodes/node1"
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := New(t.Logf, base); err == nil {
+		t.Fatal("New without token succeeded")
+	}
+	s, err := New(t.Logf, base, WithTokenFile(tokenFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ReadState("foo"); !errors.Is(err, ipn.ErrStateNotExist) {
+		t.Fatalf("ReadState on empty store: got %v; want ErrStateNotExist", err)
+	}
+	if err := s.WriteState("foo", []byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteState("foo", []byte("baz")); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := srv.Get("foo"); string(got) != "baz" {
+		t.Errorf("server has %q; want %q", got, "baz")
+	}
+
+	// Reads and unchanged writes are served from the cache.
+	n := srv.Requests()
+	if got, err := s.ReadState("foo"); err != nil || string(got) != "baz" {
+		t.Errorf("ReadState = %q, %v; want %q", got, err, "baz")
+	}
+	if err := s.WriteState("foo", []byte("baz")); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.Requests(); got != n {
+		t.Errorf("cached operations made %d requests", got-n)
+	}
+
+	// A new store sees the existing state.
+	s2, err := New(t.Logf, base, WithTokenFile(tokenFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s2.ReadState("foo"); err != nil || string(got) != "baz" {
+		t.Errorf("second store ReadState = %q, %v; want %q", got, err, "baz")
+	}
+
+	// A concurrent modification is detected, and the new value is picked up.
+	srv.Set("foo", []byte("other"))
+	if err := s.WriteState("foo", []byte("mine")); !errors.Is(err, ErrConflict) {
+		t.Fatalf("WriteState after concurrent modification: got %v; want ErrConflict", err)
+	}
+	if got, err := s.ReadState("foo"); err != nil || string(got) != "other" {
+		t.Errorf("ReadState after conflict = %q, %v; want %q", got, err, "other")
+	}
+	if err := s.WriteState("foo", []byte("mine")); err != nil {
+		t.Errorf("WriteState after refresh: %v", err)
+	}
+
+	// Creating a key that someone else created also conflicts.
+	srv.Set("new", []byte("theirs"))
+	if err := s.WriteState("new", []byte("mine")); !errors.Is(err, ErrConflict) {
+		t.Errorf("WriteState of concurrently created key: got %v; want ErrConflict", err)
+	}
+
+	got := map[ipn.StateKey]string{}
+	for k, v := range s.All() {
+		got[k] = string(v)
+	}
+	if len(got) != 2 || got["foo"] != "mine" || got["new"] != "theirs" {
+		t.Errorf("All = %v", got)
+	}
+}
+
+func TestCacheFile(t *testing.T) {
+	srv := &statestore.Server{}
+	ts := httptest.NewServer(srv)
+	base := ts.URL + "/nodes/node1"
+	cacheFile := filepath.Join(t.TempDir(), "cache.json")
+
+	s, err := New(t.Logf, base, WithCacheFile(cacheFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteState("foo", []byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(cacheFile); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode().Perm() != 0600 {
+		t.Errorf("cache file mode = %v; want 0600", fi.Mode().Perm())
+	}
+
+	// With the server down, the state comes from the cache file.
+	ts.Close()
+	if _, err := New(t.Logf, base); err == nil {
+		t.Fatal("New without cache file succeeded with the server down")
+	}
+	s2, err := New(t.Logf, base, WithCacheFile(cacheFile))
+	if err != nil {
+		t.Fatalf("New with cache file and the server down: %v", err)
+	}
+	if got, err := s2.ReadState("foo"); err != nil || string(got) != "bar" {
+		t.Errorf("ReadState from cache = %q, %v; want %q", got, err, "bar")
+	}
+	if err := s2.WriteState("foo", []byte("baz")); err == nil {
+		t.Error("WriteState succeeded with the server down")
+	}
+
+	// Errors from the server are not papered over with the cache file.
+	ts = httptest.NewServer(&statestore.Server{Token: "secret"})
+	defer ts.Close()
+	if _, err := New(t.Logf, ts.URL+"/nodes/node1", WithCacheFile(cacheFile)); err == nil {
+		t.Error("New with cache file succeeded with the token rejected")
+	}
+
+	// Without a server or a cache file, New fails.
+	if _, err := New(t.Logf, base, WithCacheFile(filepath.Join(t.TempDir(), "missing"))); err == nil {
+		t.Error("New succeeded with neither the server nor a cache file")
+	}
+}
+
+func TestParseURLAndOpts(t *testing.T) {
+	tests := []struct {
+		in        string
+		base      string
+		tokenFile string
+		cacheFile string
+		wantErr   bool
+	}{
+		{in: "https://state.example.com/nodes/a", base: "https://state.example.com/nodes/a"},
+		{in: "http://127.0.0.1:8080/?tokenFile=/run/token", base: "http://127.0.0.1:8080/", tokenFile: "/run/token"},
+		{in: "https://state.example.com/a?cacheFile=/var/lib/tailscale/cache.json", base: "https://state.example.com/a", cacheFile: "/var/lib/tailscale/cache.json"},
+		{in: "https://state.example.com/?kmsKey=foo", wantErr: true},
+		{in: "https:///nodes/a", wantErr: true},
+		{in: "ftp://state.example.com/", wantErr: true},
+	}
+	for _, tt := range tests {
+		base, opts, err := ParseURLAndOpts(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseURLAndOpts(%q) succeeded; want error", tt.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseURLAndOpts(%q): %v", tt.in, err)
+			continue
+		}
+		var so storeOptions
+		for _, o := range opts {
+			o(&so)
+		}
+		if base != tt.base || so.tokenFile != tt.tokenFile || so.cacheFile != tt.cacheFile {
+			t.Errorf("ParseURLAndOpts(%q) = %q, tokenFile %q, cacheFile %q; want %q, %q, %q", tt.in, base, so.tokenFile, so.cacheFile, tt.base, tt.tokenFile, tt.cacheFile)
+		}
+	}
+}
+
+func TestWriteDoesNotBlockRead(t *testing.T) {
+	srv := &statestore.Server{}
+	unblock := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			<-unblock
+		}
+		srv.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	srv.Set("foo", []byte("bar"))
+	s, err := New(t.Logf, ts.URL+"/nodes/node1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- s.WriteState("foo", []byte("baz")) }()
+	if got, err := s.ReadState("foo"); err != nil || string(got) != "bar" {
+		t.Errorf("ReadState during write = %q, %v; want %q", got, err, "bar")
+	}
+	close(unblock)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.ReadState("foo"); err != nil || string(got) != "baz" {
+		t.Errorf("ReadState after write = %q, %v; want %q", got, err, "baz")
+	}
+}
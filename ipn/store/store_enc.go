@@ -0,0 +1,14 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !ts_omit_encstore
+
+package store
+
+import (
+	"tailscale.com/ipn/store/encstore"
+)
+
+func init() {
+	Register(encstore.Prefix, encstore.New)
+}
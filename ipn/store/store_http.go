@@ -0,0 +1,24 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !ts_omit_httpstore
+
+package store
+
+import (
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/store/httpstore"
+	"tailscale.com/types/logger"
+)
+
+func init() {
+	newHTTPStore := func(logf logger.Logf, arg string) (ipn.StateStore, error) {
+		baseURL, opts, err := httpstore.ParseURLAndOpts(arg)
+		if err != nil {
+			return nil, err
+		}
+		return httpstore.New(logf, baseURL, opts...)
+	}
+	Register("http:", newHTTPStore)
+	Register("https:", newHTTPStore)
+}
@@ -55,6 +55,11 @@ func init() {
 //     the suffix is a Kubernetes secret name
 //   - (Linux or Windows) if the string begins with "tpmseal:", the suffix is
 //     filepath that is sealed with the local TPM device.
+//   - if the string begins with "enc:", the suffix is of the form
+//     "<provider>[=<arg>],<filepath>" and the file is encrypted with a key
+//     from the named key provider; see package encstore.
+//   - if the string begins with "http:" or "https:", it is the base URL of
+//     an HTTP state server; see package httpstore.
 //   - In all other cases, the path is treated as a filepath.
 func New(logf logger.Logf, path string) (ipn.StateStore, error) {
 	for prefix, sf := range knownStores {
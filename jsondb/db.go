@@ -3,13 +3,21 @@
 
 // Package jsondb provides a trivial "database": a Go object saved to
 // disk as JSON.
+//
+// Writes are atomic, and Update additionally serializes read-modify-write
+// cycles across processes using an advisory lock on a sibling ".lock" file
+// (on platforms that support it). Databases opened with OpenWithOptions can
+// also evolve their schema with migrations and keep backups of previous
+// contents.
 package jsondb
 
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/fs"
 	"os"
+	"sync"
 
 	"tailscale.com/atomicfile"
 )
@@ -20,38 +28,214 @@ type DB[T any] struct {
 	Data *T
 
 	path string
+	opts Options
+
+	mu sync.Mutex // serializes Save and Update within this process
+}
+
+// A Migration converts the JSON encoding of a database from one schema
+// version to the next.
+type Migration func(old json.RawMessage) (json.RawMessage, error)
+
+// Options are optional settings for OpenWithOptions.
+type Options struct {
+	// Migrations are the schema migrations of the database, in order:
+	// Migrations[i] converts the data from version i to version i+1. The
+	// current version is thus len(Migrations).
+	//
+	// Files written by a DB with no migrations, including those written by
+	// earlier versions of this package, are bare JSON and are treated as
+	// version 0. Once there is at least one migration, files are written
+	// in a versioned envelope.
+	Migrations []Migration
+
+	// Backups is the number of previous versions of the file to keep when
+	// writing, named path+".1" (the most recent) through path+".N".
+	// Zero means no backups are kept.
+	Backups int
+}
+
+// envelope is the on-disk format of versioned databases.
+type envelope struct {
+	Version *int            `json:"jsondbVersion"`
+	Data    json.RawMessage `json:"data"`
 }
 
 // Open opens the database at path, creating it with a zero value if
 // necessary.
 func Open[T any](path string) (*DB[T], error) {
-	bs, err := os.ReadFile(path)
-	if errors.Is(err, fs.ErrNotExist) {
-		return &DB[T]{
-			Data: new(T),
-			path: path,
-		}, nil
-	} else if err != nil {
+	return OpenWithOptions[T](path, Options{})
+}
+
+// OpenWithOptions is like Open, but with the given options. Data written by
+// an older schema version is migrated when it is read; the migrated data is
+// written on the next Save or Update.
+func OpenWithOptions[T any](path string, opts Options) (*DB[T], error) {
+	db := &DB[T]{
+		path: path,
+		opts: opts,
+	}
+	val, _, err := db.read()
+	if err != nil {
 		return nil, err
 	}
+	db.Data = val
+	return db, nil
+}
+
+// version returns the current schema version of db.
+func (db *DB[T]) version() int {
+	return len(db.opts.Migrations)
+}
 
+// read reads and decodes the database file, migrating it to the current
+// version if needed. It returns a zero value if the file does not exist. It
+// also returns the raw file contents, or nil if the file does not exist.
+func (db *DB[T]) read() (*T, []byte, error) {
+	bs, err := os.ReadFile(db.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return new(T), nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	data, err := db.migrate(bs)
+	if err != nil {
+		return nil, nil, err
+	}
 	var val T
-	if err := json.Unmarshal(bs, &val); err != nil {
-		return nil, err
+	if err := json.Unmarshal(data, &val); err != nil {
+		return nil, nil, err
 	}
+	return &val, bs, nil
+}
 
-	return &DB[T]{
-		Data: &val,
-		path: path,
-	}, nil
+// migrate returns the JSON encoding of the data in the file contents bs,
+// converted to the current version.
+func (db *DB[T]) migrate(bs []byte) (json.RawMessage, error) {
+	data := json.RawMessage(bs)
+	version := 0
+	var env envelope
+	if err := json.Unmarshal(bs, &env); err == nil && env.Version != nil {
+		data, version = env.Data, *env.Version
+	}
+	if version > db.version() {
+		return nil, fmt.Errorf("jsondb: %s has version %d, newer than supported version %d", db.path, version, db.version())
+	}
+	for ; version < db.version(); version++ {
+		var err error
+		data, err = db.opts.Migrations[version](data)
+		if err != nil {
+			return nil, fmt.Errorf("jsondb: migrating %s from version %d: %w", db.path, version, err)
+		}
+	}
+	return data, nil
 }
 
 // Save writes db.Data back to disk.
+//
+// Unless backups are enabled, it overwrites the file without taking the
+// lock used by Update, as it does not depend on the previous contents.
 func (db *DB[T]) Save() error {
-	bs, err := json.Marshal(db.Data)
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.opts.Backups == 0 {
+		return db.writeLocked(db.Data, nil)
+	}
+	unlock, err := lockPath(db.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	old, err := os.ReadFile(db.path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return db.writeLocked(db.Data, old)
+}
+
+// Update atomically modifies the database.
+//
+// It takes an exclusive lock on the database, rereads it from disk to pick
+// up changes made by other processes and calls fn with the result. If fn
+// returns nil, the modified value is written back to disk and becomes
+// db.Data. If fn returns an error, nothing is written, db.Data is left
+// unchanged and the error is returned.
+func (db *DB[T]) Update(fn func(*T) error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	unlock, err := lockPath(db.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	val, old, err := db.read()
 	if err != nil {
 		return err
 	}
+	if err := fn(val); err != nil {
+		return err
+	}
+	if err := db.writeLocked(val, old); err != nil {
+		return err
+	}
+	db.Data = val
+	return nil
+}
 
+// writeLocked atomically writes val to disk, first backing up old, the
+// previous file contents, if backups are enabled and old is non-nil. db.mu
+// must be held, and so must the file lock if old is non-nil.
+func (db *DB[T]) writeLocked(val *T, old []byte) error {
+	bs, err := json.Marshal(val)
+	if err != nil {
+		return err
+	}
+	if v := db.version(); v > 0 {
+		bs, err = json.Marshal(envelope{Version: &v, Data: bs})
+		if err != nil {
+			return err
+		}
+	}
+	if db.opts.Backups > 0 && old != nil {
+		if err := db.rotateBackups(old); err != nil {
+			return fmt.Errorf("jsondb: backing up %s: %w", db.path, err)
+		}
+	}
 	return atomicfile.WriteFile(db.path, bs, 0600)
 }
+
+// rotateBackups shifts the existing backups of the database up by one,
+// dropping the oldest, and writes old as the most recent backup.
+func (db *DB[T]) rotateBackups(old []byte) error {
+	n := db.opts.Backups
+	for i := n - 1; i >= 1; i-- {
+		err := os.Rename(backupPath(db.path, i), backupPath(db.path, i+1))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return atomicfile.WriteFile(backupPath(db.path, 1), old, 0600)
+}
+
+func backupPath(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
+
+// lockPath takes an exclusive advisory lock on the file at path, creating it
+// if needed, and returns a function that releases it.
+func lockPath(path string) (unlock func(), err error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("jsondb: locking %s: %w", path, err)
+	}
+	return func() {
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
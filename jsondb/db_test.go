@@ -4,9 +4,13 @@
 package jsondb
 
 import (
+	"encoding/json"
+	"errors"
+	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -34,6 +38,9 @@ func TestDB(t *testing.T) {
 	if err := db.Save(); err != nil {
 		t.Fatalf("saving database: %v", err)
 	}
+	if _, err := os.Stat(path + ".lock"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Save without backups created a lock file; stat err = %v", err)
+	}
 
 	db2, err := Open[testDB](path)
 	if err != nil {
@@ -53,3 +60,183 @@ type testDB struct {
 	unexported string
 	AnInt      int64
 }
+
+func TestUpdate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.json")
+	db, err := Open[testDB](path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db2, err := Open[testDB](path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Update(func(d *testDB) error {
+		d.AnInt = 1
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// db2 has not seen the first update, but Update rereads the file.
+	if err := db2.Update(func(d *testDB) error {
+		d.AnInt++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if db2.Data.AnInt != 2 {
+		t.Errorf("AnInt = %d; want 2", db2.Data.AnInt)
+	}
+
+	errAbort := errors.New("abort")
+	if err := db2.Update(func(d *testDB) error {
+		d.AnInt = 100
+		return errAbort
+	}); err != errAbort {
+		t.Fatalf("Update = %v; want %v", err, errAbort)
+	}
+	if db2.Data.AnInt != 2 {
+		t.Errorf("after failed Update, AnInt = %d; want 2", db2.Data.AnInt)
+	}
+	db3, err := Open[testDB](path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db3.Data.AnInt != 2 {
+		t.Errorf("after failed Update, stored AnInt = %d; want 2", db3.Data.AnInt)
+	}
+}
+
+func TestUpdateConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.json")
+	const n = 20
+	var wg sync.WaitGroup
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Each goroutine uses its own DB, as separate processes would.
+			db, err := Open[testDB](path)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if err := db.Update(func(d *testDB) error {
+				d.AnInt++
+				return nil
+			}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	db, err := Open[testDB](path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Data.AnInt != n {
+		t.Errorf("AnInt = %d; want %d", db.Data.AnInt, n)
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.json")
+
+	// Version 0 is the bare format written by Open.
+	type v0 struct {
+		Name string
+	}
+	db0, err := Open[v0](path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db0.Data.Name = "alice"
+	if err := db0.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Version 1 renames Name to MyString, and version 2 sets AnInt.
+	migrations := []Migration{
+		func(old json.RawMessage) (json.RawMessage, error) {
+			var o v0
+			if err := json.Unmarshal(old, &o); err != nil {
+				return nil, err
+			}
+			return json.Marshal(testDB{MyString: o.Name})
+		},
+		func(old json.RawMessage) (json.RawMessage, error) {
+			var o testDB
+			if err := json.Unmarshal(old, &o); err != nil {
+				return nil, err
+			}
+			o.AnInt = 42
+			return json.Marshal(o)
+		},
+	}
+	db, err := OpenWithOptions[testDB](path, Options{Migrations: migrations})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &testDB{MyString: "alice", AnInt: 42}
+	if diff := cmp.Diff(db.Data, want, cmp.AllowUnexported(testDB{})); diff != "" {
+		t.Fatalf("unexpected migrated content (-got+want):\n%s", diff)
+	}
+	if err := db.Save(); err != nil {
+		t.Fatal(err)
+	}
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(bs), `{"jsondbVersion":2,"data":{"MyString":"alice","AnInt":42}}`; got != want {
+		t.Errorf("stored %s; want %s", got, want)
+	}
+
+	// Reopening must not rerun the migrations.
+	db, err = OpenWithOptions[testDB](path, Options{Migrations: migrations})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(db.Data, want, cmp.AllowUnexported(testDB{})); diff != "" {
+		t.Fatalf("unexpected reopened content (-got+want):\n%s", diff)
+	}
+
+	// Files from the future are rejected.
+	if _, err := OpenWithOptions[testDB](path, Options{Migrations: migrations[:1]}); err == nil {
+		t.Error("opened database with newer version")
+	}
+}
+
+func TestBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.json")
+	db, err := OpenWithOptions[testDB](path, Options{Backups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 4 {
+		if err := db.Update(func(d *testDB) error {
+			d.AnInt = int64(i)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, want := range map[int]int64{1: 2, 2: 1} {
+		bs, err := os.ReadFile(backupPath(path, i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got testDB
+		if err := json.Unmarshal(bs, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.AnInt != want {
+			t.Errorf("backup %d has AnInt %d; want %d", i, got.AnInt, want)
+		}
+	}
+	if _, err := os.Stat(backupPath(path, 3)); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("backup 3 exists or error: %v", err)
+	}
+}
@@ -0,0 +1,14 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd || windows)
+
+package jsondb
+
+import "os"
+
+// lockFile is a no-op on platforms without advisory file locking. Updates
+// are still serialized within a process.
+func lockFile(f *os.File) error { return nil }
+
+func unlockFile(f *os.File) error { return nil }
@@ -209,6 +209,10 @@ type Wrapper struct {
 
 	captureHook syncs.AtomicValue[packet.CaptureCallback]
 
+	// inboundDstHook, if non-nil, is called with the destination address of
+	// each packet from WireGuard that the filter accepts.
+	inboundDstHook syncs.AtomicValue[func(netip.Addr)]
+
 	metrics *metrics
 }
 
@@ -1195,6 +1199,10 @@ func (t *Wrapper) filterPacketInboundFromWireGuard(p *packet.Parsed, captHook pa
 		return filter.Drop, gro
 	}
 
+	if hook := t.inboundDstHook.Load(); hook != nil {
+		hook(p.Dst.Addr())
+	}
+
 	if t.PostFilterPacketInboundFromWireGuard != nil {
 		var res filter.Response
 		res, gro = t.PostFilterPacketInboundFromWireGuard(p, t, gro)
@@ -1493,3 +1501,11 @@ func (t *Wrapper) SetStatistics(stats *connstats.Statistics) {
 func (t *Wrapper) InstallCaptureHook(cb packet.CaptureCallback) {
 	t.captureHook.Store(cb)
 }
+
+// SetInboundDestinationHook sets a function to be called with the
+// destination address of each packet from WireGuard that passes the packet
+// filter. It runs for every such packet, so must be cheap. Nil may be
+// specified to remove the hook.
+func (t *Wrapper) SetInboundDestinationHook(fn func(netip.Addr)) {
+	t.inboundDstHook.Store(fn)
+}
@@ -0,0 +1,229 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package udprelay
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"slices"
+	"time"
+
+	"tailscale.com/net/udprelay/status"
+	"tailscale.com/types/key"
+	"tailscale.com/types/ptr"
+	"tailscale.com/util/clientmetric"
+	"tailscale.com/util/set"
+)
+
+var (
+	metricPacketsRelayed   = clientmetric.NewCounter("udprelay_packets_relayed")
+	metricBytesRelayed     = clientmetric.NewCounter("udprelay_bytes_relayed")
+	metricPacketsRateLimit = clientmetric.NewCounter("udprelay_packets_dropped_rate_limit")
+	metricAllocsRejected   = clientmetric.NewCounter("udprelay_allocs_rejected_endpoint_limit")
+	metricEndpointsEvicted = clientmetric.NewCounter("udprelay_endpoints_evicted")
+)
+
+// ErrEndpointLimit is returned by [Server.AllocateEndpointForPeer] when the
+// peer owns the maximum number of endpoints allowed by the server's
+// [status.Limits], and none could be evicted.
+var ErrEndpointLimit = errors.New("peer endpoint limit reached")
+
+// idlePeerRetention is how long the state of a peer that no longer owns
+// any endpoints is kept, so that its usage counters and rate limit carry
+// over if it allocates endpoints again.
+const idlePeerRetention = time.Hour
+
+// peerState is the resource usage of a peer that owns endpoints, or did
+// within idlePeerRetention, for enforcing [status.Limits]. Its methods are
+// not thread-safe.
+type peerState struct {
+	nodeKey   key.NodePublic
+	endpoints set.Set[*serverEndpoint] // owned by the peer
+
+	// idleSince is when the peer's last endpoint was removed, or zero
+	// while it owns endpoints.
+	idleSince time.Time
+
+	// tokens is the number of bytes that may be relayed immediately,
+	// replenished at the rate limit since lastFill.
+	tokens   float64
+	lastFill time.Time
+
+	packetsTx      uint64
+	bytesTx        uint64
+	packetsDropped uint64
+	rejections     uint64
+	evictions      uint64
+}
+
+// allow reports whether a packet of n bytes may be relayed at now under a
+// rate limit of bytesPerSec, with bursts of up to one second's worth. A
+// non-positive bytesPerSec means no limit.
+func (p *peerState) allow(now time.Time, n, bytesPerSec int) bool {
+	if bytesPerSec <= 0 {
+		return true
+	}
+	rate := float64(bytesPerSec)
+	if p.lastFill.IsZero() {
+		p.tokens = rate
+	} else {
+		p.tokens = min(rate, p.tokens+now.Sub(p.lastFill).Seconds()*rate)
+	}
+	p.lastFill = now
+	if p.tokens < float64(n) {
+		return false
+	}
+	p.tokens -= float64(n)
+	return true
+}
+
+// lastActive returns when e was last allocated, or saw traffic from either
+// client.
+func (e *serverEndpoint) lastActive() time.Time {
+	t := e.allocatedAt
+	for _, seen := range e.lastSeen {
+		if seen.After(t) {
+			t = seen
+		}
+	}
+	return t
+}
+
+// countRelayed accounts for a packet of n bytes from the client at
+// senderIndex, and reports whether it may be relayed under the owner's rate
+// limit.
+func (e *serverEndpoint) countRelayed(now time.Time, senderIndex, n int) bool {
+	if e.owner != nil && !e.owner.allow(now, n, e.maxBytesPerSec) {
+		e.packetsDropped[senderIndex]++
+		e.owner.packetsDropped++
+		metricPacketsRateLimit.Add(1)
+		return false
+	}
+	e.packetsTx[senderIndex]++
+	e.bytesTx[senderIndex] += uint64(n)
+	if e.owner != nil {
+		e.owner.packetsTx++
+		e.owner.bytesTx += uint64(n)
+	}
+	metricPacketsRelayed.Add(1)
+	metricBytesRelayed.Add(int64(n))
+	return true
+}
+
+// SetLimits sets the per-peer limits on the resources the server spends on
+// relaying. They apply to endpoints allocated with
+// [Server.AllocateEndpointForPeer]. Lowering MaxEndpoints does not evict
+// existing endpoints, but applies to subsequent allocations.
+func (s *Server) SetLimits(limits status.Limits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limits = limits
+	for _, e := range s.byVNI {
+		if e.owner != nil {
+			e.maxBytesPerSec = limits.MaxBytesPerSec
+		}
+	}
+}
+
+// makeRoomForPeerLocked ensures that the peer with state p may own another
+// endpoint, evicting one of its endpoints if necessary and allowed by the
+// server's limits. s.mu must be held.
+func (s *Server) makeRoomForPeerLocked(p *peerState) error {
+	maxEndpoints := s.limits.MaxEndpoints
+	if maxEndpoints <= 0 || len(p.endpoints) < maxEndpoints {
+		return nil
+	}
+	if s.limits.Eviction != status.EvictIdlest {
+		p.rejections++
+		metricAllocsRejected.Add(1)
+		return ErrEndpointLimit
+	}
+	owned := p.endpoints.Slice()
+	slices.SortFunc(owned, func(a, b *serverEndpoint) int {
+		return a.lastActive().Compare(b.lastActive())
+	})
+	for _, e := range owned[:len(owned)-maxEndpoints+1] {
+		s.logf("evicting endpoint vni=%d of peer %v at endpoint limit %d", e.vni, p.nodeKey.ShortString(), maxEndpoints)
+		s.removeEndpointLocked(e)
+		p.evictions++
+		metricEndpointsEvicted.Add(1)
+	}
+	return nil
+}
+
+// removeEndpointLocked removes e from the server, returning its VNI to the
+// pool. s.mu must be held.
+func (s *Server) removeEndpointLocked(e *serverEndpoint) {
+	delete(s.byDisco, e.discoPubKeys)
+	delete(s.byVNI, e.vni)
+	s.vniPool = append(s.vniPool, e.vni)
+	if p := e.owner; p != nil {
+		p.endpoints.Delete(e)
+		if len(p.endpoints) == 0 {
+			p.idleSince = time.Now()
+		}
+	}
+}
+
+// removeIdlePeersLocked forgets the peers that have not owned any
+// endpoints for idlePeerRetention as of now. s.mu must be held.
+func (s *Server) removeIdlePeersLocked(now time.Time) {
+	for k, p := range s.byPeer {
+		if len(p.endpoints) == 0 && now.Sub(p.idleSince) >= idlePeerRetention {
+			delete(s.byPeer, k)
+		}
+	}
+}
+
+// Status returns the current state of the server's endpoints and the peers
+// that own them.
+func (s *Server) Status() status.ServerStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := status.ServerStatus{
+		UDPPort:  ptr.To(int(s.uc4Port)),
+		Limits:   s.limits,
+		Sessions: make([]status.ServerSession, 0, len(s.byVNI)),
+		Peers:    make([]status.PeerStatus, 0, len(s.byPeer)),
+	}
+	for _, e := range s.byVNI {
+		ss := status.ServerSession{
+			VNI:         e.vni,
+			AllocatedAt: e.allocatedAt,
+		}
+		if e.owner != nil {
+			ss.Owner = e.owner.nodeKey
+		}
+		for i, ci := range []*status.ClientInfo{&ss.Client1, &ss.Client2} {
+			*ci = status.ClientInfo{
+				Endpoint:       e.boundAddrPorts[i],
+				ShortDisco:     e.discoPubKeys.Get()[i].ShortString(),
+				PacketsTx:      e.packetsTx[i],
+				BytesTx:        e.bytesTx[i],
+				PacketsDropped: e.packetsDropped[i],
+			}
+		}
+		st.Sessions = append(st.Sessions, ss)
+	}
+	for _, p := range s.byPeer {
+		st.Peers = append(st.Peers, status.PeerStatus{
+			NodeKey:        p.nodeKey,
+			Endpoints:      len(p.endpoints),
+			PacketsTx:      p.packetsTx,
+			BytesTx:        p.bytesTx,
+			PacketsDropped: p.packetsDropped,
+			Rejections:     p.rejections,
+			Evictions:      p.evictions,
+		})
+	}
+	slices.SortFunc(st.Sessions, func(a, b status.ServerSession) int {
+		return cmp.Compare(a.VNI, b.VNI)
+	})
+	slices.SortFunc(st.Peers, func(a, b status.PeerStatus) int {
+		ra, rb := a.NodeKey.Raw32(), b.NodeKey.Raw32()
+		return bytes.Compare(ra[:], rb[:])
+	})
+	return st
+}
@@ -31,6 +31,7 @@
 	"tailscale.com/net/sockopts"
 	"tailscale.com/net/stun"
 	"tailscale.com/net/udprelay/endpoint"
+	"tailscale.com/net/udprelay/status"
 	"tailscale.com/tstime"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
@@ -79,6 +80,8 @@ type Server struct {
 	vniPool           []uint32 // the pool of available VNIs
 	byVNI             map[uint32]*serverEndpoint
 	byDisco           map[key.SortedPairOfDiscoPublic]*serverEndpoint
+	limits            status.Limits
+	byPeer            map[key.NodePublic]*peerState // peers owning endpoints, or recently; see idlePeerRetention
 }
 
 // serverEndpoint contains Server-internal [endpoint.ServerEndpoint] state.
@@ -99,6 +102,12 @@ type serverEndpoint struct {
 	lamportID   uint64
 	vni         uint32
 	allocatedAt time.Time
+
+	owner          *peerState // or nil if not allocated on behalf of a peer
+	maxBytesPerSec int        // rate limit of owner, or zero for none
+	packetsTx      [2]uint64  // relayed from each client
+	bytesTx        [2]uint64
+	packetsDropped [2]uint64 // from each client, by the rate limit
 }
 
 func (e *serverEndpoint) handleDiscoControlMsg(from netip.AddrPort, senderIndex int, discoMsg disco.Message, serverDisco key.DiscoPublic) (write []byte, to netip.AddrPort) {
@@ -223,9 +232,15 @@ func (e *serverEndpoint) handlePacket(from netip.AddrPort, gh packet.GeneveHeade
 		switch {
 		case from == e.boundAddrPorts[0]:
 			e.lastSeen[0] = time.Now()
+			if !e.countRelayed(e.lastSeen[0], 0, len(b)) {
+				return nil, netip.AddrPort{}
+			}
 			return b, e.boundAddrPorts[1]
 		case from == e.boundAddrPorts[1]:
 			e.lastSeen[1] = time.Now()
+			if !e.countRelayed(e.lastSeen[1], 1, len(b)) {
+				return nil, netip.AddrPort{}
+			}
 			return b, e.boundAddrPorts[0]
 		default:
 			// unrecognized source
@@ -275,6 +290,7 @@ func NewServer(logf logger.Logf, port int, overrideAddrs []netip.Addr) (s *Serve
 		closeCh:             make(chan struct{}),
 		byDisco:             make(map[key.SortedPairOfDiscoPublic]*serverEndpoint),
 		byVNI:               make(map[uint32]*serverEndpoint),
+		byPeer:              make(map[key.NodePublic]*peerState),
 	}
 	s.discoPublic = s.disco.Public()
 	// TODO: instead of allocating 10s of MBs for the full pool, allocate
@@ -549,6 +565,7 @@ func (s *Server) Close() error {
 		defer s.mu.Unlock()
 		clear(s.byVNI)
 		clear(s.byDisco)
+		clear(s.byPeer)
 		s.vniPool = nil
 		s.closed = true
 		s.bus.Close()
@@ -567,13 +584,12 @@ func (s *Server) endpointGCLoop() {
 		// holding s.mu for the duration. Keep it simple (and slow) for now.
 		s.mu.Lock()
 		defer s.mu.Unlock()
-		for k, v := range s.byDisco {
+		for _, v := range s.byDisco {
 			if v.isExpired(now, s.bindLifetime, s.steadyStateLifetime) {
-				delete(s.byDisco, k)
-				delete(s.byVNI, v.vni)
-				s.vniPool = append(s.vniPool, v.vni)
+				s.removeEndpointLocked(v)
 			}
 		}
+		s.removeIdlePeersLocked(now)
 	}
 
 	for {
@@ -713,6 +729,17 @@ func (e ErrServerNotReady) Error() string {
 //  1. [ErrServerClosed] if the server has been closed.
 //  2. [ErrServerNotReady] if the server is not ready.
 func (s *Server) AllocateEndpoint(discoA, discoB key.DiscoPublic) (endpoint.ServerEndpoint, error) {
+	return s.AllocateEndpointForPeer(key.NodePublic{}, discoA, discoB)
+}
+
+// AllocateEndpointForPeer is like [Server.AllocateEndpoint], but on behalf of
+// the peer node with node key peer. A new endpoint is owned by the peer, and
+// counts toward its [status.Limits] set by [Server.SetLimits]. An existing
+// endpoint is returned regardless of its owner. In addition to the errors
+// returned by AllocateEndpoint, it returns [ErrEndpointLimit] if the peer owns
+// the maximum number of endpoints. A zero peer is the same as calling
+// AllocateEndpoint, which allocates endpoints that are not subject to limits.
+func (s *Server) AllocateEndpointForPeer(peer key.NodePublic, discoA, discoB key.DiscoPublic) (endpoint.ServerEndpoint, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if s.closed {
@@ -754,6 +781,17 @@ func (s *Server) AllocateEndpoint(discoA, discoB key.DiscoPublic) (endpoint.Serv
 		}, nil
 	}
 
+	var owner *peerState
+	if !peer.IsZero() {
+		owner = s.byPeer[peer]
+		if owner == nil {
+			owner = &peerState{nodeKey: peer}
+		}
+		if err := s.makeRoomForPeerLocked(owner); err != nil {
+			return endpoint.ServerEndpoint{}, err
+		}
+	}
+
 	if len(s.vniPool) == 0 {
 		return endpoint.ServerEndpoint{}, errors.New("VNI pool exhausted")
 	}
@@ -764,6 +802,15 @@ func (s *Server) AllocateEndpoint(discoA, discoB key.DiscoPublic) (endpoint.Serv
 		lamportID:    s.lamportID,
 		allocatedAt:  time.Now(),
 	}
+	if owner != nil {
+		e.owner = owner
+		e.maxBytesPerSec = s.limits.MaxBytesPerSec
+		owner.endpoints.Make()
+		owner.endpoints.Add(e)
+		owner.idleSince = time.Time{}
+		// A new owner is only added once it owns an endpoint.
+		s.byPeer[peer] = owner
+	}
 	e.discoSharedSecrets[0] = s.disco.Shared(e.discoPubKeys.Get()[0])
 	e.discoSharedSecrets[1] = s.disco.Shared(e.discoPubKeys.Get()[1])
 	e.vni, s.vniPool = s.vniPool[0], s.vniPool[1:]
@@ -5,6 +5,7 @@
 
 import (
 	"bytes"
+	"errors"
 	"net"
 	"net/netip"
 	"testing"
@@ -15,6 +16,8 @@
 	"go4.org/mem"
 	"tailscale.com/disco"
 	"tailscale.com/net/packet"
+	"tailscale.com/net/udprelay/endpoint"
+	"tailscale.com/net/udprelay/status"
 	"tailscale.com/types/key"
 )
 
@@ -319,3 +322,206 @@ func TestServer(t *testing.T) {
 		})
 	}
 }
+
+func TestServerEndpointLimit(t *testing.T) {
+	server, err := NewServer(t.Logf, 0, []netip.Addr{netip.MustParseAddr("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.SetLimits(status.Limits{MaxEndpoints: 2})
+
+	peer, otherPeer := key.NewNode().Public(), key.NewNode().Public()
+	self := key.NewDisco().Public()
+	allocate := func(peer key.NodePublic, disco key.DiscoPublic) (endpoint.ServerEndpoint, error) {
+		return server.AllocateEndpointForPeer(peer, self, disco)
+	}
+	disco1, disco2, disco3 := key.NewDisco().Public(), key.NewDisco().Public(), key.NewDisco().Public()
+	ep1, err := allocate(peer, disco1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := allocate(peer, disco2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := allocate(peer, disco3); !errors.Is(err, ErrEndpointLimit) {
+		t.Fatalf("third allocation: got %v, want %v", err, ErrEndpointLimit)
+	}
+	// Existing endpoints, and those of other peers or of no peer, are not
+	// affected by the limit.
+	if _, err := allocate(peer, disco1); err != nil {
+		t.Fatalf("existing allocation: %v", err)
+	}
+	if _, err := allocate(otherPeer, disco3); err != nil {
+		t.Fatalf("other peer: %v", err)
+	}
+	if _, err := server.AllocateEndpoint(self, key.NewDisco().Public()); err != nil {
+		t.Fatalf("no peer: %v", err)
+	}
+
+	// Evict the endpoint that has been idle the longest.
+	server.SetLimits(status.Limits{MaxEndpoints: 2, Eviction: status.EvictIdlest})
+	server.mu.Lock()
+	server.byVNI[ep1.VNI].allocatedAt = time.Now().Add(-time.Minute)
+	server.mu.Unlock()
+	if _, err := allocate(peer, key.NewDisco().Public()); err != nil {
+		t.Fatalf("allocation with eviction: %v", err)
+	}
+
+	st := server.Status()
+	if len(st.Sessions) != 4 {
+		t.Errorf("got %d sessions, want 4", len(st.Sessions))
+	}
+	for _, ss := range st.Sessions {
+		if ss.VNI == ep1.VNI {
+			t.Errorf("evicted endpoint vni=%d still present", ep1.VNI)
+		}
+	}
+	var got *status.PeerStatus
+	for i := range st.Peers {
+		if st.Peers[i].NodeKey == peer {
+			got = &st.Peers[i]
+		}
+	}
+	if got == nil {
+		t.Fatalf("peer missing from status: %+v", st.Peers)
+	}
+	if got.Endpoints != 2 || got.Rejections != 1 || got.Evictions != 1 {
+		t.Errorf("peer status = %+v, want 2 endpoints, 1 rejection, 1 eviction", got)
+	}
+	if len(st.Peers) != 2 {
+		t.Errorf("got %d peers, want 2", len(st.Peers))
+	}
+}
+
+func TestServerRateLimit(t *testing.T) {
+	discoA := key.NewDisco()
+	discoB := key.NewDisco()
+	server, err := NewServer(t.Logf, 0, []netip.Addr{netip.MustParseAddr("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.SetLimits(status.Limits{MaxBytesPerSec: 64})
+
+	peer := key.NewNode().Public()
+	ep, err := server.AllocateEndpointForPeer(peer, discoA.Public(), discoB.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcA := newTestClient(t, ep.VNI, ep.AddrPorts[0], discoA, discoB.Public(), ep.ServerDisco)
+	defer tcA.close()
+	tcB := newTestClient(t, ep.VNI, ep.AddrPorts[0], discoB, discoA.Public(), ep.ServerDisco)
+	defer tcB.close()
+	for range 2 {
+		// See TestServer for why we handshake twice.
+		tcA.handshake(t)
+		tcB.handshake(t)
+	}
+
+	// A packet larger than the burst allowed by the rate limit is always
+	// dropped, while the small packets on either side of it are relayed.
+	tcA.writeDataPkt(t, []byte{1, 2, 3})
+	tcA.writeDataPkt(t, make([]byte, 100))
+	tcA.writeDataPkt(t, []byte{4, 5, 6})
+	for _, want := range [][]byte{{1, 2, 3}, {4, 5, 6}} {
+		if got := tcB.readDataPkt(t); !bytes.Equal(got, want) {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+
+	st := server.Status()
+	if len(st.Sessions) != 1 {
+		t.Fatalf("got %d sessions, want 1", len(st.Sessions))
+	}
+	ss := st.Sessions[0]
+	client := ss.Client1
+	if ss.Client2.ShortDisco == discoA.Public().ShortString() {
+		client = ss.Client2
+	}
+	wantBytes := uint64(2 * (packet.GeneveFixedHeaderLength + 3))
+	if ss.Owner != peer || client.PacketsTx != 2 || client.BytesTx != wantBytes || client.PacketsDropped != 1 {
+		t.Errorf("session = %+v, want owner %v and 2 packets (%d bytes) relayed and 1 dropped from A", ss, peer, wantBytes)
+	}
+	if len(st.Peers) != 1 || st.Peers[0].PacketsDropped != 1 || st.Peers[0].BytesTx != wantBytes {
+		t.Errorf("peers = %+v", st.Peers)
+	}
+}
+
+func TestServerPeerStateRetained(t *testing.T) {
+	server, err := NewServer(t.Logf, 0, []netip.Addr{netip.MustParseAddr("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.SetLimits(status.Limits{MaxEndpoints: 1, MaxBytesPerSec: 1000})
+
+	peer := key.NewNode().Public()
+	self := key.NewDisco().Public()
+	ep, err := server.AllocateEndpointForPeer(peer, self, key.NewDisco().Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.AllocateEndpointForPeer(peer, self, key.NewDisco().Public()); !errors.Is(err, ErrEndpointLimit) {
+		t.Fatalf("second allocation: got %v, want %v", err, ErrEndpointLimit)
+	}
+	now := time.Now()
+	server.mu.Lock()
+	e := server.byVNI[ep.VNI]
+	if !e.countRelayed(now, 0, 800) {
+		t.Fatal("packet within burst dropped")
+	}
+	server.removeEndpointLocked(e)
+	server.mu.Unlock()
+
+	// Reconnecting neither resets the counters nor refills the rate limit.
+	ep, err = server.AllocateEndpointForPeer(peer, self, key.NewDisco().Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.mu.Lock()
+	if server.byVNI[ep.VNI].countRelayed(now, 0, 800) {
+		t.Error("packet beyond burst relayed after reconnecting")
+	}
+	server.mu.Unlock()
+	st := server.Status()
+	if len(st.Peers) != 1 || st.Peers[0].Endpoints != 1 || st.Peers[0].BytesTx != 800 || st.Peers[0].PacketsDropped != 1 || st.Peers[0].Rejections != 1 {
+		t.Errorf("peers after reconnecting = %+v", st.Peers)
+	}
+
+	// The state of a peer without endpoints is eventually forgotten.
+	server.mu.Lock()
+	server.removeEndpointLocked(server.byVNI[ep.VNI])
+	server.removeIdlePeersLocked(time.Now())
+	server.mu.Unlock()
+	if st := server.Status(); len(st.Peers) != 1 || st.Peers[0].Endpoints != 0 {
+		t.Errorf("peers after removing endpoint = %+v", st.Peers)
+	}
+	server.mu.Lock()
+	server.removeIdlePeersLocked(time.Now().Add(idlePeerRetention))
+	server.mu.Unlock()
+	if st := server.Status(); len(st.Peers) != 0 {
+		t.Errorf("peers after retention = %+v", st.Peers)
+	}
+}
+
+func TestPeerStateAllow(t *testing.T) {
+	var p peerState
+	now := time.Now()
+	if !p.allow(now, 1<<20, 0) {
+		t.Fatal("packet dropped without a rate limit")
+	}
+	const rate = 1000
+	if !p.allow(now, 600, rate) {
+		t.Fatal("first packet within burst dropped")
+	}
+	if p.allow(now, 600, rate) {
+		t.Fatal("packet beyond burst relayed")
+	}
+	if !p.allow(now.Add(200*time.Millisecond), 600, rate) {
+		t.Fatal("packet after refill dropped")
+	}
+	if p.allow(now.Add(time.Hour), rate+1, rate) {
+		t.Fatal("packet larger than burst relayed")
+	}
+}
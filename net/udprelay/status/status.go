@@ -0,0 +1,126 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package status contains types relating to the status of a peer relay
+// server. It does not import tailscale.com/net/udprelay, so that clients
+// of the LocalAPI do not need to.
+package status
+
+import (
+	"net/netip"
+	"time"
+
+	"tailscale.com/types/key"
+)
+
+// ServerStatus is the state of this node's peer relay server at a point in
+// time.
+type ServerStatus struct {
+	// UDPPort is the port the server is listening on, or nil if it is not
+	// running.
+	UDPPort *int `json:",omitempty"`
+
+	// Limits are the per-peer limits enforced by the server.
+	Limits Limits
+
+	// Sessions are the endpoints currently allocated by the server.
+	Sessions []ServerSession
+
+	// Peers are the peers that own at least one endpoint, or did within
+	// the last hour. Their counters are kept across endpoint removal.
+	Peers []PeerStatus
+}
+
+// Limits are per-peer limits on the resources a peer relay server spends on
+// relaying. Zero values mean no limit.
+type Limits struct {
+	// MaxEndpoints is the maximum number of endpoints a peer may own at once.
+	MaxEndpoints int `json:",omitempty"`
+
+	// MaxBytesPerSec is the maximum rate at which packets are relayed
+	// through the endpoints a peer owns, in bytes per second, with bursts
+	// of up to one second's worth. Packets in excess of it are dropped.
+	MaxBytesPerSec int `json:",omitempty"`
+
+	// Eviction is what happens when a peer that owns MaxEndpoints endpoints
+	// requests another.
+	Eviction EvictionPolicy `json:",omitempty"`
+}
+
+// EvictionPolicy determines what happens when a peer that owns the maximum
+// number of endpoints requests another.
+type EvictionPolicy string
+
+const (
+	// EvictNone rejects the request.
+	EvictNone EvictionPolicy = ""
+
+	// EvictIdlest evicts the peer's endpoint that has been idle the
+	// longest to make room for the new one.
+	EvictIdlest EvictionPolicy = "idlest"
+)
+
+// ServerSession is an endpoint allocated by a peer relay server, through
+// which it relays packets between two clients.
+type ServerSession struct {
+	// VNI is the Geneve virtual network identifier of the endpoint.
+	VNI uint32
+
+	// Owner is the node key of the peer that requested the endpoint, and
+	// whose limits it counts toward, or the zero value if it has none.
+	Owner key.NodePublic `json:",omitzero"`
+
+	// AllocatedAt is when the endpoint was allocated.
+	AllocatedAt time.Time
+
+	// Client1 and Client2 are the two clients of the endpoint.
+	Client1 ClientInfo
+	Client2 ClientInfo
+}
+
+// ClientInfo is the state of one client of a [ServerSession].
+type ClientInfo struct {
+	// Endpoint is the address the client is bound to, or the zero value if
+	// it has not completed its handshake.
+	Endpoint netip.AddrPort `json:",omitzero"`
+
+	// ShortDisco is the short form of the client's disco key.
+	ShortDisco string
+
+	// PacketsTx and BytesTx count the packets, and their bytes, relayed
+	// from the client towards the other.
+	PacketsTx uint64
+	BytesTx   uint64
+
+	// PacketsDropped counts the packets from the client that were dropped
+	// because they exceeded the owner's rate limit.
+	PacketsDropped uint64 `json:",omitempty"`
+}
+
+// PeerStatus is the resource usage of a peer that owns endpoints of a peer
+// relay server. Counters are kept for as long as the peer owns at least one
+// endpoint.
+type PeerStatus struct {
+	// NodeKey is the node key of the peer.
+	NodeKey key.NodePublic
+
+	// Endpoints is the number of endpoints the peer owns.
+	Endpoints int
+
+	// PacketsTx and BytesTx count the packets, and their bytes, relayed
+	// through the endpoints the peer owns or owned.
+	PacketsTx uint64
+	BytesTx   uint64
+
+	// PacketsDropped counts the packets dropped because they exceeded the
+	// peer's rate limit.
+	PacketsDropped uint64 `json:",omitempty"`
+
+	// Rejections counts the endpoint requests that were rejected because the
+	// peer owned the maximum number of endpoints.
+	Rejections uint64 `json:",omitempty"`
+
+	// Evictions counts the endpoints the peer owned that were evicted to make
+	// room for new ones.
+	Evictions uint64 `json:",omitempty"`
+}
@@ -0,0 +1,426 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package prober
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/netip"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tailscale/hujson"
+	"tailscale.com/tstime"
+	"tailscale.com/types/key"
+)
+
+// DefaultConfigInterval is the probe interval used for a ProbeConfig that
+// doesn't specify one.
+const DefaultConfigInterval = 30 * time.Second
+
+// Config is a declarative set of probes, typically loaded from a HuJSON
+// file with LoadConfig and applied with Prober.ApplyConfig.
+type Config struct {
+	Probes []ProbeConfig
+}
+
+// ProbeConfig is the definition of a single probe.
+type ProbeConfig struct {
+	// Name is the unique name of the probe.
+	Name string
+
+	// Class is the kind of probe: "http", "tls", "tcp", "dns" or "derp".
+	Class string
+
+	// Target is what to probe. Its meaning depends on Class:
+	//
+	//   - http: the URL to fetch
+	//   - tls, tcp: the "host:port" to connect to
+	//   - dns: the hostname to resolve; each of its addresses is then
+	//     probed with AddrClass on Port
+	//   - derp: the DERP map URL (https:// or file://), or "local"
+	Target string
+
+	// Interval is how often to run the probe. It defaults to
+	// DefaultConfigInterval.
+	Interval tstime.GoDuration
+
+	// Timeout is the maximum duration of a single probe run. It defaults
+	// to 80% of Interval.
+	Timeout tstime.GoDuration `json:",omitzero"`
+
+	// MaxLatency, if non-zero, is the latency threshold above which a
+	// probe run that otherwise succeeded is considered failed.
+	MaxLatency tstime.GoDuration `json:",omitzero"`
+
+	// Labels are additional metric labels for the probe.
+	Labels Labels `json:",omitempty"`
+
+	// WantText is, for http probes, text that must be present in the
+	// response body.
+	WantText string `json:",omitempty"`
+
+	// AddrClass is, for dns probes, the class of the per-address probes:
+	// "tls" (the default) or "tcp".
+	AddrClass string `json:",omitempty"`
+
+	// Port is, for dns probes, the port the per-address probes connect
+	// to. It defaults to 443.
+	Port uint16 `json:",omitempty"`
+
+	// Networks is, for dns probes, the list of networks to resolve
+	// ("ip", "ip4" or "ip6"). It defaults to "ip".
+	Networks []string `json:",omitempty"`
+
+	// DERP contains additional settings for derp probes.
+	DERP *DERPProbeConfig `json:",omitempty"`
+}
+
+// DERPProbeConfig contains the settings of a derp ProbeConfig. Zero
+// intervals disable the corresponding kind of probe.
+type DERPProbeConfig struct {
+	MeshInterval      tstime.GoDuration `json:",omitzero"`
+	STUNInterval      tstime.GoDuration `json:",omitzero"`
+	TLSInterval       tstime.GoDuration `json:",omitzero"`
+	BandwidthInterval tstime.GoDuration `json:",omitzero"`
+	BandwidthSize     int64             `json:",omitempty"`
+
+	// Region, if non-empty, restricts probing to the region with this
+	// code or ID.
+	Region string `json:",omitempty"`
+
+	// MeshPSKFile, if non-empty, is the path to a file containing the
+	// DERP mesh key.
+	MeshPSKFile string `json:",omitempty"`
+}
+
+// LoadConfig reads and parses the HuJSON config file at path.
+func LoadConfig(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := ParseConfig(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+// ParseConfig parses and validates a HuJSON probe config.
+func ParseConfig(b []byte) (*Config, error) {
+	b, err := hujson.Standardize(b)
+	if err != nil {
+		return nil, err
+	}
+	var c Config
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (c *Config) validate() error {
+	names := make(map[string]bool)
+	derps := 0
+	for i := range c.Probes {
+		pc := &c.Probes[i]
+		if pc.Name == "" {
+			return fmt.Errorf("probe %d: missing Name", i)
+		}
+		if names[pc.Name] {
+			return fmt.Errorf("probe %q: duplicate name", pc.Name)
+		}
+		names[pc.Name] = true
+		if pc.Interval.Duration == 0 {
+			pc.Interval.Duration = DefaultConfigInterval
+		}
+		if pc.Interval.Duration < 0 || pc.Timeout.Duration < 0 || pc.MaxLatency.Duration < 0 {
+			return fmt.Errorf("probe %q: negative duration", pc.Name)
+		}
+		if pc.Target == "" {
+			return fmt.Errorf("probe %q: missing Target", pc.Name)
+		}
+		switch pc.Class {
+		case "http", "tls", "tcp":
+		case "dns":
+			switch pc.AddrClass {
+			case "", "tls", "tcp":
+			default:
+				return fmt.Errorf("probe %q: unknown AddrClass %q", pc.Name, pc.AddrClass)
+			}
+		case "derp":
+			// The DERP prober names its probes after the DERP servers, so
+			// two of them would collide.
+			derps++
+			if derps > 1 {
+				return fmt.Errorf("probe %q: only one derp probe is supported", pc.Name)
+			}
+		default:
+			return fmt.Errorf("probe %q: unknown Class %q", pc.Name, pc.Class)
+		}
+	}
+
+	// The probes that dns and derp probes start for each address or DERP
+	// server are named under the parent probe's name or "derp/",
+	// respectively; other probes must not use those names.
+	for _, pc := range c.Probes {
+		var prefix string
+		switch pc.Class {
+		case "dns":
+			prefix = pc.Name + "/"
+		case "derp":
+			prefix = derpProbePrefix
+		default:
+			continue
+		}
+		for _, other := range c.Probes {
+			if strings.HasPrefix(other.Name, prefix) {
+				return fmt.Errorf("probe %q: name is reserved for the probes started by %q", other.Name, pc.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// configuredProbe is a probe started by ApplyConfig.
+type configuredProbe struct {
+	cfg   ProbeConfig
+	probe *Probe
+	// closeChildren, if non-nil, closes the probes that probe started.
+	closeChildren func()
+}
+
+func (cp *configuredProbe) close() {
+	cp.probe.Close()
+	if cp.closeChildren != nil {
+		cp.closeChildren()
+	}
+}
+
+// configState is the state of the probes managed by ApplyConfig.
+type configState struct {
+	mu     sync.Mutex
+	probes map[string]*configuredProbe
+}
+
+// ApplyConfig starts and stops probes so that the probes previously started
+// by ApplyConfig match c. Probes whose definition did not change keep
+// running and keep their history; changed probes are restarted.
+//
+// If any probe in c cannot be set up, ApplyConfig returns an error without
+// changing the running probes.
+func (p *Prober) ApplyConfig(c *Config) error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+	cs := &p.config
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	type start struct {
+		cfg ProbeConfig
+		run func() *configuredProbe
+	}
+	var starts []start
+	want := make(map[string]bool)
+	for _, pc := range c.Probes {
+		want[pc.Name] = true
+		cur, ok := cs.probes[pc.Name]
+		if ok && reflect.DeepEqual(cur.cfg, pc) {
+			continue
+		}
+		if !ok && p.hasProbe(pc.Name) {
+			return fmt.Errorf("probe %q: name already in use", pc.Name)
+		}
+		run, err := p.configProbe(pc)
+		if err != nil {
+			return fmt.Errorf("probe %q: %w", pc.Name, err)
+		}
+		starts = append(starts, start{pc, run})
+	}
+
+	if cs.probes == nil {
+		cs.probes = make(map[string]*configuredProbe)
+	}
+	for name, cp := range cs.probes {
+		if !want[name] {
+			log.Printf("removing probe %q", name)
+			cp.close()
+			delete(cs.probes, name)
+		}
+	}
+	// Changed probes, and the probes they started, continue the history
+	// of the ones they replace.
+	p.retainState(func() {
+		for _, s := range starts {
+			if cp, ok := cs.probes[s.cfg.Name]; ok {
+				log.Printf("restarting changed probe %q", s.cfg.Name)
+				cp.close()
+			}
+		}
+	})
+	for _, s := range starts {
+		if _, ok := cs.probes[s.cfg.Name]; !ok {
+			log.Printf("adding %s probe %q for %s every %v", s.cfg.Class, s.cfg.Name, s.cfg.Target, s.cfg.Interval)
+		}
+		cs.probes[s.cfg.Name] = s.run()
+	}
+	return nil
+}
+
+// hasProbe reports whether a probe named name is registered.
+func (p *Prober) hasProbe(name string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.probes[name]
+	return ok
+}
+
+// configProbe returns a function that starts the probe described by pc.
+func (p *Prober) configProbe(pc ProbeConfig) (func() *configuredProbe, error) {
+	var pcl ProbeClass
+	var closeChildren func()
+	switch pc.Class {
+	case "http":
+		pcl = HTTP(pc.Target, pc.WantText)
+	case "tls":
+		pcl = TLS(pc.Target)
+	case "tcp":
+		pcl = TCP(pc.Target)
+	case "dns":
+		port := pc.Port
+		if port == 0 {
+			port = 443
+		}
+		f := makeForEachAddr(pc.Target, func(addr netip.Addr) []*Probe {
+			ap := netip.AddrPortFrom(addr, port)
+			var apc ProbeClass
+			if pc.AddrClass == "tcp" {
+				apc = TCP(ap.String())
+			} else {
+				apc = TLSWithIP(pc.Target, ap)
+			}
+			apc.Timeout = pc.Timeout.Duration
+			labels := maps.Clone(pc.Labels)
+			if labels == nil {
+				labels = Labels{}
+			}
+			labels["addr"] = addr.String()
+			name := pc.Name + "/" + addr.String()
+			probe, err := p.tryRun(name, pc.Interval.Duration, labels, withMaxLatency(apc, pc))
+			if err != nil {
+				log.Printf("not probing %v for %q: %v", addr, pc.Name, err)
+				return nil
+			}
+			return []*Probe{probe}
+		}, ForEachAddrOpts{Logf: log.Printf, Networks: pc.Networks})
+		pcl = ProbeClass{Probe: f.run, Class: "dns_each_addr"}
+		closeChildren = f.close
+	case "derp":
+		d, err := p.configDERP(pc)
+		if err != nil {
+			return nil, err
+		}
+		pcl = d.ProbeMap
+		closeChildren = d.close
+	default:
+		return nil, fmt.Errorf("unknown Class %q", pc.Class)
+	}
+	pcl.Timeout = pc.Timeout.Duration
+	pcl = withMaxLatency(pcl, pc)
+	return func() *configuredProbe {
+		return &configuredProbe{
+			cfg:           pc,
+			probe:         p.Run(pc.Name, pc.Interval.Duration, pc.Labels, pcl),
+			closeChildren: closeChildren,
+		}
+	}, nil
+}
+
+func (p *Prober) configDERP(pc ProbeConfig) (*derpProber, error) {
+	dc := pc.DERP
+	if dc == nil {
+		dc = new(DERPProbeConfig)
+	}
+	opts := []DERPOpt{
+		WithMeshProbing(dc.MeshInterval.Duration),
+		WithSTUNProbing(dc.STUNInterval.Duration),
+		WithTLSProbing(dc.TLSInterval.Duration),
+	}
+	if dc.BandwidthInterval.Duration > 0 {
+		opts = append(opts, WithBandwidthProbing(dc.BandwidthInterval.Duration, dc.BandwidthSize, ""))
+	}
+	if dc.Region != "" {
+		opts = append(opts, WithRegionCodeOrID(dc.Region))
+	}
+	if dc.MeshPSKFile != "" {
+		b, err := os.ReadFile(dc.MeshPSKFile)
+		if err != nil {
+			return nil, err
+		}
+		k, err := key.ParseDERPMesh(strings.TrimSpace(string(b)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid mesh key in %s: %w", dc.MeshPSKFile, err)
+		}
+		opts = append(opts, WithMeshKey(k))
+	}
+	return DERP(p, pc.Target, opts...)
+}
+
+// withMaxLatency wraps pcl to fail runs that take longer than
+// pc.MaxLatency, if set.
+func withMaxLatency(pcl ProbeClass, pc ProbeConfig) ProbeClass {
+	max := pc.MaxLatency.Duration
+	if max <= 0 {
+		return pcl
+	}
+	probe := pcl.Probe
+	pcl.Probe = func(ctx context.Context) error {
+		start := time.Now()
+		if err := probe(ctx); err != nil {
+			return err
+		}
+		if d := time.Since(start); d > max {
+			return fmt.Errorf("latency %v exceeds threshold %v", d.Round(time.Millisecond), max)
+		}
+		return nil
+	}
+	return pcl
+}
+
+// close closes all the per-address probes created by f, and prevents it
+// from creating more.
+func (f *forEachAddrProbe) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	for addr, probes := range f.probes {
+		for _, probe := range probes {
+			probe.Close()
+		}
+		delete(f.probes, addr)
+	}
+}
+
+// close closes all the per-server probes created by d, and prevents it
+// from creating more.
+func (d *derpProber) close() {
+	d.Lock()
+	defer d.Unlock()
+	d.closed = true
+	for n, probe := range d.probes {
+		probe.Close()
+		delete(d.probes, n)
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package prober
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"tailscale.com/tstest"
+	"tailscale.com/tstime"
+)
+
+func TestParseConfig(t *testing.T) {
+	c, err := ParseConfig([]byte(`{
+		// Comments and trailing commas are allowed.
+		"Probes": [
+			{"Name": "web", "Class": "http", "Target": "https://example.com/", "WantText": "ok", "Interval": "1m", "Labels": {"team": "sre"}},
+			{"Name": "api", "Class": "dns", "Target": "api.example.com", "AddrClass": "tcp", "Port": 8443, "MaxLatency": "500ms"},
+		],
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Probes) != 2 {
+		t.Fatalf("got %d probes; want 2", len(c.Probes))
+	}
+	if got := c.Probes[0].Interval.Duration; got != time.Minute {
+		t.Errorf("web interval = %v; want 1m", got)
+	}
+	if got := c.Probes[0].Labels["team"]; got != "sre" {
+		t.Errorf("web team label = %q; want sre", got)
+	}
+	if got := c.Probes[1].Interval.Duration; got != DefaultConfigInterval {
+		t.Errorf("api interval = %v; want default %v", got, DefaultConfigInterval)
+	}
+	if got := c.Probes[1].MaxLatency.Duration; got != 500*time.Millisecond {
+		t.Errorf("api max latency = %v; want 500ms", got)
+	}
+
+	for _, bad := range []string{
+		`{"Probes": [{"Class": "tcp", "Target": "a:1"}]}`,
+		`{"Probes": [{"Name": "a", "Class": "tcp", "Target": "a:1"}, {"Name": "a", "Class": "tcp", "Target": "b:1"}]}`,
+		`{"Probes": [{"Name": "a", "Class": "icmp", "Target": "a"}]}`,
+		`{"Probes": [{"Name": "a", "Class": "tcp"}]}`,
+		`{"Probes": [{"Name": "a", "Class": "tcp", "Target": "a:1", "Interval": "soon"}]}`,
+		`{"Probes": [{"Name": "a", "Class": "dns", "Target": "a", "AddrClass": "http"}]}`,
+		`{"Probes": [{"Name": "a", "Class": "derp", "Target": "local"}, {"Name": "b", "Class": "derp", "Target": "local"}]}`,
+		`{"Probes": [{"Name": "a", "Class": "dns", "Target": "a"}, {"Name": "a/10.0.0.1", "Class": "tcp", "Target": "b:1"}]}`,
+		`{"Probes": [{"Name": "a", "Class": "derp", "Target": "local"}, {"Name": "derp/nyc/1a/tls", "Class": "tcp", "Target": "b:1"}]}`,
+	} {
+		if _, err := ParseConfig([]byte(bad)); err == nil {
+			t.Errorf("ParseConfig(%s) succeeded; want error", bad)
+		}
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	clk := newFakeTime()
+	p := newForTest(clk.Now, clk.NewTicker)
+	defer p.ApplyConfig(&Config{})
+
+	tcp := func(name string) ProbeConfig {
+		// Nothing listens on port 1, so the probes fail quickly.
+		return ProbeConfig{Name: name, Class: "tcp", Target: "127.0.0.1:1"}
+	}
+	probe := func(name string) *Probe {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return p.probes[name]
+	}
+
+	if err := p.ApplyConfig(&Config{Probes: []ProbeConfig{tcp("a"), tcp("b")}}); err != nil {
+		t.Fatal(err)
+	}
+	a := probe("a")
+	if a == nil || probe("b") == nil {
+		t.Fatal("probes not started")
+	}
+	info := func(pr *Probe) ProbeInfo {
+		pr.mu.Lock()
+		defer pr.mu.Unlock()
+		return pr.probeInfoLocked()
+	}
+	if err := tstest.WaitFor(convergenceTimeout, func() error {
+		if len(info(a).RecentResults) == 0 {
+			return errors.New("probe a has not run")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.ApplyConfig(&Config{Probes: []ProbeConfig{tcp("a"), tcp("c")}}); err != nil {
+		t.Fatal(err)
+	}
+	if probe("a") != a {
+		t.Error("unchanged probe a was restarted")
+	}
+	if probe("b") != nil {
+		t.Error("removed probe b still running")
+	}
+	if probe("c") == nil {
+		t.Error("added probe c not running")
+	}
+
+	changed := tcp("a")
+	changed.Labels = Labels{"env": "prod"}
+	if err := p.ApplyConfig(&Config{Probes: []ProbeConfig{changed, tcp("c")}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := probe("a"); got == a || got == nil || got.metricLabels["env"] != "prod" {
+		t.Error("changed probe a was not restarted with its new definition")
+	} else if got, want := info(got), info(a); got.Start != want.Start || len(got.RecentResults) < len(want.RecentResults) {
+		t.Errorf("restarted probe a lost its history: got start %v, %d results; want %v, %d", got.Start, len(got.RecentResults), want.Start, len(want.RecentResults))
+	}
+
+	// Probes not managed by ApplyConfig are left alone, and their names
+	// can't be reused.
+	other := p.Run("other", time.Minute, nil, FuncProbe(func(context.Context) error { return nil }))
+	defer other.Close()
+	if err := p.ApplyConfig(&Config{Probes: []ProbeConfig{tcp("other")}}); err == nil {
+		t.Error("ApplyConfig reused the name of an existing probe")
+	}
+	if probe("a") == nil || probe("c") == nil {
+		t.Error("failed ApplyConfig changed the running probes")
+	}
+
+	if err := p.ApplyConfig(&Config{}); err != nil {
+		t.Fatal(err)
+	}
+	if probe("a") != nil || probe("c") != nil || probe("other") == nil {
+		t.Error("empty config did not remove exactly the configured probes")
+	}
+}
+
+func TestMaxLatency(t *testing.T) {
+	slow := FuncProbe(func(context.Context) error {
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	})
+	pc := ProbeConfig{MaxLatency: tstime.GoDuration{Duration: time.Millisecond}}
+	if err := withMaxLatency(slow, pc).Probe(context.Background()); err == nil {
+		t.Error("slow probe succeeded despite MaxLatency")
+	}
+	pc.MaxLatency = tstime.GoDuration{Duration: time.Minute}
+	if err := withMaxLatency(slow, pc).Probe(context.Background()); err != nil {
+		t.Errorf("probe within MaxLatency failed: %v", err)
+	}
+}
@@ -79,6 +79,7 @@ type derpProber struct {
 	lastDERPMapAt time.Time
 	nodes         map[string]*tailcfg.DERPNode
 	probes        map[string]*Probe
+	closed        bool // whether close was called
 }
 
 type DERPOpt func(*derpProber)
@@ -176,6 +177,21 @@ func DERP(p *Prober, derpMapURL string, opts ...DERPOpt) (*derpProber, error) {
 	return d, nil
 }
 
+// derpProbePrefix is the prefix of the names of the probes started by a
+// derpProber in probeMapFn.
+const derpProbePrefix = "derp/"
+
+// runLocked starts the probe named n and records it in d.probes, unless a
+// probe of that name was registered by someone else. d must be locked.
+func (d *derpProber) runLocked(n string, interval time.Duration, labels Labels, pc ProbeClass) {
+	probe, err := d.p.tryRun(n, interval, labels, pc)
+	if err != nil {
+		log.Printf("not adding DERP probe: %v", err)
+		return
+	}
+	d.probes[n] = probe
+}
+
 // probeMapFn fetches the DERPMap and creates/destroys probes for each
 // DERP server as necessary. It should get regularly executed as a
 // probe function itself.
@@ -187,6 +203,9 @@ func (d *derpProber) probeMapFn(ctx context.Context) error {
 	wantProbes := map[string]bool{}
 	d.Lock()
 	defer d.Unlock()
+	if d.closed {
+		return nil
+	}
 
 	for _, region := range d.lastDERPMap.Regions {
 		if d.skipRegion(region) {
@@ -206,7 +225,7 @@ func (d *derpProber) probeMapFn(ctx context.Context) error {
 				if d.probes[n] == nil {
 					log.Printf("adding DERP TLS probe for %s (%s) every %v", server.Name, region.RegionName, d.tlsInterval)
 					derpPort := cmp.Or(server.DERPPort, 443)
-					d.probes[n] = d.p.Run(n, d.tlsInterval, labels, d.tlsProbeFn(fmt.Sprintf("%s:%d", server.HostName, derpPort)))
+					d.runLocked(n, d.tlsInterval, labels, d.tlsProbeFn(fmt.Sprintf("%s:%d", server.HostName, derpPort)))
 				}
 			}
 
@@ -224,7 +243,7 @@ func (d *derpProber) probeMapFn(ctx context.Context) error {
 					wantProbes[n] = true
 					if d.probes[n] == nil {
 						log.Printf("adding DERP UDP probe for %s (%s) every %v", server.Name, n, d.udpInterval)
-						d.probes[n] = d.p.Run(n, d.udpInterval, labels, d.udpProbeFn(ipStr, server.STUNPort))
+						d.runLocked(n, d.udpInterval, labels, d.udpProbeFn(ipStr, server.STUNPort))
 					}
 				}
 			}
@@ -235,7 +254,7 @@ func (d *derpProber) probeMapFn(ctx context.Context) error {
 					wantProbes[n] = true
 					if d.probes[n] == nil {
 						log.Printf("adding DERP mesh probe for %s->%s (%s) every %v", server.Name, to.Name, region.RegionName, d.meshInterval)
-						d.probes[n] = d.p.Run(n, d.meshInterval, labels, d.meshProbeFn(server.Name, to.Name))
+						d.runLocked(n, d.meshInterval, labels, d.meshProbeFn(server.Name, to.Name))
 					}
 				}
 
@@ -248,7 +267,7 @@ func (d *derpProber) probeMapFn(ctx context.Context) error {
 							tunString = " (TUN)"
 						}
 						log.Printf("adding%s DERP bandwidth probe for %s->%s (%s) %v bytes every %v", tunString, server.Name, to.Name, region.RegionName, d.bwProbeSize, d.bwInterval)
-						d.probes[n] = d.p.Run(n, d.bwInterval, labels, d.bwProbeFn(server.Name, to.Name, d.bwProbeSize))
+						d.runLocked(n, d.bwInterval, labels, d.bwProbeFn(server.Name, to.Name, d.bwProbeSize))
 					}
 				}
 
@@ -257,7 +276,7 @@ func (d *derpProber) probeMapFn(ctx context.Context) error {
 					wantProbes[n] = true
 					if d.probes[n] == nil {
 						log.Printf("adding DERP queuing delay probe for %s->%s (%s)", server.Name, to.Name, region.RegionName)
-						d.probes[n] = d.p.Run(n, -10*time.Second, labels, d.qdProbeFn(server.Name, to.Name, d.qdPacketsPerSecond, d.qdPacketTimeout, d.meshKey))
+						d.runLocked(n, -10*time.Second, labels, d.qdProbeFn(server.Name, to.Name, d.qdPacketsPerSecond, d.qdPacketTimeout, d.meshKey))
 					}
 				}
 			}
@@ -75,6 +75,7 @@ type forEachAddrProbe struct {
 	// state
 	mu     sync.Mutex // protects following
 	probes map[netip.Addr][]*Probe
+	closed bool // whether close was called
 }
 
 // run matches the ProbeFunc signature
@@ -95,6 +96,9 @@ func (f *forEachAddrProbe) run(ctx context.Context) error {
 	// exist in our probe map.
 	f.mu.Lock()
 	defer f.mu.Unlock()
+	if f.closed {
+		return nil
+	}
 
 	sawIPs := make(map[netip.Addr]bool)
 	for _, addr := range addrs {
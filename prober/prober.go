@@ -26,6 +26,7 @@
 	"golang.org/x/sync/errgroup"
 	"tailscale.com/syncs"
 	"tailscale.com/tsweb"
+	"tailscale.com/util/mak"
 )
 
 // recentHistSize is the number of recent probe results and latencies to keep
@@ -84,8 +85,16 @@ type Prober struct {
 	mu     sync.Mutex // protects all following fields
 	probes map[string]*Probe
 
+	// retaining is whether unregister saves the state of the probes it
+	// removes in retained, to be restored by the next Run of the same
+	// name. See retainState.
+	retaining bool
+	retained  map[string]*probeState
+
 	namespace string
 	metrics   *prometheus.Registry
+
+	config configState // probes managed by ApplyConfig
 }
 
 // New returns a new Prober.
@@ -112,10 +121,20 @@ func newForTest(now func() time.Time, newTicker func(time.Duration) ticker) *Pro
 //
 // Registering a probe under an already-registered name panics.
 func (p *Prober) Run(name string, interval time.Duration, labels Labels, pc ProbeClass) *Probe {
+	probe, err := p.tryRun(name, interval, labels, pc)
+	if err != nil {
+		panic(err.Error())
+	}
+	return probe
+}
+
+// tryRun is like Run, but returns an error rather than panicking if a probe
+// named name is already registered.
+func (p *Prober) tryRun(name string, interval time.Duration, labels Labels, pc ProbeClass) (*Probe, error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	if _, ok := p.probes[name]; ok {
-		panic(fmt.Sprintf("probe named %q already registered", name))
+		return nil, fmt.Errorf("probe named %q already registered", name)
 	}
 
 	l := prometheus.Labels{
@@ -130,9 +149,13 @@ func (p *Prober) Run(name string, interval time.Duration, labels Labels, pc Prob
 	}
 
 	probe := newProbe(p, name, interval, l, pc)
+	if st, ok := p.retained[name]; ok {
+		delete(p.retained, name)
+		probe.restoreState(st)
+	}
 	p.probes[name] = probe
 	go probe.loop()
-	return probe
+	return probe, nil
 }
 
 // newProbe creates a new Probe with the given parameters, but does not start it.
@@ -183,6 +206,27 @@ func (p *Prober) unregister(probe *Probe) {
 	p.metrics.Unregister(probe.metrics)
 	name := probe.name
 	delete(p.probes, name)
+	if p.retaining {
+		mak.Set(&p.retained, name, probe.state())
+	}
+}
+
+// retainState calls f, which closes probes, and keeps the state of the
+// probes closed meanwhile, so that probes of the same names started later
+// continue from it. Retained state that is not picked up is discarded by the
+// next call.
+func (p *Prober) retainState(f func()) {
+	p.mu.Lock()
+	clear(p.retained)
+	p.retaining = true
+	p.mu.Unlock()
+
+	defer func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.retaining = false
+	}()
+	f()
 }
 
 // WithSpread is used to enable random delay before the first run of
@@ -276,6 +320,45 @@ type Probe struct {
 	latencyHist *ring.Ring
 }
 
+// probeState is the result history of a Probe, as carried over to its
+// replacement by retainState.
+type probeState struct {
+	start, end  time.Time
+	latency     time.Duration
+	succeeded   bool
+	lastErr     error
+	successHist *ring.Ring
+	latencyHist *ring.Ring
+}
+
+// state returns the result history of p. It must only be called once p is
+// stopped.
+func (p *Probe) state() *probeState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return &probeState{
+		start:       p.start,
+		end:         p.end,
+		latency:     p.latency,
+		succeeded:   p.succeeded,
+		lastErr:     p.lastErr,
+		successHist: p.successHist,
+		latencyHist: p.latencyHist,
+	}
+}
+
+// restoreState replaces the result history of p, which must not be running
+// yet, with st.
+func (p *Probe) restoreState(st *probeState) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.start, p.end = st.start, st.end
+	p.latency = st.latency
+	p.succeeded = st.succeeded
+	p.lastErr = st.lastErr
+	p.successHist, p.latencyHist = st.successHist, st.latencyHist
+}
+
 // IsContinuous indicates that this is a continuous probe.
 func (p *Probe) IsContinuous() bool {
 	return p.interval < 0
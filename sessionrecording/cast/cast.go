@@ -0,0 +1,132 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package cast reads session recordings in the asciinema format written by
+// Tailscale SSH and the Kubernetes API server proxy, and replays, transcribes
+// and searches them.
+package cast
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"tailscale.com/sessionrecording"
+)
+
+// Event types, as in the asciinema file format.
+const (
+	EventOutput = "o" // data written to the terminal
+	EventInput  = "i" // data read from the terminal
+	EventResize = "r" // terminal resized; Data is "WIDTHxHEIGHT"
+	EventMarker = "m" // a marker; Data is its label
+)
+
+// Event is an event in a recording.
+type Event struct {
+	// Time is the time of the event, relative to the start of the
+	// recording.
+	Time time.Duration
+	// Type is the type of the event, such as EventOutput.
+	Type string
+	// Data is the data of the event.
+	Data string
+}
+
+// Reader reads the events of a recording.
+type Reader struct {
+	br     *bufio.Reader
+	header sessionrecording.CastHeader
+	line   int // number of lines read
+}
+
+// NewReader returns a Reader reading a recording from r, having read its
+// header.
+func NewReader(r io.Reader) (*Reader, error) {
+	cr := &Reader{br: bufio.NewReader(r)}
+	line, err := cr.readLine()
+	if err == io.EOF {
+		return nil, errors.New("empty recording")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(line, &cr.header); err != nil {
+		return nil, fmt.Errorf("invalid recording header: %w", err)
+	}
+	return cr, nil
+}
+
+// Header returns the header of the recording.
+func (r *Reader) Header() sessionrecording.CastHeader { return r.header }
+
+// Next returns the next event in the recording. It returns io.EOF at the end
+// of the recording, and io.ErrUnexpectedEOF if its last line is incomplete,
+// as happens when a recording ends abruptly.
+func (r *Reader) Next() (Event, error) {
+	for {
+		line, err := r.readLine()
+		if err != nil {
+			return Event{}, err
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		return r.parseEvent(line)
+	}
+}
+
+// readLine returns the next line, without its trailing newline.
+func (r *Reader) readLine() ([]byte, error) {
+	line, err := r.br.ReadBytes('\n')
+	if err == io.EOF {
+		if len(line) == 0 {
+			return nil, io.EOF
+		}
+		if !json.Valid(line) {
+			return nil, io.ErrUnexpectedEOF
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	r.line++
+	return bytes.TrimSuffix(line, []byte("\n")), nil
+}
+
+func (r *Reader) parseEvent(line []byte) (Event, error) {
+	var fields []json.RawMessage
+	if err := json.Unmarshal(line, &fields); err != nil || len(fields) != 3 {
+		return Event{}, fmt.Errorf("line %d: invalid event", r.line)
+	}
+	var secs float64
+	var ev Event
+	if err := json.Unmarshal(fields[0], &secs); err != nil || secs < 0 || math.IsInf(secs, 0) {
+		return Event{}, fmt.Errorf("line %d: invalid event time", r.line)
+	}
+	if err := json.Unmarshal(fields[1], &ev.Type); err != nil {
+		return Event{}, fmt.Errorf("line %d: invalid event type", r.line)
+	}
+	if err := json.Unmarshal(fields[2], &ev.Data); err != nil {
+		return Event{}, fmt.Errorf("line %d: invalid event data", r.line)
+	}
+	ev.Time = time.Duration(secs * float64(time.Second))
+	return ev, nil
+}
+
+// isEnd reports whether err, as returned by [Reader.Next], marks the end of
+// the recording, complete or not.
+func isEnd(err error) bool {
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// FormatTime formats the time of an event as it is printed in transcripts
+// and search results, such as "1m2.5s". It can be parsed with
+// time.ParseDuration.
+func FormatTime(d time.Duration) string {
+	return d.Round(time.Millisecond).String()
+}
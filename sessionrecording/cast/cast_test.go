@@ -0,0 +1,185 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cast
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testRecording = `{"version":2,"width":80,"height":24,"timestamp":1700000000,"srcNode":"laptop.tail-scale.ts.net","srcNodeID":"n1","env":{"TERM":"xterm"},"sshUser":"alice","localUser":"alice","connectionID":"c1"}
+[0.1,"o","\u001b]0;alice@server\u0007\u001b[1;32malice@server\u001b[0m:~$ "]
+[1.0,"i","lx"]
+[1.0,"o","lx"]
+[1.5,"i","\b"]
+[1.5,"o","\b\u001b[K"]
+[2.0,"o","s\r\n"]
+[2.25,"o","notes.txt\r\nSecret.txt\r\n"]
+[2.5,"r","100x30"]
+[60.0,"o","progress 10%\rprogress 100%\r\n\r\n"]
+[61.0,"o","bye"]
+[61.5,"o","`
+
+func mustReader(t *testing.T, s string) *Reader {
+	t.Helper()
+	r, err := NewReader(strings.NewReader(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestReader(t *testing.T) {
+	r := mustReader(t, testRecording)
+	if h := r.Header(); h.SSHUser != "alice" || h.Width != 80 {
+		t.Errorf("header = %+v", h)
+	}
+	var n int
+	for {
+		ev, err := r.Next()
+		if err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("event %d: %v", n, err)
+		}
+		if n == 1 && (ev.Type != EventInput || ev.Time != time.Second || ev.Data != "lx") {
+			t.Errorf("event %d = %+v", n, ev)
+		}
+		n++
+	}
+	if n != 10 {
+		t.Errorf("got %d events, want 10", n)
+	}
+
+	if _, err := NewReader(strings.NewReader("")); err == nil {
+		t.Error("NewReader of empty recording succeeded")
+	}
+	r = mustReader(t, "{}\n[1,\"o\"]\n")
+	if _, err := r.Next(); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("Next of invalid event = %v, want error on line 2", err)
+	}
+}
+
+func TestTranscribe(t *testing.T) {
+	var got []Line
+	if err := Transcribe(mustReader(t, testRecording), func(l Line) error {
+		got = append(got, l)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := []Line{
+		{100 * time.Millisecond, "alice@server:~$ ls"},
+		{2250 * time.Millisecond, "notes.txt"},
+		{2250 * time.Millisecond, "Secret.txt"},
+		{60 * time.Second, "progress 100%"},
+		{60 * time.Second, ""},
+		{61 * time.Second, "bye"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q\nwant %q", got, want)
+	}
+
+	var sb strings.Builder
+	if err := WriteTranscript(&sb, mustReader(t, testRecording), true); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(sb.String(), "[100ms] alice@server:~$ ls\n[2.25s] notes.txt\n") {
+		t.Errorf("WriteTranscript = %q", sb.String())
+	}
+}
+
+func TestPlay(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       PlayOptions
+		wantSleeps []time.Duration
+	}{
+		{
+			name:       "original-speed",
+			wantSleeps: []time.Duration{100 * time.Millisecond, 900 * time.Millisecond, 500 * time.Millisecond, 500 * time.Millisecond, 250 * time.Millisecond, 57750 * time.Millisecond, time.Second},
+		},
+		{
+			name:       "double-speed-max-idle",
+			opts:       PlayOptions{Speed: 2, MaxIdle: 2 * time.Second},
+			wantSleeps: []time.Duration{50 * time.Millisecond, 450 * time.Millisecond, 250 * time.Millisecond, 250 * time.Millisecond, 125 * time.Millisecond, time.Second, 500 * time.Millisecond},
+		},
+		{
+			name:       "start",
+			opts:       PlayOptions{Start: 59 * time.Second},
+			wantSleeps: []time.Duration{time.Second, time.Second},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sleeps []time.Duration
+			var out strings.Builder
+			err := play(context.Background(), &out, mustReader(t, testRecording), tt.opts, func(_ context.Context, d time.Duration) error {
+				sleeps = append(sleeps, d)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(sleeps, tt.wantSleeps) {
+				t.Errorf("sleeps = %v, want %v", sleeps, tt.wantSleeps)
+			}
+			// All output is written, including that before Start.
+			if !strings.Contains(out.String(), "\u001b[1;32malice@server") || !strings.HasSuffix(out.String(), "bye") {
+				t.Errorf("output = %q", out.String())
+			}
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := Play(ctx, io.Discard, mustReader(t, testRecording), PlayOptions{}); err != context.Canceled {
+		t.Errorf("Play with canceled context = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, contents string) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	a := write("a.cast", testRecording)
+	b := write("sub/b.cast", "{\"sshUser\":\"bob\"}\n[3.5,\"o\",\"cat secret.txt\\r\\n\"]\n")
+	write("c.txt", "secret")
+	write("d.cast", "not a recording")
+
+	matches, err := Search(dir, "SECRET")
+	if err == nil || !strings.Contains(err.Error(), "d.cast") {
+		t.Errorf("Search error = %v, want error for d.cast", err)
+	}
+	var got []string
+	for _, m := range matches {
+		got = append(got, m.String())
+	}
+	want := []string{
+		a + "@2.25s: Secret.txt",
+		b + "@3.5s: cat secret.txt",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("matches = %q, want %q", got, want)
+	}
+	if matches[1].Header.SSHUser != "bob" {
+		t.Errorf("header = %+v", matches[1].Header)
+	}
+}
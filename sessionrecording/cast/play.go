@@ -0,0 +1,80 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cast
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// PlayOptions are options for [Play].
+type PlayOptions struct {
+	// Speed is the factor by which to speed up playback, such as 2 for
+	// double speed or 0.5 for half speed. If zero, the recording is played
+	// at its original speed.
+	Speed float64
+
+	// MaxIdle, if non-zero, is the longest pause between events during
+	// playback, before Speed is applied. Longer pauses are shortened to it.
+	MaxIdle time.Duration
+
+	// Start is the time into the recording at which to start playback.
+	// Output before Start is written without pausing, so that the terminal
+	// is in the state it was in at Start.
+	Start time.Duration
+}
+
+// Play replays the output of the recording read from r to w, typically a
+// terminal, pausing between events as they were paused when recorded. It
+// returns when the recording ends or ctx is done.
+func Play(ctx context.Context, w io.Writer, r *Reader, opts PlayOptions) error {
+	return play(ctx, w, r, opts, sleep)
+}
+
+func play(ctx context.Context, w io.Writer, r *Reader, opts PlayOptions, sleep func(context.Context, time.Duration) error) error {
+	speed := opts.Speed
+	if speed <= 0 {
+		speed = 1
+	}
+	last := opts.Start
+	for {
+		ev, err := r.Next()
+		if isEnd(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if ev.Type != EventOutput {
+			continue
+		}
+		if ev.Time > last {
+			d := ev.Time - last
+			if opts.MaxIdle > 0 && d > opts.MaxIdle {
+				d = opts.MaxIdle
+			}
+			if err := sleep(ctx, time.Duration(float64(d)/speed)); err != nil {
+				return err
+			}
+			last = ev.Time
+		}
+		if _, err := io.WriteString(w, ev.Data); err != nil {
+			return err
+		}
+	}
+}
+
+// sleep sleeps for d or until ctx is done, returning ctx.Err() in the
+// latter case.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cast
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"tailscale.com/sessionrecording"
+	"tailscale.com/util/multierr"
+)
+
+// Match is a line of a recording's transcript that matched a [Search].
+type Match struct {
+	// File is the path of the recording.
+	File string
+	// Header is the header of the recording.
+	Header sessionrecording.CastHeader
+	// Line is the matching line. Its Time can be passed as
+	// PlayOptions.Start to replay the recording from the match.
+	Line Line
+}
+
+// String returns the match as "FILE@TIME: TEXT".
+func (m Match) String() string {
+	return fmt.Sprintf("%s@%s: %s", m.File, FormatTime(m.Line.Time), m.Line.Text)
+}
+
+// Search searches the transcripts of the recordings (files ending in
+// ".cast") in dir and its subdirectories for lines containing query,
+// ignoring case. Matches are returned in order of file name, then time.
+//
+// Recordings that cannot be read are skipped, and the errors reading them
+// returned along with the matches in the others.
+func Search(dir, query string) ([]Match, error) {
+	query = strings.ToLower(query)
+	var matches []Match
+	var errs []error
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			errs = append(errs, err)
+			return nil
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".cast") {
+			return nil
+		}
+		m, err := searchFile(path, query)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+		}
+		matches = append(matches, m...)
+		return nil
+	})
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return matches, multierr.New(errs...)
+}
+
+// searchFile searches the recording at path for lines containing query,
+// which must be lower case.
+func searchFile(path, query string) ([]Match, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	var matches []Match
+	err = Transcribe(r, func(l Line) error {
+		if strings.Contains(strings.ToLower(l.Text), query) {
+			matches = append(matches, Match{File: path, Header: r.Header(), Line: l})
+		}
+		return nil
+	})
+	return matches, err
+}
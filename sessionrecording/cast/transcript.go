@@ -0,0 +1,222 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cast
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Line is a line of the plain-text transcript of a recording.
+type Line struct {
+	// Time is the time, relative to the start of the recording, of the
+	// output that began the line.
+	Time time.Duration
+	// Text is the text of the line, without a trailing newline.
+	Text string
+}
+
+// Transcribe calls fn with each line of the plain-text transcript of the
+// output of the recording read from r, stopping at the first error returned
+// by fn.
+//
+// Escape sequences are removed from the output, apart from the effect of
+// those that erase to the end of the line, and carriage returns and
+// backspaces move within the current line, so that lines edited in a shell
+// read as they were when entered. Cursor movement between lines is not
+// followed, so the transcripts of full-screen programs are approximate.
+func Transcribe(r *Reader, fn func(Line) error) error {
+	var t transcriber
+	for {
+		ev, err := r.Next()
+		if isEnd(err) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if ev.Type != EventOutput {
+			continue
+		}
+		t.write(ev.Time, ev.Data)
+		for _, l := range t.lines {
+			if err := fn(l); err != nil {
+				return err
+			}
+		}
+		t.lines = t.lines[:0]
+	}
+	if l, ok := t.flush(); ok {
+		return fn(l)
+	}
+	return nil
+}
+
+// WriteTranscript writes the plain-text transcript of the output of the
+// recording read from r to w, as produced by [Transcribe]. If timestamps is
+// true, each line is prefixed with the time it began, in brackets.
+func WriteTranscript(w io.Writer, r *Reader, timestamps bool) error {
+	return Transcribe(r, func(l Line) error {
+		var err error
+		if timestamps {
+			_, err = fmt.Fprintf(w, "[%s] %s\n", FormatTime(l.Time), l.Text)
+		} else {
+			_, err = fmt.Fprintln(w, l.Text)
+		}
+		return err
+	})
+}
+
+// transcriberState is the state of a transcriber's escape sequence parser.
+type transcriberState int
+
+const (
+	stateText         transcriberState = iota
+	stateEscape                        // after ESC
+	stateCSI                           // in a control sequence, after ESC [
+	stateString                        // in an OSC, DCS or similar string, ended by BEL or ESC \
+	stateStringEscape                  // after ESC in a string
+)
+
+// transcriber converts terminal output into lines of plain text.
+type transcriber struct {
+	state  transcriberState
+	params strings.Builder // parameters of the current control sequence
+
+	cur     []rune // current line
+	col     int    // cursor position in cur
+	curTime time.Duration
+	started bool // whether cur has been written to since it began
+
+	lines []Line // completed lines
+}
+
+func (t *transcriber) write(at time.Duration, s string) {
+	for _, r := range s {
+		switch t.state {
+		case stateEscape:
+			switch r {
+			case '[':
+				t.state = stateCSI
+				t.params.Reset()
+			case ']', 'P', 'X', '^', '_':
+				t.state = stateString
+			default:
+				// A two-character sequence, or one with intermediate
+				// characters that we drop along with its final one.
+				if r < 0x20 || r > 0x2f {
+					t.state = stateText
+				}
+			}
+		case stateCSI:
+			if r >= 0x40 && r <= 0x7e {
+				t.csi(r)
+				t.state = stateText
+			} else {
+				t.params.WriteRune(r)
+			}
+		case stateString:
+			switch r {
+			case '\a':
+				t.state = stateText
+			case '\x1b':
+				t.state = stateStringEscape
+			}
+		case stateStringEscape:
+			if r == '\\' {
+				t.state = stateText
+			} else {
+				t.state = stateString
+			}
+		default:
+			t.text(at, r)
+		}
+	}
+}
+
+// text handles a rune of output outside any escape sequence.
+func (t *transcriber) text(at time.Duration, r rune) {
+	switch {
+	case r == '\x1b':
+		t.state = stateEscape
+	case r == '\n':
+		if !t.started {
+			t.curTime = at
+		}
+		l, _ := t.flush()
+		t.lines = append(t.lines, l)
+	case r == '\r':
+		t.col = 0
+	case r == '\b':
+		if t.col > 0 {
+			t.col--
+		}
+	case r == '\t' || r >= 0x20 && r != 0x7f:
+		if !t.started {
+			t.started = true
+			t.curTime = at
+		}
+		t.pad()
+		if t.col < len(t.cur) {
+			t.cur[t.col] = r
+		} else {
+			t.cur = append(t.cur, r)
+		}
+		t.col++
+	}
+}
+
+// csi handles a control sequence ending in final.
+func (t *transcriber) csi(final rune) {
+	switch final {
+	case 'K': // erase in line
+		switch t.params.String() {
+		case "", "0":
+			t.pad()
+			t.cur = t.cur[:t.col]
+		case "1":
+			for i := 0; i < t.col && i < len(t.cur); i++ {
+				t.cur[i] = ' '
+			}
+		case "2":
+			t.cur = t.cur[:0]
+		}
+	case 'P': // delete characters
+		n := 1
+		fmt.Sscan(t.params.String(), &n)
+		if t.col < len(t.cur) {
+			t.cur = slices.Delete(t.cur, t.col, min(t.col+max(n, 1), len(t.cur)))
+		}
+	case 'C': // cursor forward
+		n := 1
+		fmt.Sscan(t.params.String(), &n)
+		t.col += max(n, 1)
+	case 'D': // cursor back
+		n := 1
+		fmt.Sscan(t.params.String(), &n)
+		t.col = max(t.col-max(n, 1), 0)
+	}
+}
+
+// pad pads the current line with spaces up to the cursor, if it is beyond
+// the end of the line.
+func (t *transcriber) pad() {
+	for len(t.cur) < t.col {
+		t.cur = append(t.cur, ' ')
+	}
+}
+
+// flush ends the current line, returning it and whether anything had been
+// written to it.
+func (t *transcriber) flush() (Line, bool) {
+	l := Line{Time: t.curTime, Text: strings.TrimRight(string(t.cur), " ")}
+	ok := t.started
+	t.cur = t.cur[:0]
+	t.col = 0
+	t.started = false
+	return l, ok
+}
@@ -195,8 +195,12 @@ func connectV2(ctx context.Context, hc *http.Client, ap netip.AddrPort) (io.Writ
 		return nil, nil, err
 	}
 	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("recording: unexpected status: %v", resp.Status)
+		// Stop sending the request body, which would otherwise block closing
+		// the response body.
+		pr.CloseWithError(err)
 		resp.Body.Close()
-		return nil, nil, fmt.Errorf("recording: unexpected status: %v", resp.Status)
+		return nil, nil, err
 	}
 
 	errChan := make(chan error, 1)
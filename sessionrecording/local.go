@@ -0,0 +1,484 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package sessionrecording
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/util/multierr"
+)
+
+const (
+	// ChainFile is the name of the file in a [LocalStore]'s directory that
+	// holds its hash chain, as lines of JSON-encoded [ChainEntry] values.
+	ChainFile = "chain.jsonl"
+
+	// castExt is the extension of recordings in a [LocalStore].
+	castExt = ".cast"
+
+	// partialExt is appended to the name of recordings that are still being
+	// written.
+	partialExt = ".partial"
+)
+
+// Operations recorded in a [ChainEntry].
+const (
+	ChainOpAdd    = "add"    // a recording was stored
+	ChainOpRemove = "remove" // a recording was removed by rotation
+)
+
+// ChainEntry is an entry in the hash chain of a [LocalStore]. Each entry
+// includes the hash of the one before it, so that modifying, removing or
+// reordering entries, or modifying or removing the recordings they describe,
+// is detected by [VerifyLocalStore] unless every later entry is rewritten
+// too. Logging each entry's hash elsewhere as it is added guards against
+// the latter.
+type ChainEntry struct {
+	Seq    int64     `json:"seq"`
+	Time   time.Time `json:"time"`
+	Op     string    `json:"op"`     // ChainOpAdd or ChainOpRemove
+	File   string    `json:"file"`   // base name of the recording
+	Size   int64     `json:"size"`   // size of the recording in bytes
+	SHA256 string    `json:"sha256"` // hex SHA-256 of the recording's contents
+
+	// Source is the authenticated identity of the node that uploaded the
+	// recording, if known. It is only set for ChainOpAdd entries.
+	Source string `json:"source,omitempty"`
+
+	// Prev is the Hash of the previous entry, or empty for the first.
+	Prev string `json:"prev"`
+	// Hash is the hex SHA-256 of the JSON encoding of the entry with an
+	// empty Hash.
+	Hash string `json:"hash"`
+}
+
+// computeHash returns the Hash that ce should have.
+func (ce ChainEntry) computeHash() string {
+	ce.Hash = ""
+	j, err := json.Marshal(ce)
+	if err != nil {
+		panic(err) // can't happen
+	}
+	sum := sha256.Sum256(j)
+	return hex.EncodeToString(sum[:])
+}
+
+// LocalStoreOptions configure the rotation of recordings in a [LocalStore].
+// Zero values mean no limit.
+type LocalStoreOptions struct {
+	// MaxSize is the total size, in bytes, of the recordings to keep. When a
+	// new recording takes the total above it, the oldest recordings are
+	// removed. The newest recording is always kept.
+	MaxSize int64
+
+	// MaxAge is how long to keep recordings for. Recordings older than it
+	// are removed when a new one is added.
+	MaxAge time.Duration
+
+	// Logf, if non-nil, is used to log the recordings stored and removed,
+	// along with the hash of the chain entry recording it.
+	Logf func(format string, args ...any)
+}
+
+// LocalStore stores session recordings as files in a local directory. It
+// keeps a hash chain of the recordings stored and removed, so that tampering
+// with them can be detected by [VerifyLocalStore], and rotates recordings
+// according to its [LocalStoreOptions].
+//
+// It is safe for concurrent use, but only one LocalStore should use a given
+// directory at a time.
+type LocalStore struct {
+	dir string
+	now func() time.Time // for tests
+
+	mu      sync.Mutex
+	opts    LocalStoreOptions
+	chain   *os.File     // opened for appending
+	last    ChainEntry   // last entry of chain; zero if empty
+	live    []ChainEntry // added and not removed, oldest first
+	writing int          // number of recordings being written
+	closed  bool         // Close was called; chain is closed once writing is 0
+}
+
+// OpenLocalStore opens the store of recordings in dir, creating the
+// directory if needed. Recordings left incomplete by a previous process are
+// added to the store as they are.
+func OpenLocalStore(dir string, opts LocalStoreOptions) (*LocalStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &LocalStore{
+		dir:  dir,
+		opts: opts,
+		now:  time.Now,
+	}
+	entries, err := readChain(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, ce := range entries {
+		s.replay(ce)
+	}
+	s.chain, err = os.OpenFile(filepath.Join(dir, ChainFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	partials, err := filepath.Glob(filepath.Join(dir, "*"+castExt+partialExt))
+	if err != nil {
+		s.chain.Close()
+		return nil, err
+	}
+	for _, p := range partials {
+		if err := s.recover(p); err != nil {
+			s.chain.Close()
+			return nil, fmt.Errorf("recovering incomplete recording: %w", err)
+		}
+	}
+	return s, nil
+}
+
+// Dir returns the directory of the store.
+func (s *LocalStore) Dir() string { return s.dir }
+
+// Options returns the current options of the store.
+func (s *LocalStore) Options() LocalStoreOptions {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.opts
+}
+
+// SetOptions changes the options of the store. New rotation limits apply
+// from when the next recording is added.
+func (s *LocalStore) SetOptions(opts LocalStoreOptions) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.opts = opts
+}
+
+// Close closes the store. Recordings that are still being written are
+// added to the store when they are closed, after which the store's chain is
+// closed; those left incomplete by the process exiting are added when the
+// store is opened next.
+func (s *LocalStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return os.ErrClosed
+	}
+	s.closed = true
+	if s.writing > 0 {
+		return nil
+	}
+	return s.chain.Close()
+}
+
+// doneWritingLocked records that a recording is no longer being written,
+// closing the chain if it was the last one after Close. s.mu must be held.
+func (s *LocalStore) doneWritingLocked() {
+	s.writing--
+	if s.closed && s.writing == 0 {
+		s.chain.Close()
+	}
+}
+
+// Create starts a new recording, whose name starts with prefix. The
+// recording is added to the store when the returned WriteCloser is closed.
+func (s *LocalStore) Create(prefix string) (io.WriteCloser, error) {
+	return s.CreateFrom(prefix, "")
+}
+
+// CreateFrom is like Create, but records source, the authenticated identity
+// of the uploader, in the recording's chain entry.
+func (s *LocalStore) CreateFrom(prefix, source string) (io.WriteCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, os.ErrClosed
+	}
+	f, err := os.CreateTemp(s.dir, fmt.Sprintf("%s-%d-*%s%s", prefix, s.now().UnixNano(), castExt, partialExt))
+	if err != nil {
+		return nil, err
+	}
+	s.writing++
+	h := sha256.New()
+	return &localRecording{
+		s:      s,
+		source: source,
+		f:      f,
+		h:      h,
+		w:      io.MultiWriter(f, h),
+	}, nil
+}
+
+// localRecording is a recording being written to a [LocalStore].
+type localRecording struct {
+	s      *LocalStore
+	source string // for ChainEntry.Source
+	f      *os.File
+	h      hash.Hash
+	w      io.Writer // to f and h
+
+	mu     sync.Mutex
+	size   int64
+	closed bool
+}
+
+func (r *localRecording) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return 0, os.ErrClosed
+	}
+	n, err := r.w.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *localRecording) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return os.ErrClosed
+	}
+	r.closed = true
+	err := r.f.Sync()
+	if cerr := r.f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = r.s.add(r.f.Name(), r.size, hex.EncodeToString(r.h.Sum(nil)), r.source)
+	}
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	r.s.doneWritingLocked()
+	return err
+}
+
+// recover adds the incomplete recording at partial to the store.
+func (s *LocalStore) recover(partial string) error {
+	f, err := os.Open(partial)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	return s.add(partial, n, hex.EncodeToString(h.Sum(nil)), "")
+}
+
+// add renames the complete recording at partial, uploaded from source, to
+// its final name, appends it to the chain and then rotates recordings.
+func (s *LocalStore) add(partial string, size int64, sum, source string) error {
+	final := strings.TrimSuffix(partial, partialExt)
+	if err := os.Rename(partial, final); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.appendLocked(ChainOpAdd, filepath.Base(final), size, sum, source); err != nil {
+		return err
+	}
+	return s.rotateLocked()
+}
+
+// rotateLocked removes the oldest recordings, other than the newest one, while
+// they exceed the store's MaxSize or MaxAge. s.mu must be held.
+func (s *LocalStore) rotateLocked() error {
+	var total int64
+	for _, ce := range s.live {
+		total += ce.Size
+	}
+	now := s.now()
+	for len(s.live) > 1 {
+		oldest := s.live[0]
+		tooBig := s.opts.MaxSize > 0 && total > s.opts.MaxSize
+		tooOld := s.opts.MaxAge > 0 && now.Sub(oldest.Time) > s.opts.MaxAge
+		if !tooBig && !tooOld {
+			break
+		}
+		if err := os.Remove(filepath.Join(s.dir, oldest.File)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if err := s.appendLocked(ChainOpRemove, oldest.File, oldest.Size, oldest.SHA256, ""); err != nil {
+			return err
+		}
+		total -= oldest.Size
+	}
+	return nil
+}
+
+// appendLocked appends an entry to the chain. s.mu must be held.
+func (s *LocalStore) appendLocked(op, file string, size int64, sum, source string) error {
+	ce := ChainEntry{
+		Seq:    s.last.Seq + 1,
+		Time:   s.now().UTC().Round(0),
+		Op:     op,
+		File:   file,
+		Size:   size,
+		SHA256: sum,
+		Source: source,
+		Prev:   s.last.Hash,
+	}
+	ce.Hash = ce.computeHash()
+	j, err := json.Marshal(ce)
+	if err != nil {
+		return err
+	}
+	if _, err := s.chain.Write(append(j, '\n')); err != nil {
+		return err
+	}
+	if err := s.chain.Sync(); err != nil {
+		return err
+	}
+	s.replay(ce)
+	if s.opts.Logf != nil {
+		if source != "" {
+			s.opts.Logf("recording: %s %s from %s (%d bytes, sha256 %s); chain entry %d hash %s", op, file, source, size, sum, ce.Seq, ce.Hash)
+		} else {
+			s.opts.Logf("recording: %s %s (%d bytes, sha256 %s); chain entry %d hash %s", op, file, size, sum, ce.Seq, ce.Hash)
+		}
+	}
+	return nil
+}
+
+// replay updates the in-memory state of the store for ce, the next entry of
+// its chain.
+func (s *LocalStore) replay(ce ChainEntry) {
+	s.last = ce
+	switch ce.Op {
+	case ChainOpAdd:
+		s.live = append(s.live, ce)
+	case ChainOpRemove:
+		for i, l := range s.live {
+			if l.File == ce.File {
+				s.live = append(s.live[:i], s.live[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// readChain reads the chain of the store in dir, which may not exist yet.
+func readChain(dir string) ([]ChainEntry, error) {
+	f, err := os.Open(filepath.Join(dir, ChainFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []ChainEntry
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var ce ChainEntry
+		if err := json.Unmarshal(sc.Bytes(), &ce); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", ChainFile, line, err)
+		}
+		entries = append(entries, ce)
+	}
+	return entries, sc.Err()
+}
+
+// VerifyLocalStore checks the recordings in dir, as written by a
+// [LocalStore], against its hash chain. It returns an error describing every
+// problem found: entries that do not link up, recordings that are missing or
+// whose contents do not match the chain, and recordings the chain does not
+// know about. Recordings that are still being written are ignored.
+//
+// The returned entries are those of the chain, which can be used to check
+// the hash of its last entry against one recorded elsewhere.
+func VerifyLocalStore(dir string) ([]ChainEntry, error) {
+	entries, err := readChain(dir)
+	if err != nil {
+		return nil, err
+	}
+	var problems []error
+	live := map[string]ChainEntry{}
+	var prev ChainEntry
+	for _, ce := range entries {
+		if ce.Seq != prev.Seq+1 || ce.Prev != prev.Hash {
+			problems = append(problems, fmt.Errorf("entry %d does not follow entry %d", ce.Seq, prev.Seq))
+		}
+		if ce.Hash != ce.computeHash() {
+			problems = append(problems, fmt.Errorf("entry %d has been modified", ce.Seq))
+		}
+		switch ce.Op {
+		case ChainOpAdd:
+			live[ce.File] = ce
+		case ChainOpRemove:
+			delete(live, ce.File)
+		default:
+			problems = append(problems, fmt.Errorf("entry %d has unknown op %q", ce.Seq, ce.Op))
+		}
+		prev = ce
+	}
+
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	onDisk := map[string]bool{}
+	for _, de := range des {
+		if name := de.Name(); strings.HasSuffix(name, castExt) {
+			onDisk[name] = true
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(live)) {
+		ce := live[name]
+		if !onDisk[name] {
+			problems = append(problems, fmt.Errorf("%s (entry %d) is missing", name, ce.Seq))
+			continue
+		}
+		size, sum, err := hashFile(filepath.Join(dir, name))
+		if err != nil {
+			problems = append(problems, err)
+		} else if size != ce.Size || sum != ce.SHA256 {
+			problems = append(problems, fmt.Errorf("%s (entry %d) has been modified", name, ce.Seq))
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(onDisk)) {
+		if _, ok := live[name]; !ok {
+			problems = append(problems, fmt.Errorf("%s is not in the chain", name))
+		}
+	}
+	return entries, multierr.New(problems...)
+}
+
+// hashFile returns the size and hex SHA-256 of the file at path.
+func hashFile(path string) (size int64, sum string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err = io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
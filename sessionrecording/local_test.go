@@ -0,0 +1,226 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package sessionrecording
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeRecording(t *testing.T, s *LocalStore, contents string) string {
+	t.Helper()
+	w, err := s.Create("ssh-session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(contents)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSuffix(filepath.Base(w.(*localRecording).f.Name()), partialExt)
+}
+
+func liveFiles(s *LocalStore) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var files []string
+	for _, ce := range s.live {
+		files = append(files, ce.File)
+	}
+	return files
+}
+
+func mustVerify(t *testing.T, dir string) []ChainEntry {
+	t.Helper()
+	entries, err := VerifyLocalStore(dir)
+	if err != nil {
+		t.Fatalf("VerifyLocalStore: %v", err)
+	}
+	return entries
+}
+
+func TestLocalStoreRotation(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenLocalStore(dir, LocalStoreOptions{MaxSize: 25, MaxAge: time.Hour, Logf: t.Logf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	a := writeRecording(t, s, "0123456789")
+	b := writeRecording(t, s, "0123456789")
+	if got := liveFiles(s); len(got) != 2 {
+		t.Fatalf("live = %q, want 2 recordings", got)
+	}
+	// A third recording takes the total above MaxSize.
+	c := writeRecording(t, s, "0123456789")
+	if got := liveFiles(s); len(got) != 2 || got[0] != b || got[1] != c {
+		t.Fatalf("live = %q, want [%q %q]", got, b, c)
+	}
+	if _, err := os.Stat(filepath.Join(dir, a)); !os.IsNotExist(err) {
+		t.Errorf("rotated recording still exists: %v", err)
+	}
+	// Recordings older than MaxAge are removed, but the newest one is kept
+	// even if it exceeds MaxSize.
+	now = now.Add(2 * time.Hour)
+	d := writeRecording(t, s, strings.Repeat("x", 30))
+	if got := liveFiles(s); len(got) != 1 || got[0] != d {
+		t.Fatalf("live = %q, want [%q]", got, d)
+	}
+
+	entries := mustVerify(t, dir)
+	var ops []string
+	for _, ce := range entries {
+		ops = append(ops, ce.Op)
+	}
+	if got, want := strings.Join(ops, " "), "add add add remove add remove remove"; got != want {
+		t.Errorf("ops = %q, want %q", got, want)
+	}
+}
+
+func TestLocalStoreReopen(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenLocalStore(dir, LocalStoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := writeRecording(t, s, "complete\n")
+	w, err := s.Create("ssh-session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("incomplete\n")); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// The incomplete recording is added to the chain when the store is
+	// reopened, continuing the existing chain.
+	s, err = OpenLocalStore(dir, LocalStoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if got := liveFiles(s); len(got) != 2 || got[0] != a {
+		t.Fatalf("live = %q, want %q and the incomplete recording", got, a)
+	}
+	entries := mustVerify(t, dir)
+	if len(entries) != 2 || entries[1].Size != int64(len("incomplete\n")) {
+		t.Errorf("entries = %+v", entries)
+	}
+}
+
+func TestLocalStoreCloseWhileWriting(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenLocalStore(dir, LocalStoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := s.CreateFrom("ssh-session", "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Create("ssh-session"); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Create after Close: err = %v, want %v", err, os.ErrClosed)
+	}
+
+	// The recording in progress is still added to the chain.
+	if _, err := w.Write([]byte("late\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	entries := mustVerify(t, dir)
+	if len(entries) != 1 || entries[0].Size != int64(len("late\n")) || entries[0].Source != "laptop" {
+		t.Errorf("entries = %+v", entries)
+	}
+}
+
+func TestVerifyLocalStore(t *testing.T) {
+	tests := []struct {
+		name    string
+		tamper  func(t *testing.T, dir string, files []string)
+		wantErr string
+	}{
+		{
+			name: "modified-recording",
+			tamper: func(t *testing.T, dir string, files []string) {
+				os.WriteFile(filepath.Join(dir, files[0]), []byte("something else"), 0600)
+			},
+			wantErr: "has been modified",
+		},
+		{
+			name: "removed-recording",
+			tamper: func(t *testing.T, dir string, files []string) {
+				os.Remove(filepath.Join(dir, files[1]))
+			},
+			wantErr: "is missing",
+		},
+		{
+			name: "added-recording",
+			tamper: func(t *testing.T, dir string, files []string) {
+				os.WriteFile(filepath.Join(dir, "ssh-session-1-1.cast"), []byte("{}\n"), 0600)
+			},
+			wantErr: "is not in the chain",
+		},
+		{
+			name: "removed-entry",
+			tamper: func(t *testing.T, dir string, files []string) {
+				path := filepath.Join(dir, ChainFile)
+				b, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				lines := bytes.SplitAfter(b, []byte("\n"))
+				os.WriteFile(path, bytes.Join(lines[1:], nil), 0600)
+			},
+			wantErr: "does not follow",
+		},
+		{
+			name: "modified-entry",
+			tamper: func(t *testing.T, dir string, files []string) {
+				path := filepath.Join(dir, ChainFile)
+				b, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				os.WriteFile(path, bytes.Replace(b, []byte(`"size":6`), []byte(`"size":7`), 1), 0600)
+			},
+			wantErr: "entry 1 has been modified",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s, err := OpenLocalStore(dir, LocalStoreOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			files := []string{
+				writeRecording(t, s, "first\n"),
+				writeRecording(t, s, "second\n"),
+			}
+			mustVerify(t, dir)
+			tt.tamper(t, dir, files)
+			_, err = VerifyLocalStore(dir)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("VerifyLocalStore = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
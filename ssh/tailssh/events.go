@@ -0,0 +1,74 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tailssh
+
+import (
+	"net/netip"
+	"time"
+
+	"tailscale.com/tailcfg"
+)
+
+// Kinds of port forwarding, as in [PortForwardEvent.Kind].
+const (
+	PortForwardLocal  = "local"  // a connection dialed by the server for the client
+	PortForwardRemote = "remote" // a connection accepted by the server for the client
+)
+
+// Port forwarding audit events, as in [PortForwardEvent.Event].
+const (
+	PortForwardOpened = "open"  // a forwarded connection was established
+	PortForwardClosed = "close" // a forwarded connection was closed
+	PortForwardDenied = "deny"  // a port forwarding request was denied
+)
+
+// PortForwardEvent is an audit event published on the event bus, and
+// written to the recordings of the connection's recorded sessions, when a
+// connection forwarded over a Tailscale SSH connection is opened or closed,
+// or when the SSH policy denies a request to forward one.
+type PortForwardEvent struct {
+	// Event is what happened: PortForwardOpened, PortForwardClosed or
+	// PortForwardDenied.
+	Event string `json:"event"`
+	// ConnID is the ID of the SSH connection, as shared with control.
+	ConnID string `json:"connID"`
+	// Kind is the kind of port forwarding, PortForwardLocal or
+	// PortForwardRemote.
+	Kind string `json:"kind"`
+
+	// SrcNode is the node the SSH connection came from.
+	SrcNode tailcfg.StableNodeID `json:"srcNode"`
+	// SrcNodeName is the name of SrcNode.
+	SrcNodeName string `json:"srcNodeName,omitempty"`
+	// SrcAddr is the Tailscale IP and port the SSH connection came from.
+	SrcAddr netip.AddrPort `json:"srcAddr"`
+	// SrcUser is the login name of the user owning SrcNode, if not tagged.
+	SrcUser string `json:"srcUser,omitempty"`
+	// LocalUser is the local user the SSH connection is logged in as.
+	LocalUser string `json:"localUser"`
+
+	// Destination is the "host:port" address forwarded to: the address
+	// dialed for local port forwarding, or the address listened on for
+	// remote port forwarding.
+	Destination string `json:"destination"`
+	// Origin is the "host:port" address at the other end: the originator
+	// of the connection as reported by the client for local port
+	// forwarding, or the remote address of the accepted connection for
+	// remote port forwarding. It is empty for PortForwardDenied events.
+	Origin string `json:"origin,omitempty"`
+
+	// BytesFromClient is the number of bytes forwarded from the SSH client
+	// to the other end of the connection, as of a PortForwardClosed event.
+	BytesFromClient int64 `json:"bytesFromClient"`
+	// BytesToClient is the number of bytes forwarded to the SSH client, as
+	// of a PortForwardClosed event.
+	BytesToClient int64 `json:"bytesToClient"`
+
+	// Start is when the forwarded connection was established, or when the
+	// request was denied.
+	Start time.Time `json:"start"`
+	// Duration is how long the forwarded connection was open, as of a
+	// PortForwardClosed event.
+	Duration time.Duration `json:"duration"`
+}
@@ -0,0 +1,287 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build (linux && !android) || (darwin && !ios) || freebsd || openbsd || plan9
+
+package tailssh
+
+import (
+	"encoding/json"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/tempfork/gliderlabs/ssh"
+	"tailscale.com/util/mak"
+)
+
+// forwardDestAllowed reports whether patterns, the port forwarding
+// destination allowlist of an SSHAction, permit forwarding to host and port.
+// An empty allowlist permits any destination.
+func forwardDestAllowed(patterns []string, host string, port uint32) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(patterns, func(p string) bool {
+		return matchForwardDest(p, host, port)
+	})
+}
+
+// matchForwardDest reports whether host and port match pattern, a
+// "host:port" pattern as documented on
+// tailcfg.SSHAction.LocalPortForwardingDestinations. Invalid patterns match
+// nothing.
+func matchForwardDest(pattern, host string, port uint32) bool {
+	ph, pp, err := net.SplitHostPort(pattern)
+	if err != nil {
+		return false
+	}
+	return matchForwardHost(ph, host) && matchForwardPort(pp, port)
+}
+
+func matchForwardHost(pattern, host string) bool {
+	if pattern == "*" {
+		return true
+	}
+	if strings.Contains(pattern, "/") {
+		pfx, err := netip.ParsePrefix(pattern)
+		if err != nil {
+			return false
+		}
+		ip, err := netip.ParseAddr(host)
+		return err == nil && pfx.Contains(ip.Unmap())
+	}
+	if pip, err := netip.ParseAddr(pattern); err == nil {
+		ip, err := netip.ParseAddr(host)
+		return err == nil && ip.Unmap() == pip.Unmap()
+	}
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(host, "."+suffix)
+	}
+	return host == pattern
+}
+
+func matchForwardPort(pattern string, port uint32) bool {
+	if pattern == "*" {
+		return true
+	}
+	lo, hi, ok := strings.Cut(pattern, "-")
+	if !ok {
+		hi = lo
+	}
+	l, err := strconv.ParseUint(lo, 10, 16)
+	if err != nil {
+		return false
+	}
+	h, err := strconv.ParseUint(hi, 10, 16)
+	if err != nil {
+		return false
+	}
+	return uint64(port) >= l && uint64(port) <= h
+}
+
+// forwardAllowed reports whether action a allows port forwarding of kind,
+// PortForwardLocal or PortForwardRemote, to host and port.
+func forwardAllowed(a *tailcfg.SSHAction, kind, host string, port uint32) bool {
+	if a == nil {
+		return false
+	}
+	allow, patterns := a.AllowLocalPortForwarding, a.LocalPortForwardingDestinations
+	if kind == PortForwardRemote {
+		allow, patterns = a.AllowRemotePortForwarding, a.RemotePortForwardingDestinations
+	}
+	if !allow {
+		return false
+	}
+	return forwardDestAllowed(patterns, host, port)
+}
+
+// forwardingAction returns the action whose port forwarding settings apply
+// to c: the latest one the SSH policy evaluated to, or else finalAction.
+func (c *conn) forwardingAction() *tailcfg.SSHAction {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.fwdAction != nil {
+		return c.fwdAction
+	}
+	return c.finalAction
+}
+
+// mayForward reports whether port forwarding of kind to host and port is
+// allowed, reporting a PortForwardDenied event if not.
+func (c *conn) mayForward(kind, host string, port uint32) bool {
+	if forwardAllowed(c.forwardingAction(), kind, host, port) {
+		return true
+	}
+	metricPortForwardDenied.Add(1)
+	dest := net.JoinHostPort(host, strconv.FormatUint(uint64(port), 10))
+	c.reportPortForward(c.newPortForwardEvent(PortForwardDenied, kind, dest, ""))
+	return false
+}
+
+// newPortForwardEvent returns a PortForwardEvent for c, starting now.
+func (c *conn) newPortForwardEvent(event, kind, destination, origin string) PortForwardEvent {
+	ev := PortForwardEvent{
+		Event:       event,
+		ConnID:      c.connID,
+		Kind:        kind,
+		Destination: destination,
+		Origin:      origin,
+		Start:       c.srv.now(),
+	}
+	if ci := c.info; ci != nil {
+		ev.SrcAddr = ci.src
+		if ci.node.Valid() {
+			ev.SrcNode = ci.node.StableID()
+			ev.SrcNodeName = ci.node.Name()
+			if !ci.node.IsTagged() {
+				ev.SrcUser = ci.uprof.LoginName
+			}
+		}
+	}
+	if c.localUser != nil {
+		ev.LocalUser = c.localUser.Username
+	}
+	return ev
+}
+
+// auditForwardedConn implements ssh.PortForwardingConnCallback. It reports
+// a PortForwardOpened event for nc, and wraps it to track it while it is
+// open and report a PortForwardClosed event when it is closed.
+func (c *conn) auditForwardedConn(ctx ssh.Context, reverse bool, destination, origin string, nc net.Conn) net.Conn {
+	kind := PortForwardLocal
+	if reverse {
+		kind = PortForwardRemote
+	}
+	ev := c.newPortForwardEvent(PortForwardOpened, kind, destination, origin)
+	ac := &auditedConn{Conn: nc, kind: kind}
+	host, port, err := net.SplitHostPort(destination)
+	if err == nil {
+		ac.host = host
+		if p, err := strconv.ParseUint(port, 10, 16); err == nil {
+			ac.port = uint32(p)
+		}
+	}
+	ac.done = func(fromClient, toClient int64) {
+		c.mu.Lock()
+		delete(c.forwards, ac)
+		c.mu.Unlock()
+		ev.Event = PortForwardClosed
+		ev.BytesFromClient = fromClient
+		ev.BytesToClient = toClient
+		ev.Duration = c.srv.now().Sub(ev.Start)
+		c.reportPortForward(ev)
+	}
+	c.mu.Lock()
+	mak.Set(&c.forwards, ac, true)
+	c.mu.Unlock()
+	c.reportPortForward(ev)
+	return ac
+}
+
+// setForwardingAction makes the port forwarding settings of a, the action
+// the SSH policy now evaluates to for c, apply to it. Open forwards that a
+// no longer allows are closed.
+func (c *conn) setForwardingAction(a *tailcfg.SSHAction) {
+	c.mu.Lock()
+	c.fwdAction = a
+	var closing []*auditedConn
+	for ac := range c.forwards {
+		if !forwardAllowed(a, ac.kind, ac.host, ac.port) {
+			closing = append(closing, ac)
+		}
+	}
+	c.mu.Unlock()
+	for _, ac := range closing {
+		c.logf("closing %s port forward to %s no longer allowed by SSH policy", ac.kind, net.JoinHostPort(ac.host, strconv.FormatUint(uint64(ac.port), 10)))
+		ac.Close()
+	}
+	c.fwdHandler.CloseForwardsFunc(func(host string, port uint32) bool {
+		if forwardAllowed(a, PortForwardRemote, host, port) {
+			return false
+		}
+		c.logf("stopping remote port forward from %s no longer allowed by SSH policy", net.JoinHostPort(host, strconv.FormatUint(uint64(port), 10)))
+		return true
+	})
+}
+
+// reportPortForward logs ev and publishes it on the event bus, and writes it
+// to the recordings of c's recorded sessions.
+func (c *conn) reportPortForward(ev PortForwardEvent) {
+	switch ev.Event {
+	case PortForwardOpened:
+		c.logf("%s port forward %s -> %s opened", ev.Kind, ev.Origin, ev.Destination)
+	case PortForwardClosed:
+		c.logf("%s port forward %s -> %s closed after %v: %d bytes from client, %d bytes to client",
+			ev.Kind, ev.Origin, ev.Destination, ev.Duration.Round(time.Millisecond), ev.BytesFromClient, ev.BytesToClient)
+	case PortForwardDenied:
+		c.logf("denied %s port forwarding to %s", ev.Kind, ev.Destination)
+	}
+	if pub := c.srv.portForwardPub; pub != nil {
+		pub.Publish(ev)
+	}
+	c.mu.Lock()
+	var recs []*recording
+	for _, ss := range c.sessions {
+		if ss.rec != nil {
+			recs = append(recs, ss.rec)
+		}
+	}
+	c.mu.Unlock()
+	if len(recs) == 0 {
+		return
+	}
+	j, err := json.Marshal(ev)
+	if err != nil {
+		c.logf("marshaling port forward event: %v", err)
+		return
+	}
+	for _, rec := range recs {
+		if err := rec.writeMarker(string(j)); err != nil {
+			c.vlogf("recording port forward event: %v", err)
+		}
+	}
+}
+
+// auditedConn is a forwarded connection that counts the bytes forwarded
+// over it, and calls done with the counts when it is first closed.
+type auditedConn struct {
+	net.Conn
+	kind string // PortForwardLocal or PortForwardRemote
+	host string // host of the forwarded destination
+	port uint32 // port of the forwarded destination
+
+	read, written atomic.Int64
+	closeOnce     sync.Once
+	done          func(fromClient, toClient int64)
+}
+
+func (ac *auditedConn) Read(p []byte) (int, error) {
+	n, err := ac.Conn.Read(p)
+	ac.read.Add(int64(n))
+	return n, err
+}
+
+func (ac *auditedConn) Write(p []byte) (int, error) {
+	n, err := ac.Conn.Write(p)
+	ac.written.Add(int64(n))
+	return n, err
+}
+
+func (ac *auditedConn) Close() error {
+	err := ac.Conn.Close()
+	ac.closeOnce.Do(func() {
+		// Bytes written to the connection came from the client, whichever
+		// end of it dialed the other.
+		ac.done(ac.written.Load(), ac.read.Load())
+	})
+	return err
+}
@@ -0,0 +1,210 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux || darwin
+
+package tailssh
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"runtime"
+	"testing"
+	"time"
+
+	"tailscale.com/net/memnet"
+	"tailscale.com/tailcfg"
+	testssh "tailscale.com/tempfork/sshtest/ssh"
+	"tailscale.com/tstest"
+	"tailscale.com/util/eventbus"
+	"tailscale.com/util/eventbus/eventbustest"
+	"tailscale.com/util/must"
+)
+
+func TestForwardDestAllowed(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		host     string
+		port     uint32
+		want     bool
+	}{
+		{nil, "example.com", 22, true},
+		{[]string{"*:*"}, "example.com", 22, true},
+		{[]string{"localhost:5432"}, "localhost", 5432, true},
+		{[]string{"localhost:5432"}, "LOCALHOST.", 5432, true},
+		{[]string{"localhost:5432"}, "localhost", 5433, false},
+		{[]string{"10.0.0.0/8:*"}, "10.1.2.3", 80, true},
+		{[]string{"10.0.0.0/8:*"}, "::ffff:10.1.2.3", 80, true},
+		{[]string{"10.0.0.0/8:*"}, "11.1.2.3", 80, false},
+		{[]string{"10.0.0.0/8:*"}, "ten.example.com", 80, false},
+		{[]string{"127.0.0.1:22"}, "127.0.0.1", 22, true},
+		{[]string{"127.0.0.1:22"}, "localhost", 22, false},
+		{[]string{"[::1]:22"}, "::1", 22, true},
+		{[]string{"*.example.com:443"}, "db.example.com", 443, true},
+		{[]string{"*.example.com:443"}, "example.com", 443, false},
+		{[]string{"*.example.com:443"}, "db.example.com", 80, false},
+		{[]string{"*:8000-8999"}, "db", 8000, true},
+		{[]string{"*:8000-8999"}, "db", 8999, true},
+		{[]string{"*:8000-8999"}, "db", 9000, false},
+		{[]string{"example.com"}, "example.com", 22, false},
+		{[]string{"*:ssh"}, "example.com", 22, false},
+		{[]string{"*:70000"}, "example.com", 4464, false},
+		{[]string{"*:1-x", "example.com:22"}, "example.com", 22, true},
+	}
+	for _, tt := range tests {
+		if got := forwardDestAllowed(tt.patterns, tt.host, tt.port); got != tt.want {
+			t.Errorf("forwardDestAllowed(%q, %q, %d) = %v, want %v", tt.patterns, tt.host, tt.port, got, tt.want)
+		}
+	}
+}
+
+// startEchoServer starts a TCP echo server, returning its address.
+func startEchoServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// dialTestServer starts handling an SSH connection to s, and returns a
+// client for it. The connection is closed when the test ends.
+func dialTestServer(t *testing.T, s *server) *testssh.Client {
+	t.Helper()
+	src, dst := must.Get(netip.ParseAddrPort("100.100.100.101:2231")), must.Get(netip.ParseAddrPort("100.100.100.102:22"))
+	sc, dc := memnet.NewTCPConn(src, dst, 1024)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := s.HandleSSHConn(dc); err != nil {
+			t.Errorf("HandleSSHConn: %v", err)
+		}
+	}()
+	c, chans, reqs, err := testssh.NewClientConn(sc, sc.RemoteAddr().String(), &testssh.ClientConfig{
+		User:            "alice",
+		HostKeyCallback: testssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := testssh.NewClient(c, chans, reqs)
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+	return client
+}
+
+// TestSSHLocalPortForwarding tests that local port forwarding is limited to
+// the destinations allowed by the SSH policy, that forwarded connections
+// and denied requests are reported on the event bus, and that forwards the
+// policy no longer allows are closed when it changes.
+func TestSSHLocalPortForwarding(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skipf("skipping on %q; only runs on linux and darwin", runtime.GOOS)
+	}
+	allowed := startEchoServer(t)
+	other := startEchoServer(t)
+
+	bus := eventbustest.NewBus(t)
+	lb := &localState{
+		sshEnabled: true,
+		matchingRule: newSSHRule(&tailcfg.SSHAction{
+			Accept:                          true,
+			AllowLocalPortForwarding:        true,
+			LocalPortForwardingDestinations: []string{allowed},
+		}),
+	}
+	s := &server{
+		logf:        tstest.WhileTestRunningLogger(t),
+		lb:          lb,
+		eventClient: bus.Client("tailssh"),
+	}
+	s.portForwardPub = eventbus.Publish[PortForwardEvent](s.eventClient)
+	defer s.Shutdown()
+	sub := eventbus.Subscribe[PortForwardEvent](bus.Client("test"))
+	nextEvent := func(want, dest string) PortForwardEvent {
+		t.Helper()
+		select {
+		case ev := <-sub.Events():
+			if ev.Event != want || ev.Kind != PortForwardLocal || ev.Destination != dest || ev.LocalUser != currentUser {
+				t.Fatalf("event = %+v, want %s of local forward to %s as %s", ev, want, dest, currentUser)
+			}
+			if ev.SrcAddr.Addr() != netip.MustParseAddr("100.100.100.101") {
+				t.Errorf("event SrcAddr = %v, want 100.100.100.101", ev.SrcAddr)
+			}
+			return ev
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for %s PortForwardEvent", want)
+		}
+		panic("unreachable")
+	}
+
+	client := dialTestServer(t, s)
+	if fc, err := client.Dial("tcp", other); err == nil {
+		fc.Close()
+		t.Errorf("forwarding to %s succeeded, want denied", other)
+	}
+	nextEvent(PortForwardDenied, other)
+
+	fc, err := client.Dial("tcp", allowed)
+	if err != nil {
+		t.Fatalf("forwarding to %s: %v", allowed, err)
+	}
+	nextEvent(PortForwardOpened, allowed)
+	const msg = "hello, world"
+	if _, err := io.WriteString(fc, msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(fc, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Errorf("echoed %q, want %q", buf, msg)
+	}
+	fc.Close()
+	ev := nextEvent(PortForwardClosed, allowed)
+	if ev.BytesFromClient != int64(len(msg)) || ev.BytesToClient != int64(len(msg)) {
+		t.Errorf("event bytes = %d from client, %d to client; want %d each", ev.BytesFromClient, ev.BytesToClient, len(msg))
+	}
+
+	// Changing the policy to no longer allow the destination closes the
+	// open forward, and denies new ones.
+	fc, err = client.Dial("tcp", allowed)
+	if err != nil {
+		t.Fatalf("forwarding to %s: %v", allowed, err)
+	}
+	defer fc.Close()
+	nextEvent(PortForwardOpened, allowed)
+	lb.matchingRule = newSSHRule(&tailcfg.SSHAction{
+		Accept:                          true,
+		AllowLocalPortForwarding:        true,
+		LocalPortForwardingDestinations: []string{other},
+	})
+	s.OnPolicyChange()
+	nextEvent(PortForwardClosed, allowed)
+	if _, err := fc.Read(buf); err == nil {
+		t.Error("read from forward closed by policy change succeeded")
+	}
+	if fc, err := client.Dial("tcp", allowed); err == nil {
+		fc.Close()
+		t.Errorf("forwarding to %s after policy change succeeded, want denied", allowed)
+	}
+	nextEvent(PortForwardDenied, allowed)
+}
@@ -14,6 +14,7 @@
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"net/http"
 	"net/netip"
@@ -42,8 +43,10 @@
 	"tailscale.com/types/logger"
 	"tailscale.com/types/netmap"
 	"tailscale.com/util/clientmetric"
+	"tailscale.com/util/eventbus"
 	"tailscale.com/util/httpm"
 	"tailscale.com/util/mak"
+	"tailscale.com/util/syspolicy"
 )
 
 var (
@@ -91,6 +94,15 @@ type server struct {
 	mu             sync.Mutex
 	activeConns    map[*conn]bool // set; value is always true
 	shutdownCalled bool
+
+	// recStoreMu protects recStore.
+	recStoreMu sync.Mutex
+	// recStore is the local store of recordings for sessions whose SSH
+	// policy does not specify recorders, or nil if none has been opened.
+	recStore *sessionrecording.LocalStore
+
+	eventClient    *eventbus.Client                      // or nil if there is no event bus
+	portForwardPub *eventbus.Publisher[PortForwardEvent] // or nil if there is no event bus
 }
 
 func (srv *server) now() time.Time {
@@ -114,6 +126,10 @@ func init() {
 				return lb.ControlNow(time.Now())
 			},
 		}
+		if bus, ok := lb.Sys().Bus.GetOK(); ok {
+			srv.eventClient = bus.Client("tailssh")
+			srv.portForwardPub = eventbus.Publish[PortForwardEvent](srv.eventClient)
+		}
 
 		return srv, nil
 	})
@@ -179,6 +195,16 @@ func (srv *server) Shutdown() {
 	}
 	srv.mu.Unlock()
 	srv.sessionWaitGroup.Wait()
+	if srv.eventClient != nil {
+		srv.eventClient.Close()
+	}
+
+	srv.recStoreMu.Lock()
+	defer srv.recStoreMu.Unlock()
+	if srv.recStore != nil {
+		srv.recStore.Close()
+		srv.recStore = nil
+	}
 }
 
 // OnPolicyChange terminates any active sessions that no longer match
@@ -208,6 +234,8 @@ func (srv *server) OnPolicyChange() {
 // Do the user auth with a NoClientAuthCallback. If user specified
 // a username ending in "+password", follow this with password auth
 // (to work around buggy SSH clients that don't work with noauth).
+// If the SSHUserCA policy settings require OpenSSH user certificates,
+// do it with a PublicKeyCallback instead.
 //
 // Once auth is done, the conn can be multiplexed with multiple sessions and
 // channels concurrently. At which point any of the following can be called
@@ -234,6 +262,9 @@ type conn struct {
 	action0     *tailcfg.SSHAction // set by clientAuth
 	finalAction *tailcfg.SSHAction // set by clientAuth
 
+	userCA   *userCAConfig      // set by ServerConfig; nil if user certificates are not accepted
+	userCert *gossh.Certificate // set by authenticated, if the client authenticated with a user certificate
+
 	info         *sshConnInfo // set by setInfo
 	localUser    *userMeta    // set by clientAuth
 	userGroupIDs []string     // set by clientAuth
@@ -246,6 +277,13 @@ type conn struct {
 	// acquire mu and then srv.mu.
 	mu       sync.Mutex // protects the following
 	sessions []*sshSession
+	// fwdAction is the latest action the SSH policy evaluated to for the
+	// conn, whose port forwarding settings apply in place of finalAction's;
+	// nil if the policy has not changed since auth.
+	fwdAction *tailcfg.SSHAction
+	forwards  map[*auditedConn]bool // open forwarded connections; value is always true
+
+	fwdHandler *ssh.ForwardedTCPHandler // handles remote port forwarding requests
 }
 
 func (c *conn) logf(format string, args ...any) {
@@ -298,11 +336,14 @@ func (c *conn) errUnexpected(err error) error {
 
 // clientAuth is responsible for performing client authentication.
 //
+// If cert is non-nil, it is the trusted user certificate the client offered,
+// which must also permit logging in as the local user.
+//
 // If policy evaluation fails, it returns an error.
 // If access is denied, it returns an error. This must always be an empty
 // gossh.PartialSuccessError to prevent further authentication methods from
 // being tried.
-func (c *conn) clientAuth(cm gossh.ConnMetadata) (perms *gossh.Permissions, retErr error) {
+func (c *conn) clientAuth(cm gossh.ConnMetadata, cert *gossh.Certificate) (perms *gossh.Permissions, retErr error) {
 	defer func() {
 		if pse, ok := retErr.(*gossh.PartialSuccessError); ok {
 			if pse.Next.GSSAPIWithMICConfig != nil ||
@@ -336,6 +377,10 @@ func (c *conn) clientAuth(cm gossh.ConnMetadata) (perms *gossh.Permissions, retE
 		return nil, c.errBanner("failed to evaluate tailnet policy", fmt.Errorf("failed to evaluate policy, result: %s", result))
 	}
 
+	if cert != nil && !action.Reject && c.userCA.principalFor(cert, localUser) == "" {
+		return nil, c.errBanner(fmt.Sprintf("certificate does not permit you to SSH as user %q", localUser), nil)
+	}
+
 	c.action0 = action
 
 	if action.Accept || action.HoldAndDelegate != "" {
@@ -399,16 +444,20 @@ func (c *conn) clientAuth(cm gossh.ConnMetadata) (perms *gossh.Permissions, retE
 
 // ServerConfig implements ssh.ServerConfigCallback.
 func (c *conn) ServerConfig(ctx ssh.Context) *gossh.ServerConfig {
+	c.userCA = c.srv.userCAConfig()
 	return &gossh.ServerConfig{
 		PreAuthConnCallback: func(spac gossh.ServerPreAuthConn) {
 			c.spac = spac
 		},
 		NoClientAuth: true, // required for the NoClientAuthCallback to run
 		NoClientAuthCallback: func(cm gossh.ConnMetadata) (*gossh.Permissions, error) {
+			if c.userCA != nil && c.userCA.required {
+				return nil, errUserCertRequired
+			}
 			// First perform client authentication, which can potentially
 			// involve multiple steps (for example prompting user to log in to
 			// Tailscale admin panel to confirm identity).
-			perms, err := c.clientAuth(cm)
+			perms, err := c.clientAuth(cm, nil)
 			if err != nil {
 				return nil, err
 			}
@@ -434,14 +483,20 @@ func (c *conn) ServerConfig(ctx ssh.Context) *gossh.ServerConfig {
 			// immediately supply a password. We humor them by accepting the
 			// password, but authenticate as usual, ignoring the actual value of
 			// the password.
-			return c.clientAuth(cm)
+			if c.userCA != nil && c.userCA.required {
+				return nil, errUserCertRequired
+			}
+			return c.clientAuth(cm, nil)
 		},
 		PublicKeyCallback: func(cm gossh.ConnMetadata, key gossh.PublicKey) (*gossh.Permissions, error) {
 			// Some clients don't request 'none' authentication. Instead, they
 			// immediately supply a public key. We humor them by accepting the
 			// key, but authenticate as usual, ignoring the actual content of
-			// the key.
-			return c.clientAuth(cm)
+			// the key, unless it is a user certificate to check.
+			if c.userCA != nil {
+				return c.certAuth(cm, key)
+			}
+			return c.clientAuth(cm, nil)
 		},
 	}
 }
@@ -456,17 +511,19 @@ func (srv *server) newConn() (*conn, error) {
 		return nil, errors.New("server is shutting down")
 	}
 	srv.mu.Unlock()
-	c := &conn{srv: srv}
+	c := &conn{srv: srv, fwdHandler: &ssh.ForwardedTCPHandler{}}
 	now := srv.now()
 	c.connID = fmt.Sprintf("ssh-conn-%s-%02x", now.UTC().Format("20060102T150405"), randBytes(5))
-	fwdHandler := &ssh.ForwardedTCPHandler{}
+	fwdHandler := c.fwdHandler
 	c.Server = &ssh.Server{
-		Version:              "Tailscale",
-		ServerConfigCallback: c.ServerConfig,
+		Version:               "Tailscale",
+		ServerConfigCallback:  c.ServerConfig,
+		AuthenticatedCallback: c.authenticated,
 
 		Handler:                       c.handleSessionPostSSHAuth,
 		LocalPortForwardingCallback:   c.mayForwardLocalPortTo,
 		ReversePortForwardingCallback: c.mayReversePortForwardTo,
+		PortForwardingConnCallback:    c.auditForwardedConn,
 		SubsystemHandlers: map[string]ssh.SubsystemHandler{
 			"sftp": c.handleSessionPostSSHAuth,
 		},
@@ -502,31 +559,29 @@ func (srv *server) newConn() (*conn, error) {
 }
 
 // mayReversePortPortForwardTo reports whether the ctx should be allowed to port forward
-// to the specified host and port.
-// TODO(bradfitz/maisem): should we have more checks on host/port?
+// to the specified host and port, per the action's RemotePortForwardingDestinations.
 func (c *conn) mayReversePortForwardTo(ctx ssh.Context, destinationHost string, destinationPort uint32) bool {
 	if sshDisableForwarding() {
 		return false
 	}
-	if c.finalAction != nil && c.finalAction.AllowRemotePortForwarding {
-		metricRemotePortForward.Add(1)
-		return true
+	if !c.mayForward(PortForwardRemote, destinationHost, destinationPort) {
+		return false
 	}
-	return false
+	metricRemotePortForward.Add(1)
+	return true
 }
 
 // mayForwardLocalPortTo reports whether the ctx should be allowed to port forward
-// to the specified host and port.
-// TODO(bradfitz/maisem): should we have more checks on host/port?
+// to the specified host and port, per the action's LocalPortForwardingDestinations.
 func (c *conn) mayForwardLocalPortTo(ctx ssh.Context, destinationHost string, destinationPort uint32) bool {
 	if sshDisableForwarding() {
 		return false
 	}
-	if c.finalAction != nil && c.finalAction.AllowLocalPortForwarding {
-		metricLocalPortForward.Add(1)
-		return true
+	if !c.mayForward(PortForwardLocal, destinationHost, destinationPort) {
+		return false
 	}
-	return false
+	metricLocalPortForward.Add(1)
+	return true
 }
 
 // sshPolicy returns the SSHPolicy for current node.
@@ -678,6 +733,7 @@ type sshSession struct {
 	cancelCtx     context.CancelCauseFunc
 	conn          *conn
 	agentListener net.Listener // non-nil if agent-forwarding requested+allowed
+	rec           *recording   // non-nil if recorded; guarded by conn.mu
 
 	// initialized by launchProcess:
 	cmd      *exec.Cmd
@@ -726,6 +782,14 @@ func (c *conn) isStillValid() bool {
 	if !a.Accept && a.HoldAndDelegate == "" {
 		return false
 	}
+	if c.userCert != nil {
+		// The certificate must still be accepted, by the current trusted CAs
+		// and principal map.
+		cfg := c.srv.userCAConfig()
+		if cfg == nil || cfg.checkCert(c.userCert, c.info.src.Addr(), c.srv.now()) != nil || cfg.principalFor(c.userCert, localUser) == "" {
+			return false
+		}
+	}
 	return c.localUser.Username == localUser
 }
 
@@ -733,10 +797,16 @@ func (c *conn) isStillValid() bool {
 // If not, it terminates all sessions associated with the conn.
 func (c *conn) checkStillValid() {
 	if c.isStillValid() {
+		// Apply the new policy's port forwarding settings, unless the
+		// final action is only known after holding and delegating.
+		if a, _, _, result := c.evaluatePolicy(); result == accepted && a.Accept {
+			c.setForwardingAction(a)
+		}
 		return
 	}
 	metricPolicyChangeKick.Add(1)
 	c.logf("session no longer valid per new SSH policy; closing")
+	c.setForwardingAction(&tailcfg.SSHAction{Reject: true})
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	for _, s := range c.sessions {
@@ -954,6 +1024,9 @@ func (ss *sshSession) run() {
 			ss.logf("startNewRecording: <nil>")
 			if rec != nil {
 				defer rec.Close()
+				ss.conn.mu.Lock()
+				ss.rec = rec
+				ss.conn.mu.Unlock()
 			}
 		}
 	}
@@ -1053,8 +1126,10 @@ func (ss *sshSession) run() {
 }
 
 // recordSSHToLocalDisk is a deprecated dev knob to allow recording SSH sessions
-// to local storage. It is only used if there is no recording configured by the
-// coordination server. This will be removed in the future.
+// to local storage under the var root. It is only used if there is no
+// recording configured by the coordination server or by the
+// [syspolicy.SSHRecordingDir] policy setting. This will be removed in the
+// future.
 var recordSSHToLocalDisk = envknob.RegisterBool("TS_DEBUG_LOG_SSH")
 
 // recorders returns the list of recorders to use for this session.
@@ -1070,7 +1145,59 @@ func (ss *sshSession) recorders() ([]netip.AddrPort, *tailcfg.SSHRecorderFailure
 
 func (ss *sshSession) shouldRecord() bool {
 	recs, _ := ss.recorders()
-	return len(recs) > 0 || recordSSHToLocalDisk()
+	if len(recs) > 0 {
+		return true
+	}
+	dir, _ := ss.conn.srv.localRecordingConfig()
+	return dir != ""
+}
+
+// localRecordingConfig returns the directory and rotation options of the local
+// store of recordings for sessions whose SSH policy does not specify
+// recorders, or an empty dir if they are not recorded.
+func (srv *server) localRecordingConfig() (dir string, opts sessionrecording.LocalStoreOptions) {
+	dir, _ = syspolicy.GetString(syspolicy.SSHRecordingDir, "")
+	if dir == "" {
+		if !recordSSHToLocalDisk() {
+			return "", opts
+		}
+		varRoot := srv.lb.TailscaleVarRoot()
+		if varRoot == "" {
+			return "", opts
+		}
+		return filepath.Join(varRoot, "ssh-sessions"), opts
+	}
+	maxSize, _ := syspolicy.GetUint64(syspolicy.SSHRecordingMaxSize, 0)
+	opts.MaxSize = int64(min(maxSize, math.MaxInt64))
+	opts.MaxAge, _ = syspolicy.GetDuration(syspolicy.SSHRecordingMaxAge, 0)
+	return dir, opts
+}
+
+// localRecordingStore returns the local store of recordings for sessions
+// whose SSH policy does not specify recorders, opening it if needed.
+func (srv *server) localRecordingStore() (*sessionrecording.LocalStore, error) {
+	dir, opts := srv.localRecordingConfig()
+	if dir == "" {
+		return nil, errors.New("no recorders configured")
+	}
+	opts.Logf = srv.logf
+	srv.recStoreMu.Lock()
+	defer srv.recStoreMu.Unlock()
+	if srv.recStore != nil && srv.recStore.Dir() == dir {
+		srv.recStore.SetOptions(opts)
+		return srv.recStore, nil
+	}
+	rs, err := sessionrecording.OpenLocalStore(dir, opts)
+	if err != nil {
+		return nil, err
+	}
+	if srv.recStore != nil {
+		// Sessions still recording to the previous store finish adding
+		// their recordings to it before its chain is closed.
+		srv.recStore.Close()
+	}
+	srv.recStore = rs
+	return rs, nil
 }
 
 type sshConnInfo struct {
@@ -1215,22 +1342,6 @@ func randBytes(n int) []byte {
 	return b
 }
 
-func (ss *sshSession) openFileForRecording(now time.Time) (_ io.WriteCloser, err error) {
-	varRoot := ss.conn.srv.lb.TailscaleVarRoot()
-	if varRoot == "" {
-		return nil, errors.New("no var root for recording storage")
-	}
-	dir := filepath.Join(varRoot, "ssh-sessions")
-	if err := os.MkdirAll(dir, 0700); err != nil {
-		return nil, err
-	}
-	f, err := os.CreateTemp(dir, fmt.Sprintf("ssh-session-%v-*.cast", now.UnixNano()))
-	if err != nil {
-		return nil, err
-	}
-	return f, nil
-}
-
 // startNewRecording starts a new SSH session recording.
 // It may return a nil recording if recording is not available.
 func (ss *sshSession) startNewRecording() (_ *recording, err error) {
@@ -1242,12 +1353,11 @@ func (ss *sshSession) startNewRecording() (_ *recording, err error) {
 	}
 
 	recorders, onFailure := ss.recorders()
-	var localRecording bool
+	var localStore *sessionrecording.LocalStore
 	if len(recorders) == 0 {
-		if recordSSHToLocalDisk() {
-			localRecording = true
-		} else {
-			return nil, errors.New("no recorders configured")
+		localStore, err = ss.conn.srv.localRecordingStore()
+		if err != nil {
+			return nil, err
 		}
 	}
 
@@ -1272,8 +1382,8 @@ func (ss *sshSession) startNewRecording() (_ *recording, err error) {
 	// ss.ctx is closed when the session closes, but we don't want to break the upload at that time.
 	// Instead we want to wait for the session to close the writer when it finishes.
 	ctx := context.Background()
-	if localRecording {
-		rec.out, err = ss.openFileForRecording(now)
+	if localStore != nil {
+		rec.out, err = localStore.Create("ssh-session")
 		if err != nil {
 			return nil, err
 		}
@@ -1444,6 +1554,20 @@ func (r *recording) Close() error {
 	return err
 }
 
+// writeMarker records a marker event, labeled label.
+func (r *recording) writeMarker(label string) error {
+	j, err := json.Marshal([]any{
+		time.Since(r.start).Seconds(),
+		"m",
+		label,
+	})
+	if err != nil {
+		return err
+	}
+	j = append(j, '\n')
+	return loggingWriter{r: r}.writeCastLine(j)
+}
+
 // writer returns an io.Writer around w that first records the write.
 //
 // The dir should be "i" for input or "o" for output.
@@ -1541,6 +1665,7 @@ func envEq(a, b string) bool {
 	metricSFTP                = clientmetric.NewCounter("ssh_sftp_sessions")
 	metricLocalPortForward    = clientmetric.NewCounter("ssh_local_port_forward_requests")
 	metricRemotePortForward   = clientmetric.NewCounter("ssh_remote_port_forward_requests")
+	metricPortForwardDenied   = clientmetric.NewCounter("ssh_port_forward_denied")
 )
 
 // userVisibleError is a wrapper around an error that implements
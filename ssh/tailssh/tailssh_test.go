@@ -23,6 +23,7 @@
 	"os"
 	"os/exec"
 	"os/user"
+	"path/filepath"
 	"reflect"
 	"runtime"
 	"slices"
@@ -41,6 +42,7 @@
 	"tailscale.com/net/memnet"
 	"tailscale.com/net/tsdial"
 	"tailscale.com/sessionrecording"
+	"tailscale.com/sessionrecording/cast"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tempfork/gliderlabs/ssh"
 	testssh "tailscale.com/tempfork/sshtest/ssh"
@@ -53,6 +55,9 @@
 	"tailscale.com/util/cibuild"
 	"tailscale.com/util/lineiter"
 	"tailscale.com/util/must"
+	"tailscale.com/util/syspolicy"
+	"tailscale.com/util/syspolicy/setting"
+	"tailscale.com/util/syspolicy/source"
 	"tailscale.com/version/distro"
 	"tailscale.com/wgengine"
 )
@@ -791,6 +796,110 @@ func TestSSHRecordingNonInteractive(t *testing.T) {
 	}
 }
 
+// TestSSHRecordingLocal tests that the SSH server records sessions to the
+// local store configured by policy when the SSH policy specifies no
+// recorders.
+func TestSSHRecordingLocal(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skipf("skipping on %q; only runs on linux and darwin", runtime.GOOS)
+	}
+	dir := t.TempDir()
+	syspolicy.RegisterWellKnownSettingsForTest(t)
+	policyStore := source.NewTestStore(t)
+	policyStore.SetStrings(source.TestSettingOf(syspolicy.SSHRecordingDir, dir))
+	syspolicy.MustRegisterStoreForTest(t, "TestStore", setting.DeviceScope, policyStore)
+
+	s := &server{
+		logf: tstest.WhileTestRunningLogger(t),
+		lb: &localState{
+			sshEnabled:   true,
+			matchingRule: newSSHRule(&tailcfg.SSHAction{Accept: true}),
+		},
+	}
+	defer s.Shutdown()
+
+	src, dst := must.Get(netip.ParseAddrPort("100.100.100.101:2231")), must.Get(netip.ParseAddrPort("100.100.100.102:22"))
+	sc, dc := memnet.NewTCPConn(src, dst, 1024)
+
+	const sshUser = "alice"
+	cfg := &testssh.ClientConfig{
+		User:            sshUser,
+		HostKeyCallback: testssh.InsecureIgnoreHostKey(),
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		c, chans, reqs, err := testssh.NewClientConn(sc, sc.RemoteAddr().String(), cfg)
+		if err != nil {
+			t.Errorf("client: %v", err)
+			return
+		}
+		client := testssh.NewClient(c, chans, reqs)
+		defer client.Close()
+		session, err := client.NewSession()
+		if err != nil {
+			t.Errorf("client: %v", err)
+			return
+		}
+		defer session.Close()
+		if _, err := session.CombinedOutput("echo Ran echo!"); err != nil {
+			t.Errorf("client: %v", err)
+		}
+	}()
+	if err := s.HandleSSHConn(dc); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	wg.Wait()
+
+	var entries []sessionrecording.ChainEntry
+	if err := tstest.WaitFor(5*time.Second, func() (err error) {
+		entries, err = sessionrecording.VerifyLocalStore(dir)
+		if err == nil && len(entries) == 0 {
+			err = errors.New("no recordings stored")
+		}
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	recording, err := os.ReadFile(filepath.Join(dir, entries[0].File))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(recording))
+	var ch sessionrecording.CastHeader
+	if err := dec.Decode(&ch); err != nil {
+		t.Fatal(err)
+	}
+	if ch.SSHUser != sshUser || ch.Command != "echo Ran echo!" {
+		t.Errorf("header = %+v; want SSHUser %q, Command %q", ch, sshUser, "echo Ran echo!")
+	}
+	if !bytes.Contains(recording, []byte("Ran echo!\\n")) {
+		t.Errorf("recording does not contain the command's output:\n%s", recording)
+	}
+
+	// The recording can be read back, transcribed and searched.
+	r, err := cast.NewReader(bytes.NewReader(recording))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var transcript strings.Builder
+	if err := cast.WriteTranscript(&transcript, r, false); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := transcript.String(), "Ran echo!\n"; got != want {
+		t.Errorf("transcript = %q, want %q", got, want)
+	}
+	matches, err := cast.Search(dir, "ran ECHO")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0].File != filepath.Join(dir, entries[0].File) || matches[0].Header.SSHUser != sshUser {
+		t.Errorf("matches = %+v", matches)
+	}
+}
+
 func TestSSHAuthFlow(t *testing.T) {
 	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
 		t.Skipf("skipping on %q; only runs on linux and darwin", runtime.GOOS)
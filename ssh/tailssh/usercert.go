@@ -0,0 +1,230 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build (linux && !android) || (darwin && !ios) || freebsd || openbsd || plan9
+
+package tailssh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+	"tailscale.com/tempfork/gliderlabs/ssh"
+	"tailscale.com/util/mak"
+	"tailscale.com/util/syspolicy"
+)
+
+// Values of the [syspolicy.SSHUserCAMode] policy setting.
+const (
+	userCAOptional = "optional"
+	userCARequired = "required"
+)
+
+// sourceAddressOption is the critical option of OpenSSH certificates that
+// restricts the addresses they may be used from.
+const sourceAddressOption = "source-address"
+
+// userCAConfig is the configuration for authenticating clients with OpenSSH
+// user certificates, as set by the SSHUserCA policy settings.
+type userCAConfig struct {
+	// required is whether clients must authenticate with a certificate.
+	// Otherwise, they may.
+	required bool
+
+	// trusted are the public keys of the trusted CAs.
+	trusted []gossh.PublicKey
+
+	// principalMap maps certificate principals to local users, with the
+	// same wildcards as SSHRule.SSHUsers; see mapLocalUser.
+	principalMap map[string]string
+}
+
+// userCAConfig returns the current configuration for authenticating clients
+// with user certificates, or nil if they are not accepted.
+func (srv *server) userCAConfig() *userCAConfig {
+	keys, _ := syspolicy.GetStringArray(syspolicy.SSHUserCATrustedKeys, nil)
+	cfg := &userCAConfig{}
+	for _, k := range keys {
+		pub, _, _, _, err := gossh.ParseAuthorizedKey([]byte(k))
+		if err != nil {
+			srv.logf("tailssh: ignoring invalid %s entry %q: %v", syspolicy.SSHUserCATrustedKeys, k, err)
+			continue
+		}
+		cfg.trusted = append(cfg.trusted, pub)
+	}
+
+	switch mode, _ := syspolicy.GetString(syspolicy.SSHUserCAMode, userCAOptional); mode {
+	case userCAOptional, "":
+	case userCARequired:
+		cfg.required = true
+	default:
+		// Fail closed, as the mode was likely meant to be stricter.
+		srv.logf("tailssh: unknown %s %q; requiring certificates", syspolicy.SSHUserCAMode, mode)
+		cfg.required = true
+	}
+	if len(cfg.trusted) == 0 {
+		if !cfg.required {
+			return nil
+		}
+		// Fail closed too: with no trusted CAs, no certificate is accepted,
+		// and so all clients are rejected.
+		srv.logf("tailssh: certificates required but no valid %s; rejecting all clients", syspolicy.SSHUserCATrustedKeys)
+	}
+
+	entries, _ := syspolicy.GetStringArray(syspolicy.SSHUserCAPrincipalMap, nil)
+	for _, e := range entries {
+		principal, user, ok := strings.Cut(e, "=")
+		if !ok || principal == "" || user == "" {
+			srv.logf("tailssh: ignoring invalid %s entry %q", syspolicy.SSHUserCAPrincipalMap, e)
+			continue
+		}
+		mak.Set(&cfg.principalMap, principal, user)
+	}
+	if len(entries) == 0 {
+		cfg.principalMap = map[string]string{"*": "="}
+	}
+	return cfg
+}
+
+// isTrusted reports whether auth is the public key of a trusted CA.
+func (cfg *userCAConfig) isTrusted(auth gossh.PublicKey) bool {
+	b := auth.Marshal()
+	return slices.ContainsFunc(cfg.trusted, func(k gossh.PublicKey) bool {
+		return bytes.Equal(k.Marshal(), b)
+	})
+}
+
+// checkCert checks that cert is a valid user certificate signed by a trusted
+// CA, for use from src at now. Whether it is valid for the local user being
+// logged in as is checked separately, by principalFor.
+func (cfg *userCAConfig) checkCert(cert *gossh.Certificate, src netip.Addr, now time.Time) error {
+	if cert.CertType != gossh.UserCert {
+		return errors.New("not a user certificate")
+	}
+	if !cfg.isTrusted(cert.SignatureKey) {
+		return errors.New("certificate signed by untrusted CA")
+	}
+	if len(cert.ValidPrincipals) == 0 {
+		return errors.New("certificate has no principals")
+	}
+	checker := &gossh.CertChecker{
+		Clock:                    func() time.Time { return now },
+		SupportedCriticalOptions: []string{sourceAddressOption},
+	}
+	// CheckCert checks that the principal it is passed is one of the
+	// certificate's, so pass it one that is.
+	if err := checker.CheckCert(cert.ValidPrincipals[0], cert); err != nil {
+		return err
+	}
+	if addrs, ok := cert.CriticalOptions[sourceAddressOption]; ok {
+		return checkSourceAddress(src, addrs)
+	}
+	return nil
+}
+
+// checkSourceAddress checks that src is permitted by the comma-separated
+// list of addresses and CIDR prefixes in addrs, the value of a certificate's
+// source-address critical option.
+func checkSourceAddress(src netip.Addr, addrs string) error {
+	for _, s := range strings.Split(addrs, ",") {
+		if p, err := netip.ParsePrefix(s); err == nil {
+			if p.Contains(src) {
+				return nil
+			}
+			continue
+		}
+		a, err := netip.ParseAddr(s)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q", sourceAddressOption, addrs)
+		}
+		if a == src {
+			return nil
+		}
+	}
+	return fmt.Errorf("certificate is not valid from %v", src)
+}
+
+// principalFor returns the principal of cert that maps to localUser, or the
+// empty string if none does.
+func (cfg *userCAConfig) principalFor(cert *gossh.Certificate, localUser string) string {
+	for _, p := range cert.ValidPrincipals {
+		if mapLocalUser(cfg.principalMap, p) == localUser {
+			return p
+		}
+	}
+	return ""
+}
+
+// userCertExtension is the key of the [gossh.Permissions] extension in which
+// certAuth passes the user certificate it accepted to authenticated. It is
+// never sent to the client.
+const userCertExtension = "tailscale-user-cert"
+
+// errUserCertRequired is returned by auth callbacks for methods other than
+// public key authentication when a user certificate is required. Unlike the
+// errors returned by clientAuth, it lets the client try another method.
+var errUserCertRequired = errors.New("tailssh: user certificate required")
+
+// certAuth is the PublicKeyCallback used when user certificates are
+// accepted. If key is a user certificate signed by a trusted CA, it checks
+// it and then performs client authentication with clientAuth, which further
+// checks that the certificate permits logging in as the local user the SSH
+// policy maps the client to. Other keys are refused if a certificate is
+// required, and otherwise ignored, as when certificates are not accepted.
+//
+// It is also called for keys the client only queries, before it proves
+// possession of the key, so the certificate is only recorded as used by
+// authenticated, once authentication has succeeded.
+func (c *conn) certAuth(cm gossh.ConnMetadata, key gossh.PublicKey) (*gossh.Permissions, error) {
+	cert, ok := key.(*gossh.Certificate)
+	if !ok || !c.userCA.isTrusted(cert.SignatureKey) {
+		if c.userCA.required {
+			return nil, errUserCertRequired
+		}
+		return c.clientAuth(cm, nil)
+	}
+	if err := c.userCA.checkCert(cert, toIPPort(cm.RemoteAddr()).Addr(), c.srv.now()); err != nil {
+		c.logf("rejecting user certificate %q (serial %d): %v", cert.KeyId, cert.Serial, err)
+		return nil, fmt.Errorf("tailssh: invalid user certificate: %w", err)
+	}
+	perms, err := c.clientAuth(cm, cert)
+	if err != nil {
+		return nil, err
+	}
+	mak.Set(&perms.Extensions, userCertExtension, string(cert.Marshal()))
+	return perms, nil
+}
+
+// authenticated is the AuthenticatedCallback of c. It records the user
+// certificate the client authenticated with, if any, as passed in perms by
+// certAuth.
+func (c *conn) authenticated(ctx ssh.Context, perms *gossh.Permissions) {
+	if perms == nil {
+		return
+	}
+	b, ok := perms.Extensions[userCertExtension]
+	if !ok {
+		return
+	}
+	key, err := gossh.ParsePublicKey([]byte(b))
+	if err != nil {
+		c.logf("parsing user certificate: %v", err)
+		return
+	}
+	cert, ok := key.(*gossh.Certificate)
+	if !ok {
+		return
+	}
+	c.userCert = cert
+	var p string
+	if c.localUser != nil {
+		p = c.userCA.principalFor(cert, c.localUser.Username)
+	}
+	c.logf("authenticated with user certificate %q (serial %d) as principal %q", cert.KeyId, cert.Serial, p)
+}
@@ -0,0 +1,391 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux || darwin
+
+package tailssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/netip"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+	"tailscale.com/net/memnet"
+	"tailscale.com/tailcfg"
+	testssh "tailscale.com/tempfork/sshtest/ssh"
+	"tailscale.com/tstest"
+	"tailscale.com/util/must"
+	"tailscale.com/util/syspolicy"
+	"tailscale.com/util/syspolicy/setting"
+	"tailscale.com/util/syspolicy/source"
+)
+
+// setUserCAPolicy sets the SSHUserCA policy settings for the duration of
+// the test. An empty mode leaves it unset.
+func setUserCAPolicy(t *testing.T, mode string, trustedKeys, principalMap []string) {
+	t.Helper()
+	syspolicy.RegisterWellKnownSettingsForTest(t)
+	store := source.NewTestStore(t)
+	store.SetStringLists(
+		source.TestSettingOf(syspolicy.SSHUserCATrustedKeys, trustedKeys),
+		source.TestSettingOf(syspolicy.SSHUserCAPrincipalMap, principalMap),
+	)
+	if mode != "" {
+		store.SetStrings(source.TestSettingOf(syspolicy.SSHUserCAMode, mode))
+	}
+	syspolicy.MustRegisterStoreForTest(t, "TestStore", setting.DeviceScope, store)
+}
+
+func newEd25519Key(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv
+}
+
+func TestUserCAConfig(t *testing.T) {
+	ca := must.Get(gossh.NewSignerFromKey(newEd25519Key(t)))
+	caKey := strings.TrimSpace(string(gossh.MarshalAuthorizedKey(ca.PublicKey())))
+	s := &server{logf: t.Logf}
+
+	setUserCAPolicy(t, "", nil, nil)
+	if cfg := s.userCAConfig(); cfg != nil {
+		t.Errorf("userCAConfig with no trusted keys = %+v, want nil", cfg)
+	}
+
+	setUserCAPolicy(t, "", []string{"not a key", caKey + " ca@example.com"}, nil)
+	cfg := s.userCAConfig()
+	if cfg == nil || cfg.required || len(cfg.trusted) != 1 || !cfg.isTrusted(ca.PublicKey()) {
+		t.Fatalf("userCAConfig = %+v, want optional with one trusted key", cfg)
+	}
+	cert := &gossh.Certificate{ValidPrincipals: []string{"alice", "ops"}}
+	if got := cfg.principalFor(cert, "ops"); got != "ops" {
+		t.Errorf("principalFor(ops) = %q, want ops", got)
+	}
+
+	// Requiring certificates without any usable CA rejects all clients,
+	// rather than dropping the requirement.
+	setUserCAPolicy(t, userCARequired, []string{"not a key"}, nil)
+	if cfg := s.userCAConfig(); cfg == nil || !cfg.required || len(cfg.trusted) != 0 {
+		t.Errorf("userCAConfig required with no valid keys = %+v, want required with no trusted keys", cfg)
+	}
+
+	setUserCAPolicy(t, "bogus", []string{caKey}, []string{"ops=root", "*==", "invalid", "bob="})
+	cfg = s.userCAConfig()
+	if !cfg.required {
+		t.Error("unknown mode did not require certificates")
+	}
+	for _, tt := range []struct {
+		localUser, want string
+	}{
+		{"root", "ops"},
+		{"alice", "alice"},
+		{"ops", ""},
+		{"bob", ""},
+	} {
+		if got := cfg.principalFor(cert, tt.localUser); got != tt.want {
+			t.Errorf("principalFor(%q) = %q, want %q", tt.localUser, got, tt.want)
+		}
+	}
+}
+
+func TestCheckCert(t *testing.T) {
+	ca := must.Get(gossh.NewSignerFromKey(newEd25519Key(t)))
+	otherCA := must.Get(gossh.NewSignerFromKey(newEd25519Key(t)))
+	user := must.Get(gossh.NewSignerFromKey(newEd25519Key(t)))
+	cfg := &userCAConfig{trusted: []gossh.PublicKey{ca.PublicKey()}}
+	now := time.Unix(1750000000, 0)
+	src := netip.MustParseAddr("100.100.100.101")
+
+	tests := []struct {
+		name    string
+		modify  func(*gossh.Certificate)
+		signer  gossh.Signer
+		wantErr string
+	}{
+		{name: "valid"},
+		{
+			name:    "untrusted-ca",
+			signer:  otherCA,
+			wantErr: "untrusted CA",
+		},
+		{
+			name:    "host-cert",
+			modify:  func(c *gossh.Certificate) { c.CertType = gossh.HostCert },
+			wantErr: "not a user certificate",
+		},
+		{
+			name:    "no-principals",
+			modify:  func(c *gossh.Certificate) { c.ValidPrincipals = nil },
+			wantErr: "no principals",
+		},
+		{
+			name:    "expired",
+			modify:  func(c *gossh.Certificate) { c.ValidBefore = uint64(now.Add(-time.Minute).Unix()) },
+			wantErr: "expired",
+		},
+		{
+			name:    "force-command",
+			modify:  func(c *gossh.Certificate) { c.CriticalOptions = map[string]string{"force-command": "/bin/true"} },
+			wantErr: "unsupported critical option",
+		},
+		{
+			name: "source-address",
+			modify: func(c *gossh.Certificate) {
+				c.CriticalOptions = map[string]string{sourceAddressOption: "10.0.0.1,100.100.100.0/24"}
+			},
+		},
+		{
+			name: "wrong-source-address",
+			modify: func(c *gossh.Certificate) {
+				c.CriticalOptions = map[string]string{sourceAddressOption: "10.0.0.0/8,100.100.100.102"}
+			},
+			wantErr: "not valid from 100.100.100.101",
+		},
+		{
+			name: "invalid-source-address",
+			modify: func(c *gossh.Certificate) {
+				c.CriticalOptions = map[string]string{sourceAddressOption: "example.com"}
+			},
+			wantErr: "invalid source-address",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert := &gossh.Certificate{
+				Key:             user.PublicKey(),
+				CertType:        gossh.UserCert,
+				KeyId:           "alice@example.com",
+				ValidPrincipals: []string{"alice"},
+				ValidAfter:      uint64(now.Add(-time.Hour).Unix()),
+				ValidBefore:     uint64(now.Add(time.Hour).Unix()),
+			}
+			if tt.modify != nil {
+				tt.modify(cert)
+			}
+			signer := ca
+			if tt.signer != nil {
+				signer = tt.signer
+			}
+			if err := cert.SignCert(rand.Reader, signer); err != nil {
+				t.Fatal(err)
+			}
+			err := cfg.checkCert(cert, src, now)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkCert = %v, want nil", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("checkCert = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestSSHUserCertAuth tests authenticating with user certificates end to
+// end, with the SSH policy still evaluated for the source node.
+func TestSSHUserCertAuth(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skipf("skipping on %q; only runs on linux and darwin", runtime.GOOS)
+	}
+	ca := must.Get(testssh.NewSignerFromKey(newEd25519Key(t)))
+	caKey := strings.TrimSpace(string(testssh.MarshalAuthorizedKey(ca.PublicKey())))
+	userKey := must.Get(testssh.NewSignerFromKey(newEd25519Key(t)))
+	certSigner := func(principals ...string) testssh.Signer {
+		cert := &testssh.Certificate{
+			Key:             userKey.PublicKey(),
+			CertType:        testssh.UserCert,
+			KeyId:           "alice@example.com",
+			ValidPrincipals: principals,
+			ValidBefore:     testssh.CertTimeInfinity,
+		}
+		if err := cert.SignCert(rand.Reader, ca); err != nil {
+			t.Fatal(err)
+		}
+		return must.Get(testssh.NewCertSigner(cert, userKey))
+	}
+
+	tests := []struct {
+		name         string
+		mode         string
+		trustedKeys  []string // defaults to the CA's key
+		principalMap []string
+		rule         *tailcfg.SSHRule // defaults to accepting alice as currentUser
+		signers      []testssh.Signer // if empty, "none" auth is attempted
+		wantBanners  []string
+		authErr      bool
+		wantCertAuth bool // whether the client is authenticated with a certificate
+	}{
+		{
+			name:         "required-cert",
+			mode:         userCARequired,
+			signers:      []testssh.Signer{certSigner(currentUser)},
+			wantCertAuth: true,
+		},
+		{
+			name:         "required-mapped-principal",
+			mode:         userCARequired,
+			principalMap: []string{"ops=" + currentUser},
+			signers:      []testssh.Signer{userKey, certSigner("ops")},
+			wantCertAuth: true,
+		},
+		{
+			name:        "required-no-valid-keys",
+			mode:        userCARequired,
+			trustedKeys: []string{"not a key"},
+			signers:     []testssh.Signer{certSigner(currentUser)},
+			authErr:     true,
+		},
+		{
+			name:        "required-no-valid-keys-none",
+			mode:        userCARequired,
+			trustedKeys: []string{"not a key"},
+			authErr:     true,
+		},
+		{
+			name:        "required-wrong-principal",
+			mode:        userCARequired,
+			signers:     []testssh.Signer{certSigner("someone-else")},
+			wantBanners: []string{`tailscale: certificate does not permit you to SSH as user "` + currentUser + `"` + "\n"},
+			authErr:     true,
+		},
+		{
+			name:    "required-plain-key",
+			mode:    userCARequired,
+			signers: []testssh.Signer{userKey},
+			authErr: true,
+		},
+		{
+			name:    "required-none",
+			mode:    userCARequired,
+			authErr: true,
+		},
+		{
+			name:        "required-policy-rejects",
+			mode:        userCARequired,
+			rule:        newSSHRule(&tailcfg.SSHAction{Reject: true, Message: "Go Away!"}),
+			signers:     []testssh.Signer{certSigner(currentUser)},
+			wantBanners: []string{"Go Away!"},
+			authErr:     true,
+		},
+		{
+			name: "optional-none",
+			mode: userCAOptional,
+		},
+		{
+			name:    "optional-plain-key",
+			mode:    userCAOptional,
+			signers: []testssh.Signer{userKey},
+		},
+		{
+			name:         "optional-cert",
+			mode:         userCAOptional,
+			signers:      []testssh.Signer{certSigner(currentUser)},
+			wantCertAuth: true,
+		},
+		{
+			name:        "optional-wrong-principal",
+			mode:        userCAOptional,
+			signers:     []testssh.Signer{certSigner("someone-else")},
+			wantBanners: []string{`tailscale: certificate does not permit you to SSH as user "` + currentUser + `"` + "\n"},
+			authErr:     true,
+		},
+	}
+	src, dst := must.Get(netip.ParseAddrPort("100.100.100.101:2231")), must.Get(netip.ParseAddrPort("100.100.100.102:22"))
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			trustedKeys := tc.trustedKeys
+			if trustedKeys == nil {
+				trustedKeys = []string{caKey}
+			}
+			setUserCAPolicy(t, tc.mode, trustedKeys, tc.principalMap)
+			rule := tc.rule
+			if rule == nil {
+				rule = newSSHRule(&tailcfg.SSHAction{Accept: true})
+			}
+			logf := tstest.WhileTestRunningLogger(t)
+			var certAuth atomic.Bool
+			s := &server{
+				logf: func(format string, args ...any) {
+					if strings.Contains(format, "authenticated with user certificate") {
+						certAuth.Store(true)
+					}
+					logf(format, args...)
+				},
+				lb: &localState{
+					sshEnabled:   true,
+					matchingRule: rule,
+				},
+			}
+			defer s.Shutdown()
+			sc, dc := memnet.NewTCPConn(src, dst, 1024)
+
+			wantBanners := tc.wantBanners
+			cfg := &testssh.ClientConfig{
+				User:            "alice",
+				HostKeyCallback: testssh.InsecureIgnoreHostKey(),
+				SkipNoneAuth:    len(tc.signers) > 0,
+				BannerCallback: func(message string) error {
+					if len(wantBanners) == 0 {
+						t.Errorf("unexpected banner: %q", message)
+					} else if message != wantBanners[0] {
+						t.Errorf("banner = %q; want %q", message, wantBanners[0])
+					} else {
+						wantBanners = wantBanners[1:]
+					}
+					return nil
+				},
+			}
+			if len(tc.signers) > 0 {
+				cfg.Auth = []testssh.AuthMethod{testssh.PublicKeys(tc.signers...)}
+			}
+
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c, chans, reqs, err := testssh.NewClientConn(sc, sc.RemoteAddr().String(), cfg)
+				if err != nil {
+					if !tc.authErr {
+						t.Errorf("client: %v", err)
+					}
+					return
+				} else if tc.authErr {
+					c.Close()
+					t.Errorf("client: expected error, got nil")
+					return
+				}
+				client := testssh.NewClient(c, chans, reqs)
+				defer client.Close()
+				session, err := client.NewSession()
+				if err != nil {
+					t.Errorf("client: %v", err)
+					return
+				}
+				defer session.Close()
+				if _, err := session.CombinedOutput("echo Ran echo!"); err != nil {
+					t.Errorf("client: %v", err)
+				}
+			}()
+			if err := s.HandleSSHConn(dc); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			wg.Wait()
+			if len(wantBanners) > 0 {
+				t.Errorf("missing banners: %v", wantBanners)
+			}
+			if got := certAuth.Load(); got != tc.wantCertAuth {
+				t.Errorf("authenticated with certificate = %v, want %v", got, tc.wantCertAuth)
+			}
+		})
+	}
+}
@@ -170,7 +170,8 @@
 //   - 123: 2025-07-28: fix deadlock regression from cryptokey routing change (issue #16651)
 //   - 124: 2025-08-08: removed NodeAttrDisableMagicSockCryptoRouting support, crypto routing is now mandatory
 //   - 125: 2025-08-11: dnstype.Resolver adds UseWithExitNode field.
-const CurrentCapabilityVersion CapabilityVersion = 125
+//   - 126: 2026-10-16: Client enforces SSHAction.LocalPortForwardingDestinations and SSHAction.RemotePortForwardingDestinations.
+const CurrentCapabilityVersion CapabilityVersion = 126
 
 // ID is an integer ID for a user, node, or login allocated by the
 // control plane.
@@ -1537,6 +1538,10 @@ type CapGrant struct {
 	// capabilities, such as the ability to add user groups to the OIDC
 	// claim
 	PeerCapabilityTsIDP PeerCapability = "tailscale.com/cap/tsidp"
+
+	// PeerCapabilitySessionRecorder grants a peer the ability to upload
+	// session recordings to a sessionrecorder instance.
+	PeerCapabilitySessionRecorder PeerCapability = "tailscale.com/cap/session-recorder"
 )
 
 // NodeCapMap is a map of capabilities to their optional values. It is valid for
@@ -2873,6 +2878,25 @@ type SSHAction struct {
 	// to use remote port forwarding if requested.
 	AllowRemotePortForwarding bool `json:"allowRemotePortForwarding,omitempty"`
 
+	// LocalPortForwardingDestinations, if non-empty, restricts the local
+	// port forwarding allowed by AllowLocalPortForwarding to destinations
+	// matching one of its "host:port" patterns. The host is a hostname, IP
+	// address, CIDR prefix, "*.domain" wildcard or "*", and the port is a
+	// number, range such as "8000-8999" or "*". Hostnames are matched as
+	// requested by the client, without being resolved.
+	//
+	// It is only enforced as of CapabilityVersion 126. Older clients
+	// ignore it, so control must not allow them local port forwarding
+	// when it is set.
+	LocalPortForwardingDestinations []string `json:"localPortForwardingDestinations,omitempty"`
+
+	// RemotePortForwardingDestinations, if non-empty, restricts the remote
+	// port forwarding allowed by AllowRemotePortForwarding to addresses to
+	// listen on matching one of its "host:port" patterns, as for
+	// LocalPortForwardingDestinations. Like it, it is only enforced as of
+	// CapabilityVersion 126.
+	RemotePortForwardingDestinations []string `json:"remotePortForwardingDestinations,omitempty"`
+
 	// Recorders defines the destinations of the SSH session recorders.
 	// The recording will be uploaded to http://addr:port/record.
 	Recorders []netip.AddrPort `json:"recorders,omitempty"`
@@ -532,6 +532,8 @@ func (src *SSHAction) Clone() *SSHAction {
 	}
 	dst := new(SSHAction)
 	*dst = *src
+	dst.LocalPortForwardingDestinations = append(src.LocalPortForwardingDestinations[:0:0], src.LocalPortForwardingDestinations...)
+	dst.RemotePortForwardingDestinations = append(src.RemotePortForwardingDestinations[:0:0], src.RemotePortForwardingDestinations...)
 	dst.Recorders = append(src.Recorders[:0:0], src.Recorders...)
 	if dst.OnRecordingFailure != nil {
 		dst.OnRecordingFailure = ptr.To(*src.OnRecordingFailure)
@@ -541,16 +543,18 @@ func (src *SSHAction) Clone() *SSHAction {
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _SSHActionCloneNeedsRegeneration = SSHAction(struct {
-	Message                   string
-	Reject                    bool
-	Accept                    bool
-	SessionDuration           time.Duration
-	AllowAgentForwarding      bool
-	HoldAndDelegate           string
-	AllowLocalPortForwarding  bool
-	AllowRemotePortForwarding bool
-	Recorders                 []netip.AddrPort
-	OnRecordingFailure        *SSHRecorderFailureAction
+	Message                          string
+	Reject                           bool
+	Accept                           bool
+	SessionDuration                  time.Duration
+	AllowAgentForwarding             bool
+	HoldAndDelegate                  string
+	AllowLocalPortForwarding         bool
+	AllowRemotePortForwarding        bool
+	LocalPortForwardingDestinations  []string
+	RemotePortForwardingDestinations []string
+	Recorders                        []netip.AddrPort
+	OnRecordingFailure               *SSHRecorderFailureAction
 }{})
 
 // Clone makes a deep copy of SSHPrincipal.
@@ -1488,14 +1488,20 @@ func (v *SSHActionView) UnmarshalJSONFrom(dec *jsontext.Decoder) error {
 	return nil
 }
 
-func (v SSHActionView) Message() string                        { return v.ж.Message }
-func (v SSHActionView) Reject() bool                           { return v.ж.Reject }
-func (v SSHActionView) Accept() bool                           { return v.ж.Accept }
-func (v SSHActionView) SessionDuration() time.Duration         { return v.ж.SessionDuration }
-func (v SSHActionView) AllowAgentForwarding() bool             { return v.ж.AllowAgentForwarding }
-func (v SSHActionView) HoldAndDelegate() string                { return v.ж.HoldAndDelegate }
-func (v SSHActionView) AllowLocalPortForwarding() bool         { return v.ж.AllowLocalPortForwarding }
-func (v SSHActionView) AllowRemotePortForwarding() bool        { return v.ж.AllowRemotePortForwarding }
+func (v SSHActionView) Message() string                 { return v.ж.Message }
+func (v SSHActionView) Reject() bool                    { return v.ж.Reject }
+func (v SSHActionView) Accept() bool                    { return v.ж.Accept }
+func (v SSHActionView) SessionDuration() time.Duration  { return v.ж.SessionDuration }
+func (v SSHActionView) AllowAgentForwarding() bool      { return v.ж.AllowAgentForwarding }
+func (v SSHActionView) HoldAndDelegate() string         { return v.ж.HoldAndDelegate }
+func (v SSHActionView) AllowLocalPortForwarding() bool  { return v.ж.AllowLocalPortForwarding }
+func (v SSHActionView) AllowRemotePortForwarding() bool { return v.ж.AllowRemotePortForwarding }
+func (v SSHActionView) LocalPortForwardingDestinations() views.Slice[string] {
+	return views.SliceOf(v.ж.LocalPortForwardingDestinations)
+}
+func (v SSHActionView) RemotePortForwardingDestinations() views.Slice[string] {
+	return views.SliceOf(v.ж.RemotePortForwardingDestinations)
+}
 func (v SSHActionView) Recorders() views.Slice[netip.AddrPort] { return views.SliceOf(v.ж.Recorders) }
 func (v SSHActionView) OnRecordingFailure() views.ValuePointer[SSHRecorderFailureAction] {
 	return views.ValuePointerOf(v.ж.OnRecordingFailure)
@@ -1503,16 +1509,18 @@ func (v SSHActionView) OnRecordingFailure() views.ValuePointer[SSHRecorderFailur
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _SSHActionViewNeedsRegeneration = SSHAction(struct {
-	Message                   string
-	Reject                    bool
-	Accept                    bool
-	SessionDuration           time.Duration
-	AllowAgentForwarding      bool
-	HoldAndDelegate           string
-	AllowLocalPortForwarding  bool
-	AllowRemotePortForwarding bool
-	Recorders                 []netip.AddrPort
-	OnRecordingFailure        *SSHRecorderFailureAction
+	Message                          string
+	Reject                           bool
+	Accept                           bool
+	SessionDuration                  time.Duration
+	AllowAgentForwarding             bool
+	HoldAndDelegate                  string
+	AllowLocalPortForwarding         bool
+	AllowRemotePortForwarding        bool
+	LocalPortForwardingDestinations  []string
+	RemotePortForwardingDestinations []string
+	Recorders                        []netip.AddrPort
+	OnRecordingFailure               *SSHRecorderFailureAction
 }{})
 
 // View returns a read-only view of SSHPrincipal.
@@ -59,12 +59,25 @@
 // the net.Conn that will be used as the underlying connection.
 type ConnCallback func(ctx Context, conn net.Conn) net.Conn
 
+// AuthenticatedCallback is a hook for connections whose client has been
+// authenticated, called with the permissions returned by the authentication
+// callback that succeeded, before any channels or requests are handled.
+type AuthenticatedCallback func(ctx Context, perms *gossh.Permissions)
+
 // LocalPortForwardingCallback is a hook for allowing port forwarding
 type LocalPortForwardingCallback func(ctx Context, destinationHost string, destinationPort uint32) bool
 
 // ReversePortForwardingCallback is a hook for allowing reverse port forwarding
 type ReversePortForwardingCallback func(ctx Context, bindHost string, bindPort uint32) bool
 
+// PortForwardingConnCallback is a hook for connections forwarded by
+// DirectTCPIPHandler and ForwardedTCPHandler. It allows wrapping, such as for
+// auditing, by returning the net.Conn that will be forwarded in place of conn.
+// For local port forwarding, conn was dialed to destination on behalf of origin,
+// as reported by the client. For reverse port forwarding, conn was accepted
+// from origin on destination, the forwarded address.
+type PortForwardingConnCallback func(ctx Context, reverse bool, destination, origin string, conn net.Conn) net.Conn
+
 // ServerConfigCallback is a hook for creating custom default server configs
 type ServerConfigCallback func(ctx Context) *gossh.ServerConfig
 
@@ -52,6 +52,10 @@ func DirectTCPIPHandler(srv *Server, conn *gossh.ServerConn, newChan gossh.NewCh
 		return
 	}
 	go gossh.DiscardRequests(reqs)
+	if srv.PortForwardingConnCallback != nil {
+		origin := net.JoinHostPort(d.OriginAddr, strconv.FormatInt(int64(d.OriginPort), 10))
+		dconn = srv.PortForwardingConnCallback(ctx, false, dest, origin, dconn)
+	}
 
 	go func() {
 		defer ch.Close()
@@ -94,6 +98,27 @@ type ForwardedTCPHandler struct {
 	sync.Mutex
 }
 
+// CloseForwardsFunc stops listening for the remote forwards for which f,
+// called with the address and port each was requested for, returns true.
+// Connections already forwarded are left open.
+func (h *ForwardedTCPHandler) CloseForwardsFunc(f func(bindHost string, bindPort uint32) bool) {
+	h.Lock()
+	defer h.Unlock()
+	for addr, ln := range h.forwards {
+		host, portStr, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		port, err := strconv.ParseUint(portStr, 10, 32)
+		if err != nil {
+			continue
+		}
+		if f(host, uint32(port)) {
+			ln.Close()
+		}
+	}
+}
+
 func (h *ForwardedTCPHandler) HandleSSHRequest(ctx Context, srv *Server, req *gossh.Request) (bool, []byte) {
 	h.Lock()
 	if h.forwards == nil {
@@ -155,6 +180,10 @@ func (h *ForwardedTCPHandler) HandleSSHRequest(ctx Context, srv *Server, req *go
 						return
 					}
 					go gossh.DiscardRequests(reqs)
+					if srv.PortForwardingConnCallback != nil {
+						dest := net.JoinHostPort(reqPayload.BindAddr, strconv.Itoa(destPort))
+						c = srv.PortForwardingConnCallback(ctx, true, dest, c.RemoteAddr().String(), c)
+					}
 					go func() {
 						defer ch.Close()
 						defer c.Close()
@@ -0,0 +1,344 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package boltchonk implements a tka.CompactableChonk that stores TKA state
+// in a single bbolt database file.
+//
+// Unlike tka.FS, which stores each AUM in a separate file, a Chonk only
+// needs a single file, and AUMs purged by compaction are actually deleted.
+package boltchonk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"tailscale.com/tka"
+)
+
+// Bucket names.
+var (
+	// aumsBucket maps an AUM hash to its commit time, as 8 bytes of
+	// big-endian unix seconds, followed by the serialized AUM.
+	aumsBucket = []byte("aums")
+
+	// childrenBucket contains a key for each stored AUM with a parent,
+	// consisting of the parent hash followed by the AUM's own hash. The
+	// values are empty.
+	childrenBucket = []byte("children")
+
+	// metaBucket contains other state, such as the last active ancestor.
+	metaBucket = []byte("meta")
+)
+
+// Keys in metaBucket.
+var (
+	lastActiveAncestorKey = []byte("last_active_ancestor")
+
+	// importedKey is present once Import has succeeded.
+	importedKey = []byte("imported")
+)
+
+const hashLen = len(tka.AUMHash{})
+
+// Chonk implements the tka.CompactableChonk interface using a bbolt
+// database.
+type Chonk struct {
+	db *bolt.DB
+}
+
+var _ tka.CompactableChonk = (*Chonk)(nil)
+
+// Open opens the database file at path, creating it if it doesn't exist.
+// The caller must call Close when done with the returned Chonk.
+func Open(path string) (*Chonk, error) {
+	// The timeout stops us from blocking forever if another process has
+	// the database open.
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{aumsBucket, childrenBucket, metaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("initializing %s: %w", path, err)
+	}
+	return &Chonk{db: db}, nil
+}
+
+// Close closes the underlying database.
+func (c *Chonk) Close() error {
+	return c.db.Close()
+}
+
+// decodeAUM decodes an aumsBucket value stored for hash h.
+func decodeAUM(h tka.AUMHash, v []byte) (aum tka.AUM, created time.Time, err error) {
+	if len(v) < 8 {
+		return tka.AUM{}, time.Time{}, fmt.Errorf("stored AUM %x is truncated", h)
+	}
+	created = time.Unix(int64(binary.BigEndian.Uint64(v)), 0)
+	if err := aum.Unserialize(v[8:]); err != nil {
+		return tka.AUM{}, time.Time{}, fmt.Errorf("decoding AUM %x: %w", h, err)
+	}
+	if aum.Hash() != h {
+		return tka.AUM{}, time.Time{}, fmt.Errorf("stored AUM %x has hash %x", h, aum.Hash())
+	}
+	return aum, created, nil
+}
+
+// encodeAUM returns the aumsBucket value for aum, committed at created.
+func encodeAUM(aum tka.AUM, created time.Time) []byte {
+	s := aum.Serialize()
+	v := make([]byte, 8, 8+len(s))
+	binary.BigEndian.PutUint64(v, uint64(created.Unix()))
+	return append(v, s...)
+}
+
+func getAUM(tx *bolt.Tx, h tka.AUMHash) (tka.AUM, time.Time, error) {
+	v := tx.Bucket(aumsBucket).Get(h[:])
+	if v == nil {
+		return tka.AUM{}, time.Time{}, os.ErrNotExist
+	}
+	return decodeAUM(h, v)
+}
+
+// AUM returns the AUM with the specified digest.
+//
+// If the AUM does not exist, then os.ErrNotExist is returned.
+func (c *Chonk) AUM(hash tka.AUMHash) (out tka.AUM, err error) {
+	err = c.db.View(func(tx *bolt.Tx) error {
+		out, _, err = getAUM(tx, hash)
+		return err
+	})
+	return out, err
+}
+
+// CommitTime returns the time at which the AUM was committed.
+//
+// If the AUM does not exist, then os.ErrNotExist is returned.
+func (c *Chonk) CommitTime(hash tka.AUMHash) (out time.Time, err error) {
+	err = c.db.View(func(tx *bolt.Tx) error {
+		_, out, err = getAUM(tx, hash)
+		return err
+	})
+	return out, err
+}
+
+// ChildAUMs returns all AUMs with a specified previous AUM hash, ordered
+// by their hash.
+func (c *Chonk) ChildAUMs(prevAUMHash tka.AUMHash) ([]tka.AUM, error) {
+	var out []tka.AUM
+	err := c.db.View(func(tx *bolt.Tx) error {
+		cur := tx.Bucket(childrenBucket).Cursor()
+		for k, _ := cur.Seek(prevAUMHash[:]); k != nil && bytes.HasPrefix(k, prevAUMHash[:]); k, _ = cur.Next() {
+			var h tka.AUMHash
+			copy(h[:], k[hashLen:])
+			aum, _, err := getAUM(tx, h)
+			if err != nil {
+				// We expect any AUM recorded as a child on its parent to exist.
+				return fmt.Errorf("reading child %x of %x: %w", h, prevAUMHash, err)
+			}
+			out = append(out, aum)
+		}
+		return nil
+	})
+	return out, err
+}
+
+// Heads returns AUMs for which there are no children. In other
+// words, the latest AUM in all possible chains (the 'leaves').
+func (c *Chonk) Heads() ([]tka.AUM, error) {
+	out := make([]tka.AUM, 0, 6) // 6 is arbitrary.
+	err := c.db.View(func(tx *bolt.Tx) error {
+		children := tx.Bucket(childrenBucket).Cursor()
+		return tx.Bucket(aumsBucket).ForEach(func(k, v []byte) error {
+			if ck, _ := children.Seek(k); ck != nil && bytes.HasPrefix(ck, k) {
+				return nil
+			}
+			var h tka.AUMHash
+			copy(h[:], k)
+			aum, _, err := decodeAUM(h, v)
+			if err != nil {
+				return err
+			}
+			out = append(out, aum)
+			return nil
+		})
+	})
+	return out, err
+}
+
+// AllAUMs returns all AUMs stored in the chonk.
+func (c *Chonk) AllAUMs() ([]tka.AUMHash, error) {
+	out := make([]tka.AUMHash, 0, 6) // 6 is arbitrary.
+	err := c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(aumsBucket).ForEach(func(k, _ []byte) error {
+			var h tka.AUMHash
+			copy(h[:], k)
+			out = append(out, h)
+			return nil
+		})
+	})
+	return out, err
+}
+
+// CommitVerifiedAUMs durably stores the provided AUMs.
+// Callers MUST ONLY provide AUMs which are verified (specifically,
+// a call to aumVerify must return a nil error), as the
+// implementation assumes that only verified AUMs are stored.
+func (c *Chonk) CommitVerifiedAUMs(updates []tka.AUM) error {
+	now := time.Now()
+	return c.db.Update(func(tx *bolt.Tx) error {
+		for i, aum := range updates {
+			if err := putAUM(tx, aum, now); err != nil {
+				return fmt.Errorf("committing update[%d] (%x): %w", i, aum.Hash(), err)
+			}
+		}
+		return nil
+	})
+}
+
+// putAUM stores aum with the given commit time, unless it is already
+// stored, in which case its original commit time is kept.
+func putAUM(tx *bolt.Tx, aum tka.AUM, created time.Time) error {
+	h := aum.Hash()
+	aums := tx.Bucket(aumsBucket)
+	if aums.Get(h[:]) != nil {
+		return nil
+	}
+	if err := aums.Put(h[:], encodeAUM(aum, created)); err != nil {
+		return err
+	}
+	if parent, ok := aum.Parent(); ok {
+		return tx.Bucket(childrenBucket).Put(childKey(parent, h), nil)
+	}
+	return nil
+}
+
+func childKey(parent, child tka.AUMHash) []byte {
+	k := make([]byte, 0, 2*hashLen)
+	k = append(k, parent[:]...)
+	return append(k, child[:]...)
+}
+
+// PurgeAUMs permanently and irrevocably deletes the specified
+// AUMs from storage.
+//
+// Records of the children of a purged AUM are kept, so ChildAUMs
+// continues to return them.
+func (c *Chonk) PurgeAUMs(hashes []tka.AUMHash) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		for i, h := range hashes {
+			aum, _, err := getAUM(tx, h)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("reading %d (%x): %w", i, h, err)
+			}
+			if err := tx.Bucket(aumsBucket).Delete(h[:]); err != nil {
+				return fmt.Errorf("purging %d (%x): %w", i, h, err)
+			}
+			if parent, ok := aum.Parent(); ok {
+				if err := tx.Bucket(childrenBucket).Delete(childKey(parent, h)); err != nil {
+					return fmt.Errorf("purging %d (%x): %w", i, h, err)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// SetLastActiveAncestor is called to record the oldest-known AUM
+// that contributed to the current state. This value is used as
+// a hint on next startup to determine which chain to pick when computing
+// the current state, if there are multiple distinct chains.
+func (c *Chonk) SetLastActiveAncestor(hash tka.AUMHash) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).Put(lastActiveAncestorKey, hash[:])
+	})
+}
+
+// LastActiveAncestor returns the oldest-known AUM that was (in a
+// previous run) an ancestor of the current state. This is used
+// as a hint to pick the correct chain in the event that the Chonk stores
+// multiple distinct chains.
+//
+// Nil is returned if no last-active ancestor is set.
+func (c *Chonk) LastActiveAncestor() (*tka.AUMHash, error) {
+	var out *tka.AUMHash
+	err := c.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(metaBucket).Get(lastActiveAncestorKey)
+		if v == nil {
+			return nil
+		}
+		if len(v) != hashLen {
+			return fmt.Errorf("stored hash is of wrong length: %d != %d", len(v), hashLen)
+		}
+		out = new(tka.AUMHash)
+		copy(out[:], v)
+		return nil
+	})
+	return out, err
+}
+
+// Import copies all AUMs stored in src into c, keeping their commit
+// times, along with the last active ancestor of src if it has one. AUMs
+// already present in c are left unchanged. Once Import succeeds, Imported
+// reports true.
+//
+// All changes are made in a single transaction, so if Import fails, c is
+// unchanged.
+func (c *Chonk) Import(src tka.CompactableChonk) error {
+	hashes, err := src.AllAUMs()
+	if err != nil {
+		return fmt.Errorf("listing AUMs: %w", err)
+	}
+	lastActive, err := src.LastActiveAncestor()
+	if err != nil {
+		return fmt.Errorf("reading last active ancestor: %w", err)
+	}
+	return c.db.Update(func(tx *bolt.Tx) error {
+		for _, h := range hashes {
+			aum, err := src.AUM(h)
+			if err != nil {
+				return fmt.Errorf("reading %x: %w", h, err)
+			}
+			created, err := src.CommitTime(h)
+			if err != nil {
+				return fmt.Errorf("reading commit time of %x: %w", h, err)
+			}
+			if err := putAUM(tx, aum, created); err != nil {
+				return fmt.Errorf("importing %x: %w", h, err)
+			}
+		}
+		meta := tx.Bucket(metaBucket)
+		if lastActive != nil {
+			if err := meta.Put(lastActiveAncestorKey, lastActive[:]); err != nil {
+				return err
+			}
+		}
+		return meta.Put(importedKey, nil)
+	})
+}
+
+// Imported reports whether Import has succeeded on c.
+func (c *Chonk) Imported() (bool, error) {
+	var imported bool
+	err := c.db.View(func(tx *bolt.Tx) error {
+		imported = tx.Bucket(metaBucket).Get(importedKey) != nil
+		return nil
+	})
+	return imported, err
+}
@@ -0,0 +1,181 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package boltchonk
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"tailscale.com/tka"
+)
+
+func openTest(t *testing.T, path string) *Chonk {
+	t.Helper()
+	c, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+var hashesLess = func(a, b tka.AUMHash) bool {
+	return bytes.Compare(a[:], b[:]) < 0
+}
+
+// testChain returns a genesis AUM with two children, the first of which
+// has a child of its own.
+func testChain() (genesis, left, right, leaf tka.AUM) {
+	genesis = tka.AUM{MessageKind: tka.AUMRemoveKey, KeyID: []byte{1, 2}}
+	gh := genesis.Hash()
+	left = tka.AUM{MessageKind: tka.AUMNoOp, PrevAUMHash: gh[:]}
+	right = tka.AUM{MessageKind: tka.AUMRemoveKey, KeyID: []byte{3, 4}, PrevAUMHash: gh[:]}
+	lh := left.Hash()
+	leaf = tka.AUM{MessageKind: tka.AUMNoOp, PrevAUMHash: lh[:]}
+	return genesis, left, right, leaf
+}
+
+func TestChonk(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tka.db")
+	c := openTest(t, path)
+	genesis, left, right, leaf := testChain()
+	if err := c.CommitVerifiedAUMs([]tka.AUM{genesis, left, right, leaf}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := c.AUM(left.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(left, got); diff != "" {
+		t.Errorf("AUM differs (-want, +got):\n%s", diff)
+	}
+	var missing tka.AUMHash
+	missing[0] = 42
+	if _, err := c.AUM(missing); err != os.ErrNotExist {
+		t.Errorf("AUM(missing).err = %v, want %v", err, os.ErrNotExist)
+	}
+	ct, err := c.CommitTime(genesis.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(ct) > time.Minute {
+		t.Errorf("commit time %v more than a minute before now", ct)
+	}
+
+	aumLess := func(a, b tka.AUM) bool { return hashesLess(a.Hash(), b.Hash()) }
+	children, err := c.ChildAUMs(genesis.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]tka.AUM{left, right}, children, cmpopts.SortSlices(aumLess)); diff != "" {
+		t.Errorf("ChildAUMs differs (-want, +got):\n%s", diff)
+	}
+	heads, err := c.Heads()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]tka.AUM{right, leaf}, heads, cmpopts.SortSlices(aumLess)); diff != "" {
+		t.Errorf("Heads differs (-want, +got):\n%s", diff)
+	}
+
+	if err := c.PurgeAUMs([]tka.AUMHash{genesis.Hash(), right.Hash()}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.AUM(genesis.Hash()); err != os.ErrNotExist {
+		t.Errorf("AUM() on purged AUM returned err = %v, want ErrNotExist", err)
+	}
+	all, err := c.AllAUMs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]tka.AUMHash{left.Hash(), leaf.Hash()}, all, cmpopts.SortSlices(hashesLess)); diff != "" {
+		t.Errorf("AllAUMs after purge differs (-want, +got):\n%s", diff)
+	}
+	children, err = c.ChildAUMs(genesis.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]tka.AUM{left}, children); diff != "" {
+		t.Errorf("ChildAUMs of purged AUM differs (-want, +got):\n%s", diff)
+	}
+
+	// State persists across reopening the database.
+	if err := c.SetLastActiveAncestor(left.Hash()); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	c = openTest(t, path)
+	laa, err := c.LastActiveAncestor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if laa == nil || *laa != left.Hash() {
+		t.Errorf("LastActiveAncestor() = %v, want %v", laa, left.Hash())
+	}
+	if _, err := c.AUM(leaf.Hash()); err != nil {
+		t.Errorf("AUM(leaf) after reopen: %v", err)
+	}
+}
+
+func TestImport(t *testing.T) {
+	dir := t.TempDir()
+	old, err := tka.ChonkDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis, left, right, leaf := testChain()
+	if err := old.CommitVerifiedAUMs([]tka.AUM{genesis, left, right, leaf}); err != nil {
+		t.Fatal(err)
+	}
+	if err := old.SetLastActiveAncestor(genesis.Hash()); err != nil {
+		t.Fatal(err)
+	}
+	if err := old.PurgeAUMs([]tka.AUMHash{right.Hash()}); err != nil {
+		t.Fatal(err)
+	}
+	wantTime, err := old.CommitTime(leaf.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := openTest(t, filepath.Join(dir, "tka.db"))
+	if imported, err := c.Imported(); err != nil || imported {
+		t.Fatalf("Imported() before Import = %v, %v; want false", imported, err)
+	}
+	if err := c.Import(old); err != nil {
+		t.Fatal(err)
+	}
+	if imported, err := c.Imported(); err != nil || !imported {
+		t.Errorf("Imported() after Import = %v, %v; want true", imported, err)
+	}
+
+	all, err := c.AllAUMs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []tka.AUMHash{genesis.Hash(), left.Hash(), leaf.Hash()}
+	if diff := cmp.Diff(want, all, cmpopts.SortSlices(hashesLess)); diff != "" {
+		t.Errorf("migrated AUMs differ (-want, +got):\n%s", diff)
+	}
+	if got, err := c.CommitTime(leaf.Hash()); err != nil || !got.Equal(wantTime) {
+		t.Errorf("CommitTime(leaf) = %v, %v; want %v", got, err, wantTime)
+	}
+	if laa, err := c.LastActiveAncestor(); err != nil || laa == nil || *laa != genesis.Hash() {
+		t.Errorf("LastActiveAncestor() = %v, %v; want %v", laa, err, genesis.Hash())
+	}
+
+	// Importing again keeps the existing AUMs.
+	if err := c.Import(old); err != nil {
+		t.Fatal(err)
+	}
+	if all, err := c.AllAUMs(); err != nil || len(all) != len(want) {
+		t.Errorf("AllAUMs() after second import = %v, %v; want %d AUMs", all, err, len(want))
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tka
+
+import (
+	"bytes"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"tailscale.com/types/key"
+)
+
+// SigningRequest carries changes to be signed by a tailnet lock key held
+// elsewhere, such as on an air-gapped machine, and back again once signed.
+//
+// A request carries either a chain of AUMs, or a node-key signature.
+type SigningRequest struct {
+	// AUMs is a chain of updates to the authority, ordered oldest to
+	// newest. The first AUM's parent is the head of the authority the
+	// request was generated from.
+	AUMs []AUM `cbor:"1,keyasint,omitempty"`
+
+	// NodeKeySig is a node-key signature to be signed.
+	NodeKeySig *NodeKeySignature `cbor:"2,keyasint,omitempty"`
+}
+
+// signingRequestTextPrefix is the prefix of the text encoding of
+// a SigningRequest.
+const signingRequestTextPrefix = "TLSR1:"
+
+// signingRequestEncoding only uses characters that can be encoded in the
+// alphanumeric mode of QR codes.
+var signingRequestEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Serialize returns the given request in a serialized format.
+func (r *SigningRequest) Serialize() []byte {
+	out := bytes.NewBuffer(make([]byte, 0, 256))
+	encoder, err := cbor.CTAP2EncOptions().EncMode()
+	if err != nil {
+		// Deterministic validation of encoding options, should
+		// never fail.
+		panic(err)
+	}
+	if err := encoder.NewEncoder(out).Encode(r); err != nil {
+		// Writing to a bytes.Buffer should never fail.
+		panic(err)
+	}
+	return out.Bytes()
+}
+
+// Unserialize decodes bytes representing a marshaled request.
+func (r *SigningRequest) Unserialize(data []byte) error {
+	dec, _ := cborDecOpts.DecMode()
+	if err := dec.Unmarshal(data, r); err != nil {
+		return err
+	}
+	return r.staticValidate()
+}
+
+func (r *SigningRequest) staticValidate() error {
+	switch {
+	case len(r.AUMs) == 0 && r.NodeKeySig == nil:
+		return errors.New("empty signing request")
+	case len(r.AUMs) > 0 && r.NodeKeySig != nil:
+		return errors.New("signing request has both AUMs and a node-key signature")
+	}
+	for i := range r.AUMs {
+		if err := r.AUMs[i].StaticValidate(); err != nil {
+			return fmt.Errorf("AUM %d: %v", i, err)
+		}
+		if i == 0 {
+			continue
+		}
+		if parent, _ := r.AUMs[i].Parent(); parent != r.AUMs[i-1].Hash() {
+			return fmt.Errorf("AUM %d does not follow AUM %d", i, i-1)
+		}
+	}
+	if r.NodeKeySig != nil && r.NodeKeySig.SigKind != SigDirect {
+		return fmt.Errorf("unsupported node-key signature kind %v", r.NodeKeySig.SigKind)
+	}
+	return nil
+}
+
+// Text returns the request encoded as text, split across lines of at most
+// 64 characters. It only uses characters that can be encoded in the
+// alphanumeric mode of QR codes.
+func (r *SigningRequest) Text() string {
+	enc := signingRequestTextPrefix + signingRequestEncoding.EncodeToString(r.Serialize())
+	var b strings.Builder
+	for len(enc) > 64 {
+		b.WriteString(enc[:64])
+		b.WriteByte('\n')
+		enc = enc[64:]
+	}
+	b.WriteString(enc)
+	b.WriteByte('\n')
+	return b.String()
+}
+
+// ParseSigningRequest decodes a request in the format returned by Text.
+// Whitespace is ignored.
+func ParseSigningRequest(text string) (*SigningRequest, error) {
+	text = strings.Join(strings.Fields(text), "")
+	enc, ok := strings.CutPrefix(text, signingRequestTextPrefix)
+	if !ok {
+		return nil, fmt.Errorf("not a signing request: missing %q prefix", signingRequestTextPrefix)
+	}
+	data, err := signingRequestEncoding.DecodeString(enc)
+	if err != nil {
+		return nil, fmt.Errorf("decoding signing request: %v", err)
+	}
+	r := new(SigningRequest)
+	if err := r.Unserialize(data); err != nil {
+		return nil, fmt.Errorf("decoding signing request: %v", err)
+	}
+	return r, nil
+}
+
+// Signed reports whether the request carries any signatures.
+func (r *SigningRequest) Signed() bool {
+	for _, aum := range r.AUMs {
+		if len(aum.Signatures) > 0 {
+			return true
+		}
+	}
+	return r.NodeKeySig != nil && len(r.NodeKeySig.Signature) > 0
+}
+
+// Sign signs the request with priv.
+//
+// As the hash of an AUM covers its signatures, the parent hash of each
+// AUM after the first is updated to match the signed AUM before it, so
+// a request can only be signed once.
+func (r *SigningRequest) Sign(priv key.NLPrivate) error {
+	if err := r.staticValidate(); err != nil {
+		return err
+	}
+	if r.Signed() {
+		return errors.New("signing request is already signed")
+	}
+	for i := range r.AUMs {
+		aum := &r.AUMs[i]
+		if i > 0 {
+			prev := r.AUMs[i-1].Hash()
+			aum.PrevAUMHash = prev[:]
+		}
+		sigs, err := priv.SignAUM(aum.SigHash())
+		if err != nil {
+			return fmt.Errorf("signing AUM %d: %v", i, err)
+		}
+		aum.Signatures = sigs
+	}
+	if r.NodeKeySig != nil {
+		r.NodeKeySig.KeyID = priv.KeyID()
+		sig, err := priv.SignNKS(r.NodeKeySig.SigHash())
+		if err != nil {
+			return fmt.Errorf("signing node-key signature: %v", err)
+		}
+		r.NodeKeySig.Signature = sig
+	}
+	return nil
+}
+
+// Describe returns a human-readable description of the changes in the
+// request, for review before signing.
+func (r *SigningRequest) Describe() string {
+	var b strings.Builder
+	for i, aum := range r.AUMs {
+		fmt.Fprintf(&b, "AUM %d: %s", i, aum.MessageKind)
+		switch aum.MessageKind {
+		case AUMAddKey:
+			if aum.Key != nil {
+				if keyID, err := aum.Key.ID(); err == nil {
+					fmt.Fprintf(&b, " tlpub:%x (votes: %d)", []byte(keyID), aum.Key.Votes)
+				} else {
+					fmt.Fprintf(&b, " <Error: %v>", err)
+				}
+			}
+		case AUMRemoveKey, AUMUpdateKey:
+			fmt.Fprintf(&b, " tlpub:%x", []byte(aum.KeyID))
+		}
+		if i == 0 {
+			if parent, ok := aum.Parent(); ok {
+				fmt.Fprintf(&b, " (parent %s)", parent)
+			}
+		}
+		b.WriteByte('\n')
+	}
+	if s := r.NodeKeySig; s != nil {
+		var nodeKey key.NodePublic
+		if err := nodeKey.UnmarshalBinary(s.Pubkey); err != nil {
+			fmt.Fprintf(&b, "Node-key signature: invalid node key: %v\n", err)
+		} else {
+			fmt.Fprintf(&b, "Node-key signature: %v\n", nodeKey)
+		}
+		if len(s.WrappingPubkey) > 0 {
+			fmt.Fprintf(&b, "  rotation key: %x\n", s.WrappingPubkey)
+		}
+	}
+	return b.String()
+}
+
+// CheckUpdates returns a nil error if updates are a chain of AUMs which
+// follow from the current head of the authority and would be accepted by
+// Inform. Storage is not modified.
+func (a *Authority) CheckUpdates(updates []AUM) error {
+	if len(updates) == 0 {
+		return errors.New("no updates")
+	}
+	state := a.state
+	for i, update := range updates {
+		if err := aumVerify(update, state, false); err != nil {
+			return fmt.Errorf("update %d invalid: %v", i, err)
+		}
+		var err error
+		if state, err = state.applyVerifiedAUM(update); err != nil {
+			return fmt.Errorf("update %d cannot be applied: %v", i, err)
+		}
+	}
+	return nil
+}
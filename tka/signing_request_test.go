@@ -0,0 +1,175 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tka
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"tailscale.com/types/key"
+)
+
+func TestSigningRequestAUMs(t *testing.T) {
+	offlinePriv := key.NewNLPrivate()
+	offlineKey := Key{Kind: Key25519, Votes: 1, Public: offlinePriv.Public().KeyID()}
+	pub2 := key.NewNLPrivate().Public()
+	key2 := Key{Kind: Key25519, Votes: 1, Public: pub2.KeyID()}
+	pub3 := key.NewNLPrivate().Public()
+	key3 := Key{Kind: Key25519, Votes: 1, Public: pub3.KeyID()}
+
+	storage := &Mem{}
+	a, _, err := Create(storage, State{
+		Keys:               []Key{offlineKey},
+		DisablementSecrets: [][]byte{DisablementKDF([]byte{1, 2, 3})},
+	}, offlinePriv)
+	if err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+
+	// Build an unsigned chain of updates, as a node without the trusted key
+	// would.
+	b := a.NewUpdater(nil)
+	if err := b.AddKey(key2); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AddKey(key3); err != nil {
+		t.Fatal(err)
+	}
+	updates, err := b.Finalize(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.CheckUpdates(updates); err == nil {
+		t.Error("CheckUpdates() of unsigned updates succeeded, want error")
+	}
+
+	// Round-trip through the text encoding and sign it offline.
+	text := (&SigningRequest{AUMs: updates}).Text()
+	for _, line := range strings.Split(strings.TrimSpace(text), "\n") {
+		if len(line) > 64 {
+			t.Errorf("line %q is longer than 64 characters", line)
+		}
+		if strings.ToUpper(line) != line {
+			t.Errorf("line %q is not upper case", line)
+		}
+	}
+	req, err := ParseSigningRequest(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(updates, req.AUMs); diff != "" {
+		t.Errorf("decoded AUMs differ (-want, +got):\n%s", diff)
+	}
+	if err := req.Sign(offlinePriv); err != nil {
+		t.Fatal(err)
+	}
+	if err := req.Sign(offlinePriv); err == nil {
+		t.Error("signing twice succeeded, want error")
+	}
+	signed, err := ParseSigningRequest(req.Text())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.CheckUpdates(signed.AUMs); err != nil {
+		t.Fatalf("CheckUpdates() of signed updates failed: %v", err)
+	}
+	if _, err := storage.AUM(signed.AUMs[0].Hash()); err == nil {
+		t.Error("CheckUpdates() committed an AUM to storage")
+	}
+	if err := a.Inform(storage, signed.AUMs); err != nil {
+		t.Fatalf("Inform() failed: %v", err)
+	}
+	if !a.KeyTrusted(pub2.KeyID()) || !a.KeyTrusted(pub3.KeyID()) {
+		t.Error("added keys are not trusted")
+	}
+
+	// Updates no longer apply once the head has moved.
+	if err := a.CheckUpdates(signed.AUMs); err == nil {
+		t.Error("CheckUpdates() of already-applied updates succeeded, want error")
+	}
+}
+
+func TestSigningRequestUntrustedSigner(t *testing.T) {
+	priv := key.NewNLPrivate()
+	storage := &Mem{}
+	a, _, err := Create(storage, State{
+		Keys:               []Key{{Kind: Key25519, Votes: 1, Public: priv.Public().KeyID()}},
+		DisablementSecrets: [][]byte{DisablementKDF([]byte{1, 2, 3})},
+	}, priv)
+	if err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+	b := a.NewUpdater(nil)
+	if err := b.AddKey(Key{Kind: Key25519, Votes: 1, Public: key.NewNLPrivate().Public().KeyID()}); err != nil {
+		t.Fatal(err)
+	}
+	updates, err := b.Finalize(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := &SigningRequest{AUMs: updates}
+	if err := req.Sign(key.NewNLPrivate()); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.CheckUpdates(req.AUMs); err == nil {
+		t.Error("CheckUpdates() of updates signed by an untrusted key succeeded, want error")
+	}
+}
+
+func TestSigningRequestNodeKey(t *testing.T) {
+	priv := key.NewNLPrivate()
+	a, _, err := Create(&Mem{}, State{
+		Keys:               []Key{{Kind: Key25519, Votes: 1, Public: priv.Public().KeyID()}},
+		DisablementSecrets: [][]byte{DisablementKDF([]byte{1, 2, 3})},
+	}, priv)
+	if err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+
+	nodeKey := key.NewNode().Public()
+	nkBytes, err := nodeKey.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &SigningRequest{NodeKeySig: &NodeKeySignature{SigKind: SigDirect, Pubkey: nkBytes}}
+	if got := req.Describe(); !strings.Contains(got, nodeKey.String()) {
+		t.Errorf("Describe() = %q, want it to mention %v", got, nodeKey)
+	}
+	req, err = ParseSigningRequest(req.Text())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := req.Sign(priv); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.NodeKeyAuthorized(nodeKey, req.NodeKeySig.Serialize()); err != nil {
+		t.Errorf("NodeKeyAuthorized() failed: %v", err)
+	}
+}
+
+func TestParseSigningRequestErrors(t *testing.T) {
+	tests := []struct {
+		name, text, wantErr string
+	}{
+		{"no-prefix", "ABCDEF", "missing"},
+		{"bad-encoding", signingRequestTextPrefix + "!!", "decoding"},
+		{"empty", (&SigningRequest{}).Text(), "empty signing request"},
+		{
+			"rotation",
+			(&SigningRequest{NodeKeySig: &NodeKeySignature{SigKind: SigRotation}}).Text(),
+			"unsupported node-key signature kind",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseSigningRequest(tt.text)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ParseSigningRequest() err = %v, want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
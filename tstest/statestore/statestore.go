@@ -0,0 +1,130 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package statestore contains a reference implementation of the HTTP state
+// server used by tailscale.com/ipn/store/httpstore, for use in tests.
+package statestore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Server is an in-memory HTTP state server. Its zero value is ready to use
+// and accepts all requests.
+//
+// It serves the key space at any path; the last path element is the key
+// name, and a path ending in a slash lists all keys.
+type Server struct {
+	// Token, if non-empty, is the bearer token that requests must present.
+	Token string
+
+	mu       sync.Mutex
+	vals     map[string]value
+	lastETag int
+	requests int
+}
+
+type value struct {
+	data []byte
+	etag string
+}
+
+// Requests returns the number of requests handled so far.
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// Get returns the value of key and whether it exists.
+func (s *Server) Get(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.vals[key]
+	return v.data, ok
+}
+
+// Set sets the value of key, as if by another client, giving it a new ETag.
+func (s *Server) Set(key string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setLocked(key, data)
+}
+
+func (s *Server) setLocked(key string, data []byte) string {
+	if s.vals == nil {
+		s.vals = make(map[string]value)
+	}
+	s.lastETag++
+	etag := fmt.Sprintf(`"%d"`, s.lastETag)
+	s.vals[key] = value{data: data, etag: etag}
+	return etag
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+
+	if s.Token != "" && r.Header.Get("Authorization") != "Bearer "+s.Token {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if strings.HasSuffix(r.URL.Path, "/") {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		type item struct {
+			Value []byte `json:"value"`
+			ETag  string `json:"etag"`
+		}
+		all := make(map[string]item)
+		for k, v := range s.vals {
+			all[k] = item{v.data, v.etag}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(all)
+		return
+	}
+
+	key := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	cur, exists := s.vals[key]
+	switch r.Method {
+	case http.MethodGet:
+		if !exists {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", cur.etag)
+		w.Write(cur.data)
+	case http.MethodPut:
+		if im := r.Header.Get("If-Match"); im != "" && (!exists || im != cur.etag) {
+			http.Error(w, "precondition failed", http.StatusPreconditionFailed)
+			return
+		}
+		if r.Header.Get("If-None-Match") == "*" && exists {
+			http.Error(w, "precondition failed", http.StatusPreconditionFailed)
+			return
+		}
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("ETag", s.setLocked(key, data))
+		if exists {
+			w.WriteHeader(http.StatusNoContent)
+		} else {
+			w.WriteHeader(http.StatusCreated)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
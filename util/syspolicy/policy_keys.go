@@ -171,9 +171,65 @@
 	// would otherwise obtain from the OS, e.g. by calling os.Hostname().
 	Hostname Key = "Hostname"
 
+	// SSHRecordingDir is the directory in which Tailscale SSH sessions are
+	// recorded when the tailnet's SSH policy does not specify recorders for
+	// them. Recordings are kept with a hash chain that makes tampering with
+	// them detectable; see the sessionrecording package. If blank, sessions
+	// are only recorded as specified by the SSH policy.
+	SSHRecordingDir Key = "SSHRecording.Dir"
+	// SSHRecordingMaxSize is the total size, in bytes, of the recordings to
+	// keep in [SSHRecordingDir]. The oldest recordings are removed when it is
+	// exceeded. Zero or unset means no limit.
+	SSHRecordingMaxSize Key = "SSHRecording.MaxSize"
+	// SSHRecordingMaxAge is a string value formatted for use with
+	// time.ParseDuration() that defines how long to keep recordings in
+	// [SSHRecordingDir]. An empty string or a zero duration means no limit.
+	SSHRecordingMaxAge Key = "SSHRecording.MaxAge"
+	// SSHUserCAMode is whether Tailscale SSH clients may ("optional"), or
+	// must ("required"), authenticate with an OpenSSH user certificate signed
+	// by one of the CAs in [SSHUserCATrustedKeys], in addition to being
+	// permitted by the tailnet's SSH policy. It defaults to "optional" when
+	// trusted CA keys are configured, and has no effect otherwise.
+	SSHUserCAMode Key = "SSHUserCA.Mode"
+	// AppConnectorRouteExpiry is a string value formatted for use with
+	// time.ParseDuration() that defines how long an app connector keeps
+	// advertising a route learned from a DNS response after the response's
+	// TTL has passed without the address being observed again, as long as
+	// the route carries no active flows. An empty string or a zero duration
+	// means learned routes never expire.
+	AppConnectorRouteExpiry Key = "AppConnector.RouteExpiry"
+	// AppConnectorAggregateThreshold is the number of routes an app
+	// connector learns from DNS responses within a /24 (or IPv6 /64) at
+	// which it advertises the whole prefix instead. Zero or unset disables
+	// aggregation.
+	AppConnectorAggregateThreshold Key = "AppConnector.AggregateThreshold"
+
 	// Keys with a string array value.
 	// AllowedSuggestedExitNodes's string array value is a list of exit node IDs that restricts which exit nodes are considered when generating suggestions for exit nodes.
 	AllowedSuggestedExitNodes Key = "AllowedSuggestedExitNodes"
+	// NetworkLogSinks is a list of local destinations for network flow logs,
+	// in addition to the Tailscale log service. Each entry is one of
+	// "file:<path>", "unix:<socket-path>", "ipfix:<host:port>" or
+	// "netflow9:<host:port>". Flows are logged to local sinks even if network
+	// flow logging is not enabled for the tailnet.
+	NetworkLogSinks Key = "NetworkLogSinks"
+	// TaildropReceiveRules is an ordered list of rules deciding whether
+	// files sent to this device with Taildrop are received as usual, moved
+	// into a directory automatically, or rejected, based on the sender,
+	// file name and size. Each rule is a list of space-separated key=value
+	// fields, such as "from=tag:ci name=*.tar.gz max-size=2G action=accept
+	// dir=/srv/artifacts". See the feature/taildrop package for details.
+	TaildropReceiveRules Key = "TaildropReceiveRules"
+	// SSHUserCATrustedKeys is a list of the public keys, in authorized_keys
+	// format, of the certificate authorities whose user certificates
+	// Tailscale SSH accepts. See [SSHUserCAMode].
+	SSHUserCATrustedKeys Key = "SSHUserCA.TrustedKeys"
+	// SSHUserCAPrincipalMap maps the principals of user certificates to the
+	// local users they may log in as. Each entry is "principal=user", where
+	// principal may be "*" to match any principal not otherwise listed, and
+	// user may be "=" to mean the user named by the principal. If empty,
+	// principals map to the local users of the same name.
+	SSHUserCAPrincipalMap Key = "SSHUserCA.PrincipalMap"
 )
 
 // implicitDefinitions is a list of [setting.Definition] that will be registered
@@ -182,6 +238,8 @@
 var implicitDefinitions = []*setting.Definition{
 	// Device policy settings (can only be configured on a per-device basis):
 	setting.NewDefinition(AllowedSuggestedExitNodes, setting.DeviceSetting, setting.StringListValue),
+	setting.NewDefinition(AppConnectorAggregateThreshold, setting.DeviceSetting, setting.IntegerValue),
+	setting.NewDefinition(AppConnectorRouteExpiry, setting.DeviceSetting, setting.DurationValue),
 	setting.NewDefinition(AllowExitNodeOverride, setting.DeviceSetting, setting.BooleanValue),
 	setting.NewDefinition(AlwaysOn, setting.DeviceSetting, setting.BooleanValue),
 	setting.NewDefinition(AlwaysOnOverrideWithReason, setting.DeviceSetting, setting.BooleanValue),
@@ -205,8 +263,16 @@
 	setting.NewDefinition(LogSCMInteractions, setting.DeviceSetting, setting.BooleanValue),
 	setting.NewDefinition(LogTarget, setting.DeviceSetting, setting.StringValue),
 	setting.NewDefinition(MachineCertificateSubject, setting.DeviceSetting, setting.StringValue),
+	setting.NewDefinition(NetworkLogSinks, setting.DeviceSetting, setting.StringListValue),
 	setting.NewDefinition(PostureChecking, setting.DeviceSetting, setting.PreferenceOptionValue),
 	setting.NewDefinition(ReconnectAfter, setting.DeviceSetting, setting.DurationValue),
+	setting.NewDefinition(SSHRecordingDir, setting.DeviceSetting, setting.StringValue),
+	setting.NewDefinition(SSHRecordingMaxAge, setting.DeviceSetting, setting.DurationValue),
+	setting.NewDefinition(SSHRecordingMaxSize, setting.DeviceSetting, setting.IntegerValue),
+	setting.NewDefinition(SSHUserCAMode, setting.DeviceSetting, setting.StringValue),
+	setting.NewDefinition(SSHUserCAPrincipalMap, setting.DeviceSetting, setting.StringListValue),
+	setting.NewDefinition(SSHUserCATrustedKeys, setting.DeviceSetting, setting.StringListValue),
+	setting.NewDefinition(TaildropReceiveRules, setting.DeviceSetting, setting.StringListValue),
 	setting.NewDefinition(Tailnet, setting.DeviceSetting, setting.StringValue),
 
 	// User policy settings (can be configured on a user- or device-basis):
@@ -0,0 +1,329 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netlog
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"tailscale.com/types/ipproto"
+	"tailscale.com/types/netlogtype"
+)
+
+// FlowFormat is the wire format used by a FlowExporter.
+type FlowFormat int
+
+const (
+	// IPFIX is the IP Flow Information Export protocol, per RFC 7011.
+	IPFIX FlowFormat = 10
+	// NetFlowV9 is Cisco NetFlow version 9, per RFC 3954.
+	NetFlowV9 FlowFormat = 9
+)
+
+// maxFlowPacketSize is the maximum size of an exported UDP packet, chosen to
+// avoid fragmentation on typical paths.
+const maxFlowPacketSize = 1400
+
+// Template IDs, which must be at least 256.
+const (
+	templateIPv4 = 256
+	templateIPv6 = 257
+)
+
+// Information element IDs. These are shared by IPFIX and NetFlow v9.
+const (
+	ieOctetDeltaCount          = 1
+	iePacketDeltaCount         = 2
+	ieProtocolIdentifier       = 4
+	ieSourceTransportPort      = 7
+	ieSourceIPv4Address        = 8
+	ieDestinationTransportPort = 11
+	ieDestinationIPv4Address   = 12
+	ieLastSwitched             = 21 // NetFlow v9 only
+	ieFirstSwitched            = 22 // NetFlow v9 only
+	ieSourceIPv6Address        = 27
+	ieDestinationIPv6Address   = 28
+	ieFlowDirection            = 61
+	ieFlowStartMilliseconds    = 152 // IPFIX only
+	ieFlowEndMilliseconds      = 153 // IPFIX only
+)
+
+// Values of the flowDirection information element.
+const (
+	flowIngress = 0
+	flowEgress  = 1
+)
+
+type templateField struct {
+	id, length uint16
+}
+
+// templateFields returns the fields of the template for IPv4 or IPv6
+// records in format f. The encoding of records in appendRecord must match.
+func (f FlowFormat) templateFields(is6 bool) []templateField {
+	addrLen, srcAddr, dstAddr := uint16(4), uint16(ieSourceIPv4Address), uint16(ieDestinationIPv4Address)
+	if is6 {
+		addrLen, srcAddr, dstAddr = 16, ieSourceIPv6Address, ieDestinationIPv6Address
+	}
+	fields := []templateField{
+		{ieProtocolIdentifier, 1},
+		{srcAddr, addrLen},
+		{ieSourceTransportPort, 2},
+		{dstAddr, addrLen},
+		{ieDestinationTransportPort, 2},
+		{ieFlowDirection, 1},
+		{ieOctetDeltaCount, 8},
+		{iePacketDeltaCount, 8},
+	}
+	if f == IPFIX {
+		return append(fields, templateField{ieFlowStartMilliseconds, 8}, templateField{ieFlowEndMilliseconds, 8})
+	}
+	return append(fields, templateField{ieFirstSwitched, 4}, templateField{ieLastSwitched, 4})
+}
+
+// flowRecord is a unidirectional flow.
+type flowRecord struct {
+	proto    ipproto.Proto
+	src, dst netip.AddrPort
+	egress   bool
+	packets  uint64
+	bytes    uint64
+}
+
+func (r *flowRecord) is6() bool {
+	return r.src.Addr().Is6() || r.dst.Addr().Is6()
+}
+
+// flowRecords splits the bidirectional connection counts in m into
+// unidirectional flows, as flow collectors expect.
+func flowRecords(m *netlogtype.Message) []flowRecord {
+	var out []flowRecord
+	for _, traffic := range [][]netlogtype.ConnectionCounts{m.VirtualTraffic, m.SubnetTraffic, m.ExitTraffic, m.PhysicalTraffic} {
+		for _, cc := range traffic {
+			if cc.TxPackets > 0 || cc.TxBytes > 0 {
+				out = append(out, flowRecord{cc.Proto, cc.Src, cc.Dst, true, cc.TxPackets, cc.TxBytes})
+			}
+			if cc.RxPackets > 0 || cc.RxBytes > 0 {
+				out = append(out, flowRecord{cc.Proto, cc.Dst, cc.Src, false, cc.RxPackets, cc.RxBytes})
+			}
+		}
+	}
+	return out
+}
+
+// flowEncoder encodes flow records as IPFIX or NetFlow v9 packets.
+// Each packet carries the templates, so that collectors can decode any
+// packet even if earlier ones were lost.
+type flowEncoder struct {
+	format  FlowFormat
+	started time.Time // for the NetFlow v9 system uptime
+
+	// seq is the number of data records (IPFIX) or packets (NetFlow v9)
+	// exported so far.
+	seq uint32
+}
+
+func (e *flowEncoder) headerLen() int {
+	if e.format == IPFIX {
+		return 16
+	}
+	return 20
+}
+
+func (e *flowEncoder) recordLen(is6 bool) int {
+	n := 0
+	for _, f := range e.format.templateFields(is6) {
+		n += int(f.length)
+	}
+	return n
+}
+
+// uptime returns the NetFlow v9 system uptime at t, in milliseconds.
+func (e *flowEncoder) uptime(t time.Time) uint32 {
+	if t.Before(e.started) {
+		return 0
+	}
+	return uint32(t.Sub(e.started).Milliseconds())
+}
+
+func (e *flowEncoder) appendTemplates(b []byte) []byte {
+	setID := uint16(2)
+	if e.format == NetFlowV9 {
+		setID = 0
+	}
+	start := len(b)
+	b = binary.BigEndian.AppendUint16(b, setID)
+	b = binary.BigEndian.AppendUint16(b, 0) // length, set below
+	for _, t := range []struct {
+		id  uint16
+		is6 bool
+	}{{templateIPv4, false}, {templateIPv6, true}} {
+		fields := e.format.templateFields(t.is6)
+		b = binary.BigEndian.AppendUint16(b, t.id)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(fields)))
+		for _, f := range fields {
+			b = binary.BigEndian.AppendUint16(b, f.id)
+			b = binary.BigEndian.AppendUint16(b, f.length)
+		}
+	}
+	binary.BigEndian.PutUint16(b[start+2:], uint16(len(b)-start))
+	return b
+}
+
+func appendAddr(b []byte, a netip.Addr, is6 bool) []byte {
+	switch {
+	case is6 && a.Is4():
+		a = netip.AddrFrom16(a.As16())
+	case is6 && !a.IsValid():
+		a = netip.IPv6Unspecified()
+	case !is6 && !a.IsValid():
+		a = netip.IPv4Unspecified()
+	}
+	return append(b, a.AsSlice()...)
+}
+
+func (e *flowEncoder) appendRecord(b []byte, r *flowRecord, start, end time.Time) []byte {
+	is6 := r.is6()
+	b = append(b, byte(r.proto))
+	b = appendAddr(b, r.src.Addr(), is6)
+	b = binary.BigEndian.AppendUint16(b, r.src.Port())
+	b = appendAddr(b, r.dst.Addr(), is6)
+	b = binary.BigEndian.AppendUint16(b, r.dst.Port())
+	if r.egress {
+		b = append(b, flowEgress)
+	} else {
+		b = append(b, flowIngress)
+	}
+	b = binary.BigEndian.AppendUint64(b, r.bytes)
+	b = binary.BigEndian.AppendUint64(b, r.packets)
+	if e.format == IPFIX {
+		b = binary.BigEndian.AppendUint64(b, uint64(start.UnixMilli()))
+		b = binary.BigEndian.AppendUint64(b, uint64(end.UnixMilli()))
+	} else {
+		b = binary.BigEndian.AppendUint32(b, e.uptime(start))
+		b = binary.BigEndian.AppendUint32(b, e.uptime(end))
+	}
+	return b
+}
+
+// encode returns the packets needed to export the records in m, as of now.
+func (e *flowEncoder) encode(m *netlogtype.Message, now time.Time) [][]byte {
+	records := flowRecords(m)
+	var v4, v6 []*flowRecord
+	for i := range records {
+		if records[i].is6() {
+			v6 = append(v6, &records[i])
+		} else {
+			v4 = append(v4, &records[i])
+		}
+	}
+
+	var packets [][]byte
+	for len(v4)+len(v6) > 0 {
+		b := make([]byte, e.headerLen(), maxFlowPacketSize)
+		b = e.appendTemplates(b)
+		count := 2 // template records
+		var n4, n6 int
+		b, n4 = e.appendDataSet(b, templateIPv4, v4, m.Start, m.End)
+		v4 = v4[n4:]
+		b, n6 = e.appendDataSet(b, templateIPv6, v6, m.Start, m.End)
+		v6 = v6[n6:]
+		count += n4 + n6
+		e.putHeader(b, count, n4+n6, now)
+		packets = append(packets, b)
+	}
+	return packets
+}
+
+// appendDataSet appends a data set holding as many records as fit in the
+// packet, returning the number appended.
+func (e *flowEncoder) appendDataSet(b []byte, templateID uint16, records []*flowRecord, start, end time.Time) ([]byte, int) {
+	if len(records) == 0 {
+		return b, 0
+	}
+	recLen := e.recordLen(records[0].is6())
+	room := (maxFlowPacketSize - len(b) - 4 - 3) / recLen // set header and padding
+	n := min(room, len(records))
+	if n <= 0 {
+		return b, 0
+	}
+	setStart := len(b)
+	b = binary.BigEndian.AppendUint16(b, templateID)
+	b = binary.BigEndian.AppendUint16(b, 0) // length, set below
+	for _, r := range records[:n] {
+		b = e.appendRecord(b, r, start, end)
+	}
+	if e.format == NetFlowV9 {
+		// NetFlow v9 flowsets are padded to a 32-bit boundary.
+		for (len(b)-setStart)%4 != 0 {
+			b = append(b, 0)
+		}
+	}
+	binary.BigEndian.PutUint16(b[setStart+2:], uint16(len(b)-setStart))
+	return b, n
+}
+
+// putHeader fills in the header of packet b, which holds count records in
+// total, of which data are data records.
+func (e *flowEncoder) putHeader(b []byte, count, data int, now time.Time) {
+	binary.BigEndian.PutUint16(b[0:], uint16(e.format))
+	if e.format == IPFIX {
+		binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+		binary.BigEndian.PutUint32(b[4:], uint32(now.Unix()))
+		binary.BigEndian.PutUint32(b[8:], e.seq)
+		binary.BigEndian.PutUint32(b[12:], 0) // observation domain ID
+		e.seq += uint32(data)
+		return
+	}
+	binary.BigEndian.PutUint16(b[2:], uint16(count))
+	binary.BigEndian.PutUint32(b[4:], e.uptime(now))
+	binary.BigEndian.PutUint32(b[8:], uint32(now.Unix()))
+	binary.BigEndian.PutUint32(b[12:], e.seq)
+	binary.BigEndian.PutUint32(b[16:], 0) // source ID
+	e.seq++
+}
+
+// FlowExporter is a Sink that exports flows over UDP as IPFIX or NetFlow v9.
+//
+// Each connection is exported as up to two unidirectional flows, with the
+// flowDirection information element set to egress for traffic sent by
+// the source of the connection, and ingress for traffic it received.
+type FlowExporter struct {
+	conn net.Conn
+
+	mu  sync.Mutex
+	enc flowEncoder
+}
+
+// NewFlowExporter returns a sink that exports flows to the collector at
+// addr, a host and UDP port, in the given format.
+func NewFlowExporter(addr string, format FlowFormat) (*FlowExporter, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &FlowExporter{
+		conn: conn,
+		enc:  flowEncoder{format: format, started: time.Now()},
+	}, nil
+}
+
+func (x *FlowExporter) Write(m *netlogtype.Message) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for _, p := range x.enc.encode(m, time.Now()) {
+		if _, err := x.conn.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (x *FlowExporter) Shutdown(context.Context) error {
+	return x.conn.Close()
+}
@@ -0,0 +1,280 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netlog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/logtail"
+	"tailscale.com/types/logger"
+	"tailscale.com/types/netlogtype"
+	"tailscale.com/util/multierr"
+	"tailscale.com/util/syspolicy"
+)
+
+// Sink is a destination for network flow log messages.
+//
+// Write is called from a single goroutine at a time, once per poll period
+// in which there was any traffic. It must not block for long, as traffic
+// statistics are not gathered while it runs.
+type Sink interface {
+	// Write records a message.
+	Write(*netlogtype.Message) error
+	// Shutdown flushes any pending messages and releases resources.
+	Shutdown(context.Context) error
+}
+
+// ParseSink returns the local sink described by spec, which is one of:
+//
+//   - "file:<path>": messages are appended to the file as lines of JSON,
+//     rotating it once it grows too large. See NewFileSink.
+//   - "unix:<path>": messages are written as lines of JSON to a stream
+//     Unix socket. See NewUnixSink.
+//   - "ipfix:<host:port>": flows are exported over UDP as IPFIX.
+//   - "netflow9:<host:port>": flows are exported over UDP as NetFlow v9.
+func ParseSink(spec string) (Sink, error) {
+	kind, arg, ok := strings.Cut(spec, ":")
+	if !ok || arg == "" {
+		return nil, fmt.Errorf("invalid network log sink %q", spec)
+	}
+	switch kind {
+	case "file":
+		return NewFileSink(arg, defaultMaxFileSize, defaultMaxFiles)
+	case "unix":
+		return NewUnixSink(arg), nil
+	case "ipfix":
+		return NewFlowExporter(arg, IPFIX)
+	case "netflow9":
+		return NewFlowExporter(arg, NetFlowV9)
+	}
+	return nil, fmt.Errorf("invalid network log sink %q: unknown kind %q", spec, kind)
+}
+
+// LocalSinks returns the specs, in the form accepted by ParseSink, of the
+// local sinks configured by the syspolicy.NetworkLogSinks policy setting.
+// If there are any, network flows are logged even if uploading them is
+// disabled.
+func LocalSinks() []string {
+	specs, _ := syspolicy.GetStringArray(syspolicy.NetworkLogSinks, nil)
+	return specs
+}
+
+// logtailSink uploads messages to the Tailscale log service.
+type logtailSink struct {
+	*logtail.Logger
+}
+
+func (s logtailSink) Write(m *netlogtype.Message) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	s.Logf("%s", b)
+	return nil
+}
+
+// localMessage is the form in which messages are written by the local JSON
+// sinks. It is understood by cmd/netlogfmt.
+type localMessage struct {
+	Logged time.Time `json:"logged"`
+	*netlogtype.Message
+}
+
+func marshalLine(m *netlogtype.Message) ([]byte, error) {
+	b, err := json.Marshal(localMessage{Logged: time.Now().UTC(), Message: m})
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+const (
+	defaultMaxFileSize = 50 << 20
+	defaultMaxFiles    = 10
+)
+
+// FileSink is a Sink that appends messages to a file as lines of JSON.
+//
+// Once the file grows beyond a maximum size, it is rotated: it is renamed
+// with a ".1" suffix, any previously rotated files have their suffix
+// incremented, and the oldest are removed.
+type FileSink struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mu   sync.Mutex
+	f    *os.File // nil after Shutdown
+	size int64
+}
+
+// NewFileSink returns a sink that writes to the file at path, which is
+// rotated once it exceeds maxSize bytes, keeping at most maxFiles files
+// including the current one.
+func NewFileSink(path string, maxSize int64, maxFiles int) (*FileSink, error) {
+	s := &FileSink{path: path, maxSize: maxSize, maxFiles: max(maxFiles, 1)}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f = f
+	s.size = fi.Size()
+	return nil
+}
+
+// rotatedName returns the name of the n'th most recently rotated file.
+func (s *FileSink) rotatedName(n int) string {
+	return fmt.Sprintf("%s.%d", s.path, n)
+}
+
+func (s *FileSink) rotate() error {
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+	s.f = nil
+	os.Remove(s.rotatedName(s.maxFiles - 1))
+	for n := s.maxFiles - 2; n >= 1; n-- {
+		if err := os.Rename(s.rotatedName(n), s.rotatedName(n+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if s.maxFiles > 1 {
+		if err := os.Rename(s.path, s.rotatedName(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(s.path); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+func (s *FileSink) Write(m *netlogtype.Message) error {
+	b, err := marshalLine(m)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	if s.size > 0 && s.size+int64(len(b)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return fmt.Errorf("rotating %s: %w", s.path, err)
+		}
+	}
+	n, err := s.f.Write(b)
+	s.size += int64(n)
+	return err
+}
+
+func (s *FileSink) Shutdown(context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+// unixWriteTimeout bounds how long a UnixSink may block on a slow reader.
+const unixWriteTimeout = time.Second
+
+// UnixSink is a Sink that writes messages as lines of JSON to a stream
+// Unix socket. It connects lazily, and reconnects on the next message
+// after an error, so messages are dropped while nothing is listening.
+type UnixSink struct {
+	path string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// NewUnixSink returns a sink that writes to the Unix socket at path.
+func NewUnixSink(path string) *UnixSink {
+	return &UnixSink{path: path}
+}
+
+func (s *UnixSink) Write(m *netlogtype.Message) error {
+	b, err := marshalLine(m)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		c, err := net.DialTimeout("unix", s.path, unixWriteTimeout)
+		if err != nil {
+			return err
+		}
+		s.conn = c
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(unixWriteTimeout))
+	if _, err := s.conn.Write(b); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (s *UnixSink) Shutdown(context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// openLocalSinks opens the sinks described by specs. Sinks which fail to
+// open are logged and skipped.
+func openLocalSinks(specs []string, logf logger.Logf) []Sink {
+	var sinks []Sink
+	for _, spec := range specs {
+		s, err := ParseSink(spec)
+		if err != nil {
+			logf("netlog: %v", err)
+			continue
+		}
+		sinks = append(sinks, s)
+	}
+	return sinks
+}
+
+// shutdownSinks shuts down all sinks, returning any errors.
+func shutdownSinks(ctx context.Context, sinks []Sink) error {
+	var errs []error
+	for _, s := range sinks {
+		if err := s.Shutdown(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return multierr.New(errs...)
+}
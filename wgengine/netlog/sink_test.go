@@ -0,0 +1,254 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netlog
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/types/ipproto"
+	"tailscale.com/types/netlogtype"
+)
+
+func testMessage(n int) *netlogtype.Message {
+	start := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	m := &netlogtype.Message{NodeID: "n123", Start: start, End: start.Add(pollPeriod)}
+	for i := range n {
+		m.VirtualTraffic = append(m.VirtualTraffic, netlogtype.ConnectionCounts{
+			Connection: netlogtype.Connection{
+				Proto: ipproto.TCP,
+				Src:   netip.AddrPortFrom(netip.AddrFrom4([4]byte{100, 64, 0, 1}), uint16(1000+i)),
+				Dst:   netip.MustParseAddrPort("100.64.0.2:22"),
+			},
+			Counts: netlogtype.Counts{TxPackets: 1, TxBytes: 100, RxPackets: 2, RxBytes: 200},
+		})
+	}
+	return m
+}
+
+func TestParseSink(t *testing.T) {
+	for _, spec := range []string{"", "file", "file:", "bogus:x", "ipfix:nohostport"} {
+		if s, err := ParseSink(spec); err == nil {
+			s.Shutdown(context.Background())
+			t.Errorf("ParseSink(%q) succeeded, want error", spec)
+		}
+	}
+	for _, spec := range []string{
+		"file:" + filepath.Join(t.TempDir(), "netlog.jsonl"),
+		"unix:/nonexistent/netlog.sock",
+		"ipfix:127.0.0.1:4739",
+		"netflow9:127.0.0.1:2055",
+	} {
+		s, err := ParseSink(spec)
+		if err != nil {
+			t.Errorf("ParseSink(%q): %v", spec, err)
+			continue
+		}
+		s.Shutdown(context.Background())
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "netlog.jsonl")
+	line, err := marshalLine(testMessage(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Allow two messages per file.
+	s, err := NewFileSink(path, int64(2*len(line)+len(line)/2), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 7 {
+		if err := s.Write(testMessage(1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, wantLines := range map[string]int{
+		path:        1,
+		path + ".1": 2,
+		path + ".2": 2,
+	} {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+		if len(lines) != wantLines {
+			t.Errorf("%s has %d lines, want %d", name, len(lines), wantLines)
+		}
+		for _, l := range lines {
+			var got localMessage
+			if err := json.Unmarshal([]byte(l), &got); err != nil {
+				t.Errorf("%s: %v", name, err)
+			} else if got.NodeID != "n123" || got.Logged.IsZero() {
+				t.Errorf("%s: unexpected message %s", name, l)
+			}
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Stat(%s.3) = %v, want not exist", path, err)
+	}
+}
+
+func TestUnixSink(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix sockets are not reliably available on Windows")
+	}
+	path := filepath.Join(t.TempDir(), "netlog.sock")
+	s := NewUnixSink(path)
+	defer s.Shutdown(context.Background())
+	if err := s.Write(testMessage(1)); err == nil {
+		t.Fatal("Write with no listener succeeded, want error")
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	lines := make(chan string, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		l, _ := bufio.NewReader(c).ReadString('\n')
+		lines <- l
+	}()
+	if err := s.Write(testMessage(1)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case l := <-lines:
+		if !strings.Contains(l, `"nodeId":"n123"`) {
+			t.Errorf("got line %q", l)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for message")
+	}
+}
+
+// parseFlowPacket does a minimal parse of an IPFIX or NetFlow v9 packet,
+// returning the header fields and the number of data records per
+// template ID.
+func parseFlowPacket(t *testing.T, format FlowFormat, b []byte) (seqOrCount uint32, records map[uint16]int) {
+	t.Helper()
+	if got := FlowFormat(binary.BigEndian.Uint16(b)); got != format {
+		t.Fatalf("version = %d, want %d", got, format)
+	}
+	hdrLen, templateSet := 20, uint16(0)
+	if format == IPFIX {
+		hdrLen, templateSet = 16, 2
+		if got := int(binary.BigEndian.Uint16(b[2:])); got != len(b) {
+			t.Fatalf("IPFIX length = %d, want %d", got, len(b))
+		}
+	}
+	if len(b) > maxFlowPacketSize {
+		t.Fatalf("packet length %d exceeds %d", len(b), maxFlowPacketSize)
+	}
+	enc := flowEncoder{format: format}
+	records = make(map[uint16]int)
+	for rest := b[hdrLen:]; len(rest) > 0; {
+		id, n := binary.BigEndian.Uint16(rest), int(binary.BigEndian.Uint16(rest[2:]))
+		if n < 4 || n > len(rest) {
+			t.Fatalf("bad set length %d", n)
+		}
+		switch id {
+		case templateSet:
+		case templateIPv4, templateIPv6:
+			records[id] += (n - 4) / enc.recordLen(id == templateIPv6)
+		default:
+			t.Fatalf("unknown set ID %d", id)
+		}
+		rest = rest[n:]
+	}
+	if format == IPFIX {
+		return binary.BigEndian.Uint32(b[8:]), records
+	}
+	return uint32(binary.BigEndian.Uint16(b[2:])), records
+}
+
+func TestFlowEncoder(t *testing.T) {
+	for _, format := range []FlowFormat{IPFIX, NetFlowV9} {
+		t.Run(fmt.Sprint(format), func(t *testing.T) {
+			m := testMessage(40)
+			m.PhysicalTraffic = []netlogtype.ConnectionCounts{{
+				Connection: netlogtype.Connection{
+					Src: netip.MustParseAddrPort("[fd7a:115c:a1e0::1]:0"),
+					Dst: netip.MustParseAddrPort("[2001:db8::1]:41641"),
+				},
+				Counts: netlogtype.Counts{TxPackets: 5, TxBytes: 500},
+			}}
+			// Each virtual connection has traffic in both directions.
+			wantV4, wantV6 := 80, 1
+
+			e := flowEncoder{format: format, started: m.Start.Add(-time.Minute)}
+			packets := e.encode(m, m.End)
+			if len(packets) < 2 {
+				t.Fatalf("got %d packets, want records split across several", len(packets))
+			}
+			var gotV4, gotV6 int
+			for i, p := range packets {
+				seqOrCount, records := parseFlowPacket(t, format, p)
+				switch format {
+				case IPFIX:
+					if want := uint32(gotV4 + gotV6); seqOrCount != want {
+						t.Errorf("packet %d: sequence = %d, want %d", i, seqOrCount, want)
+					}
+				case NetFlowV9:
+					if want := uint32(2 + records[templateIPv4] + records[templateIPv6]); seqOrCount != want {
+						t.Errorf("packet %d: count = %d, want %d", i, seqOrCount, want)
+					}
+				}
+				gotV4 += records[templateIPv4]
+				gotV6 += records[templateIPv6]
+			}
+			if gotV4 != wantV4 || gotV6 != wantV6 {
+				t.Errorf("got %d IPv4 and %d IPv6 records, want %d and %d", gotV4, gotV6, wantV4, wantV6)
+			}
+		})
+	}
+}
+
+func TestFlowExporter(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	x, err := NewFlowExporter(pc.LocalAddr().String(), IPFIX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer x.Shutdown(context.Background())
+	if err := x.Write(testMessage(1)); err != nil {
+		t.Fatal(err)
+	}
+	pc.SetReadDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, 2*maxFlowPacketSize)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, records := parseFlowPacket(t, IPFIX, buf[:n]); records[templateIPv4] != 2 {
+		t.Errorf("got %d IPv4 records, want 2", records[templateIPv4])
+	}
+}
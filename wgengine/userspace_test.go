@@ -4,12 +4,15 @@
 package wgengine
 
 import (
+	"errors"
 	"fmt"
 	"net/netip"
 	"os"
+	"path/filepath"
 	"reflect"
 	"runtime"
 	"testing"
+	"time"
 
 	"go4.org/mem"
 	"tailscale.com/cmd/testwrapper/flakytest"
@@ -26,7 +29,11 @@
 	"tailscale.com/types/netmap"
 	"tailscale.com/types/opt"
 	"tailscale.com/util/eventbus"
+	"tailscale.com/util/syspolicy"
+	"tailscale.com/util/syspolicy/setting"
+	"tailscale.com/util/syspolicy/source"
 	"tailscale.com/util/usermetric"
+	"tailscale.com/wgengine/netlog"
 	"tailscale.com/wgengine/router"
 	"tailscale.com/wgengine/wgcfg"
 )
@@ -393,3 +400,66 @@ func BenchmarkGenLocalAddrFunc(b *testing.B) {
 	})
 	b.Logf("x = %v", x)
 }
+
+func TestUserspaceEngineNetLogSinks(t *testing.T) {
+	syspolicy.RegisterWellKnownSettingsForTest(t)
+	sink := source.TestSettingOf(syspolicy.NetworkLogSinks, []string{"file:" + filepath.Join(t.TempDir(), "flows.jsonl")})
+	store := source.NewTestStoreOf(t, sink)
+	syspolicy.MustRegisterStoreForTest(t, "TestStore", setting.DeviceScope, store)
+
+	bus := eventbus.New()
+	defer bus.Close()
+	ht := new(health.Tracker)
+	reg := new(usermetric.Registry)
+	e, err := NewFakeUserspaceEngine(t.Logf, 0, ht, reg, bus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(e.Close)
+	ue := e.(*userspaceEngine)
+
+	cfg := &wgcfg.Config{}
+	routerCfg := &router.Config{
+		LocalAddrs: []netip.Prefix{netip.MustParsePrefix("100.100.99.1/32")},
+	}
+	if err := ue.Reconfig(cfg, routerCfg, &dns.Config{}); err != nil {
+		t.Fatal(err)
+	}
+	if !ue.networkLogger.Running() {
+		t.Fatal("network logger not running with a local sink")
+	}
+
+	// Removing the sink stops the network logger, even though the
+	// engine configuration is otherwise unchanged.
+	store.Delete(syspolicy.NetworkLogSinks)
+	if err := tstest.WaitFor(5*time.Second, func() error {
+		if len(netlog.LocalSinks()) > 0 {
+			return errors.New("sinks still configured")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ue.Reconfig(cfg, routerCfg, &dns.Config{}); err != nil {
+		t.Fatal(err)
+	}
+	if ue.networkLogger.Running() {
+		t.Error("network logger still running without sinks")
+	}
+
+	store.SetStringLists(sink)
+	if err := tstest.WaitFor(5*time.Second, func() error {
+		if len(netlog.LocalSinks()) == 0 {
+			return errors.New("sinks not configured")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ue.Reconfig(cfg, routerCfg, &dns.Config{}); err != nil {
+		t.Fatal(err)
+	}
+	if !ue.networkLogger.Running() {
+		t.Error("network logger not restarted with a local sink")
+	}
+}